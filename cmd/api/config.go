@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/auth"
+	"github.com/snigle/photocloud/internal/infra/keyenc"
+	"github.com/snigle/photocloud/internal/infra/s3compat"
+	"github.com/snigle/photocloud/internal/infra/s3store"
+)
+
+// Secrets only accepted in dev mode: they are public.
+const (
+	devJWTSecret = "default-secret-change-me"
+	devMasterKey = "dev-master-key-must-be-32-bytes-"
+	// devKeyFile is created if missing.
+	devKeyFile = "data/user-keys.key"
+	// minJWTSecretLength is the size of a key of HMAC-SHA256.
+	minJWTSecretLength = 32
+)
+
+// Config is the configuration of the API, read from the environment by
+// loadConfig.
+type Config struct {
+	// DevMode (DEV_MODE=true) allows the defaults of the settings that must
+	// not have any in production, such as the secrets.
+	DevMode bool
+	Port    int
+
+	JWTSecret    string
+	MasterKeys   *s3store.Keyring
+	KeyEncrypter KeyEncrypterConfig
+
+	GoogleClientID string
+	OIDCProviders  []auth.OIDCProviderConfig
+	SMTP           SMTPConfig
+
+	RPID     string
+	RPOrigin string
+	// FrontendURL is the base of the links sent by email.
+	FrontendURL string
+	// DevAuthEnabled lets /auth/dev log in as the dev user, in dev mode only.
+	DevAuthEnabled bool
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header
+	// gives the client address.
+	TrustedProxies []*net.IPNet
+
+	AdminEmails         []string
+	RegistrationMode    domain.RegistrationMode
+	RegistrationDomains []string
+
+	Storage StorageConfig
+}
+
+type KeyEncrypterConfig struct {
+	// Provider is local or vault.
+	Provider string
+	KeyFile  string
+	Vault    keyenc.VaultConfig
+}
+
+type SMTPConfig struct {
+	Host string
+	Port int
+	User string
+	Pass string
+	From string
+}
+
+type StorageConfig struct {
+	// Backend is ovh, s3 or local.
+	Backend string
+	OVH     OVHConfig
+	S3      s3compat.Config
+	Local   LocalStorageConfig
+}
+
+type OVHConfig struct {
+	Endpoint          string
+	ApplicationKey    string
+	ApplicationSecret string
+	ConsumerKey       string
+	ProjectID         string
+	Region            string
+	Bucket            string
+	// ServiceAccessKey and ServiceSecretKey are the key of the API's own OVH
+	// user. Without them every start of the API creates one.
+	ServiceAccessKey string
+	ServiceSecretKey string
+}
+
+type LocalStorageConfig struct {
+	Dir      string
+	Bucket   string
+	Addr     string
+	Endpoint string
+}
+
+// loadConfig reads and validates the whole configuration, and reports every
+// invalid setting at once.
+func loadConfig(getenv func(string) string) (*Config, error) {
+	r := &configReader{getenv: getenv}
+	c := &Config{DevMode: r.bool("DEV_MODE")}
+
+	c.Port = r.port("PORT", 8080)
+	c.JWTSecret = r.jwtSecret(c.DevMode)
+	c.MasterKeys = r.keyring(c.DevMode)
+	c.KeyEncrypter = r.keyEncrypter(c.DevMode)
+
+	c.GoogleClientID = getenv("GOOGLE_CLIENT_ID")
+	c.OIDCProviders = r.oidcProviders()
+	c.DevAuthEnabled = r.bool("DEV_AUTH_ENABLED")
+	if c.DevAuthEnabled && !c.DevMode {
+		r.fail("DEV_AUTH_ENABLED logs anyone in without credentials and requires DEV_MODE=true")
+	}
+	c.SMTP = SMTPConfig{
+		Host: getenv("SMTP_HOST"),
+		User: getenv("SMTP_USER"),
+		Pass: getenv("SMTP_PASS"),
+		From: getenv("SMTP_FROM"),
+	}
+	if c.SMTP.Host != "" {
+		c.SMTP.Port = r.port("SMTP_PORT", 0)
+		r.required("SMTP_PORT")
+		r.required("SMTP_FROM")
+	}
+
+	c.RPID = r.devDefault(c.DevMode, "RP_ID", "localhost")
+	c.RPOrigin = r.devDefault(c.DevMode, "RP_ORIGIN", "http://localhost:8081")
+	r.url("RP_ORIGIN", c.RPOrigin)
+	c.FrontendURL = r.string("FRONTEND_URL", "https://photocloud.ovh")
+	r.url("FRONTEND_URL", c.FrontendURL)
+
+	c.TrustedProxies = r.trustedProxies()
+
+	c.AdminEmails = splitList(getenv("ADMIN_EMAILS"))
+	c.RegistrationMode = domain.RegistrationMode(strings.ToLower(getenv("REGISTRATION_MODE")))
+	switch c.RegistrationMode {
+	case "":
+		c.RegistrationMode = domain.RegistrationOpen
+	case domain.RegistrationOpen, domain.RegistrationAllowlist, domain.RegistrationInviteOnly, domain.RegistrationClosed:
+	default:
+		r.fail("unknown REGISTRATION_MODE %q", c.RegistrationMode)
+	}
+	c.RegistrationDomains = splitList(getenv("REGISTRATION_ALLOWED_DOMAINS"))
+
+	c.Storage = r.storage()
+
+	if err := errors.Join(r.errs...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configReader collects every invalid setting instead of stopping at the
+// first one.
+type configReader struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (r *configReader) fail(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Errorf(format, args...))
+}
+
+func (r *configReader) string(name string, fallback string) string {
+	if value := r.getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (r *configReader) required(name string) string {
+	value := r.getenv(name)
+	if value == "" {
+		r.fail("%s is required", name)
+	}
+	return value
+}
+
+// devDefault returns fallback for an unset variable in dev mode only.
+func (r *configReader) devDefault(devMode bool, name string, fallback string) string {
+	if devMode {
+		return r.string(name, fallback)
+	}
+	return r.required(name)
+}
+
+func (r *configReader) bool(name string) bool {
+	value := r.getenv(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		r.fail("%s must be true or false, got %q", name, value)
+	}
+	return b
+}
+
+func (r *configReader) port(name string, fallback int) int {
+	value := r.getenv(name)
+	if value == "" {
+		return fallback
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		r.fail("%s must be a port number, got %q", name, value)
+	}
+	return port
+}
+
+// url checks that an optional setting is an absolute http(s) URL.
+func (r *configReader) url(name string, value string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		r.fail("%s must be an http(s) URL, got %q", name, value)
+	}
+}
+
+func (r *configReader) jwtSecret(devMode bool) string {
+	secret := r.getenv("JWT_SECRET")
+	switch {
+	case devMode:
+		return r.string("JWT_SECRET", devJWTSecret)
+	case secret == "":
+		r.fail("JWT_SECRET is required")
+	case secret == devJWTSecret:
+		r.fail("JWT_SECRET is the public dev secret")
+	case len(secret) < minJWTSecretLength:
+		r.fail("JWT_SECRET must be at least %d characters long", minJWTSecretLength)
+	}
+	return secret
+}
+
+// keyring reads the active MASTER_KEY, whose version is MASTER_KEY_VERSION
+// (1 by default), and the previous keys still accepted for reads from
+// MASTER_KEYS_PREVIOUS, as comma separated version:key pairs.
+func (r *configReader) keyring(devMode bool) *s3store.Keyring {
+	active := s3store.MasterKey{Version: r.string("MASTER_KEY_VERSION", "1")}
+	switch value := r.getenv("MASTER_KEY"); {
+	case value == "" && devMode:
+		active.Key = []byte(devMasterKey)
+	case value == "":
+		r.fail("MASTER_KEY is required")
+	default:
+		var ok bool
+		if active.Key, ok = parseMasterKey(value); !ok {
+			r.fail("MASTER_KEY must be a 32-byte base64 string or 32-byte raw string")
+		} else if string(active.Key) == devMasterKey && !devMode {
+			r.fail("MASTER_KEY is the public dev key")
+		}
+	}
+
+	var previous []s3store.MasterKey
+	for _, item := range strings.Split(r.getenv("MASTER_KEYS_PREVIOUS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		version, value, _ := strings.Cut(item, ":")
+		key, ok := parseMasterKey(value)
+		if !ok {
+			r.fail("MASTER_KEYS_PREVIOUS: key %s must be a 32-byte base64 string or 32-byte raw string", version)
+			continue
+		}
+		previous = append(previous, s3store.MasterKey{Version: version, Key: key})
+	}
+
+	if active.Key == nil {
+		return nil
+	}
+	keys, err := s3store.NewKeyring(active, previous...)
+	if err != nil {
+		r.fail("invalid master keys: %w", err)
+	}
+	return keys
+}
+
+// keyEncrypter reads the provider that wraps the user keys, selected by
+// KEY_ENCRYPTER: local, with the key read from KEY_ENCRYPTER_KEYFILE, or vault
+// for a transit engine configured by the VAULT_* variables.
+func (r *configReader) keyEncrypter(devMode bool) KeyEncrypterConfig {
+	c := KeyEncrypterConfig{Provider: strings.ToLower(r.devDefault(devMode, "KEY_ENCRYPTER", "local"))}
+	switch c.Provider {
+	case "":
+		// Already reported as required.
+	case "local":
+		c.KeyFile = r.devDefault(devMode, "KEY_ENCRYPTER_KEYFILE", devKeyFile)
+	case "vault":
+		c.Vault = keyenc.VaultConfig{
+			Addr:  r.required("VAULT_ADDR"),
+			Token: r.required("VAULT_TOKEN"),
+			Mount: r.getenv("VAULT_TRANSIT_MOUNT"),
+			Key:   r.required("VAULT_TRANSIT_KEY"),
+		}
+		r.url("VAULT_ADDR", c.Vault.Addr)
+	default:
+		r.fail("unknown KEY_ENCRYPTER %q", c.Provider)
+	}
+	return c
+}
+
+func parseMasterKey(value string) ([]byte, bool) {
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key, true
+	}
+	if len(value) == 32 {
+		return []byte(value), true
+	}
+	return nil, false
+}
+
+// trustedProxies reads TRUSTED_PROXIES, a comma separated list of addresses
+// or CIDR ranges.
+func (r *configReader) trustedProxies() []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, item := range splitList(r.getenv("TRUSTED_PROXIES")) {
+		cidr := item
+		if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else if ip != nil {
+			cidr += "/128"
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			r.fail("TRUSTED_PROXIES: invalid address %q", item)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// oidcProviders reads the providers listed in OIDC_PROVIDERS (e.g.
+// "keycloak,apple"), each configured by OIDC_<NAME>_ISSUER,
+// OIDC_<NAME>_CLIENT_ID and the optional OIDC_<NAME>_ALLOWED_DOMAINS.
+func (r *configReader) oidcProviders() []auth.OIDCProviderConfig {
+	var providers []auth.OIDCProviderConfig
+	for _, name := range splitList(r.getenv("OIDC_PROVIDERS")) {
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		config := auth.OIDCProviderConfig{
+			Name:     name,
+			Issuer:   r.required(prefix + "ISSUER"),
+			ClientID: r.required(prefix + "CLIENT_ID"),
+		}
+		r.url(prefix+"ISSUER", config.Issuer)
+		if domains := r.getenv(prefix + "ALLOWED_DOMAINS"); domains != "" {
+			config.AllowedEmailDomains = strings.Split(domains, ",")
+		}
+		providers = append(providers, config)
+	}
+	return providers
+}
+
+// storage reads the backend selected by STORAGE_BACKEND: ovh (default),
+// configured by the OVH_* variables, or s3 for any S3-compatible service with
+// STS, such as MinIO, configured by the S3_* variables, or local to store on
+// disk behind an embedded S3 endpoint, configured by the LOCAL_STORAGE_*
+// variables.
+func (r *configReader) storage() StorageConfig {
+	c := StorageConfig{Backend: strings.ToLower(r.string("STORAGE_BACKEND", "ovh"))}
+	switch c.Backend {
+	case "ovh":
+		c.OVH = OVHConfig{
+			Endpoint:          r.required("OVH_ENDPOINT"),
+			ApplicationKey:    r.required("OVH_APPLICATION_KEY"),
+			ApplicationSecret: r.required("OVH_APPLICATION_SECRET"),
+			ConsumerKey:       r.required("OVH_CONSUMER_KEY"),
+			ProjectID:         r.required("OVH_PROJECT_ID"),
+			Region:            r.string("OVH_REGION", "gra"),
+			Bucket:            r.required("OVH_S3_BUCKET"),
+			ServiceAccessKey:  r.getenv("OVH_SERVICE_ACCESS_KEY"),
+			ServiceSecretKey:  r.getenv("OVH_SERVICE_SECRET_KEY"),
+		}
+		if (c.OVH.ServiceAccessKey == "") != (c.OVH.ServiceSecretKey == "") {
+			r.fail("OVH_SERVICE_ACCESS_KEY and OVH_SERVICE_SECRET_KEY must be set together")
+		}
+	case "s3":
+		c.S3 = s3compat.Config{
+			Endpoint:       r.required("S3_ENDPOINT"),
+			PublicEndpoint: r.getenv("S3_PUBLIC_ENDPOINT"),
+			STSEndpoint:    r.getenv("S3_STS_ENDPOINT"),
+			Region:         r.string("S3_REGION", "us-east-1"),
+			Bucket:         r.required("S3_BUCKET"),
+			AccessKey:      r.required("S3_ACCESS_KEY"),
+			SecretKey:      r.required("S3_SECRET_KEY"),
+			RoleARN:        r.getenv("S3_ROLE_ARN"),
+		}
+		r.url("S3_ENDPOINT", c.S3.Endpoint)
+		r.url("S3_PUBLIC_ENDPOINT", c.S3.PublicEndpoint)
+		r.url("S3_STS_ENDPOINT", c.S3.STSEndpoint)
+	case "local":
+		c.Local = LocalStorageConfig{
+			Dir:      r.string("LOCAL_STORAGE_DIR", "data"),
+			Bucket:   r.string("LOCAL_STORAGE_BUCKET", "photocloud"),
+			Addr:     r.string("LOCAL_STORAGE_ADDR", ":9000"),
+			Endpoint: r.string("LOCAL_STORAGE_ENDPOINT", "http://localhost:9000"),
+		}
+		if _, _, err := net.SplitHostPort(c.Local.Addr); err != nil {
+			r.fail("LOCAL_STORAGE_ADDR must be host:port, got %q", c.Local.Addr)
+		}
+		r.url("LOCAL_STORAGE_ENDPOINT", c.Local.Endpoint)
+	default:
+		r.fail("unknown STORAGE_BACKEND %q", c.Backend)
+	}
+	return c
+}
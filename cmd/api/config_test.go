@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+var productionEnv = map[string]string{
+	"JWT_SECRET":             "a-jwt-secret-of-at-least-32-chars",
+	"MASTER_KEY":             base64.StdEncoding.EncodeToString([]byte("production-master-key-32-bytes!!")),
+	"KEY_ENCRYPTER":          "vault",
+	"VAULT_ADDR":             "https://vault.example.com:8200",
+	"VAULT_TOKEN":            "token",
+	"VAULT_TRANSIT_KEY":      "photocloud",
+	"RP_ID":                  "photocloud.example.com",
+	"RP_ORIGIN":              "https://photocloud.example.com",
+	"OVH_ENDPOINT":           "ovh-eu",
+	"OVH_APPLICATION_KEY":    "key",
+	"OVH_APPLICATION_SECRET": "secret",
+	"OVH_CONSUMER_KEY":       "consumer",
+	"OVH_PROJECT_ID":         "project",
+	"OVH_S3_BUCKET":          "photos",
+}
+
+func getenv(env map[string]string, overrides ...string) func(string) string {
+	values := make(map[string]string, len(env))
+	for name, value := range env {
+		values[name] = value
+	}
+	for i := 0; i+1 < len(overrides); i += 2 {
+		values[overrides[i]] = overrides[i+1]
+	}
+	return func(name string) string { return values[name] }
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfig(getenv(productionEnv))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.DevMode || config.Port != 8080 || config.Storage.Backend != "ovh" || config.Storage.OVH.Region != "gra" || config.KeyEncrypter.Vault.Key != "photocloud" {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.DevAuthEnabled || config.FrontendURL != "https://photocloud.ovh" {
+		t.Errorf("expected dev auth off and the default frontend, got %v, %s", config.DevAuthEnabled, config.FrontendURL)
+	}
+	if len(config.TrustedProxies) != 0 {
+		t.Errorf("expected no trusted proxy, got %v", config.TrustedProxies)
+	}
+	if active := config.MasterKeys.Active(); active.Version != "1" || string(active.Key) != "production-master-key-32-bytes!!" {
+		t.Errorf("unexpected master key %+v", active)
+	}
+}
+
+func TestLoadConfig_ReportsEveryProblem(t *testing.T) {
+	_, err := loadConfig(getenv(nil, "PORT", "http", "STORAGE_BACKEND", "s3", "S3_ENDPOINT", "minio:9000", "DEV_AUTH_ENABLED", "true"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{
+		"PORT must be a port number",
+		"JWT_SECRET is required",
+		"MASTER_KEY is required",
+		"RP_ID is required",
+		"RP_ORIGIN is required",
+		"DEV_AUTH_ENABLED",
+		"S3_ENDPOINT must be an http(s) URL",
+		"S3_BUCKET is required",
+		"S3_ACCESS_KEY is required",
+		"S3_SECRET_KEY is required",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in:\n%v", expected, err)
+		}
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides []string
+		expected  string
+	}{
+		{"dev JWT secret", []string{"JWT_SECRET", "default-secret-change-me"}, "JWT_SECRET is the public dev secret"},
+		{"short JWT secret", []string{"JWT_SECRET", "secret"}, "JWT_SECRET must be at least 32 characters long"},
+		{"dev master key", []string{"MASTER_KEY", "dev-master-key-must-be-32-bytes-"}, "MASTER_KEY is the public dev key"},
+		{"short master key", []string{"MASTER_KEY", "c2hvcnQ="}, "MASTER_KEY must be a 32-byte"},
+		{"previous master key", []string{"MASTER_KEYS_PREVIOUS", "0:short"}, "MASTER_KEYS_PREVIOUS: key 0"},
+		{"duplicate master key version", []string{"MASTER_KEYS_PREVIOUS", "1:previous-master-key-of-32-bytes!"}, "duplicate master key version 1"},
+		{"unknown key encrypter", []string{"KEY_ENCRYPTER", "kms"}, `unknown KEY_ENCRYPTER "kms"`},
+		{"local key encrypter", []string{"KEY_ENCRYPTER", "local"}, "KEY_ENCRYPTER_KEYFILE is required"},
+		{"vault", []string{"VAULT_ADDR", "vault:8200", "VAULT_TRANSIT_KEY", ""}, "VAULT_TRANSIT_KEY is required\nVAULT_ADDR must be an http(s) URL"},
+		{"missing OVH settings", []string{"OVH_CONSUMER_KEY", "", "OVH_S3_BUCKET", ""}, "OVH_CONSUMER_KEY is required\nOVH_S3_BUCKET is required"},
+		{"OVH service key", []string{"OVH_SERVICE_ACCESS_KEY", "access"}, "OVH_SERVICE_ACCESS_KEY and OVH_SERVICE_SECRET_KEY must be set together"},
+		{"unknown backend", []string{"STORAGE_BACKEND", "gcs"}, `unknown STORAGE_BACKEND "gcs"`},
+		{"local address", []string{"STORAGE_BACKEND", "local", "LOCAL_STORAGE_ADDR", "9000"}, "LOCAL_STORAGE_ADDR must be host:port"},
+		{"registration mode", []string{"REGISTRATION_MODE", "maybe"}, `unknown REGISTRATION_MODE "maybe"`},
+		{"SMTP", []string{"SMTP_HOST", "smtp.example.com", "SMTP_PORT", "70000"}, "SMTP_PORT must be a port number, got \"70000\"\nSMTP_FROM is required"},
+		{"OIDC provider", []string{"OIDC_PROVIDERS", "keycloak", "OIDC_KEYCLOAK_ISSUER", "sso.example.com"}, "OIDC_KEYCLOAK_CLIENT_ID is required\nOIDC_KEYCLOAK_ISSUER must be an http(s) URL"},
+		{"frontend URL", []string{"FRONTEND_URL", "photocloud.ovh"}, "FRONTEND_URL must be an http(s) URL"},
+		{"dev mode", []string{"DEV_MODE", "yes"}, "DEV_MODE must be true or false"},
+		{"trusted proxies", []string{"TRUSTED_PROXIES", "10.0.0.0/8, proxy.local"}, `TRUSTED_PROXIES: invalid address "proxy.local"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(getenv(productionEnv, tt.overrides...))
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_DevMode(t *testing.T) {
+	config, err := loadConfig(getenv(nil, "DEV_MODE", "true", "DEV_AUTH_ENABLED", "true", "STORAGE_BACKEND", "local"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.JWTSecret != devJWTSecret || string(config.MasterKeys.Active().Key) != devMasterKey {
+		t.Error("expected the dev secrets")
+	}
+	if config.RPID != "localhost" || config.Storage.Local.Endpoint != "http://localhost:9000" || config.KeyEncrypter.KeyFile != devKeyFile {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	// Invalid settings are still rejected.
+	if _, err := loadConfig(getenv(nil, "DEV_MODE", "true", "STORAGE_BACKEND", "local", "MASTER_KEY", "short")); err == nil {
+		t.Error("expected an invalid MASTER_KEY to be rejected in dev mode")
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
+	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/snigle/photocloud/internal/domain"
 	"github.com/snigle/photocloud/internal/infra/auth"
@@ -17,33 +21,84 @@ import (
 
 type AuthResponse struct {
 	*domain.S3Credentials
-	Email string `json:"email"`
+	*domain.SessionTokens
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
 }
 
 func RegisterHandlers(
 	mux *http.ServeMux,
 	devAuth *auth.DevAuthenticator,
 	googleAuth *auth.GoogleAuthenticator,
+	oidcProviders map[string]domain.Authenticator,
 	magicLinkAuth *auth.MagicLinkAuthenticator,
 	emailSender domain.EmailSender,
 	webAuthn *auth.PasskeyAuthenticator,
+	ceremonies *auth.CeremonySealer,
+	sessionIssuer *auth.SessionTokenIssuer,
+	sessionUseCase *usecase.SessionUseCase,
+	accountUseCase *usecase.AccountUseCase,
 	getS3CredsUseCase *usecase.GetS3CredentialsUseCase,
+	passkeyCredentialsUseCase *usecase.PasskeyCredentialsUseCase,
+	registrationUseCase *usecase.RegistrationUseCase,
+	secondFactorUseCase *usecase.SecondFactorUseCase,
+	masterKeyRotationUseCase *usecase.MasterKeyRotationUseCase,
+	userKeyRotationUseCase *usecase.UserKeyRotationUseCase,
+	recoveryKitUseCase *usecase.RecoveryKitUseCase,
+	admins []string,
+	devAuthEnabled bool,
+	frontendURL string,
 ) {
-	mux.HandleFunc("/auth/dev", handleDevAuth(devAuth, getS3CredsUseCase))
-	mux.HandleFunc("/auth/google", handleGoogleAuth(googleAuth, getS3CredsUseCase))
-	mux.HandleFunc("/auth/magic-link/request", handleMagicLinkRequest(magicLinkAuth, emailSender))
-	mux.HandleFunc("/auth/magic-link/callback", handleMagicLinkCallback(magicLinkAuth, getS3CredsUseCase))
-	mux.HandleFunc("/auth/passkey/register/begin", handlePasskeyRegisterBegin(webAuthn))
-	mux.HandleFunc("/auth/passkey/register/finish", handlePasskeyRegisterFinish(webAuthn))
-	mux.HandleFunc("/auth/passkey/login/begin", handlePasskeyLoginBegin(webAuthn))
-	mux.HandleFunc("/auth/passkey/login/finish", handlePasskeyLoginFinish(webAuthn, getS3CredsUseCase))
+	// Every check of a TOTP code of an account counts against the same limit.
+	totpLimiter := newRateLimiter(5, 15*time.Minute)
+	// Recovery kits run argon2id, which is slow on purpose, and restoring one
+	// checks a passphrase.
+	recoveryKitLimiter := newRateLimiter(5, 15*time.Minute)
+	mux.HandleFunc("/auth/dev", handleDevAuth(devAuth, devAuthEnabled, accountUseCase, secondFactorUseCase, sessionUseCase, getS3CredsUseCase))
+	mux.HandleFunc("/auth/google", handleGoogleAuth(googleAuth, accountUseCase, secondFactorUseCase, sessionUseCase, getS3CredsUseCase))
+	mux.HandleFunc("/auth/oidc/{provider}", handleOIDCAuth(oidcProviders, accountUseCase, secondFactorUseCase, sessionUseCase, getS3CredsUseCase))
+	mux.HandleFunc("/auth/magic-link/request", handleMagicLinkRequest(magicLinkAuth, emailSender, frontendURL, newRateLimiter(3, 15*time.Minute), newRateLimiter(10, time.Hour)))
+	mux.HandleFunc("/auth/magic-link/callback", handleMagicLinkCallback(magicLinkAuth, accountUseCase, secondFactorUseCase, sessionUseCase, getS3CredsUseCase))
+	mux.HandleFunc("POST /auth/magic-link/verify-code", handleMagicLinkVerifyCode(magicLinkAuth, accountUseCase, secondFactorUseCase, sessionUseCase, getS3CredsUseCase, newRateLimiter(20, 15*time.Minute)))
+	mux.HandleFunc("POST /auth/totp/verify", handleTOTPVerify(secondFactorUseCase, sessionUseCase, getS3CredsUseCase, totpLimiter, newRateLimiter(20, 15*time.Minute)))
+	mux.HandleFunc("/auth/passkey/register/begin", handlePasskeyRegisterBegin(webAuthn, ceremonies, sessionIssuer, accountUseCase, secondFactorUseCase, sessionUseCase, magicLinkAuth))
+	mux.HandleFunc("/auth/passkey/register/finish", handlePasskeyRegisterFinish(webAuthn, ceremonies, sessionIssuer, sessionUseCase))
+	mux.HandleFunc("/auth/passkey/login/begin", handlePasskeyLoginBegin(webAuthn, ceremonies, accountUseCase))
+	mux.HandleFunc("/auth/passkey/login/finish", handlePasskeyLoginFinish(webAuthn, ceremonies, accountUseCase, secondFactorUseCase, sessionUseCase, getS3CredsUseCase))
+	mux.HandleFunc("POST /auth/refresh", handleRefresh(sessionUseCase))
+	mux.HandleFunc("POST /auth/logout", handleLogout(sessionUseCase))
+	mux.HandleFunc("POST /auth/logout-all", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleLogoutAll(sessionUseCase))))
 	mux.HandleFunc("/version", handleVersion())
-	mux.HandleFunc("/credentials", handleCredentials(getS3CredsUseCase))
+	mux.HandleFunc("/credentials", requireAuth(sessionIssuer, sessionUseCase, handleCredentials(getS3CredsUseCase)))
+	mux.HandleFunc("GET /me/sessions", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleListSessions(sessionUseCase))))
+	mux.HandleFunc("DELETE /me/sessions/{id}", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleRevokeSession(sessionUseCase))))
+	mux.HandleFunc("GET /me/passkeys", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleListPasskeys(passkeyCredentialsUseCase))))
+	mux.HandleFunc("PATCH /me/passkeys/{id}", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleRenamePasskey(passkeyCredentialsUseCase))))
+	mux.HandleFunc("DELETE /me/passkeys/{id}", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleDeletePasskey(passkeyCredentialsUseCase))))
+	mux.HandleFunc("GET /me/totp", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleTOTPStatus(secondFactorUseCase))))
+	mux.HandleFunc("POST /me/totp", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleTOTPEnroll(secondFactorUseCase))))
+	mux.HandleFunc("POST /me/totp/confirm", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleTOTPConfirm(secondFactorUseCase, totpLimiter))))
+	mux.HandleFunc("POST /me/totp/recovery-codes", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleTOTPRecoveryCodes(secondFactorUseCase, totpLimiter))))
+	mux.HandleFunc("DELETE /me/totp", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleTOTPDisable(secondFactorUseCase, totpLimiter))))
+	mux.HandleFunc("POST /me/email", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleEmailChangeRequest(magicLinkAuth, emailSender, accountUseCase, frontendURL, newRateLimiter(3, 15*time.Minute)))))
+	mux.HandleFunc("POST /me/email/confirm", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleEmailChangeConfirm(magicLinkAuth, accountUseCase, sessionUseCase, getS3CredsUseCase))))
+	mux.HandleFunc("POST /admin/invites", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(requireAdmin(admins, handleCreateInvite(registrationUseCase)))))
+	mux.HandleFunc("GET /admin/invites", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(requireAdmin(admins, handleListInvites(registrationUseCase)))))
+	mux.HandleFunc("DELETE /admin/invites/{id}", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(requireAdmin(admins, handleDeleteInvite(registrationUseCase)))))
+	mux.HandleFunc("GET /admin/master-key-rotation", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(requireAdmin(admins, handleMasterKeyRotationStatus(masterKeyRotationUseCase)))))
+	mux.HandleFunc("POST /admin/master-key-rotation", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(requireAdmin(admins, handleStartMasterKeyRotation(masterKeyRotationUseCase)))))
+	mux.HandleFunc("GET /me/key-rotation", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleUserKeyRotationStatus(userKeyRotationUseCase))))
+	mux.HandleFunc("POST /me/key-rotation", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleStartUserKeyRotation(userKeyRotationUseCase))))
+	mux.HandleFunc("POST /me/recovery-kit", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleCreateRecoveryKit(recoveryKitUseCase, recoveryKitLimiter))))
+	mux.HandleFunc("POST /me/recovery-kit/restore", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleRestoreRecoveryKit(sessionUseCase, recoveryKitUseCase, recoveryKitLimiter))))
+	mux.HandleFunc("GET /me/identities", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleListIdentities(accountUseCase))))
+	mux.HandleFunc("POST /me/identities", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleLinkIdentity(identityAuthenticators(googleAuth, oidcProviders), magicLinkAuth, accountUseCase))))
+	mux.HandleFunc("DELETE /me/identities/{id}", requireAuth(sessionIssuer, sessionUseCase, requireFullScope(handleUnlinkIdentity(accountUseCase))))
 }
 
-func handleDevAuth(devAuth *auth.DevAuthenticator, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+func handleDevAuth(devAuth *auth.DevAuthenticator, enabled bool, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if os.Getenv("DEV_AUTH_ENABLED") != "true" {
+		if !enabled {
 			http.Error(w, "Dev auth disabled", http.StatusForbidden)
 			return
 		}
@@ -52,11 +107,11 @@ func handleDevAuth(devAuth *auth.DevAuthenticator, getS3CredsUseCase *usecase.Ge
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
-		returnS3Credentials(w, r, getS3CredsUseCase, userInfo.Email)
+		returnS3Credentials(w, r, accountUseCase, secondFactorUseCase, getS3CredsUseCase, sessionUseCase, userInfo)
 	}
 }
 
-func handleGoogleAuth(googleAuth *auth.GoogleAuthenticator, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+func handleGoogleAuth(googleAuth *auth.GoogleAuthenticator, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.URL.Query().Get("token")
 		userInfo, err := googleAuth.Authenticate(r.Context(), token)
@@ -64,15 +119,28 @@ func handleGoogleAuth(googleAuth *auth.GoogleAuthenticator, getS3CredsUseCase *u
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		returnS3Credentials(w, r, getS3CredsUseCase, userInfo.Email)
+		returnS3Credentials(w, r, accountUseCase, secondFactorUseCase, getS3CredsUseCase, sessionUseCase, userInfo)
 	}
 }
 
-func isAllowedRedirect(redirectURL string) bool {
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "http://localhost:8081"
+func handleOIDCAuth(providers map[string]domain.Authenticator, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := providers[r.PathValue("provider")]
+		if !ok {
+			http.Error(w, "Unknown provider", http.StatusNotFound)
+			return
+		}
+		userInfo, err := provider.Authenticate(r.Context(), r.URL.Query().Get("token"))
+		if err != nil {
+			log.Printf("OIDC login with %s rejected: %v", r.PathValue("provider"), err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		returnS3Credentials(w, r, accountUseCase, secondFactorUseCase, getS3CredsUseCase, sessionUseCase, userInfo)
 	}
+}
+
+func isAllowedRedirect(redirectURL string, frontendURL string) bool {
 	allowedOrigins := []string{frontendURL, "photocloud://", "http://localhost:8081", "exp://"}
 	for _, origin := range allowedOrigins {
 		if redirectURL == origin || strings.HasPrefix(redirectURL, origin+"/") || strings.HasPrefix(redirectURL, origin+"?") {
@@ -82,34 +150,50 @@ func isAllowedRedirect(redirectURL string) bool {
 	return false
 }
 
-func handleMagicLinkRequest(magicLinkAuth *auth.MagicLinkAuthenticator, emailSender domain.EmailSender) http.HandlerFunc {
+// frontendURL is the base of the links sent by email.
+func handleMagicLinkRequest(magicLinkAuth *auth.MagicLinkAuthenticator, emailSender domain.EmailSender, frontendURL string, emailLimiter *rateLimiter, ipLimiter *rateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		emailAddr := r.URL.Query().Get("email")
 		redirectURL := r.URL.Query().Get("redirect_url")
-		token, err := magicLinkAuth.GenerateToken(r.Context(), emailAddr)
-		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+		if emailAddr == "" {
+			http.Error(w, "Missing email", http.StatusBadRequest)
 			return
 		}
-
-		if redirectURL != "" && !isAllowedRedirect(redirectURL) {
+		if redirectURL != "" && !isAllowedRedirect(redirectURL, frontendURL) {
 			http.Error(w, "Invalid redirect_url", http.StatusBadRequest)
 			return
 		}
 
-		// The user confirmed that photocloud.ovh is the frontend URL.
-		// We use it for the login link.
-		frontendURL := os.Getenv("FRONTEND_URL")
-		if frontendURL == "" {
-			frontendURL = "https://photocloud.ovh"
+		if ok, retryAfter := ipLimiter.allow(clientInfo(r).IP); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+		if ok, retryAfter := emailLimiter.allow(strings.ToLower(strings.TrimSpace(emailAddr))); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		token, code, err := magicLinkAuth.GenerateLink(r.Context(), emailAddr)
+		if err != nil {
+			log.Printf("Error generating magic link code for %s: %v", emailAddr, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
 		}
 
 		loginURL := fmt.Sprintf("%s/login?token=%s", frontendURL, token)
 		if redirectURL != "" {
 			loginURL += fmt.Sprintf("&redirect_url=%s", redirectURL)
 		}
+		if invite := r.URL.Query().Get("invite"); invite != "" {
+			loginURL += "&invite=" + url.QueryEscape(invite)
+		}
+		// The app keeps these links for a passkey registration instead of
+		// logging in with them.
+		if r.URL.Query().Get("passkey") == "register" {
+			loginURL += "&passkey=register"
+		}
 
-		body := fmt.Sprintf(email.MagicLinkEmailTemplate, loginURL, loginURL)
+		body := fmt.Sprintf(email.MagicLinkEmailTemplate, loginURL, code, loginURL)
 		err = emailSender.SendEmail(r.Context(), emailAddr, "Lien de connexion Photo Cloud", body)
 		if err != nil {
 			http.Error(w, "Failed to send email", http.StatusInternalServerError)
@@ -119,44 +203,111 @@ func handleMagicLinkRequest(magicLinkAuth *auth.MagicLinkAuthenticator, emailSen
 	}
 }
 
-func handleMagicLinkCallback(magicLinkAuth *auth.MagicLinkAuthenticator, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+func handleMagicLinkCallback(magicLinkAuth *auth.MagicLinkAuthenticator, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.URL.Query().Get("token")
 		userInfo, err := magicLinkAuth.ValidateToken(r.Context(), token)
+		if errors.Is(err, domain.ErrMagicLinkUsed) {
+			http.Error(w, "Magic link already used", http.StatusUnauthorized)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
-		returnS3Credentials(w, r, getS3CredsUseCase, userInfo.Email)
+		returnS3Credentials(w, r, accountUseCase, secondFactorUseCase, getS3CredsUseCase, sessionUseCase, userInfo)
 	}
 }
 
-func handlePasskeyRegisterBegin(webAuthn *auth.PasskeyAuthenticator) http.HandlerFunc {
+type verifyCodeRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+func handleMagicLinkVerifyCode(magicLinkAuth *auth.MagicLinkAuthenticator, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase, ipLimiter *rateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		email := r.URL.Query().Get("email")
-		options, session, err := webAuthn.BeginRegistration(r.Context(), email)
+		if ok, retryAfter := ipLimiter.allow(clientInfo(r).IP); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		var req verifyCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" || req.Code == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		userInfo, err := magicLinkAuth.ValidateCode(r.Context(), req.Email, req.Code)
+		if errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("Error validating magic link code for %s: %v", req.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		sessionData, _ := json.Marshal(session)
-		http.SetCookie(w, &http.Cookie{Name: "webauthn_session", Value: string(sessionData), Path: "/"})
-		json.NewEncoder(w).Encode(options)
+		returnS3Credentials(w, r, accountUseCase, secondFactorUseCase, getS3CredsUseCase, sessionUseCase, userInfo)
 	}
 }
 
-func handlePasskeyRegisterFinish(webAuthn *auth.PasskeyAuthenticator) http.HandlerFunc {
+const (
+	ceremonyCookieName = "webauthn_session"
+	ceremonyHeaderName = "X-WebAuthn-Ceremony"
+)
+
+type passkeyCreationResponse struct {
+	*protocol.CredentialCreation
+	CeremonyID string `json:"ceremony_id"`
+}
+
+type passkeyAssertionResponse struct {
+	*protocol.CredentialAssertion
+	CeremonyID string `json:"ceremony_id"`
+}
+
+func handlePasskeyRegisterBegin(webAuthn *auth.PasskeyAuthenticator, ceremonies *auth.CeremonySealer, sessionIssuer domain.SessionTokenIssuer, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, magicLinkAuth domain.MagicLinkAuthenticator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		email := r.URL.Query().Get("email")
-		cookie, err := r.Cookie("webauthn_session")
+		userInfo, err := passkeyRegistrationIdentity(r, sessionIssuer, accountUseCase, secondFactorUseCase, sessionUseCase, magicLinkAuth)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		options, session, err := webAuthn.BeginRegistration(r.Context(), userInfo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ceremonyID, err := ceremonies.Seal(auth.CeremonyRegistration, userInfo, session)
 		if err != nil {
-			http.Error(w, "Session not found", http.StatusBadRequest)
+			log.Printf("Error sealing passkey registration for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		setCeremonyCookie(w, ceremonyID, ceremonies.TTL())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(passkeyCreationResponse{options, ceremonyID})
+	}
+}
+
+func handlePasskeyRegisterFinish(webAuthn *auth.PasskeyAuthenticator, ceremonies *auth.CeremonySealer, sessionIssuer domain.SessionTokenIssuer, sessionUseCase *usecase.SessionUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ceremony, ok := openCeremony(w, r, ceremonies, auth.CeremonyRegistration)
+		if !ok {
 			return
 		}
-		var session webauthn.SessionData
-		json.Unmarshal([]byte(cookie.Value), &session)
+		// The ceremony account was verified when it began. A session sent
+		// along must belong to the same account.
+		if token := bearerToken(r); token != "" {
+			userInfo, err := authenticate(r, token, sessionIssuer, sessionUseCase)
+			if err != nil || userInfo.UserID != ceremony.UserID {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
 
-		err = webAuthn.FinishRegistration(r.Context(), email, session, r)
+		userInfo := &domain.UserInfo{UserID: ceremony.UserID, Email: ceremony.Email}
+		err := webAuthn.FinishRegistration(r.Context(), userInfo, r.URL.Query().Get("nickname"), ceremony.Session, r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -165,37 +316,220 @@ func handlePasskeyRegisterFinish(webAuthn *auth.PasskeyAuthenticator) http.Handl
 	}
 }
 
-func handlePasskeyLoginBegin(webAuthn *auth.PasskeyAuthenticator) http.HandlerFunc {
+// passkeyRegistrationIdentity returns the account a passkey may be attached to:
+// the owner of a live session or, for a first sign-up, the owner of a fresh
+// magic link token. A query-string email is never trusted, and a magic link
+// alone cannot add a passkey to an account protected by a second factor.
+func passkeyRegistrationIdentity(r *http.Request, sessionIssuer domain.SessionTokenIssuer, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, magicLinkAuth domain.MagicLinkAuthenticator) (*domain.UserInfo, error) {
+	if token := bearerToken(r); token != "" {
+		userInfo, err := authenticate(r, token, sessionIssuer, sessionUseCase)
+		if err != nil {
+			return nil, err
+		}
+		if !userInfo.Scope.Allows(domain.CredentialScopeFull) {
+			return nil, domain.ErrCredentialScopeDenied
+		}
+		return userInfo, nil
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		userInfo, err := magicLinkAuth.ValidateToken(r.Context(), token)
+		if err != nil {
+			return nil, err
+		}
+		if err := accountUseCase.Resolve(r.Context(), userInfo, r.URL.Query().Get("invite")); err != nil {
+			return nil, err
+		}
+		required, err := secondFactorUseCase.Required(r.Context(), userInfo)
+		if err != nil {
+			return nil, err
+		}
+		if required {
+			return nil, domain.ErrSecondFactorRequired
+		}
+		return userInfo, nil
+	}
+	return nil, errors.New("authentication required")
+}
+
+func handlePasskeyLoginBegin(webAuthn *auth.PasskeyAuthenticator, ceremonies *auth.CeremonySealer, accountUseCase *usecase.AccountUseCase) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Without an email the browser is asked for a discoverable credential.
 		email := r.URL.Query().Get("email")
-		options, session, err := webAuthn.BeginLogin(r.Context(), email)
+		var (
+			user    *domain.UserInfo
+			options *protocol.CredentialAssertion
+			session *webauthn.SessionData
+			err     error
+		)
+		if email == "" {
+			options, session, err = webAuthn.BeginDiscoverableLogin(r.Context())
+		} else {
+			// Unknown emails and accounts without passkeys get a discoverable
+			// challenge, so that the answer does not tell whether the email
+			// has an account.
+			user = &domain.UserInfo{Email: email}
+			var userID string
+			if userID, err = accountUseCase.Lookup(r.Context(), email); err == nil {
+				options, session, err = webAuthn.BeginLogin(r.Context(), userID)
+			}
+			if err == nil {
+				user.UserID = userID
+			} else {
+				if !errors.Is(err, domain.ErrAccountNotFound) && !errors.Is(err, domain.ErrUserNotFound) {
+					log.Printf("Error starting passkey login for %s: %v", email, err)
+				}
+				options, session, err = webAuthn.BeginDiscoverableLogin(r.Context())
+			}
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("Error starting passkey login: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		ceremonyID, err := ceremonies.Seal(auth.CeremonyLogin, user, session)
+		if err != nil {
+			log.Printf("Error sealing passkey login for %s: %v", email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		sessionData, _ := json.Marshal(session)
-		http.SetCookie(w, &http.Cookie{Name: "webauthn_session", Value: string(sessionData), Path: "/"})
-		json.NewEncoder(w).Encode(options)
+		setCeremonyCookie(w, ceremonyID, ceremonies.TTL())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(passkeyAssertionResponse{options, ceremonyID})
 	}
 }
 
-func handlePasskeyLoginFinish(webAuthn *auth.PasskeyAuthenticator, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+func handlePasskeyLoginFinish(webAuthn *auth.PasskeyAuthenticator, ceremonies *auth.CeremonySealer, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		email := r.URL.Query().Get("email")
-		cookie, err := r.Cookie("webauthn_session")
-		if err != nil {
-			http.Error(w, "Session not found", http.StatusBadRequest)
+		ceremony, ok := openCeremony(w, r, ceremonies, auth.CeremonyLogin)
+		if !ok {
+			return
+		}
+		if queryEmail := r.URL.Query().Get("email"); queryEmail != "" && queryEmail != ceremony.Email {
+			http.Error(w, "Invalid passkey ceremony", http.StatusBadRequest)
 			return
 		}
-		var session webauthn.SessionData
-		json.Unmarshal([]byte(cookie.Value), &session)
 
-		userInfo, err := webAuthn.FinishLogin(r.Context(), email, session, r)
+		var userInfo *domain.UserInfo
+		var err error
+		if ceremony.UserID == "" {
+			userInfo, err = webAuthn.FinishDiscoverableLogin(r.Context(), ceremony.Session, r)
+		} else {
+			userInfo, err = webAuthn.FinishLogin(r.Context(), ceremony.UserID, ceremony.Session, r)
+		}
+		if errors.Is(err, domain.ErrPasskeyCloned) {
+			log.Printf("Rejected passkey login for %s: sign counter went backwards, possible cloned authenticator", ceremony.Email)
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
-		returnS3Credentials(w, r, getS3CredsUseCase, userInfo.Email)
+		returnS3Credentials(w, r, accountUseCase, secondFactorUseCase, getS3CredsUseCase, sessionUseCase, userInfo)
+	}
+}
+
+// setCeremonyCookie hands the ceremony ID to browsers. Native clients, which
+// have no cookie jar, send back the ceremony_id from the JSON body instead.
+func setCeremonyCookie(w http.ResponseWriter, ceremonyID string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ceremonyCookieName,
+		Value:    ceremonyID,
+		Path:     "/auth/passkey",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// openCeremony reads the ceremony ID from the header or the cookie and writes
+// the error response itself when it cannot be used.
+func openCeremony(w http.ResponseWriter, r *http.Request, ceremonies *auth.CeremonySealer, kind string) (*auth.Ceremony, bool) {
+	ceremonyID := r.Header.Get(ceremonyHeaderName)
+	if ceremonyID == "" {
+		cookie, err := r.Cookie(ceremonyCookieName)
+		if err != nil {
+			http.Error(w, "Passkey ceremony not found", http.StatusBadRequest)
+			return nil, false
+		}
+		ceremonyID = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ceremonyCookieName,
+		Path:     "/auth/passkey",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	ceremony, err := ceremonies.Open(kind, ceremonyID)
+	if errors.Is(err, auth.ErrCeremonyExpired) {
+		http.Error(w, "Passkey ceremony expired", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Invalid passkey ceremony", http.StatusBadRequest)
+		return nil, false
+	}
+	return ceremony, true
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func handleRefresh(sessionUseCase *usecase.SessionUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req refreshTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userInfo, tokens, err := sessionUseCase.Refresh(r.Context(), req.RefreshToken, clientInfo(r))
+		if err != nil {
+			if errors.Is(err, domain.ErrRefreshTokenReused) {
+				log.Printf("Refresh token reuse detected, session family revoked")
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{
+			SessionTokens: tokens,
+			UserID:        userInfo.UserID,
+			Email:         userInfo.Email,
+		})
+	}
+}
+
+func handleLogout(sessionUseCase *usecase.SessionUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req refreshTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := sessionUseCase.Logout(r.Context(), req.RefreshToken); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleLogoutAll(sessionUseCase *usecase.SessionUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := sessionUseCase.LogoutAll(r.Context(), userInfo); err != nil {
+			log.Printf("Error revoking sessions for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
@@ -205,27 +539,962 @@ func handleVersion() http.HandlerFunc {
 	}
 }
 
-func handleCredentials(getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	AuthMethod string    `json:"auth_method"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+func handleListSessions(sessionUseCase *usecase.SessionUseCase) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		email := r.Header.Get("X-User-Email")
-		if email == "" {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sessions, err := sessionUseCase.List(r.Context(), userInfo)
+		if err != nil {
+			log.Printf("Error listing sessions for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		res := make([]sessionResponse, len(sessions))
+		for i, s := range sessions {
+			res[i] = sessionResponse{
+				ID:         s.ID,
+				AuthMethod: s.AuthMethod,
+				UserAgent:  s.UserAgent,
+				IP:         s.IP,
+				CreatedAt:  s.CreatedAt,
+				LastSeenAt: s.LastSeenAt,
+				Current:    s.ID == userInfo.SessionID,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func handleRevokeSession(sessionUseCase *usecase.SessionUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		err := sessionUseCase.Revoke(r.Context(), userInfo, r.PathValue("id"))
+		if errors.Is(err, domain.ErrSessionNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error revoking session for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type passkeyResponse struct {
+	ID             string    `json:"id"`
+	Nickname       string    `json:"nickname"`
+	AAGUID         string    `json:"aaguid"`
+	Transports     []string  `json:"transports"`
+	BackupEligible bool      `json:"backup_eligible"`
+	BackupState    bool      `json:"backup_state"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+}
+
+func handleListPasskeys(passkeyCredentialsUseCase *usecase.PasskeyCredentialsUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		creds, err := passkeyCredentialsUseCase.List(r.Context(), userInfo)
+		if err != nil {
+			log.Printf("Error listing passkeys for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		res := make([]passkeyResponse, len(creds))
+		for i, c := range creds {
+			res[i] = passkeyResponse{
+				ID:         base64.RawURLEncoding.EncodeToString(c.ID),
+				Nickname:   c.Nickname,
+				AAGUID:     formatAAGUID(c.AAGUID),
+				Transports: c.Transport,
+				CreatedAt:  c.CreatedAt,
+				LastUsedAt: c.LastUsedAt,
+			}
+			if c.Flags != nil {
+				res[i].BackupEligible = c.Flags.BackupEligible
+				res[i].BackupState = c.Flags.BackupState
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+type renamePasskeyRequest struct {
+	Nickname string `json:"nickname"`
+}
+
+func handleRenamePasskey(passkeyCredentialsUseCase *usecase.PasskeyCredentialsUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		credentialID, err := base64.RawURLEncoding.DecodeString(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		var req renamePasskeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err = passkeyCredentialsUseCase.Rename(r.Context(), userInfo, credentialID, req.Nickname)
+		writePasskeyUpdateResult(w, userInfo, err)
+	}
+}
+
+func handleDeletePasskey(passkeyCredentialsUseCase *usecase.PasskeyCredentialsUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		credentialID, err := base64.RawURLEncoding.DecodeString(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		err = passkeyCredentialsUseCase.Delete(r.Context(), userInfo, credentialID)
+		writePasskeyUpdateResult(w, userInfo, err)
+	}
+}
+
+func writePasskeyUpdateResult(w http.ResponseWriter, userInfo *domain.UserInfo, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, domain.ErrPasskeyNotFound):
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+	case errors.Is(err, usecase.ErrInvalidPasskeyNickname):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error updating passkeys for %s: %v", userInfo.Email, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// formatAAGUID renders the authenticator model ID in the UUID form used by the
+// FIDO metadata service.
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", aaguid[0:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:16])
+}
+
+type identityResponse struct {
+	ID       string    `json:"id"`
+	Provider string    `json:"provider"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+func handleListIdentities(accountUseCase *usecase.AccountUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		account, err := accountUseCase.Get(r.Context(), userInfo)
+		if err != nil {
+			log.Printf("Error getting account for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		res := make([]identityResponse, len(account.Identities))
+		for i, identity := range account.Identities {
+			res[i] = identityResponse{
+				ID:       identity.ID(),
+				Provider: identity.Provider,
+				Email:    identity.Email,
+				LinkedAt: identity.LinkedAt,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// identityAuthenticators maps the providers that can be linked to an account
+// to the authenticator validating their tokens.
+func identityAuthenticators(googleAuth *auth.GoogleAuthenticator, oidcProviders map[string]domain.Authenticator) map[string]domain.Authenticator {
+	authenticators := map[string]domain.Authenticator{"google": googleAuth}
+	for name, provider := range oidcProviders {
+		authenticators["oidc:"+name] = provider
+	}
+	return authenticators
+}
+
+type linkIdentityRequest struct {
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+}
+
+func handleLinkIdentity(authenticators map[string]domain.Authenticator, magicLinkAuth domain.MagicLinkAuthenticator, accountUseCase *usecase.AccountUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req linkIdentityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var linked *domain.UserInfo
+		var err error
+		if req.Provider == domain.IdentityProviderEmail {
+			linked, err = magicLinkAuth.ValidateToken(r.Context(), req.Token)
+		} else if authenticator, ok := authenticators[req.Provider]; ok {
+			linked, err = authenticator.Authenticate(r.Context(), req.Token)
+		} else {
+			http.Error(w, "Unknown provider", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Identity link with %s rejected for %s: %v", req.Provider, userInfo.Email, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		identity, err := accountUseCase.Link(r.Context(), userInfo, linked)
+		switch {
+		case err == nil:
+		case errors.Is(err, domain.ErrIdentityAlreadyLinked):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			log.Printf("Error linking identity for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(identityResponse{
+			ID:       identity.ID(),
+			Provider: identity.Provider,
+			Email:    identity.Email,
+			LinkedAt: identity.LinkedAt,
+		})
+	}
+}
+
+func handleUnlinkIdentity(accountUseCase *usecase.AccountUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		err := accountUseCase.Unlink(r.Context(), userInfo, r.PathValue("id"))
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, domain.ErrIdentityNotFound):
+			http.Error(w, "Identity not found", http.StatusNotFound)
+		case errors.Is(err, domain.ErrLastIdentity):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Printf("Error unlinking identity for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+	}
+}
+
+type emailChangeRequest struct {
+	Email string `json:"email"`
+}
+
+func handleEmailChangeRequest(magicLinkAuth *auth.MagicLinkAuthenticator, emailSender domain.EmailSender, accountUseCase *usecase.AccountUseCase, frontendURL string, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		returnS3Credentials(w, r, getS3CredsUseCase, email)
+		var req emailChangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.Contains(req.Email, "@") {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if ok, retryAfter := limiter.allow(userInfo.UserID); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		err := accountUseCase.CheckEmail(r.Context(), userInfo, req.Email)
+		if errors.Is(err, domain.ErrEmailInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking new email for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		token, code, err := magicLinkAuth.GenerateLink(r.Context(), req.Email)
+		if err != nil {
+			log.Printf("Error generating email change code for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		// The frontend confirms the change with the session it is logged in with.
+		confirmURL := fmt.Sprintf("%s/?change_email_token=%s", frontendURL, token)
+		body := fmt.Sprintf(email.EmailChangeEmailTemplate, confirmURL, code)
+		if err := emailSender.SendEmail(r.Context(), req.Email, "Confirmez votre nouvelle adresse Photo Cloud", body); err != nil {
+			http.Error(w, "Failed to send email", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Email sent"))
+	}
+}
+
+type emailChangeConfirmRequest struct {
+	Token string `json:"token"`
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+func handleEmailChangeConfirm(magicLinkAuth *auth.MagicLinkAuthenticator, accountUseCase *usecase.AccountUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req emailChangeConfirmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Token == "" && (req.Email == "" || req.Code == "")) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var verified *domain.UserInfo
+		var err error
+		if req.Token != "" {
+			verified, err = magicLinkAuth.ValidateToken(r.Context(), req.Token)
+		} else {
+			verified, err = magicLinkAuth.ValidateCode(r.Context(), req.Email, req.Code)
+		}
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		previous := userInfo.Email
+		err = accountUseCase.ChangeEmail(r.Context(), userInfo, verified.Email)
+		if errors.Is(err, domain.ErrEmailInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			// The change resumes on the next login.
+			log.Printf("Error changing email of %s: %v", previous, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Changed email of %s to %s", previous, userInfo.Email)
+		// The current session goes on under the new email, rather than a new
+		// one that would skip the second factor.
+		tokens, err := sessionUseCase.Reissue(r.Context(), userInfo, clientInfo(r))
+		if errors.Is(err, domain.ErrSessionRevoked) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Error reissuing session for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeSession(w, r, getS3CredsUseCase, userInfo, tokens)
+	}
+}
+
+type secondFactorChallengeResponse struct {
+	SecondFactor   string `json:"second_factor"`
+	ChallengeToken string `json:"challenge_token"`
+	UserID         string `json:"user_id"`
+	Email          string `json:"email"`
+}
+
+type totpVerifyRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+func handleTOTPVerify(secondFactorUseCase *usecase.SecondFactorUseCase, sessionUseCase *usecase.SessionUseCase, getS3CredsUseCase *usecase.GetS3CredentialsUseCase, userLimiter *rateLimiter, ipLimiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := ipLimiter.allow(clientInfo(r).IP); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		var req totpVerifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeToken == "" || req.Code == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userInfo, err := secondFactorUseCase.OpenChallenge(r.Context(), req.ChallengeToken)
+		if err != nil {
+			http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+			return
+		}
+		if ok, retryAfter := userLimiter.allow(userInfo.UserID); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		err = secondFactorUseCase.Verify(r.Context(), userInfo.UserID, req.Code)
+		if errors.Is(err, domain.ErrTOTPCodeInvalid) || errors.Is(err, domain.ErrTOTPNotEnabled) {
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Error verifying second factor for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		startSession(w, r, getS3CredsUseCase, sessionUseCase, userInfo)
+	}
+}
+
+type totpStatusResponse struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type totpEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func handleTOTPStatus(secondFactorUseCase *usecase.SecondFactorUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		config, err := secondFactorUseCase.Status(r.Context(), userInfo)
+		if err != nil {
+			log.Printf("Error loading second factor of %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		res := totpStatusResponse{Enabled: config.Enabled()}
+		if res.Enabled {
+			res.RecoveryCodesLeft = config.RecoveryCodesLeft()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func handleTOTPEnroll(secondFactorUseCase *usecase.SecondFactorUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		secret, uri, err := secondFactorUseCase.BeginEnrollment(r.Context(), userInfo)
+		if errors.Is(err, domain.ErrTOTPAlreadyEnabled) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error enrolling second factor for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(totpEnrollmentResponse{Secret: secret, OTPAuthURI: uri})
+	}
+}
+
+func handleTOTPConfirm(secondFactorUseCase *usecase.SecondFactorUseCase, limiter *rateLimiter) http.HandlerFunc {
+	return handleTOTPCode(limiter, func(r *http.Request, userInfo *domain.UserInfo, code string) ([]string, error) {
+		return secondFactorUseCase.ConfirmEnrollment(r.Context(), userInfo, code)
+	})
+}
+
+func handleTOTPRecoveryCodes(secondFactorUseCase *usecase.SecondFactorUseCase, limiter *rateLimiter) http.HandlerFunc {
+	return handleTOTPCode(limiter, func(r *http.Request, userInfo *domain.UserInfo, code string) ([]string, error) {
+		return secondFactorUseCase.RegenerateRecoveryCodes(r.Context(), userInfo, code)
+	})
+}
+
+func handleTOTPDisable(secondFactorUseCase *usecase.SecondFactorUseCase, limiter *rateLimiter) http.HandlerFunc {
+	return handleTOTPCode(limiter, func(r *http.Request, userInfo *domain.UserInfo, code string) ([]string, error) {
+		return nil, secondFactorUseCase.Disable(r.Context(), userInfo, code)
+	})
+}
+
+// handleTOTPCode runs a second factor change that needs a current code. Codes
+// are throttled per account so that a stolen session cannot guess them.
+func handleTOTPCode(limiter *rateLimiter, apply func(r *http.Request, userInfo *domain.UserInfo, code string) ([]string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req totpCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if ok, retryAfter := limiter.allow(userInfo.UserID); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		recoveryCodes, err := apply(r, userInfo, req.Code)
+		switch {
+		case err == nil && recoveryCodes == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case err == nil:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+		case errors.Is(err, domain.ErrTOTPCodeInvalid):
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+		case errors.Is(err, domain.ErrTOTPNotEnabled), errors.Is(err, domain.ErrTOTPAlreadyEnabled):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Printf("Error updating second factor of %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+	}
+}
+
+type createInviteRequest struct {
+	MaxUses   int    `json:"max_uses"`
+	ValidDays int    `json:"valid_days"`
+	Note      string `json:"note"`
+}
+
+type inviteResponse struct {
+	ID        string    `json:"id"`
+	Code      string    `json:"code,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+}
+
+func newInviteResponse(invite *domain.Invite) inviteResponse {
+	return inviteResponse{
+		ID:        invite.ID,
+		Note:      invite.Note,
+		CreatedBy: invite.CreatedBy,
+		CreatedAt: invite.CreatedAt,
+		ExpiresAt: invite.ExpiresAt,
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+	}
+}
+
+func handleCreateInvite(registrationUseCase *usecase.RegistrationUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req := createInviteRequest{MaxUses: 1, ValidDays: 7}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		code, invite, err := registrationUseCase.CreateInvite(r.Context(), userInfo, req.MaxUses, time.Duration(req.ValidDays)*24*time.Hour, req.Note)
+		if errors.Is(err, usecase.ErrInvalidInvite) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating invite for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		res := newInviteResponse(invite)
+		res.Code = code
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func handleListInvites(registrationUseCase *usecase.RegistrationUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		invites, err := registrationUseCase.ListInvites(r.Context())
+		if err != nil {
+			log.Printf("Error listing invites: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		res := make([]inviteResponse, len(invites))
+		for i := range invites {
+			res[i] = newInviteResponse(&invites[i])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func handleDeleteInvite(registrationUseCase *usecase.RegistrationUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		err := registrationUseCase.DeleteInvite(r.Context(), r.PathValue("id"))
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, domain.ErrInviteNotFound):
+			http.Error(w, "Invite not found", http.StatusNotFound)
+		default:
+			log.Printf("Error deleting invite for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+	}
+}
+
+func handleMasterKeyRotationStatus(masterKeyRotationUseCase *usecase.MasterKeyRotationUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rotation, err := masterKeyRotationUseCase.Status(r.Context())
+		if err != nil {
+			log.Printf("Error getting master key rotation: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if rotation == nil {
+			http.Error(w, "No master key rotation", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rotation)
+	}
+}
+
+// handleStartMasterKeyRotation runs the rotation in the background; its
+// progress is read from GET /admin/master-key-rotation.
+func handleStartMasterKeyRotation(masterKeyRotationUseCase *usecase.MasterKeyRotationUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Master key rotation started by %s", userInfo.Email)
+		go runMasterKeyRotation(masterKeyRotationUseCase)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func handleUserKeyRotationStatus(userKeyRotationUseCase *usecase.UserKeyRotationUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rotation, err := userKeyRotationUseCase.Status(r.Context(), userInfo.UserID)
+		if err != nil {
+			log.Printf("Error getting key rotation of %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if rotation == nil {
+			http.Error(w, "No key rotation", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rotation)
+	}
+}
+
+// handleStartUserKeyRotation creates a new version of the user key and
+// re-encrypts the photos in the background; the progress is read from GET
+// /me/key-rotation. The S3 keys of every session are revoked: the apps must
+// fetch new credentials, with the new user key, from /credentials.
+func handleStartUserKeyRotation(userKeyRotationUseCase *usecase.UserKeyRotationUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rotation, err := userKeyRotationUseCase.Start(r.Context(), userInfo.UserID)
+		switch {
+		case errors.Is(err, domain.ErrUserKeyRotationPending):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, domain.ErrUserKeyNotFound):
+			http.Error(w, "No key to rotate", http.StatusNotFound)
+			return
+		case err != nil:
+			log.Printf("Error starting key rotation of %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		go runUserKeyRotation(userKeyRotationUseCase, userInfo.UserID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(rotation)
+	}
+}
+
+// recoveryKitLoginAge is how recent the login of a session restoring a
+// recovery kit must be.
+const recoveryKitLoginAge = 10 * time.Minute
+
+type recoveryKitRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+type restoreRecoveryKitRequest struct {
+	Code       string `json:"code"`
+	Passphrase string `json:"passphrase"`
+}
+
+type restoreRecoveryKitResponse struct {
+	KeyVersion int `json:"key_version"`
+}
+
+// handleCreateRecoveryKit returns the keys of the user sealed with a
+// passphrase. The response is the file to save, and its code is printed or
+// shown as a QR code.
+func handleCreateRecoveryKit(recoveryKitUseCase *usecase.RecoveryKitUseCase, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req recoveryKitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if ok, retryAfter := limiter.allow(userInfo.UserID); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		kit, err := recoveryKitUseCase.Create(r.Context(), userInfo, req.Passphrase)
+		switch {
+		case errors.Is(err, domain.ErrPassphraseTooShort):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, domain.ErrUserKeyNotFound):
+			http.Error(w, "No key to save", http.StatusNotFound)
+			return
+		case err != nil:
+			log.Printf("Error creating recovery kit of %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="photocloud-recovery-kit.json"`)
+		json.NewEncoder(w).Encode(kit)
+	}
+}
+
+// handleRestoreRecoveryKit installs the keys of a recovery kit. The session
+// must have logged in recently, so that a stolen session cannot replace the
+// keys. The S3 keys of every session are revoked: the apps must fetch new
+// credentials from /credentials.
+func handleRestoreRecoveryKit(sessionUseCase *usecase.SessionUseCase, recoveryKitUseCase *usecase.RecoveryKitUseCase, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req restoreRecoveryKitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := sessionUseCase.RequireRecentLogin(r.Context(), userInfo, recoveryKitLoginAge); err != nil {
+			if errors.Is(err, domain.ErrReauthenticationRequired) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if ok, retryAfter := limiter.allow(userInfo.UserID); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		keys, err := recoveryKitUseCase.Restore(r.Context(), userInfo, req.Code, req.Passphrase)
+		switch {
+		case errors.Is(err, domain.ErrInvalidRecoveryKit), errors.Is(err, domain.ErrRecoveryKitPassphrase):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("Error restoring recovery kit of %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Recovery kit restored for %s, user key version %d", userInfo.Email, keys.Active().Version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(restoreRecoveryKitResponse{KeyVersion: keys.Active().Version})
+	}
+}
+
+func handleCredentials(getS3CredsUseCase *usecase.GetS3CredentialsUseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		scope, err := domain.ParseCredentialScope(r.URL.Query().Get("scope"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		creds, err := getS3CredsUseCase.Execute(r.Context(), userInfo, scope)
+		if errors.Is(err, domain.ErrCredentialScopeDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("Error getting S3 credentials for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{
+			S3Credentials: creds,
+			UserID:        userInfo.UserID,
+			Email:         userInfo.Email,
+		})
+	}
+}
+
+// returnS3Credentials finishes a login: it resolves the account, asks for the
+// second factor when the account has one, then starts the session. A nil
+// secondFactorUseCase skips the second factor.
+func returnS3Credentials(w http.ResponseWriter, r *http.Request, accountUseCase *usecase.AccountUseCase, secondFactorUseCase *usecase.SecondFactorUseCase, useCase *usecase.GetS3CredentialsUseCase, sessionUseCase *usecase.SessionUseCase, userInfo *domain.UserInfo) {
+	// The scope is chosen at login and bounds the session for its lifetime.
+	scope, err := domain.ParseCredentialScope(r.URL.Query().Get("scope"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if scope == "" {
+		scope = domain.CredentialScopeFull
+	}
+	userInfo.Scope = scope
+
+	// Accounts are created here, before any OVH user is provisioned.
+	err = accountUseCase.Resolve(r.Context(), userInfo, r.URL.Query().Get("invite"))
+	if errors.Is(err, domain.ErrRegistrationClosed) || errors.Is(err, domain.ErrInviteRequired) || errors.Is(err, domain.ErrInviteInvalid) {
+		log.Printf("Sign-up refused for %s: %v", userInfo.Email, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error resolving account for %s: %v", userInfo.Email, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if secondFactorUseCase != nil {
+		challenge, err := secondFactorUseCase.Challenge(r.Context(), userInfo)
+		if err != nil {
+			log.Printf("Error checking second factor for %s: %v", userInfo.Email, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if challenge != "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(secondFactorChallengeResponse{
+				SecondFactor:   "totp",
+				ChallengeToken: challenge,
+				UserID:         userInfo.UserID,
+				Email:          userInfo.Email,
+			})
+			return
+		}
+	}
+	startSession(w, r, useCase, sessionUseCase, userInfo)
+}
+
+// startSession opens the session first: the S3 key is bound to it.
+func startSession(w http.ResponseWriter, r *http.Request, useCase *usecase.GetS3CredentialsUseCase, sessionUseCase *usecase.SessionUseCase, userInfo *domain.UserInfo) {
+	tokens, err := sessionUseCase.Start(r.Context(), userInfo, clientInfo(r))
+	if err != nil {
+		log.Printf("Error issuing session for %s: %v", userInfo.Email, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
+	writeSession(w, r, useCase, userInfo, tokens)
 }
 
-func returnS3Credentials(w http.ResponseWriter, r *http.Request, useCase *usecase.GetS3CredentialsUseCase, email string) {
-	creds, err := useCase.Execute(r.Context(), email)
+// writeSession returns the tokens of a session along with an S3 key bound to
+// it.
+func writeSession(w http.ResponseWriter, r *http.Request, useCase *usecase.GetS3CredentialsUseCase, userInfo *domain.UserInfo, tokens *domain.SessionTokens) {
+	creds, err := useCase.Execute(r.Context(), userInfo, "")
 	if err != nil {
-		log.Printf("Error getting S3 credentials for %s: %v", email, err)
+		log.Printf("Error getting S3 credentials for %s: %v", userInfo.Email, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AuthResponse{
 		S3Credentials: creds,
-		Email:         email,
+		SessionTokens: tokens,
+		UserID:        userInfo.UserID,
+		Email:         userInfo.Email,
 	})
 }
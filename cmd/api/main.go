@@ -2,20 +2,27 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
+	"context"
+	"errors"
 	"flag"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/ovh/go-ovh/ovh"
 	"github.com/rs/cors"
+	"github.com/snigle/photocloud/internal/domain"
 	"github.com/snigle/photocloud/internal/infra/auth"
 	"github.com/snigle/photocloud/internal/infra/email"
+	"github.com/snigle/photocloud/internal/infra/keyenc"
+	"github.com/snigle/photocloud/internal/infra/localfs"
 	ovhinfra "github.com/snigle/photocloud/internal/infra/ovh"
+	"github.com/snigle/photocloud/internal/infra/s3compat"
+	"github.com/snigle/photocloud/internal/infra/s3store"
 	"github.com/snigle/photocloud/internal/usecase"
 )
 
@@ -35,101 +42,100 @@ func main() {
 		}
 	}
 
-	// Load configuration from environment
-	endpoint := os.Getenv("OVH_ENDPOINT")
-	appKey := os.Getenv("OVH_APPLICATION_KEY")
-	appSecret := os.Getenv("OVH_APPLICATION_SECRET")
-	consumerKey := os.Getenv("OVH_CONSUMER_KEY")
-	projectID := os.Getenv("OVH_PROJECT_ID")
-	region := os.Getenv("OVH_REGION")
-	bucket := os.Getenv("OVH_S3_BUCKET")
-	googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
-
-	// Email config
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASS")
-	smtpFrom := os.Getenv("SMTP_FROM")
-
-	// Auth secrets
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default-secret-change-me"
-	}
-
-	masterKeyStr := os.Getenv("MASTER_KEY")
-	var masterKey []byte
-	if masterKeyStr != "" {
-		var err error
-		masterKey, err = base64.StdEncoding.DecodeString(masterKeyStr)
-		if err != nil || len(masterKey) != 32 {
-			if len(masterKeyStr) == 32 {
-				masterKey = []byte(masterKeyStr)
-			} else {
-				log.Printf("Warning: MASTER_KEY must be a 32-byte base64 string or 32-byte raw string. Using dev key.")
-				masterKey = []byte("dev-master-key-must-be-32-bytes-")
-			}
-		}
-	} else {
-		masterKey = []byte("dev-master-key-must-be-32-bytes-")
+	config, err := loadConfig(os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
-
-	if region == "" {
-		region = "gra" // Default region
+	if config.DevMode {
+		log.Printf("Warning: DEV_MODE is enabled, unset secrets use public dev values")
 	}
 
-	ovhClient, err := ovh.NewClient(endpoint, appKey, appSecret, consumerKey)
-	if err != nil {
-		log.Fatalf("Failed to create OVH client: %v", err)
+	storageRepo := loadStorage(config.Storage, config.MasterKeys)
+	if err := storageRepo.MigrateLegacyUserConfig(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate user configuration: %v", err)
 	}
+	userKeys := keyenc.NewUserStorage(storageRepo, loadKeyEncrypter(config.KeyEncrypter, config.DevMode))
+	getS3CredsUseCase := usecase.NewGetS3CredentialsUseCase(storageRepo, userKeys)
+	passkeyCredentialsUseCase := usecase.NewPasskeyCredentialsUseCase(storageRepo)
+	if config.RegistrationMode == domain.RegistrationAllowlist && len(config.RegistrationDomains) == 0 {
+		log.Printf("Warning: REGISTRATION_MODE is allowlist without REGISTRATION_ALLOWED_DOMAINS, only invitations can sign up")
+	}
+	registrationUseCase := usecase.NewRegistrationUseCase(config.RegistrationMode, config.RegistrationDomains, storageRepo)
+	accountUseCase := usecase.NewAccountUseCase(storageRepo, storageRepo, userKeys, storageRepo, registrationUseCase)
+	masterKeyRotationUseCase := usecase.NewMasterKeyRotationUseCase(storageRepo)
+	userKeyRotationUseCase := usecase.NewUserKeyRotationUseCase(userKeys, storageRepo, storageRepo, storageRepo)
+	recoveryKitUseCase := usecase.NewRecoveryKitUseCase(userKeys, storageRepo, storageRepo)
 
-	storageRepo := ovhinfra.NewStorageRepository(ovhClient, projectID, region, bucket, masterKey)
-	getS3CredsUseCase := usecase.NewGetS3CredentialsUseCase(storageRepo, storageRepo)
-
-	googleAuth := auth.NewGoogleAuthenticator(googleClientID)
-	magicLinkAuth := auth.NewMagicLinkAuthenticator(jwtSecret, "photocloud-api")
-	emailSender := email.NewSMTPEmailSender(smtpHost, smtpPort, smtpUser, smtpPass, smtpFrom)
-	devAuth := auth.NewDevAuthenticator("dev@photocloud.local")
+	googleAuth := auth.NewGoogleAuthenticator(config.GoogleClientID)
+	oidcProviders := make(map[string]domain.Authenticator)
+	for _, provider := range config.OIDCProviders {
+		oidcProviders[provider.Name] = auth.NewOIDCAuthenticator(provider)
+	}
+	magicLinkAuth := auth.NewMagicLinkAuthenticator(config.JWTSecret, "photocloud-api", storageRepo)
+	emailSender := email.NewSMTPEmailSender(config.SMTP.Host, config.SMTP.Port, config.SMTP.User, config.SMTP.Pass, config.SMTP.From)
+	devAuth := auth.NewDevAuthenticator("dev@photocloud.local", config.DevAuthEnabled)
+	sessionIssuer := auth.NewSessionTokenIssuer(config.JWTSecret, "photocloud-api")
+	sessionUseCase := usecase.NewSessionUseCase(storageRepo, sessionIssuer, storageRepo)
+	secondFactorUseCase := usecase.NewSecondFactorUseCase(storageRepo, sessionIssuer, "Photo Cloud")
 
-	webAuthn, err := auth.NewPasskeyAuthenticator(storageRepo, &webauthn.Config{
+	webAuthn, err := auth.NewPasskeyAuthenticator(storageRepo, storageRepo, &webauthn.Config{
 		RPDisplayName: "Photo Cloud",
-		RPID:          os.Getenv("RP_ID"),               // e.g. localhost or your domain
-		RPOrigins:     []string{os.Getenv("RP_ORIGIN")}, // e.g. http://localhost:3000
+		RPID:          config.RPID,
+		RPOrigins:     []string{config.RPOrigin},
 	})
 	if err != nil {
 		log.Fatalf("Failed to create WebAuthn authenticator: %v", err)
 	}
+	ceremonies, err := auth.NewCeremonySealer(config.JWTSecret)
+	if err != nil {
+		log.Fatalf("Failed to create WebAuthn ceremony sealer: %v", err)
+	}
 
 	// Handlers
 	RegisterHandlers(
 		http.DefaultServeMux,
 		devAuth,
 		googleAuth,
+		oidcProviders,
 		magicLinkAuth,
 		emailSender,
 		webAuthn,
+		ceremonies,
+		sessionIssuer,
+		sessionUseCase,
+		accountUseCase,
 		getS3CredsUseCase,
+		passkeyCredentialsUseCase,
+		registrationUseCase,
+		secondFactorUseCase,
+		masterKeyRotationUseCase,
+		userKeyRotationUseCase,
+		recoveryKitUseCase,
+		config.AdminEmails,
+		config.DevAuthEnabled,
+		config.FrontendURL,
 	)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
 	addr := *hostFlag
 	if addr == "" {
-		addr = ":" + port
+		addr = ":" + strconv.Itoa(config.Port)
 	}
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type", "X-User-Email"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "X-WebAuthn-Ceremony"},
 		AllowCredentials: true,
 	})
 
-	handler := c.Handler(http.DefaultServeMux)
+	handler := trustForwardedFor(config.TrustedProxies, c.Handler(http.DefaultServeMux))
+
+	go revokeExpiredCredentials(getS3CredsUseCase, 10*time.Minute)
+	go pruneMagicLinkNonces(magicLinkAuth, time.Hour)
+	if len(config.MasterKeys.Previous()) > 0 {
+		go runMasterKeyRotation(masterKeyRotationUseCase)
+	}
+	go resumeUserKeyRotations(userKeyRotationUseCase)
 
 	log.Printf("Server starting on %s", addr)
 	if err := http.ListenAndServe(addr, handler); err != nil {
@@ -137,6 +143,147 @@ func main() {
 	}
 }
 
+// storage is implemented by every storage backend.
+type storage interface {
+	domain.StorageRepository
+	domain.UserStorage
+	domain.UserHandleStorage
+	domain.SessionStorage
+	domain.TOTPStorage
+	domain.MagicLinkStorage
+	domain.AccountStorage
+	domain.AccountDataStorage
+	domain.InviteStorage
+	domain.MasterKeyRotationStorage
+	domain.UserKeyRotationStorage
+	MigrateLegacyUserConfig(ctx context.Context) error
+}
+
+// loadStorage creates the backend selected by STORAGE_BACKEND.
+func loadStorage(config StorageConfig, keys *s3store.Keyring) storage {
+	switch config.Backend {
+	case "ovh":
+		ovhClient, err := ovh.NewClient(config.OVH.Endpoint, config.OVH.ApplicationKey, config.OVH.ApplicationSecret, config.OVH.ConsumerKey)
+		if err != nil {
+			log.Fatalf("Failed to create OVH client: %v", err)
+		}
+		if config.OVH.ServiceAccessKey == "" {
+			log.Printf("Warning: OVH_SERVICE_ACCESS_KEY is not set, a new key is created for the service user on every start")
+		}
+		return ovhinfra.NewStorageRepository(ovhClient, config.OVH.ProjectID, config.OVH.Region, config.OVH.Bucket, config.OVH.ServiceAccessKey, config.OVH.ServiceSecretKey, keys)
+	case "s3":
+		repo, err := s3compat.NewStorageRepository(context.Background(), config.S3, keys)
+		if err != nil {
+			log.Fatalf("Failed to create S3 storage: %v", err)
+		}
+		return repo
+	case "local":
+		local := config.Local
+		repo, err := localfs.NewStorageRepository(context.Background(), local.Dir, local.Bucket, local.Endpoint, keys)
+		if err != nil {
+			log.Fatalf("Failed to create local storage: %v", err)
+		}
+		go func() {
+			log.Printf("Local S3 endpoint listening on %s, storing in %s", local.Addr, local.Dir)
+			log.Fatal(http.ListenAndServe(local.Addr, repo.Handler()))
+		}()
+		return repo
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q", config.Backend)
+		return nil
+	}
+}
+
+// loadKeyEncrypter creates the provider selected by KEY_ENCRYPTER. In dev mode
+// the local key file is created if missing.
+func loadKeyEncrypter(config KeyEncrypterConfig, devMode bool) domain.KeyEncrypter {
+	switch config.Provider {
+	case "local":
+		encrypter, err := keyenc.NewLocalEncrypter(config.KeyFile, devMode)
+		if err != nil {
+			log.Fatalf("Failed to load KEY_ENCRYPTER_KEYFILE: %v", err)
+		}
+		return encrypter
+	case "vault":
+		return keyenc.NewVaultEncrypter(config.Vault)
+	default:
+		log.Fatalf("Unknown KEY_ENCRYPTER %q", config.Provider)
+		return nil
+	}
+}
+
+// revokeExpiredCredentials deletes the S3 keys of clients that stopped
+// fetching new ones, which would otherwise stay valid forever.
+func revokeExpiredCredentials(useCase *usecase.GetS3CredentialsUseCase, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := useCase.RevokeExpired(context.Background()); err != nil {
+			log.Printf("Error revoking expired S3 credentials: %v", err)
+		}
+	}
+}
+
+// pruneMagicLinkNonces deletes the markers of used magic links once the links
+// have expired.
+func pruneMagicLinkNonces(magicLinkAuth *auth.MagicLinkAuthenticator, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := magicLinkAuth.PruneNonces(context.Background()); err != nil {
+			log.Printf("Error pruning magic link nonces: %v", err)
+		}
+	}
+}
+
+// runMasterKeyRotation re-encrypts the server objects still using a previous
+// MASTER_KEY, resuming an interrupted rotation.
+func runMasterKeyRotation(useCase *usecase.MasterKeyRotationUseCase) {
+	rotation, err := useCase.Run(context.Background(), func(r *domain.MasterKeyRotation) {
+		log.Printf("Master key rotation to version %s: %d objects scanned, %d re-encrypted, %d failed", r.Version, r.Scanned, r.Rotated, len(r.Failed))
+	})
+	switch {
+	case errors.Is(err, usecase.ErrRotationRunning):
+	case err != nil:
+		log.Printf("Error rotating the master key: %v", err)
+	case len(rotation.Failed) > 0:
+		log.Printf("Master key rotation to version %s left %d objects on a previous key, last error: %s", rotation.Version, len(rotation.Failed), rotation.LastError)
+	}
+}
+
+// runUserKeyRotation re-encrypts the objects of the user with the new
+// version of the user key.
+func runUserKeyRotation(useCase *usecase.UserKeyRotationUseCase, userID string) {
+	rotation, err := useCase.Run(context.Background(), userID, nil)
+	switch {
+	case errors.Is(err, domain.ErrUserKeyRotationRunning):
+	case err != nil:
+		log.Printf("Error rotating the user key of %s: %v", userID, err)
+	case rotation != nil && len(rotation.Failed) > 0:
+		log.Printf("User key rotation of %s to version %d left %d objects on a previous key, last error: %s", userID, rotation.Version, len(rotation.Failed), rotation.LastError)
+	}
+}
+
+// resumeUserKeyRotations resumes the rotations interrupted by a restart, one
+// user at a time.
+func resumeUserKeyRotations(useCase *usecase.UserKeyRotationUseCase) {
+	userIDs, err := useCase.Pending(context.Background())
+	if err != nil {
+		log.Printf("Error listing pending user key rotations: %v", err)
+		return
+	}
+	for _, userID := range userIDs {
+		runUserKeyRotation(useCase, userID)
+	}
+}
+
+// splitList parses a comma separated list, lowercased.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func loadEnv(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// sessionChecker checks that the session behind an access token is still
+// active. It is implemented by usecase.SessionUseCase.
+type sessionChecker interface {
+	Touch(ctx context.Context, user *domain.UserInfo, client domain.ClientInfo) error
+}
+
+// requireAuth only lets requests carrying the access token of an active
+// session through and exposes the authenticated domain.UserInfo on the request
+// context. Revoked sessions are rejected here, before their token expires.
+func requireAuth(sessionIssuer domain.SessionTokenIssuer, sessions sessionChecker, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userInfo, err := authenticate(r, token, sessionIssuer, sessions)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(domain.ContextWithUserInfo(r.Context(), userInfo)))
+	}
+}
+
+// authenticate validates an access token and checks that its session has not
+// been revoked.
+func authenticate(r *http.Request, token string, sessionIssuer domain.SessionTokenIssuer, sessions sessionChecker) (*domain.UserInfo, error) {
+	userInfo, err := sessionIssuer.ValidateAccessToken(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	if err := sessions.Touch(r.Context(), userInfo, clientInfo(r)); err != nil {
+		if !errors.Is(err, domain.ErrSessionRevoked) {
+			log.Printf("Error checking session for %s: %v", userInfo.Email, err)
+		}
+		return nil, err
+	}
+	return userInfo, nil
+}
+
+// requireAdmin only lets admins through. It must be wrapped by requireAuth.
+func requireAdmin(admins []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok || !slices.Contains(admins, domain.NormalizeEmail(userInfo.Email)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireFullScope keeps sessions of restricted scopes, such as backup
+// devices, away from the account settings. It must be wrapped by requireAuth.
+func requireFullScope(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := domain.UserInfoFromContext(r.Context())
+		if !ok || !userInfo.Scope.Allows(domain.CredentialScopeFull) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[len("Bearer "):])
+}
+
+// clientInfo describes the caller. The IP keys the rate limiters, so it is the
+// peer address, or the client address given by a trusted proxy once
+// trustForwardedFor has rewritten it.
+func clientInfo(r *http.Request) domain.ClientInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	return domain.ClientInfo{
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
+}
+
+// trustForwardedFor sets the remote address of the requests sent by one of
+// proxies to the client address in X-Forwarded-For. Proxies append the address
+// of their peer to the header, so the address is the last one that is not a
+// proxy: the entries before it are set by the client.
+func trustForwardedFor(proxies []*net.IPNet, next http.Handler) http.Handler {
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		return ip != nil && slices.ContainsFunc(proxies, func(network *net.IPNet) bool { return network.Contains(ip) })
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !trusted(host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if trusted(hop) {
+				continue
+			}
+			if net.ParseIP(hop) != nil {
+				r = r.WithContext(r.Context())
+				r.RemoteAddr = net.JoinHostPort(hop, "0")
+			}
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/auth"
+)
+
+// activeSessions stands in for the session use case.
+type activeSessions map[string]bool
+
+func (s activeSessions) Touch(ctx context.Context, user *domain.UserInfo, client domain.ClientInfo) error {
+	if !s[user.SessionID] {
+		return domain.ErrSessionRevoked
+	}
+	return nil
+}
+
+func TestRequireAuth(t *testing.T) {
+	sessionIssuer := auth.NewSessionTokenIssuer("test-secret", "test-issuer")
+	session := &domain.Session{ID: "session-1", RefreshTokenID: "token-1", ExpiresAt: time.Now().Add(time.Hour)}
+	tokens, err := sessionIssuer.IssueTokens(t.Context(), &domain.UserInfo{Email: "user@example.com"}, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := &domain.Session{ID: "session-2", RefreshTokenID: "token-2", ExpiresAt: time.Now().Add(time.Hour)}
+	revokedTokens, err := sessionIssuer.IssueTokens(t.Context(), &domain.UserInfo{Email: "user@example.com"}, revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotEmail string
+	handler := requireAuth(sessionIssuer, activeSessions{"session-1": true}, func(w http.ResponseWriter, r *http.Request) {
+		userInfo, _ := domain.UserInfoFromContext(r.Context())
+		gotEmail = userInfo.Email
+	})
+
+	tests := []struct {
+		name           string
+		header         http.Header
+		expectedStatus int
+	}{
+		{"no token", http.Header{}, http.StatusUnauthorized},
+		{"legacy email header", http.Header{"X-User-Email": {"user@example.com"}}, http.StatusUnauthorized},
+		{"refresh token", http.Header{"Authorization": {"Bearer " + tokens.RefreshToken}}, http.StatusUnauthorized},
+		{"access token", http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}, http.StatusOK},
+		{"revoked session", http.Header{"Authorization": {"Bearer " + revokedTokens.AccessToken}}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		gotEmail = ""
+		req := httptest.NewRequest(http.MethodGet, "/credentials", nil)
+		req.Header = tt.header
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expectedStatus, rec.Code)
+		}
+		if tt.expectedStatus == http.StatusOK && gotEmail != "user@example.com" {
+			t.Errorf("%s: expected user on context, got %q", tt.name, gotEmail)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := requireAdmin([]string{"admin@example.com"}, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name           string
+		user           *domain.UserInfo
+		expectedStatus int
+	}{
+		{"no user", nil, http.StatusForbidden},
+		{"not an admin", &domain.UserInfo{Email: "user@example.com"}, http.StatusForbidden},
+		{"admin", &domain.UserInfo{Email: "Admin@Example.com"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/invites", nil)
+		if tt.user != nil {
+			req = req.WithContext(domain.ContextWithUserInfo(req.Context(), tt.user))
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expectedStatus, rec.Code)
+		}
+	}
+}
+
+func TestRequireFullScope(t *testing.T) {
+	handler := requireFullScope(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name           string
+		user           *domain.UserInfo
+		expectedStatus int
+	}{
+		{"no user", nil, http.StatusForbidden},
+		{"upload session", &domain.UserInfo{Scope: domain.CredentialScopeUpload}, http.StatusForbidden},
+		{"read session", &domain.UserInfo{Scope: domain.CredentialScopeRead}, http.StatusForbidden},
+		{"full session", &domain.UserInfo{Scope: domain.CredentialScopeFull}, http.StatusOK},
+		{"session without scope", &domain.UserInfo{}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/me/sessions", nil)
+		if tt.user != nil {
+			req = req.WithContext(domain.ContextWithUserInfo(req.Context(), tt.user))
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expectedStatus, rec.Code)
+		}
+	}
+}
+
+func TestTrustForwardedFor(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	var gotIP string
+	handler := trustForwardedFor([]*net.IPNet{proxies}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIP = clientInfo(r).IP
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expectedIP string
+	}{
+		{"direct client", "203.0.113.7:4000", "", "203.0.113.7"},
+		{"forged header from a client", "203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:4000", "198.51.100.1", "198.51.100.1"},
+		{"forged entry before the proxy", "10.0.0.2:4000", "192.0.2.9, 198.51.100.1", "198.51.100.1"},
+		{"chain of proxies", "10.0.0.2:4000", "198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"proxy without header", "10.0.0.2:4000", "", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if gotIP != tt.expectedIP {
+			t.Errorf("%s: expected IP %s, got %s", tt.name, tt.expectedIP, gotIP)
+		}
+	}
+}
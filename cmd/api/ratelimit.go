@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows at most limit hits per key over a sliding window. Hits
+// are kept in memory, so each API instance throttles on its own; that is
+// enough to stop a single client from flooding an inbox.
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	hits      map[string][]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string][]time.Time),
+		now:    time.Now,
+	}
+}
+
+// allow records a hit for key. Once the limit is reached it returns false and
+// the time until the oldest hit leaves the window.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > l.window {
+		for k, hits := range l.hits {
+			if len(l.recent(hits, now)) == 0 {
+				delete(l.hits, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	hits := l.recent(l.hits[key], now)
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false, hits[0].Add(l.window).Sub(now)
+	}
+	l.hits[key] = append(hits, now)
+	return true, 0
+}
+
+func (l *rateLimiter) recent(hits []time.Time, now time.Time) []time.Time {
+	for len(hits) > 0 && !hits[0].After(now.Add(-l.window)) {
+		hits = hits[1:]
+	}
+	return hits
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("hit %d should be allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.allow("a")
+	if ok {
+		t.Fatal("third hit should be throttled")
+	}
+	if retryAfter != time.Minute {
+		t.Errorf("expected retry after 1m, got %s", retryAfter)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("other keys should not be throttled")
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, retryAfter := l.allow("a"); retryAfter != 30*time.Second {
+		t.Errorf("expected retry after 30s, got %s", retryAfter)
+	}
+
+	now = now.Add(31 * time.Second)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("hit should be allowed once the window has passed")
+	}
+}
+
+func TestWriteTooManyRequests(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeTooManyRequests(rec, 1500*time.Millisecond)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After 2, got %q", got)
+	}
+}
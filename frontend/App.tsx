@@ -1,4 +1,4 @@
-import React, { useEffect, useRef, useMemo } from 'react';
+import React, { useEffect, useRef, useMemo, useState } from 'react';
 import { StyleSheet, View } from 'react-native';
 import { PaperProvider, ActivityIndicator, MD3LightTheme } from 'react-native-paper';
 import { StatusBar } from 'expo-status-bar';
@@ -8,6 +8,7 @@ import AuthScreen from './src/react/screens/AuthScreen';
 import GalleryScreen from './src/react/screens/GalleryScreen';
 import { AuthRepository } from './src/infra/auth.repository';
 import { AuthUseCase } from './src/usecase/auth.usecase';
+import type { AuthResponse, PasskeyRegistrationAuth } from './src/domain/types';
 
 const theme = {
   ...MD3LightTheme,
@@ -23,9 +24,14 @@ const theme = {
 const authRepo = new AuthRepository();
 
 export default function App() {
-  const { session, loading, login, logout } = useAuth();
   const authUseCase = useMemo(() => new AuthUseCase(authRepo), []);
+  const { session, loading, login, logout } = useAuth(authUseCase);
   const processedTokens = useRef<Set<string>>(new Set());
+  // Magic links of accounts with a second factor end on the code prompt.
+  const [challengeToken, setChallengeToken] = useState<string | undefined>();
+  // Magic links requested for a passkey registration are kept for it: the
+  // token is single-use, so it cannot also log in.
+  const [passkeyRegistration, setPasskeyRegistration] = useState<PasskeyRegistrationAuth | undefined>();
 
   useEffect(() => {
     const handleDeepLink = async (event: { url: string }) => {
@@ -34,6 +40,23 @@ export default function App() {
       const { queryParams, path, hostname, scheme } = parsed;
       console.log('Parsed URL details:', { scheme, hostname, path, queryParams });
 
+      // Links confirming a new email are opened while logged in.
+      const changeEmailToken = queryParams?.change_email_token as string;
+      if (changeEmailToken && session && !processedTokens.current.has(changeEmailToken)) {
+        processedTokens.current.add(changeEmailToken);
+        try {
+          const accessToken = (session.creds as AuthResponse).access_token || '';
+          const response = await authUseCase.confirmEmailChange(accessToken, changeEmailToken);
+          login(response, response.user_id || response.email);
+          if (typeof window !== 'undefined' && window.history) {
+            window.history.replaceState({}, '', window.location.pathname);
+          }
+        } catch (e) {
+          console.error('Failed to confirm email change', e);
+        }
+        return;
+      }
+
       // Support token in query params or as the last part of the path
       let token = queryParams?.token as string;
       if (!token && path) {
@@ -44,13 +67,26 @@ export default function App() {
         }
       }
 
+      if (token && !session && queryParams?.passkey === 'register' && !processedTokens.current.has(token)) {
+        processedTokens.current.add(token);
+        setPasskeyRegistration({ magicLinkToken: token, invite: queryParams?.invite as string | undefined });
+        if (typeof window !== 'undefined' && window.history) {
+          window.history.replaceState({}, '', window.location.pathname);
+        }
+        return;
+      }
+
       if (token && !processedTokens.current.has(token)) {
         console.log('Validating magic link token:', token.substring(0, 10) + '...');
         processedTokens.current.add(token);
         try {
-          const response = await authUseCase.validateMagicLink(token);
+          const response = await authUseCase.validateMagicLink(token, queryParams?.invite as string | undefined);
           console.log('Magic link validated successfully for:', response.email);
-          login(response, response.email);
+          if (response.challenge_token) {
+            setChallengeToken(response.challenge_token);
+          } else {
+            login(response, response.user_id || response.email);
+          }
           // Clear URL params to avoid reload loops
           if (typeof window !== 'undefined' && window.history) {
             const cleanUrl = window.location.pathname + window.location.search.replace(/[?&]token=[^&]+/, '').replace(/^&/, '?');
@@ -74,7 +110,7 @@ export default function App() {
     return () => {
       subscription.remove();
     };
-  }, [authUseCase, login]);
+  }, [authUseCase, login, session]);
 
   if (loading) {
     return (
@@ -95,7 +131,12 @@ export default function App() {
             onLogout={logout}
           />
         ) : (
-          <AuthScreen onLogin={login} authUseCase={authUseCase} />
+          <AuthScreen
+            onLogin={login}
+            authUseCase={authUseCase}
+            challengeToken={challengeToken}
+            passkeyRegistration={passkeyRegistration}
+          />
         )}
       </View>
     </PaperProvider>
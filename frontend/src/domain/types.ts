@@ -1,10 +1,22 @@
 export interface S3Credentials {
   access: string;
   secret: string;
+  // Set for temporary keys, which S3 requires along with the key.
+  session_token?: string;
   endpoint: string;
   region: string;
   bucket: string;
   user_key: string;
+  // Version of user_key, set on uploads so the server knows which objects a
+  // key rotation still has to re-encrypt.
+  user_key_version?: number;
+  // Keys replaced by a rotation, newest first: objects not re-encrypted yet
+  // are read with them.
+  previous_user_keys?: { version: number; key: string }[];
+  // The key is revoked at this time; new credentials must be fetched before.
+  credentials_expires_at?: string;
+  // Backup devices and viewers log in with a restricted scope.
+  scope?: 'full' | 'read' | 'upload';
 }
 
 export interface BasePhoto {
@@ -33,29 +45,54 @@ export interface UserSession {
 }
 
 export interface AuthResponse extends S3Credentials {
+  // user_id keys the storage prefix; older servers only return the email.
+  user_id?: string;
   email: string;
+  access_token?: string;
+  refresh_token?: string;
+  expires_at?: string;
+  // Set instead of the credentials when the account has a second factor: the
+  // challenge token is exchanged with a code for the actual response.
+  second_factor?: 'totp';
+  challenge_token?: string;
 }
 
+// A passkey is attached to the account of a live session or, for a first
+// sign-up, to the account of an unused magic link.
+export type PasskeyRegistrationAuth =
+  | { accessToken: string }
+  | { magicLinkToken: string; invite?: string };
+
 export interface IAuthRepository {
   devLogin(): Promise<AuthResponse>;
-  googleLogin(token: string): Promise<AuthResponse>;
-  requestMagicLink(email: string, redirectUrl?: string): Promise<void>;
-  validateMagicLink(token: string): Promise<AuthResponse>;
-  beginPasskeyRegistration(email: string): Promise<any>;
-  finishPasskeyRegistration(email: string, credential: any): Promise<void>;
+  googleLogin(token: string, invite?: string): Promise<AuthResponse>;
+  requestMagicLink(email: string, redirectUrl?: string, invite?: string, forPasskey?: boolean): Promise<void>;
+  validateMagicLink(token: string, invite?: string): Promise<AuthResponse>;
+  verifyMagicLinkCode(email: string, code: string, invite?: string): Promise<AuthResponse>;
+  beginPasskeyRegistration(auth: PasskeyRegistrationAuth): Promise<any>;
+  finishPasskeyRegistration(auth: PasskeyRegistrationAuth, credential: any, ceremonyId?: string): Promise<void>;
   beginPasskeyLogin(email: string): Promise<any>;
-  finishPasskeyLogin(email: string, credential: any): Promise<AuthResponse>;
+  finishPasskeyLogin(email: string, credential: any, ceremonyId?: string): Promise<AuthResponse>;
+  requestEmailChange(accessToken: string, email: string): Promise<void>;
+  confirmEmailChange(accessToken: string, token: string): Promise<AuthResponse>;
+  verifySecondFactor(challengeToken: string, code: string): Promise<AuthResponse>;
+  refreshSession(refreshToken: string): Promise<AuthResponse>;
+  getCredentials(accessToken: string): Promise<AuthResponse>;
+  logout(refreshToken: string): Promise<void>;
   getVersion(): Promise<string>;
 }
 
 export interface IS3Repository {
   listPhotos(bucket: string, email: string): Promise<UploadedPhoto[]>;
   getCloudIndex(bucket: string, email: string): Promise<{ years: { year: string, count: number }[] }>;
+  // With onlyIfAbsent an existing object is left as is: upload keys may only
+  // create objects.
   uploadFile(
     bucket: string,
     key: string,
     data: Uint8Array,
-    contentType: string
+    contentType: string,
+    onlyIfAbsent?: boolean
   ): Promise<void>;
   getFile(bucket: string, key: string): Promise<Uint8Array>;
   getDownloadUrl(bucket: string, key: string): Promise<string>;
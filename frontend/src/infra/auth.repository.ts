@@ -1,7 +1,19 @@
-import type { IAuthRepository, AuthResponse } from '../domain/types';
+import type { IAuthRepository, AuthResponse, PasskeyRegistrationAuth } from '../domain/types';
 
 const API_URL = process.env.EXPO_PUBLIC_API_URL || 'http://localhost:8080';
 
+// New accounts may need an invitation code, depending on the server's
+// registration mode.
+const inviteParam = (invite?: string) => (invite ? `&invite=${encodeURIComponent(invite)}` : '');
+
+// The magic link token of a first sign-up goes in the query string; it is
+// consumed by the begin request.
+const passkeyRegistrationQuery = (auth: PasskeyRegistrationAuth) =>
+  'magicLinkToken' in auth ? `?token=${encodeURIComponent(auth.magicLinkToken)}${inviteParam(auth.invite)}` : '';
+
+const passkeyRegistrationHeaders = (auth: PasskeyRegistrationAuth): Record<string, string> =>
+  'accessToken' in auth ? { Authorization: `Bearer ${auth.accessToken}` } : {};
+
 export class AuthRepository implements IAuthRepository {
   async devLogin(): Promise<AuthResponse> {
     const response = await fetch(`${API_URL}/auth/dev`);
@@ -9,39 +21,59 @@ export class AuthRepository implements IAuthRepository {
     return await response.json();
   }
 
-  async googleLogin(token: string): Promise<AuthResponse> {
-    const response = await fetch(`${API_URL}/auth/google?token=${token}`);
+  async googleLogin(token: string, invite?: string): Promise<AuthResponse> {
+    const response = await fetch(`${API_URL}/auth/google?token=${token}${inviteParam(invite)}`);
+    if (response.status === 403) throw new Error(await response.text());
     if (!response.ok) throw new Error('Failed to google login');
     return await response.json();
   }
 
-  async requestMagicLink(email: string, redirectUrl?: string): Promise<void> {
+  async requestMagicLink(email: string, redirectUrl?: string, invite?: string, forPasskey?: boolean): Promise<void> {
     let url = `${API_URL}/auth/magic-link/request?email=${email}`;
     if (redirectUrl) {
       url += `&redirect_url=${encodeURIComponent(redirectUrl)}`;
     }
+    url += inviteParam(invite);
+    if (forPasskey) {
+      url += '&passkey=register';
+    }
     const response = await fetch(url);
+    if (response.status === 429) throw new Error('Too many requests, please try again later');
     if (!response.ok) throw new Error('Failed to request magic link');
   }
 
-  async validateMagicLink(token: string): Promise<AuthResponse> {
-    const response = await fetch(`${API_URL}/auth/magic-link/callback?token=${token}`);
+  async validateMagicLink(token: string, invite?: string): Promise<AuthResponse> {
+    const response = await fetch(`${API_URL}/auth/magic-link/callback?token=${token}${inviteParam(invite)}`);
+    if (response.status === 403) throw new Error(await response.text());
     if (!response.ok) throw new Error('Failed to validate magic link');
     return await response.json();
   }
 
-  async beginPasskeyRegistration(email: string): Promise<any> {
-    const response = await fetch(`${API_URL}/auth/passkey/register/begin?email=${email}`, {
+  async verifyMagicLinkCode(email: string, code: string, invite?: string): Promise<AuthResponse> {
+    const response = await fetch(`${API_URL}/auth/magic-link/verify-code?${inviteParam(invite).slice(1)}`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ email, code })
+    });
+    if (response.status === 429) throw new Error('Too many attempts, please try again later');
+    if (response.status === 403) throw new Error(await response.text());
+    if (!response.ok) throw new Error('Invalid code');
+    return await response.json();
+  }
+
+  async beginPasskeyRegistration(auth: PasskeyRegistrationAuth): Promise<any> {
+    const response = await fetch(`${API_URL}/auth/passkey/register/begin${passkeyRegistrationQuery(auth)}`, {
+      headers: passkeyRegistrationHeaders(auth),
       credentials: 'include'
     });
     if (!response.ok) throw new Error('Failed to begin passkey registration');
     return await response.json();
   }
 
-  async finishPasskeyRegistration(email: string, credential: any): Promise<void> {
-    const response = await fetch(`${API_URL}/auth/passkey/register/finish?email=${email}`, {
+  async finishPasskeyRegistration(auth: PasskeyRegistrationAuth, credential: any, ceremonyId?: string): Promise<void> {
+    const response = await fetch(`${API_URL}/auth/passkey/register/finish`, {
       method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
+      headers: { ...this.ceremonyHeaders(ceremonyId), ...passkeyRegistrationHeaders(auth) },
       body: JSON.stringify(credential),
       credentials: 'include'
     });
@@ -56,10 +88,10 @@ export class AuthRepository implements IAuthRepository {
     return await response.json();
   }
 
-  async finishPasskeyLogin(email: string, credential: any): Promise<AuthResponse> {
+  async finishPasskeyLogin(email: string, credential: any, ceremonyId?: string): Promise<AuthResponse> {
     const response = await fetch(`${API_URL}/auth/passkey/login/finish?email=${email}`, {
       method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
+      headers: this.ceremonyHeaders(ceremonyId),
       body: JSON.stringify(credential),
       credentials: 'include'
     });
@@ -67,6 +99,74 @@ export class AuthRepository implements IAuthRepository {
     return await response.json();
   }
 
+  async requestEmailChange(accessToken: string, email: string): Promise<void> {
+    const response = await fetch(`${API_URL}/me/email`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json', Authorization: `Bearer ${accessToken}` },
+      body: JSON.stringify({ email })
+    });
+    if (response.status === 409) throw new Error('This email is already used by another account');
+    if (response.status === 429) throw new Error('Too many attempts, please try again later');
+    if (!response.ok) throw new Error('Failed to request email change');
+  }
+
+  async confirmEmailChange(accessToken: string, token: string): Promise<AuthResponse> {
+    const response = await fetch(`${API_URL}/me/email/confirm`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json', Authorization: `Bearer ${accessToken}` },
+      body: JSON.stringify({ token })
+    });
+    if (response.status === 409) throw new Error('This email is already used by another account');
+    if (!response.ok) throw new Error('Failed to confirm email change');
+    return await response.json();
+  }
+
+  async refreshSession(refreshToken: string): Promise<AuthResponse> {
+    const response = await fetch(`${API_URL}/auth/refresh`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ refresh_token: refreshToken })
+    });
+    if (!response.ok) throw new Error('Session expired');
+    return await response.json();
+  }
+
+  async getCredentials(accessToken: string): Promise<AuthResponse> {
+    const response = await fetch(`${API_URL}/credentials`, {
+      headers: { Authorization: `Bearer ${accessToken}` }
+    });
+    if (!response.ok) throw new Error('Failed to get credentials');
+    return await response.json();
+  }
+
+  async logout(refreshToken: string): Promise<void> {
+    const response = await fetch(`${API_URL}/auth/logout`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ refresh_token: refreshToken })
+    });
+    if (!response.ok) throw new Error('Failed to logout');
+  }
+
+  async verifySecondFactor(challengeToken: string, code: string): Promise<AuthResponse> {
+    const response = await fetch(`${API_URL}/auth/totp/verify`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ challenge_token: challengeToken, code })
+    });
+    if (response.status === 429) throw new Error('Too many attempts, please try again later');
+    if (!response.ok) throw new Error('Invalid code');
+    return await response.json();
+  }
+
+  // Native clients have no cookie jar, so the ceremony ID returned by the
+  // begin call is sent back explicitly.
+  private ceremonyHeaders(ceremonyId?: string): Record<string, string> {
+    const headers: Record<string, string> = { 'Content-Type': 'application/json' };
+    if (ceremonyId) headers['X-WebAuthn-Ceremony'] = ceremonyId;
+    return headers;
+  }
+
   async getVersion(): Promise<string> {
     const response = await fetch(`${API_URL}/version`);
     if (!response.ok) return 'unknown';
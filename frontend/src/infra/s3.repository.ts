@@ -11,10 +11,12 @@ import type { IS3Repository, S3Credentials, UploadedPhoto } from '../domain/type
 import { base64ToUint8Array, uint8ArrayToBase64, decodeText, md5 } from './utils';
 import { ThumbnailCache } from './thumbnail-cache';
 
+type SSEParams = { algorithm: string, key: string, keyMD5: string };
+
 export class S3Repository implements IS3Repository {
   private s3: S3Client;
   private creds: S3Credentials;
-  private sseParams: { algorithm: string, key: string, keyMD5: string } | null = null;
+  private sseParams: SSEParams[] | null = null;
 
   constructor(creds: S3Credentials) {
     this.creds = creds;
@@ -22,6 +24,7 @@ export class S3Repository implements IS3Repository {
       credentials: {
         accessKeyId: creds.access,
         secretAccessKey: creds.secret,
+        sessionToken: creds.session_token,
       },
       endpoint: creds.endpoint,
       region: creds.region,
@@ -29,25 +32,49 @@ export class S3Repository implements IS3Repository {
     });
   }
 
-  private async getSSE() {
+  // The active user key first, then the keys replaced by a rotation.
+  private async getSSEKeys(): Promise<SSEParams[]> {
     if (this.sseParams) return this.sseParams;
 
-    const key = this.creds.user_key; // already base64
-    const binaryKey = base64ToUint8Array(key);
-
-    // Compute MD5 of the binary key using our cross-platform utility
-    const hash = md5(binaryKey);
+    const keys = [this.creds.user_key, ...(this.creds.previous_user_keys || []).map(k => k.key)];
+    this.sseParams = keys.map(key => {
+        // already base64
+        const binaryKey = base64ToUint8Array(key);
 
-    const keyMD5 = uint8ArrayToBase64(hash);
+        // Compute MD5 of the binary key using our cross-platform utility
+        const hash = md5(binaryKey);
 
-    this.sseParams = {
-        algorithm: 'AES256',
-        key: key,
-        keyMD5: keyMD5
-    };
+        return {
+            algorithm: 'AES256',
+            key: key,
+            keyMD5: uint8ArrayToBase64(hash),
+        };
+    });
     return this.sseParams;
   }
 
+  private async getSSE(): Promise<SSEParams> {
+    return (await this.getSSEKeys())[0];
+  }
+
+  // withUserKey runs a read with the active key, then with the previous keys
+  // while S3 rejects the key: objects written before a rotation keep their
+  // key until the server re-encrypts them.
+  private async withUserKey<T>(read: (sse: SSEParams) => Promise<T>): Promise<T> {
+    const keys = await this.getSSEKeys();
+    let firstErr: any;
+    for (const sse of keys) {
+      try {
+        return await read(sse);
+      } catch (err: any) {
+        const status = err.$metadata?.httpStatusCode;
+        if (status !== 400 && status !== 403) throw err;
+        if (firstErr === undefined) firstErr = err;
+      }
+    }
+    throw firstErr;
+  }
+
   async getCloudIndex(bucket: string, email: string): Promise<{ years: { year: string, count: number }[] }> {
     const indexKey = `users/${email}/index.json`;
     try {
@@ -158,7 +185,20 @@ export class S3Repository implements IS3Repository {
   }
 
   async getDownloadUrl(bucket: string, key: string): Promise<string> {
-    const sse = await this.getSSE();
+    let sse = await this.getSSE();
+    if (this.creds.previous_user_keys?.length) {
+      // A signed URL carries one key: find the one of the object first.
+      sse = await this.withUserKey(async candidate => {
+        await this.s3.send(new HeadObjectCommand({
+          Bucket: bucket,
+          Key: key,
+          SSECustomerAlgorithm: candidate.algorithm,
+          SSECustomerKey: candidate.key,
+          SSECustomerKeyMD5: candidate.keyMD5,
+        }));
+        return candidate;
+      });
+    }
     const getObjectCommand = new GetObjectCommand({
         Bucket: bucket,
         Key: key,
@@ -175,7 +215,8 @@ export class S3Repository implements IS3Repository {
     bucket: string,
     key: string,
     data: Uint8Array,
-    contentType: string
+    contentType: string,
+    onlyIfAbsent: boolean = false
   ): Promise<void> {
     const sse = await this.getSSE();
     const command = new PutObjectCommand({
@@ -183,12 +224,19 @@ export class S3Repository implements IS3Repository {
       Key: key,
       Body: data,
       ContentType: contentType,
+      IfNoneMatch: onlyIfAbsent ? '*' : undefined,
+      Metadata: this.creds.user_key_version ? { 'user-key-version': String(this.creds.user_key_version) } : undefined,
       SSECustomerAlgorithm: sse.algorithm,
       SSECustomerKey: sse.key,
       SSECustomerKeyMD5: sse.keyMD5,
     });
 
-    await this.s3.send(command);
+    try {
+      await this.s3.send(command);
+    } catch (err: any) {
+      if (onlyIfAbsent && err.$metadata?.httpStatusCode === 412) return;
+      throw err;
+    }
   }
 
   async getFile(bucket: string, key: string): Promise<Uint8Array> {
@@ -198,16 +246,13 @@ export class S3Repository implements IS3Repository {
         if (cached) return cached.data;
     }
 
-    const sse = await this.getSSE();
-    const command = new GetObjectCommand({
+    const data = await this.withUserKey(sse => this.s3.send(new GetObjectCommand({
       Bucket: bucket,
       Key: key,
       SSECustomerAlgorithm: sse.algorithm,
       SSECustomerKey: sse.key,
       SSECustomerKeyMD5: sse.keyMD5,
-    });
-
-    const data = await this.s3.send(command);
+    })));
     if (!data.Body) {
       throw new Error('No body in S3 response');
     }
@@ -257,16 +302,14 @@ export class S3Repository implements IS3Repository {
   }
 
   async exists(bucket: string, key: string): Promise<boolean> {
-    const sse = await this.getSSE();
     try {
-      const command = new HeadObjectCommand({
+      await this.withUserKey(sse => this.s3.send(new HeadObjectCommand({
         Bucket: bucket,
         Key: key,
         SSECustomerAlgorithm: sse.algorithm,
         SSECustomerKey: sse.key,
         SSECustomerKeyMD5: sse.keyMD5,
-      });
-      await this.s3.send(command);
+      })));
       return true;
     } catch (err: any) {
       if (err.name === 'NotFound' || err.$metadata?.httpStatusCode === 404) {
@@ -1,10 +1,13 @@
 import { useState, useEffect } from 'react';
 import AsyncStorage from '@react-native-async-storage/async-storage';
-import type { S3Credentials, UserSession } from '../../domain/types';
+import type { AuthResponse, S3Credentials, UserSession } from '../../domain/types';
+import type { AuthUseCase } from '../../usecase/auth.usecase';
 
 const SESSION_KEY = '@photocloud_session';
+// S3 keys are short-lived: they are renewed this long before they expire.
+const RENEW_MARGIN_MS = 2 * 60 * 1000;
 
-export const useAuth = () => {
+export const useAuth = (authUseCase: AuthUseCase) => {
   const [session, setSession] = useState<UserSession | null>(null);
   const [loading, setLoading] = useState(true);
 
@@ -12,6 +15,22 @@ export const useAuth = () => {
     loadSession();
   }, []);
 
+  useEffect(() => {
+    const expiresAt = session?.creds.credentials_expires_at;
+    if (!session || !expiresAt) return;
+    const delay = Math.max(0, new Date(expiresAt).getTime() - Date.now() - RENEW_MARGIN_MS);
+    const timer = setTimeout(async () => {
+      try {
+        const creds = await authUseCase.renewCredentials(session.creds as AuthResponse);
+        await login(creds, session.email);
+      } catch (e) {
+        console.error('Failed to renew credentials', e);
+        await clearSession();
+      }
+    }, delay);
+    return () => clearTimeout(timer);
+  }, [session, authUseCase]);
+
   const loadSession = async () => {
     try {
       const stored = await AsyncStorage.getItem(SESSION_KEY);
@@ -36,6 +55,14 @@ export const useAuth = () => {
   };
 
   const logout = async () => {
+    if (session) {
+      // Revokes the S3 key of the session on the server.
+      authUseCase.logout(session.creds as AuthResponse).catch((e) => console.error('Failed to logout', e));
+    }
+    await clearSession();
+  };
+
+  const clearSession = async () => {
     setSession(null);
     try {
       await AsyncStorage.removeItem(SESSION_KEY);
@@ -5,7 +5,7 @@ import { Mail, Chrome, Code, Fingerprint } from 'lucide-react-native';
 import * as WebBrowser from 'expo-web-browser';
 import * as Linking from 'expo-linking';
 import * as Google from 'expo-auth-session/providers/google';
-import type { S3Credentials } from '../../domain/types';
+import type { AuthResponse, PasskeyRegistrationAuth, S3Credentials } from '../../domain/types';
 import type { AuthUseCase } from '../../usecase/auth.usecase';
 
 WebBrowser.maybeCompleteAuthSession();
@@ -13,16 +13,29 @@ WebBrowser.maybeCompleteAuthSession();
 interface Props {
   onLogin: (creds: S3Credentials, email: string) => void;
   authUseCase: AuthUseCase;
+  // Set when a login from a deep link still needs the second factor.
+  challengeToken?: string;
+  // Set when the app was opened from a magic link sent for a passkey
+  // registration.
+  passkeyRegistration?: PasskeyRegistrationAuth;
 }
 
-const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
+const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase, challengeToken, passkeyRegistration }) => {
   const theme = useTheme();
   const [email, setEmail] = useState('');
   const [magicLinkSent, setMagicLinkSent] = useState(false);
+  const [code, setCode] = useState('');
+  const [invite, setInvite] = useState('');
+  const [challenge, setChallenge] = useState<string | undefined>(challengeToken);
+  const [totpCode, setTotpCode] = useState('');
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState<string | null>(null);
   const [backendVersion, setBackendVersion] = useState<string>('...');
 
+  useEffect(() => {
+    if (challengeToken) setChallenge(challengeToken);
+  }, [challengeToken]);
+
   useEffect(() => {
     authUseCase.getVersion().then(setBackendVersion).catch(() => setBackendVersion('error'));
   }, [authUseCase]);
@@ -41,14 +54,36 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
     }
   }, [response]);
 
+  const completeLogin = (res: AuthResponse) => {
+    if (res.challenge_token) {
+      setChallenge(res.challenge_token);
+      return;
+    }
+    onLogin(res, res.user_id || res.email);
+  };
+
+  const handleSecondFactor = async () => {
+    if (!challenge || !totpCode) return;
+    setLoading(true);
+    setError(null);
+    try {
+      const res = await authUseCase.verifySecondFactor(challenge, totpCode);
+      onLogin(res, res.user_id || res.email);
+    } catch (err: any) {
+      setError(err?.message || 'Invalid code');
+    } finally {
+      setLoading(false);
+    }
+  };
+
   const handleGoogleLogin = async (token: string) => {
     setLoading(true);
     setError(null);
     try {
-      const res = await authUseCase.loginWithGoogle(token);
-      onLogin(res, res.email);
-    } catch (err) {
-      setError('Google login failed');
+      const res = await authUseCase.loginWithGoogle(token, invite);
+      completeLogin(res);
+    } catch (err: any) {
+      setError(err?.message || 'Google login failed');
     } finally {
       setLoading(false);
     }
@@ -63,7 +98,7 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
     setError(null);
     try {
       const res = await authUseCase.loginWithPasskey(email);
-      onLogin(res, res.email);
+      completeLogin(res);
     } catch (err: any) {
       console.error(err);
       setError('Passkey login failed. Have you registered a passkey?');
@@ -72,15 +107,19 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
     }
   };
 
+  // Passkeys can only be attached to an account the user has already proven
+  // they own: without a registration link, one is sent to the email first.
   const handlePasskeyRegister = async () => {
-    if (!email) {
-      setError('Please enter your email first');
-      return;
-    }
     setLoading(true);
     setError(null);
     try {
-      await authUseCase.registerPasskey(email);
+      if (!passkeyRegistration) {
+        const redirectUrl = Linking.createURL('/');
+        await authUseCase.requestMagicLink(email, redirectUrl, invite, true);
+        setError('Open the link sent to your email to register the passkey.');
+        return;
+      }
+      await authUseCase.registerPasskey(passkeyRegistration);
       setError('Passkey registered successfully! You can now login with it.');
     } catch (err: any) {
       console.error(err);
@@ -95,7 +134,7 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
     setError(null);
     try {
       const res = await authUseCase.loginWithDev();
-      onLogin(res, res.email);
+      completeLogin(res);
     } catch (err) {
       setError('Dev login failed');
     } finally {
@@ -109,7 +148,7 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
     setError(null);
     try {
       const redirectUrl = Linking.createURL('/');
-      await authUseCase.requestMagicLink(email, redirectUrl);
+      await authUseCase.requestMagicLink(email, redirectUrl, invite);
       setMagicLinkSent(true);
     } catch (err) {
       setError('Failed to send magic link');
@@ -118,6 +157,20 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
     }
   };
 
+  const handleVerifyCode = async () => {
+    if (!code) return;
+    setLoading(true);
+    setError(null);
+    try {
+      const res = await authUseCase.verifyMagicLinkCode(email, code, invite);
+      completeLogin(res);
+    } catch (err: any) {
+      setError(err?.message || 'Invalid code');
+    } finally {
+      setLoading(false);
+    }
+  };
+
   return (
     <KeyboardAvoidingView
       behavior={Platform.OS === 'ios' ? 'padding' : 'height'}
@@ -140,7 +193,24 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
               </HelperText>
             )}
 
-            {!magicLinkSent ? (
+            {challenge ? (
+              <View style={styles.sentContainer}>
+                <Text style={styles.sentText}>Enter the code from your authenticator app, or a recovery code.</Text>
+                <TextInput
+                  label="Verification code"
+                  value={totpCode}
+                  onChangeText={setTotpCode}
+                  mode="outlined"
+                  autoCapitalize="none"
+                  maxLength={9}
+                  style={styles.input}
+                />
+                <Button mode="contained" onPress={handleSecondFactor} disabled={loading || !totpCode}>
+                  Verify
+                </Button>
+                <Button onPress={() => { setChallenge(undefined); setTotpCode(''); }}>Cancel</Button>
+              </View>
+            ) : !magicLinkSent ? (
               <>
                 <TextInput
                   label="Email Address"
@@ -152,6 +222,14 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
                   left={<TextInput.Icon icon={() => <Mail size={20} color={theme.colors.primary} />} />}
                   style={styles.input}
                 />
+                <TextInput
+                  label="Invitation code (new accounts)"
+                  value={invite}
+                  onChangeText={setInvite}
+                  mode="outlined"
+                  autoCapitalize="characters"
+                  style={styles.input}
+                />
                 <Button
                   mode="contained"
                   onPress={handleMagicLinkRequest}
@@ -175,7 +253,7 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
                   mode="text"
                   onPress={handlePasskeyRegister}
                   loading={loading}
-                  disabled={loading || !email}
+                  disabled={loading || (!email && !passkeyRegistration)}
                   style={{ marginTop: 4 }}
                 >
                   Register new Passkey
@@ -184,7 +262,19 @@ const AuthScreen: React.FC<Props> = ({ onLogin, authUseCase }) => {
             ) : (
               <View style={styles.sentContainer}>
                 <Text style={styles.sentText}>Magic link sent to {email}!</Text>
-                <Button onPress={() => setMagicLinkSent(false)}>Change Email</Button>
+                <TextInput
+                  label="Or enter the code from the email"
+                  value={code}
+                  onChangeText={setCode}
+                  mode="outlined"
+                  keyboardType="number-pad"
+                  maxLength={9}
+                  style={styles.input}
+                />
+                <Button mode="contained" onPress={handleVerifyCode} disabled={loading || !code}>
+                  Verify Code
+                </Button>
+                <Button onPress={() => { setMagicLinkSent(false); setCode(''); }}>Change Email</Button>
               </View>
             )}
 
@@ -1,6 +1,6 @@
 import { Platform } from 'react-native';
 import { Passkey } from 'react-native-passkey';
-import type { IAuthRepository, AuthResponse } from '../domain/types';
+import type { IAuthRepository, AuthResponse, PasskeyRegistrationAuth } from '../domain/types';
 
 export class AuthUseCase {
   constructor(private authRepo: IAuthRepository) {}
@@ -9,20 +9,24 @@ export class AuthUseCase {
     return await this.authRepo.devLogin();
   }
 
-  async loginWithGoogle(token: string): Promise<AuthResponse> {
-    return await this.authRepo.googleLogin(token);
+  async loginWithGoogle(token: string, invite?: string): Promise<AuthResponse> {
+    return await this.authRepo.googleLogin(token, invite);
   }
 
-  async requestMagicLink(email: string, redirectUrl?: string): Promise<void> {
-    await this.authRepo.requestMagicLink(email, redirectUrl);
+  async requestMagicLink(email: string, redirectUrl?: string, invite?: string, forPasskey?: boolean): Promise<void> {
+    await this.authRepo.requestMagicLink(email, redirectUrl, invite, forPasskey);
   }
 
-  async validateMagicLink(token: string): Promise<AuthResponse> {
-    return await this.authRepo.validateMagicLink(token);
+  async validateMagicLink(token: string, invite?: string): Promise<AuthResponse> {
+    return await this.authRepo.validateMagicLink(token, invite);
   }
 
-  async registerPasskey(email: string): Promise<void> {
-    const options = await this.authRepo.beginPasskeyRegistration(email);
+  async verifyMagicLinkCode(email: string, code: string, invite?: string): Promise<AuthResponse> {
+    return await this.authRepo.verifyMagicLinkCode(email, code, invite);
+  }
+
+  async registerPasskey(auth: PasskeyRegistrationAuth): Promise<void> {
+    const options = await this.authRepo.beginPasskeyRegistration(auth);
 
     let credential;
     if (Platform.OS === 'web') {
@@ -34,7 +38,7 @@ export class AuthUseCase {
       credential = await Passkey.create(options);
     }
 
-    await this.authRepo.finishPasskeyRegistration(email, credential);
+    await this.authRepo.finishPasskeyRegistration(auth, credential, options.ceremony_id);
   }
 
   async loginWithPasskey(email: string): Promise<AuthResponse> {
@@ -50,7 +54,37 @@ export class AuthUseCase {
       credential = await Passkey.get(options);
     }
 
-    return await this.authRepo.finishPasskeyLogin(email, credential);
+    return await this.authRepo.finishPasskeyLogin(email, credential, options.ceremony_id);
+  }
+
+  async requestEmailChange(accessToken: string, email: string): Promise<void> {
+    await this.authRepo.requestEmailChange(accessToken, email);
+  }
+
+  async confirmEmailChange(accessToken: string, token: string): Promise<AuthResponse> {
+    return await this.authRepo.confirmEmailChange(accessToken, token);
+  }
+
+  // renewCredentials rotates the session tokens, then fetches a new S3 key
+  // for the session before the current one is revoked.
+  async renewCredentials(current: AuthResponse): Promise<AuthResponse> {
+    if (!current.refresh_token) throw new Error('No session to renew');
+    const tokens = await this.authRepo.refreshSession(current.refresh_token);
+    const creds = await this.authRepo.getCredentials(tokens.access_token || '');
+    return {
+      ...creds,
+      access_token: tokens.access_token,
+      refresh_token: tokens.refresh_token,
+      expires_at: tokens.expires_at,
+    };
+  }
+
+  async logout(current: AuthResponse): Promise<void> {
+    if (current.refresh_token) await this.authRepo.logout(current.refresh_token);
+  }
+
+  async verifySecondFactor(challengeToken: string, code: string): Promise<AuthResponse> {
+    return await this.authRepo.verifySecondFactor(challengeToken, code);
   }
 
   async getVersion(): Promise<string> {
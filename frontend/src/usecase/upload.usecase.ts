@@ -74,13 +74,15 @@ export class UploadUseCase {
           creds.bucket,
           `${basePrefix}/1080p/${photoId}.enc`,
           reducedData,
-          'application/octet-stream'
+          'application/octet-stream',
+          true
         ),
         this.s3Repo.uploadFile(
           creds.bucket,
           `${basePrefix}/thumbnail/${photoId}.enc`,
           thumbnailData,
-          'application/octet-stream'
+          'application/octet-stream',
+          true
         )
     ];
 
@@ -90,7 +92,8 @@ export class UploadUseCase {
                 creds.bucket,
                 `${basePrefix}/original/${photoId}.enc`,
                 originalData,
-                'application/octet-stream'
+                'application/octet-stream',
+                true
             )
         );
     }
@@ -107,11 +110,14 @@ export class UploadUseCase {
       creds.bucket,
       `${basePrefix}/metadata/${photoId}.json.enc`,
       metadataData,
-      'application/octet-stream'
+      'application/octet-stream',
+      true
     );
 
-    // Index
-    await this.updateIndex(creds, email, year);
+    // Index. Upload keys cannot write it.
+    if (creds.scope !== 'upload') {
+        await this.updateIndex(creds, email, year);
+    }
 
     const uploadedPhoto: UploadedPhoto = {
         id: hash,
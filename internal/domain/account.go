@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAccountNotFound       = errors.New("account not found")
+	ErrIdentityNotFound      = errors.New("identity not found")
+	ErrIdentityAlreadyLinked = errors.New("identity already linked to another account")
+	ErrLastIdentity          = errors.New("cannot unlink the last login method")
+	ErrEmailInUse            = errors.New("email already used by another account")
+)
+
+// IdentityProviderEmail is the provider of identities proven by receiving an
+// email, i.e. magic links. Its subject is the normalized address.
+const IdentityProviderEmail = "email"
+
+// Identity is a way to log in to an account: a provider and the provider's
+// stable identifier for the user.
+type Identity struct {
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// ID is the stable reference of the identity used in URLs and storage keys.
+func (i Identity) ID() string {
+	return IdentityID(i.Provider, i.Subject)
+}
+
+func IdentityID(provider string, subject string) string {
+	hash := sha256.Sum256([]byte(provider + "\x00" + subject))
+	return hex.EncodeToString(hash[:16])
+}
+
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Account owns a photo library. Its ID keys the storage layout and never
+// changes; accounts created before IDs existed use their email as ID.
+type Account struct {
+	ID         string     `json:"id"`
+	Email      string     `json:"email"`
+	Identities []Identity `json:"identities"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// EmailChange is set while an email change is in progress.
+	EmailChange *EmailChange `json:"email_change,omitempty"`
+}
+
+// KeyedByEmail reports whether the account was created before account IDs
+// existed, so that its storage is keyed by its original email.
+func (a *Account) KeyedByEmail() bool {
+	return strings.Contains(a.ID, "@")
+}
+
+// EmailChange is saved before an email change touches anything, so that it can
+// be resumed if the API stops halfway. Accounts keyed by email move their data
+// from FromID to ToID.
+type EmailChange struct {
+	Email     string    `json:"email"`
+	FromID    string    `json:"from_id,omitempty"`
+	ToID      string    `json:"to_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func (a *Account) AddIdentity(identity Identity) bool {
+	for _, i := range a.Identities {
+		if i.ID() == identity.ID() {
+			return false
+		}
+	}
+	a.Identities = append(a.Identities, identity)
+	return true
+}
+
+func (a *Account) RemoveIdentity(id string) (Identity, bool) {
+	for i, identity := range a.Identities {
+		if identity.ID() == id {
+			a.Identities = append(a.Identities[:i], a.Identities[i+1:]...)
+			return identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+type AccountStorage interface {
+	// GetAccount returns ErrAccountNotFound when no account record exists.
+	GetAccount(ctx context.Context, id string) (*Account, error)
+	SaveAccount(ctx context.Context, account *Account) error
+	// GetAccountIDByIdentity returns ErrIdentityNotFound when the identity is not linked.
+	GetAccountIDByIdentity(ctx context.Context, provider string, subject string) (string, error)
+	// LinkIdentity returns ErrIdentityAlreadyLinked if the identity belongs to another account.
+	LinkIdentity(ctx context.Context, provider string, subject string, accountID string) error
+	UnlinkIdentity(ctx context.Context, provider string, subject string) error
+	// MoveIdentity hands an identity of fromID over to toID. It returns
+	// ErrIdentityAlreadyLinked if the identity belongs to another account.
+	MoveIdentity(ctx context.Context, provider string, subject string, fromID string, toID string) error
+	DeleteAccount(ctx context.Context, id string) error
+	// LegacyAccountExists reports whether an account keyed by this email was
+	// created before account IDs existed.
+	LegacyAccountExists(ctx context.Context, email string) (bool, error)
+}
+
+// AccountDataStorage moves the stored objects of an account to a new ID. Every
+// step can be repeated safely.
+type AccountDataStorage interface {
+	// BeginUserMove gives the storage user of fromID the new ID and access to
+	// both prefixes.
+	BeginUserMove(ctx context.Context, fromID string, toID string) error
+	// CopyUserData copies every object of fromID to toID, skipping objects
+	// that were already copied. Photos are copied with the version of keys
+	// they are encrypted with.
+	CopyUserData(ctx context.Context, fromID string, toID string, keys UserKeys) error
+	// DeleteUserData deletes the objects of fromID once they were copied.
+	DeleteUserData(ctx context.Context, fromID string, toID string) error
+	// EndUserMove restricts the storage user to the toID prefix.
+	EndUserMove(ctx context.Context, toID string) error
+}
@@ -1,11 +1,46 @@
 package domain
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrPasskeyNotFound = errors.New("passkey not found")
+	// ErrPasskeyCloned is returned when the sign counter of a credential goes
+	// backwards, meaning two copies of the private key are in use.
+	ErrPasskeyCloned = errors.New("passkey sign counter went backwards")
+	ErrMagicLinkUsed = errors.New("magic link already used")
+	// ErrMagicLinkCodeInvalid covers wrong, expired and exhausted codes alike
+	// so that callers cannot tell them apart.
+	ErrMagicLinkCodeInvalid = errors.New("invalid magic link code")
+)
+
+const (
+	AuthMethodDev       = "dev"
+	AuthMethodGoogle    = "google"
+	AuthMethodMagicLink = "magic-link"
+	AuthMethodOIDC      = "oidc"
+	AuthMethodPasskey   = "passkey"
 )
 
 type UserInfo struct {
-	Email string
+	// UserID is the account the user logged in to. It is empty until the
+	// identity has been resolved to an account.
+	UserID string
+	Email  string
+	// Provider and Subject identify the login identity, e.g. "google" and
+	// the Google account ID. They are empty for passkeys, which belong
+	// directly to an account.
+	Provider   string
+	Subject    string
+	SessionID  string
+	AuthMethod string
+	// Scope is the widest credential scope the session may get.
+	Scope CredentialScope
 }
 
 type Authenticator interface {
@@ -15,6 +50,37 @@ type Authenticator interface {
 type MagicLinkAuthenticator interface {
 	GenerateToken(ctx context.Context, email string) (string, error)
 	ValidateToken(ctx context.Context, token string) (*UserInfo, error)
+	// GenerateLink returns a link token along with a short numeric code for
+	// devices where the link opens in the wrong browser. Either one can be
+	// used, once.
+	GenerateLink(ctx context.Context, email string) (token string, code string, err error)
+	ValidateCode(ctx context.Context, email string, code string) (*UserInfo, error)
+}
+
+// MagicLinkCode is the pending one-time code of a user. Only a keyed hash of
+// the code is stored.
+type MagicLinkCode struct {
+	Hash []byte `json:"hash"`
+	// Nonce is the nonce of the link sent with the code.
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Attempts  int       `json:"attempts"`
+}
+
+// MagicLinkStorage keeps the server-side state of magic links: consumed link
+// nonces and the pending one-time code of each user.
+type MagicLinkStorage interface {
+	// ConsumeMagicLinkNonce returns ErrMagicLinkUsed if the nonce was already consumed.
+	ConsumeMagicLinkNonce(ctx context.Context, email string, nonce string) error
+	// DeleteMagicLinkNonces forgets the nonces consumed before consumedBefore.
+	DeleteMagicLinkNonces(ctx context.Context, consumedBefore time.Time) error
+	// SaveMagicLinkCode replaces the pending code of the user.
+	SaveMagicLinkCode(ctx context.Context, email string, code *MagicLinkCode) error
+	// UpdateMagicLinkCode applies update to the pending code, nil when the
+	// user has none, atomically. update runs again on the latest code when
+	// another write got in first, and nothing is written when it returns an
+	// error.
+	UpdateMagicLinkCode(ctx context.Context, email string, update func(*MagicLinkCode) (*MagicLinkCode, error)) error
 }
 
 // Passkey related types
@@ -27,25 +93,86 @@ type PasskeyUser interface {
 }
 
 type PasskeyCredential struct {
-	ID        []byte
-	PublicKey []byte
+	ID              []byte
+	PublicKey       []byte
 	AttestationType string
-	Transport []string
+	Transport       []string
+	AAGUID          []byte
+	SignCount       uint32
+	// Flags is nil for credentials registered before the flags were recorded.
+	Flags      *PasskeyCredentialFlags
+	Nickname   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+type PasskeyCredentialFlags struct {
+	UserPresent    bool
+	UserVerified   bool
+	BackupEligible bool
+	BackupState    bool
 }
 
 type UserStorage interface {
-	GetUser(ctx context.Context, email string) (PasskeyUser, error)
-	SaveUser(ctx context.Context, email string, user PasskeyUser) error
-	GetUserKey(ctx context.Context, email string) ([]byte, error)
-	SaveUserKey(ctx context.Context, email string, key []byte) error
+	GetUser(ctx context.Context, userID string) (PasskeyUser, error)
+	SaveUser(ctx context.Context, userID string, user PasskeyUser) error
+	// GetUserKeys returns ErrUserKeyNotFound until the first key is saved.
+	GetUserKeys(ctx context.Context, userID string) (UserKeys, error)
+	SaveUserKeys(ctx context.Context, userID string, keys UserKeys) error
+}
+
+// KeyEncrypter wraps the user keys with a key it keeps to itself (envelope
+// encryption), so that a stored user key is useless without it.
+type KeyEncrypter interface {
+	// Name identifies the encrypter that wrapped a stored key.
+	Name() string
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// UserHandleStorage maps the opaque WebAuthn user handle returned by
+// discoverable credentials back to the account ID.
+type UserHandleStorage interface {
+	GetUserIDByUserHandle(ctx context.Context, handle []byte) (string, error)
+	SaveUserHandle(ctx context.Context, handle []byte, userID string) error
 }
 
 type PasskeyUserEntity struct {
-	Email       string
+	UserID string
+	Email  string
+	// UserHandle is empty for accounts whose passkeys were registered with
+	// the email, which is also their account ID, as WebAuthn user ID.
+	UserHandle  []byte
 	Credentials []PasskeyCredential
 }
 
-func (u *PasskeyUserEntity) WebAuthnID() []byte          { return []byte(u.Email) }
+func (u *PasskeyUserEntity) WebAuthnID() []byte {
+	if len(u.UserHandle) > 0 {
+		return u.UserHandle
+	}
+	return []byte(u.UserID)
+}
+
+func (u *PasskeyUserEntity) UpdateCredential(credential PasskeyCredential) bool {
+	for i, c := range u.Credentials {
+		if bytes.Equal(c.ID, credential.ID) {
+			u.Credentials[i] = credential
+			return true
+		}
+	}
+	return false
+}
+
+func (u *PasskeyUserEntity) RemoveCredential(id []byte) bool {
+	for i, c := range u.Credentials {
+		if bytes.Equal(c.ID, id) {
+			u.Credentials = append(u.Credentials[:i], u.Credentials[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (u *PasskeyUserEntity) WebAuthnName() string        { return u.Email }
 func (u *PasskeyUserEntity) WebAuthnDisplayName() string { return u.Email }
 func (u *PasskeyUserEntity) WebAuthnIcon() string        { return "" }
@@ -0,0 +1,24 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrPassphraseTooShort = errors.New("the passphrase is too short")
+	ErrInvalidRecoveryKit = errors.New("invalid recovery kit")
+	// ErrRecoveryKitPassphrase cannot tell a wrong passphrase from a damaged
+	// code: both fail the authentication of the sealed keys.
+	ErrRecoveryKitPassphrase = errors.New("wrong passphrase or damaged recovery kit")
+)
+
+// RecoveryKit holds the keys of a user sealed with a passphrase, so that the
+// photos remain readable if the server loses the keys. Code is meant to be
+// printed or shown as a QR code; the whole kit is saved as a file.
+type RecoveryKit struct {
+	Code       string    `json:"code"`
+	Email      string    `json:"email"`
+	KeyVersion int       `json:"key_version"`
+	CreatedAt  time.Time `json:"created_at"`
+}
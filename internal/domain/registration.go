@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RegistrationMode decides who may create an account. Existing accounts can
+// always log in.
+type RegistrationMode string
+
+const (
+	RegistrationOpen RegistrationMode = "open"
+	// RegistrationAllowlist admits emails of the allowed domains, and anyone
+	// with an invitation code.
+	RegistrationAllowlist  RegistrationMode = "allowlist"
+	RegistrationInviteOnly RegistrationMode = "invite"
+	RegistrationClosed     RegistrationMode = "closed"
+)
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInviteRequired     = errors.New("an invitation code is required to sign up")
+	ErrInviteInvalid      = errors.New("invalid or expired invitation code")
+	ErrInviteNotFound     = errors.New("invitation not found")
+)
+
+// Invite is an invitation code issued by an admin. The code itself is not
+// stored: the ID is a hash of it.
+type Invite struct {
+	ID        string    `json:"id"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+}
+
+func (i *Invite) Usable(now time.Time) bool {
+	return now.Before(i.ExpiresAt) && i.Uses < i.MaxUses
+}
+
+type InviteStorage interface {
+	SaveInvite(ctx context.Context, invite *Invite) error
+	ListInvites(ctx context.Context) ([]Invite, error)
+	// UpdateInvite applies update to the stored invite atomically and returns
+	// ErrInviteNotFound if it does not exist.
+	UpdateInvite(ctx context.Context, id string, update func(*Invite) error) error
+	DeleteInvite(ctx context.Context, id string) error
+}
@@ -0,0 +1,65 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrSecondFactorRequired = errors.New("second factor required")
+	ErrTOTPNotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrTOTPAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	// ErrTOTPCodeInvalid covers wrong, replayed and used recovery codes alike.
+	ErrTOTPCodeInvalid = errors.New("invalid verification code")
+)
+
+// TOTPConfig is the authenticator app of an account. It is pending until the
+// user proves the app was set up by entering a first code.
+type TOTPConfig struct {
+	Secret    []byte     `json:"secret"`
+	EnabledAt *time.Time `json:"enabled_at,omitempty"`
+	// LastStep is the time step of the last accepted code, so that a code
+	// cannot be used twice.
+	LastStep      int64          `json:"last_step"`
+	RecoveryCodes []RecoveryCode `json:"recovery_codes,omitempty"`
+}
+
+// RecoveryCode is a single-use code replacing the app when it is lost. Only a
+// hash of the code is stored.
+type RecoveryCode struct {
+	Hash   []byte     `json:"hash"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+func (c *TOTPConfig) Enabled() bool {
+	return c != nil && c.EnabledAt != nil
+}
+
+func (c *TOTPConfig) RecoveryCodesLeft() int {
+	left := 0
+	for _, rc := range c.RecoveryCodes {
+		if rc.UsedAt == nil {
+			left++
+		}
+	}
+	return left
+}
+
+type TOTPStorage interface {
+	// GetTOTP returns nil when the account has no authenticator app.
+	GetTOTP(ctx context.Context, userID string) (*TOTPConfig, error)
+	// UpdateTOTP applies update to the configuration, nil when the account
+	// has none, atomically. update runs again on the latest configuration
+	// when another write got in first, and nothing is written when it
+	// returns an error.
+	UpdateTOTP(ctx context.Context, userID string, update func(*TOTPConfig) (*TOTPConfig, error)) error
+	DeleteTOTP(ctx context.Context, userID string) error
+}
+
+// SecondFactorChallengeIssuer signs the short-lived token proving that the
+// first factor succeeded while the second one is pending.
+type SecondFactorChallengeIssuer interface {
+	IssueChallengeToken(ctx context.Context, user *UserInfo) (string, error)
+	ValidateChallengeToken(ctx context.Context, token string) (*UserInfo, error)
+}
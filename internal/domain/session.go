@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrSessionRevoked     = errors.New("session revoked or expired")
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrReauthenticationRequired is returned for sensitive changes when the
+	// session logged in too long ago.
+	ErrReauthenticationRequired = errors.New("log in again to continue")
+)
+
+type SessionTokens struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Session is a refresh-token family: every rotation replaces RefreshTokenID,
+// so presenting an older token of the same family means it was stolen.
+type Session struct {
+	ID             string          `json:"id"`
+	RefreshTokenID string          `json:"refresh_token_id"`
+	AuthMethod     string          `json:"auth_method"`
+	Scope          CredentialScope `json:"scope,omitempty"`
+	UserAgent      string          `json:"user_agent"`
+	IP             string          `json:"ip"`
+	CreatedAt      time.Time       `json:"created_at"`
+	LastSeenAt     time.Time       `json:"last_seen_at"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+	RevokedAt      *time.Time      `json:"revoked_at,omitempty"`
+}
+
+// ClientInfo describes the device a request comes from. It is only used to
+// help users recognise their sessions, never to authenticate them.
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+func (s *Session) Seen(now time.Time, client ClientInfo) {
+	s.LastSeenAt = now
+	s.IP = client.IP
+	if client.UserAgent != "" {
+		s.UserAgent = client.UserAgent
+	}
+}
+
+type RefreshTokenClaims struct {
+	User    *UserInfo
+	TokenID string
+}
+
+// SessionTokenIssuer signs the API session once a user has been authenticated
+// by any of the Authenticator implementations.
+type SessionTokenIssuer interface {
+	IssueTokens(ctx context.Context, user *UserInfo, session *Session) (*SessionTokens, error)
+	ValidateAccessToken(ctx context.Context, token string) (*UserInfo, error)
+	ValidateRefreshToken(ctx context.Context, token string) (*RefreshTokenClaims, error)
+}
+
+type SessionStorage interface {
+	GetSessions(ctx context.Context, userID string) ([]Session, error)
+	// UpdateSessions applies update to the stored sessions atomically. update
+	// runs again on the latest sessions when another write got in first, and
+	// nothing is written when it returns an error.
+	UpdateSessions(ctx context.Context, userID string, update func([]Session) ([]Session, error)) error
+}
+
+type userInfoContextKey struct{}
+
+func ContextWithUserInfo(ctx context.Context, user *UserInfo) context.Context {
+	return context.WithValue(ctx, userInfoContextKey{}, user)
+}
+
+func UserInfoFromContext(ctx context.Context) (*UserInfo, bool) {
+	user, ok := ctx.Value(userInfoContextKey{}).(*UserInfo)
+	return user, ok && user != nil
+}
@@ -1,16 +1,113 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrInvalidCredentialScope = errors.New("invalid credential scope")
+	// ErrCredentialScopeDenied is returned when a session asks for more than
+	// it was opened with.
+	ErrCredentialScopeDenied = errors.New("credential scope not granted to this session")
+)
+
+// CredentialScope restricts what the S3 keys of a session may do, so that a
+// compromised device cannot wipe the library.
+type CredentialScope string
+
+const (
+	CredentialScopeFull CredentialScope = "full"
+	// CredentialScopeRead is for viewers such as TV apps.
+	CredentialScopeRead CredentialScope = "read"
+	// CredentialScopeUpload adds photos but cannot delete them, for backup
+	// devices.
+	CredentialScopeUpload CredentialScope = "upload"
+)
+
+var CredentialScopes = []CredentialScope{CredentialScopeFull, CredentialScopeRead, CredentialScopeUpload}
+
+// ParseCredentialScope returns an empty scope for an empty string, letting
+// the caller pick its default.
+func ParseCredentialScope(s string) (CredentialScope, error) {
+	scope := CredentialScope(s)
+	if s != "" && !slices.Contains(CredentialScopes, scope) {
+		return "", ErrInvalidCredentialScope
+	}
+	return scope, nil
+}
+
+// Allows tells whether a session opened with scope s may get keys of the
+// requested scope. Sessions opened before scopes existed have full access.
+func (s CredentialScope) Allows(requested CredentialScope) bool {
+	return s == "" || s == CredentialScopeFull || s == requested
+}
 
 type S3Credentials struct {
 	AccessKey string `json:"access"`
 	SecretKey string `json:"secret"`
-	Endpoint  string `json:"endpoint"`
-	Region    string `json:"region"`
-	Bucket    string `json:"bucket"`
-	UserKey   string `json:"user_key,omitempty"`
+	// SessionToken is set for temporary keys, which S3 requires along with
+	// the key.
+	SessionToken string `json:"session_token,omitempty"`
+	Endpoint     string `json:"endpoint"`
+	Region       string `json:"region"`
+	Bucket       string `json:"bucket"`
+	UserKey      string `json:"user_key,omitempty"`
+	// UserKeyVersion is recorded in the user-key-version metadata of new
+	// objects.
+	UserKeyVersion int `json:"user_key_version,omitempty"`
+	// PreviousUserKeys decrypt the objects that were not re-encrypted with
+	// UserKey, newest first.
+	PreviousUserKeys []S3UserKey     `json:"previous_user_keys,omitempty"`
+	Scope            CredentialScope `json:"scope,omitempty"`
+	// ExpiresAt is when the key is revoked. Clients fetch a new one from
+	// /credentials before then.
+	ExpiresAt *time.Time `json:"credentials_expires_at,omitempty"`
+}
+
+// S3UserKey is a version of the user key, in base64.
+type S3UserKey struct {
+	Version int    `json:"version"`
+	Key     string `json:"key"`
 }
 
+// StorageRepository hands out S3 keys bound to a session.
 type StorageRepository interface {
-	GetS3Credentials(ctx context.Context, email string) (*S3Credentials, error)
+	// IssueS3Credentials creates a key of the given scope valid until
+	// expiresAt, replacing the previous key of the session.
+	IssueS3Credentials(ctx context.Context, userID string, sessionID string, scope CredentialScope, expiresAt time.Time) (*S3Credentials, error)
+	RevokeS3Credentials(ctx context.Context, userID string, sessionIDs []string) error
+	// RevokeExpiredS3Credentials deletes the expired keys of every account.
+	RevokeExpiredS3Credentials(ctx context.Context) error
+}
+
+// MasterKeyRotation is the progress of re-encrypting the server objects with
+// the active MASTER_KEY. Objects are visited in order, so LastKey is enough
+// to resume.
+type MasterKeyRotation struct {
+	Version     string     `json:"version"`
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	LastKey     string     `json:"last_key,omitempty"`
+	Scanned     int        `json:"scanned"`
+	Rotated     int        `json:"rotated"`
+	// Failed lists the objects left on a previous key.
+	Failed    []string `json:"failed,omitempty"`
+	LastError string   `json:"last_error,omitempty"`
+}
+
+type MasterKeyRotationStorage interface {
+	ActiveMasterKeyVersion() string
+	// ListServiceObjects returns, in order, up to limit server objects after
+	// the given key.
+	ListServiceObjects(ctx context.Context, after string, limit int) ([]string, error)
+	// RotateServiceObject re-encrypts an object with the active MASTER_KEY
+	// and reports whether it had to.
+	RotateServiceObject(ctx context.Context, key string) (bool, error)
+	// GetMasterKeyRotation returns nil if no rotation ever started.
+	GetMasterKeyRotation(ctx context.Context) (*MasterKeyRotation, error)
+	SaveMasterKeyRotation(ctx context.Context, rotation *MasterKeyRotation) error
 }
@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUserKeyNotFound = errors.New("user key not found")
+	// ErrUserKeyRotationPending is returned when a new key is asked for before
+	// the objects were re-encrypted with the previous one.
+	ErrUserKeyRotationPending = errors.New("the previous key rotation is not finished")
+	ErrUserKeyRotationRunning = errors.New("the key rotation is already running")
+)
+
+// UserKey is a version of the key that encrypts the objects of a user with
+// SSE-C. Objects record the version of their key in their user-key-version
+// metadata; objects without it predate versions.
+type UserKey struct {
+	Version   int
+	Key       []byte
+	CreatedAt time.Time
+}
+
+// UserKeys lists every version of the key of a user, oldest first. Previous
+// versions are kept to read the objects that were not re-encrypted.
+type UserKeys []UserKey
+
+// Active returns the key of new objects.
+func (k UserKeys) Active() UserKey {
+	return k[len(k)-1]
+}
+
+// Previous returns the older versions, newest first.
+func (k UserKeys) Previous() UserKeys {
+	previous := make(UserKeys, 0, len(k)-1)
+	for i := len(k) - 2; i >= 0; i-- {
+		previous = append(previous, k[i])
+	}
+	return previous
+}
+
+// UserKeyRotation is the progress of re-encrypting the objects of a user with
+// the active version of the user key. Objects are visited in order, so
+// LastKey is enough to resume.
+type UserKeyRotation struct {
+	Version     int        `json:"version"`
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	LastKey     string     `json:"last_key,omitempty"`
+	Scanned     int        `json:"scanned"`
+	Rotated     int        `json:"rotated"`
+	// Failed lists the objects left on a previous version.
+	Failed    []string `json:"failed,omitempty"`
+	LastError string   `json:"last_error,omitempty"`
+}
+
+type UserKeyRotationStorage interface {
+	// ListUserObjects returns, in order, up to limit objects of the user
+	// after the given key.
+	ListUserObjects(ctx context.Context, userID string, after string, limit int) ([]string, error)
+	// RotateUserObject re-encrypts an object with the active key and reports
+	// whether it had to.
+	RotateUserObject(ctx context.Context, userID string, key string, keys UserKeys) (bool, error)
+	// GetUserKeyRotation returns nil if the user never rotated the key.
+	GetUserKeyRotation(ctx context.Context, userID string) (*UserKeyRotation, error)
+	SaveUserKeyRotation(ctx context.Context, userID string, rotation *UserKeyRotation) error
+	// ListPendingUserKeyRotations returns the users whose rotation did not
+	// complete.
+	ListPendingUserKeyRotations(ctx context.Context) ([]string, error)
+}
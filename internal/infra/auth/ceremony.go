@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+const (
+	CeremonyRegistration = "registration"
+	CeremonyLogin        = "login"
+
+	defaultCeremonyTTL = 5 * time.Minute
+)
+
+var (
+	ErrCeremonyMalformed = errors.New("malformed passkey ceremony")
+	ErrCeremonyExpired   = errors.New("passkey ceremony expired")
+)
+
+// CeremonySealer keeps the WebAuthn session data on the client side, sealed with
+// AES-GCM under a server key, so that the challenge cannot be forged or reused
+// for another account. The sealed value is the opaque ceremony ID.
+//
+// The user sealed in a registration ceremony has been verified when the
+// ceremony began, so the finish step can trust it.
+type CeremonySealer struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+func NewCeremonySealer(secret string) (*CeremonySealer, error) {
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, "photocloud webauthn ceremony", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive ceremony key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &CeremonySealer{
+		aead: aead,
+		ttl:  defaultCeremonyTTL,
+		now:  time.Now,
+	}, nil
+}
+
+type Ceremony struct {
+	UserID    string               `json:"uid,omitempty"`
+	Email     string               `json:"email,omitempty"`
+	ExpiresAt time.Time            `json:"exp"`
+	Session   webauthn.SessionData `json:"session"`
+}
+
+func (s *CeremonySealer) TTL() time.Duration {
+	return s.ttl
+}
+
+// Seal returns the ceremony ID for a WebAuthn session of the given kind,
+// bound to the account it was started for. user is nil for discoverable logins.
+func (s *CeremonySealer) Seal(kind string, user *domain.UserInfo, session *webauthn.SessionData) (string, error) {
+	ceremony := Ceremony{
+		ExpiresAt: s.now().Add(s.ttl),
+		Session:   *session,
+	}
+	if user != nil {
+		ceremony.UserID = user.UserID
+		ceremony.Email = user.Email
+	}
+	plaintext, err := json.Marshal(ceremony)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ceremony: %w", err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate ceremony nonce: %w", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(kind))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open returns the ceremony sealed in the ceremony ID. It fails if the ceremony
+// was tampered with, started for another kind, or expired. Callers that know
+// the account must still compare it with Ceremony.UserID.
+func (s *CeremonySealer) Open(kind string, ceremonyID string) (*Ceremony, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(ceremonyID)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return nil, ErrCeremonyMalformed
+	}
+
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(kind))
+	if err != nil {
+		return nil, ErrCeremonyMalformed
+	}
+
+	var ceremony Ceremony
+	if err := json.Unmarshal(plaintext, &ceremony); err != nil {
+		return nil, ErrCeremonyMalformed
+	}
+	if !s.now().Before(ceremony.ExpiresAt) {
+		return nil, ErrCeremonyExpired
+	}
+	return &ceremony, nil
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+func TestCeremonySealer(t *testing.T) {
+	sealer, err := NewCeremonySealer("test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &webauthn.SessionData{Challenge: "challenge", UserID: []byte("user@example.com")}
+
+	ceremonyID, err := sealer.Seal(CeremonyLogin, &domain.UserInfo{UserID: "3f2a9c", Email: "user@example.com"}, session)
+	if err != nil {
+		t.Fatalf("failed to seal ceremony: %v", err)
+	}
+
+	opened, err := sealer.Open(CeremonyLogin, ceremonyID)
+	if err != nil {
+		t.Fatalf("failed to open ceremony: %v", err)
+	}
+	if opened.Session.Challenge != session.Challenge || opened.UserID != "3f2a9c" || opened.Email != "user@example.com" {
+		t.Errorf("unexpected ceremony %+v", opened)
+	}
+
+	tampered := []byte(ceremonyID)
+	tampered[len(tampered)/2] ^= 1
+
+	tests := []struct {
+		name       string
+		kind       string
+		ceremonyID string
+	}{
+		{"other kind", CeremonyRegistration, ceremonyID},
+		{"tampered", CeremonyLogin, string(tampered)},
+		{"raw json", CeremonyLogin, `{"challenge":"forged"}`},
+		{"empty", CeremonyLogin, ""},
+	}
+	for _, tt := range tests {
+		if _, err := sealer.Open(tt.kind, tt.ceremonyID); !errors.Is(err, ErrCeremonyMalformed) {
+			t.Errorf("%s: expected ErrCeremonyMalformed, got %v", tt.name, err)
+		}
+	}
+
+	sealer.now = func() time.Time { return time.Now().Add(sealer.ttl) }
+	if _, err := sealer.Open(CeremonyLogin, ceremonyID); !errors.Is(err, ErrCeremonyExpired) {
+		t.Errorf("expected ErrCeremonyExpired, got %v", err)
+	}
+}
@@ -3,21 +3,21 @@ package auth
 import (
 	"context"
 	"errors"
-	"os"
 
 	"github.com/snigle/photocloud/internal/domain"
 )
 
 type DevAuthenticator struct {
 	devEmail string
+	enabled  bool
 }
 
-func NewDevAuthenticator(devEmail string) *DevAuthenticator {
-	return &DevAuthenticator{devEmail: devEmail}
+func NewDevAuthenticator(devEmail string, enabled bool) *DevAuthenticator {
+	return &DevAuthenticator{devEmail: devEmail, enabled: enabled}
 }
 
 func (a *DevAuthenticator) Authenticate(ctx context.Context, token string) (*domain.UserInfo, error) {
-	if os.Getenv("DEV_AUTH_ENABLED") != "true" {
+	if !a.enabled {
 		return nil, errors.New("dev auth is disabled")
 	}
 
@@ -26,5 +26,5 @@ func (a *DevAuthenticator) Authenticate(ctx context.Context, token string) (*dom
 		return nil, errors.New("invalid dev token")
 	}
 
-	return &domain.UserInfo{Email: a.devEmail}, nil
+	return &domain.UserInfo{Email: a.devEmail, Provider: domain.IdentityProviderEmail, AuthMethod: domain.AuthMethodDev}, nil
 }
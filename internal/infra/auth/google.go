@@ -31,6 +31,9 @@ func (a *GoogleAuthenticator) Authenticate(ctx context.Context, token string) (*
 	if !ok {
 		return nil, errors.New("email not found in token")
 	}
+	if verified, ok := payload.Claims["email_verified"].(bool); ok && !verified {
+		return nil, errors.New("email not verified by google")
+	}
 
-	return &domain.UserInfo{Email: email}, nil
+	return &domain.UserInfo{Email: email, Provider: "google", Subject: payload.Subject, AuthMethod: domain.AuthMethodGoogle}, nil
 }
@@ -2,38 +2,76 @@ package auth
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/snigle/photocloud/internal/domain"
 )
 
+const (
+	magicLinkTTL          = 15 * time.Minute
+	magicLinkCodeDigits   = 8
+	magicLinkCodeAttempts = 5
+	magicLinkAudience     = "photocloud-magic-link"
+	tokenTypeMagicLink    = "magic-link"
+)
+
 type MagicLinkAuthenticator struct {
-	secret []byte
-	issuer string
+	secret  []byte
+	issuer  string
+	storage domain.MagicLinkStorage
+	now     func() time.Time
 }
 
-func NewMagicLinkAuthenticator(secret string, issuer string) *MagicLinkAuthenticator {
+func NewMagicLinkAuthenticator(secret string, issuer string, storage domain.MagicLinkStorage) *MagicLinkAuthenticator {
 	return &MagicLinkAuthenticator{
-		secret: []byte(secret),
-		issuer: issuer,
+		secret:  []byte(secret),
+		issuer:  issuer,
+		storage: storage,
+		now:     time.Now,
 	}
 }
 
 type magicLinkClaims struct {
-	Email string `json:"email"`
+	Email     string `json:"email"`
+	TokenType string `json:"typ"`
 	jwt.RegisteredClaims
 }
 
 func (a *MagicLinkAuthenticator) GenerateToken(ctx context.Context, email string) (string, error) {
+	nonce, err := newMagicLinkNonce()
+	if err != nil {
+		return "", err
+	}
+	return a.signToken(email, nonce)
+}
+
+func newMagicLinkNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate magic link nonce: %w", err)
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+func (a *MagicLinkAuthenticator) signToken(email string, nonce string) (string, error) {
 	claims := magicLinkClaims{
 		email,
+		tokenTypeMagicLink,
 		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
+			ID:        nonce,
+			Audience:  jwt.ClaimStrings{magicLinkAudience},
+			ExpiresAt: jwt.NewNumericDate(a.now().Add(magicLinkTTL)),
 			Issuer:    a.issuer,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			IssuedAt:  jwt.NewNumericDate(a.now()),
 		},
 	}
 
@@ -53,9 +91,112 @@ func (a *MagicLinkAuthenticator) ValidateToken(ctx context.Context, tokenString
 		return nil, fmt.Errorf("invalid token: %w", err)
 	}
 
-	if claims, ok := token.Claims.(*magicLinkClaims); ok && token.Valid {
-		return &domain.UserInfo{Email: claims.Email}, nil
+	claims, ok := token.Claims.(*magicLinkClaims)
+	if !ok || !token.Valid || claims.Email == "" || claims.ID == "" || claims.ExpiresAt == nil {
+		return nil, errors.New("invalid token claims")
+	}
+	// Session tokens share the signing secret, so the audience and type are
+	// what keeps them from being used as magic links.
+	if !claims.VerifyAudience(magicLinkAudience, true) || !claims.VerifyIssuer(a.issuer, true) || claims.TokenType != tokenTypeMagicLink {
+		return nil, errors.New("token is not a magic link")
+	}
+
+	// The nonce is only consumed once the token is known to be a magic link,
+	// so other tokens cannot write markers for their own IDs.
+	if err := a.storage.ConsumeMagicLinkNonce(ctx, claims.Email, claims.ID); err != nil {
+		return nil, fmt.Errorf("failed to consume magic link: %w", err)
+	}
+
+	return &domain.UserInfo{Email: claims.Email, Provider: domain.IdentityProviderEmail, AuthMethod: domain.AuthMethodMagicLink}, nil
+}
+
+// PruneNonces deletes the nonces of the links that have expired. A nonce is
+// consumed before its link expires, so it is kept for the lifetime of a link.
+func (a *MagicLinkAuthenticator) PruneNonces(ctx context.Context) error {
+	if err := a.storage.DeleteMagicLinkNonces(ctx, a.now().Add(-magicLinkTTL)); err != nil {
+		return fmt.Errorf("failed to prune magic link nonces: %w", err)
+	}
+	return nil
+}
+
+// GenerateLink returns a magic link token and the code sent along with it.
+// Both stand for the same link, so using one invalidates the other. The code
+// replaces any pending code of the user, which also resets its attempt
+// counter.
+func (a *MagicLinkAuthenticator) GenerateLink(ctx context.Context, email string) (string, string, error) {
+	nonce, err := newMagicLinkNonce()
+	if err != nil {
+		return "", "", err
+	}
+	token, err := a.signToken(email, nonce)
+	if err != nil {
+		return "", "", err
 	}
 
-	return nil, errors.New("invalid token claims")
+	n, err := rand.Int(rand.Reader, big.NewInt(1e8))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate magic link code: %w", err)
+	}
+	code := fmt.Sprintf("%0*d", magicLinkCodeDigits, n)
+
+	err = a.storage.SaveMagicLinkCode(ctx, email, &domain.MagicLinkCode{
+		Hash:      a.hashCode(email, code),
+		Nonce:     nonce,
+		ExpiresAt: a.now().Add(magicLinkTTL),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to save magic link code: %w", err)
+	}
+	return token, code, nil
+}
+
+func (a *MagicLinkAuthenticator) ValidateCode(ctx context.Context, email string, code string) (*domain.UserInfo, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	var (
+		valid bool
+		nonce string
+	)
+	// Attempts are counted with a conditional write, so that concurrent
+	// guesses cannot overwrite each other's count. A used code is kept as
+	// exhausted rather than deleted.
+	err := a.storage.UpdateMagicLinkCode(ctx, email, func(pending *domain.MagicLinkCode) (*domain.MagicLinkCode, error) {
+		if pending == nil || pending.Nonce == "" || !a.now().Before(pending.ExpiresAt) || pending.Attempts >= magicLinkCodeAttempts {
+			return nil, domain.ErrMagicLinkCodeInvalid
+		}
+		valid, nonce = hmac.Equal(pending.Hash, a.hashCode(email, code)), pending.Nonce
+		if valid {
+			pending.Attempts = magicLinkCodeAttempts
+		} else {
+			pending.Attempts++
+		}
+		return pending, nil
+	})
+	if errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to record magic link code attempt: %w", err)
+	}
+	if !valid {
+		return nil, domain.ErrMagicLinkCodeInvalid
+	}
+
+	// The code consumes its link, and fails if the link was already used.
+	err = a.storage.ConsumeMagicLinkNonce(ctx, email, nonce)
+	if errors.Is(err, domain.ErrMagicLinkUsed) {
+		return nil, domain.ErrMagicLinkCodeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume magic link: %w", err)
+	}
+	return &domain.UserInfo{Email: email, Provider: domain.IdentityProviderEmail, AuthMethod: domain.AuthMethodMagicLink}, nil
+}
+
+// hashCode keys the hash with the server secret: a leaked code record must
+// not be brute-forceable offline, which a plain hash of 8 digits would be.
+// The email is normalized like the storage key of the code.
+func (a *MagicLinkAuthenticator) hashCode(email string, code string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte("magic-link-code\x00" + domain.NormalizeEmail(email) + "\x00" + code))
+	return mac.Sum(nil)
 }
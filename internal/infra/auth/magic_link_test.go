@@ -2,13 +2,70 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
 )
 
+type mockMagicLinkStorage struct {
+	mu    sync.Mutex
+	used  map[string]bool
+	codes map[string]domain.MagicLinkCode
+}
+
+func (m *mockMagicLinkStorage) ConsumeMagicLinkNonce(ctx context.Context, email string, nonce string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used == nil {
+		m.used = make(map[string]bool)
+	}
+	key := domain.NormalizeEmail(email) + "/" + nonce
+	if m.used[key] {
+		return domain.ErrMagicLinkUsed
+	}
+	m.used[key] = true
+	return nil
+}
+
+func (m *mockMagicLinkStorage) DeleteMagicLinkNonces(ctx context.Context, consumedBefore time.Time) error {
+	return nil
+}
+
+func (m *mockMagicLinkStorage) SaveMagicLinkCode(ctx context.Context, email string, code *domain.MagicLinkCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.codes == nil {
+		m.codes = make(map[string]domain.MagicLinkCode)
+	}
+	m.codes[domain.NormalizeEmail(email)] = *code
+	return nil
+}
+
+func (m *mockMagicLinkStorage) UpdateMagicLinkCode(ctx context.Context, email string, update func(*domain.MagicLinkCode) (*domain.MagicLinkCode, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pending *domain.MagicLinkCode
+	if code, ok := m.codes[domain.NormalizeEmail(email)]; ok {
+		pending = &code
+	}
+	code, err := update(pending)
+	if err != nil {
+		return err
+	}
+	if m.codes == nil {
+		m.codes = make(map[string]domain.MagicLinkCode)
+	}
+	m.codes[domain.NormalizeEmail(email)] = *code
+	return nil
+}
+
 func TestMagicLinkAuthenticator(t *testing.T) {
 	secret := "test-secret"
 	issuer := "test-issuer"
-	a := NewMagicLinkAuthenticator(secret, issuer)
+	a := NewMagicLinkAuthenticator(secret, issuer, &mockMagicLinkStorage{})
 	email := "user@example.com"
 
 	token, err := a.GenerateToken(context.Background(), email)
@@ -25,3 +82,137 @@ func TestMagicLinkAuthenticator(t *testing.T) {
 		t.Errorf("expected email %s, got %s", email, userInfo.Email)
 	}
 }
+
+func TestMagicLinkAuthenticator_SingleUse(t *testing.T) {
+	ctx := context.Background()
+	a := NewMagicLinkAuthenticator("test-secret", "test-issuer", &mockMagicLinkStorage{})
+
+	token, err := a.GenerateToken(ctx, "user@example.com")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	if _, err := a.ValidateToken(ctx, token); err != nil {
+		t.Fatalf("failed to validate token: %v", err)
+	}
+	if _, err := a.ValidateToken(ctx, token); !errors.Is(err, domain.ErrMagicLinkUsed) {
+		t.Errorf("expected ErrMagicLinkUsed on replay, got %v", err)
+	}
+
+	other, err := a.GenerateToken(ctx, "user@example.com")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	if _, err := a.ValidateToken(ctx, other); err != nil {
+		t.Errorf("expected a new link to be accepted, got %v", err)
+	}
+}
+
+func TestMagicLinkAuthenticator_Code(t *testing.T) {
+	ctx := context.Background()
+	a := NewMagicLinkAuthenticator("test-secret", "test-issuer", &mockMagicLinkStorage{})
+	email := "user@example.com"
+
+	_, code, err := a.GenerateLink(ctx, email)
+	if err != nil {
+		t.Fatalf("failed to generate code: %v", err)
+	}
+	if len(code) != 8 {
+		t.Errorf("expected an 8 digit code, got %q", code)
+	}
+
+	if _, err := a.ValidateCode(ctx, "other@example.com", code); !errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+		t.Errorf("expected code of another user to be rejected, got %v", err)
+	}
+
+	userInfo, err := a.ValidateCode(ctx, email, code[:4]+" "+code[4:])
+	if err != nil {
+		t.Fatalf("failed to validate code: %v", err)
+	}
+	if userInfo.Email != email || userInfo.AuthMethod != domain.AuthMethodMagicLink {
+		t.Errorf("unexpected user info %+v", userInfo)
+	}
+
+	if _, err := a.ValidateCode(ctx, email, code); !errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+		t.Errorf("expected code to be single-use, got %v", err)
+	}
+}
+
+func TestMagicLinkAuthenticator_CodeAttempts(t *testing.T) {
+	ctx := context.Background()
+	a := NewMagicLinkAuthenticator("test-secret", "test-issuer", &mockMagicLinkStorage{})
+	email := "user@example.com"
+
+	_, code, err := a.GenerateLink(ctx, email)
+	if err != nil {
+		t.Fatalf("failed to generate code: %v", err)
+	}
+	wrong := "00000000"
+	if code == wrong {
+		wrong = "11111111"
+	}
+	for i := 0; i < magicLinkCodeAttempts; i++ {
+		if _, err := a.ValidateCode(ctx, email, wrong); !errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+			t.Fatalf("attempt %d: expected ErrMagicLinkCodeInvalid, got %v", i+1, err)
+		}
+	}
+	if _, err := a.ValidateCode(ctx, email, code); !errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+		t.Errorf("expected code to be burnt after too many attempts, got %v", err)
+	}
+}
+
+func TestMagicLinkAuthenticator_CodeExpiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	a := NewMagicLinkAuthenticator("test-secret", "test-issuer", &mockMagicLinkStorage{})
+	a.now = func() time.Time { return now }
+
+	_, code, err := a.GenerateLink(ctx, "user@example.com")
+	if err != nil {
+		t.Fatalf("failed to generate code: %v", err)
+	}
+	now = now.Add(magicLinkTTL)
+	if _, err := a.ValidateCode(ctx, "user@example.com", code); !errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+		t.Errorf("expected expired code to be rejected, got %v", err)
+	}
+}
+
+func TestMagicLinkAuthenticator_CodeNormalizedEmail(t *testing.T) {
+	ctx := context.Background()
+	a := NewMagicLinkAuthenticator("test-secret", "test-issuer", &mockMagicLinkStorage{})
+
+	_, code, err := a.GenerateLink(ctx, "User@Example.com")
+	if err != nil {
+		t.Fatalf("failed to generate code: %v", err)
+	}
+	if _, err := a.ValidateCode(ctx, " user@example.com", code); err != nil {
+		t.Errorf("expected the code to match the normalized email, got %v", err)
+	}
+}
+
+func TestMagicLinkAuthenticator_LinkAndCodeAreExclusive(t *testing.T) {
+	ctx := context.Background()
+	a := NewMagicLinkAuthenticator("test-secret", "test-issuer", &mockMagicLinkStorage{})
+	email := "user@example.com"
+
+	token, code, err := a.GenerateLink(ctx, email)
+	if err != nil {
+		t.Fatalf("failed to generate link: %v", err)
+	}
+	if _, err := a.ValidateToken(ctx, token); err != nil {
+		t.Fatalf("failed to validate token: %v", err)
+	}
+	if _, err := a.ValidateCode(ctx, email, code); !errors.Is(err, domain.ErrMagicLinkCodeInvalid) {
+		t.Errorf("expected the code of a used link to be rejected, got %v", err)
+	}
+
+	token, code, err = a.GenerateLink(ctx, email)
+	if err != nil {
+		t.Fatalf("failed to generate link: %v", err)
+	}
+	if _, err := a.ValidateCode(ctx, email, code); err != nil {
+		t.Fatalf("failed to validate code: %v", err)
+	}
+	if _, err := a.ValidateToken(ctx, token); !errors.Is(err, domain.ErrMagicLinkUsed) {
+		t.Errorf("expected the link of a used code to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+const (
+	oidcKeysTTL = time.Hour
+	// oidcKeysMinRefresh bounds how often an unknown kid may trigger a JWKS
+	// download, so forged tokens cannot hammer the provider.
+	oidcKeysMinRefresh = time.Minute
+)
+
+// OIDCProviderConfig describes one OpenID Connect identity provider.
+type OIDCProviderConfig struct {
+	Name     string
+	Issuer   string
+	ClientID string
+	// AllowedEmailDomains restricts sign-in to these domains when not empty.
+	AllowedEmailDomains []string
+}
+
+// OIDCAuthenticator validates ID tokens of any OpenID Connect provider using
+// its discovery document and JWKS.
+type OIDCAuthenticator struct {
+	config     OIDCProviderConfig
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu        sync.Mutex
+	jwksURI   string
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	// refreshing is closed when the JWKS download in progress ends.
+	refreshing chan struct{}
+}
+
+func NewOIDCAuthenticator(config OIDCProviderConfig) *OIDCAuthenticator {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	for i, d := range config.AllowedEmailDomains {
+		config.AllowedEmailDomains[i] = strings.ToLower(strings.TrimSpace(d))
+	}
+	return &OIDCAuthenticator{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+}
+
+func (a *OIDCAuthenticator) Authenticate(ctx context.Context, token string) (*domain.UserInfo, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}))
+	parsed, err := parser.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s token: %w", a.config.Name, err)
+	}
+
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || !parsed.Valid {
+		return nil, errors.New("invalid token claims")
+	}
+	if !claims.VerifyIssuer(a.config.Issuer, true) && !claims.VerifyIssuer(a.config.Issuer+"/", true) {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if !claims.VerifyAudience(a.config.ClientID, true) {
+		return nil, errors.New("unexpected token audience")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("token has no expiry")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("subject not found in token")
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil, errors.New("email not found in token")
+	}
+	// Apple sends email_verified as a string.
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		ok = verified
+	case string:
+		ok = verified == "true"
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, errors.New("email not verified by provider")
+	}
+	if len(a.config.AllowedEmailDomains) > 0 {
+		domainPart := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+		if !slices.Contains(a.config.AllowedEmailDomains, domainPart) {
+			return nil, fmt.Errorf("email domain %s is not allowed", domainPart)
+		}
+	}
+
+	return &domain.UserInfo{Email: email, Provider: "oidc:" + a.config.Name, Subject: subject, AuthMethod: domain.AuthMethodOIDC}, nil
+}
+
+// key returns the verification key for kid, downloading the JWKS when it is
+// stale or does not know kid yet (providers rotate keys without notice). The
+// download runs without the lock, so that a slow provider only holds up the
+// tokens that need it, which wait for the download in progress.
+func (a *OIDCAuthenticator) key(ctx context.Context, kid string) (interface{}, error) {
+	a.mu.Lock()
+	for {
+		key, ok := a.keys[kid]
+		stale := a.now().Sub(a.fetchedAt) > oidcKeysTTL
+		if ok && (!stale || a.refreshing != nil) {
+			a.mu.Unlock()
+			return key, nil
+		}
+		if a.refreshing == nil {
+			break
+		}
+		refreshing := a.refreshing
+		a.mu.Unlock()
+		select {
+		case <-refreshing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		a.mu.Lock()
+	}
+
+	now := a.now()
+	key, ok := a.keys[kid]
+	if now.Sub(a.fetchedAt) <= oidcKeysTTL && now.Sub(a.fetchedAt) < oidcKeysMinRefresh {
+		a.mu.Unlock()
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	a.fetchedAt = now
+	refreshing := make(chan struct{})
+	a.refreshing = refreshing
+	jwksURI := a.jwksURI
+	a.mu.Unlock()
+
+	jwksURI, keys, err := a.fetchKeys(ctx, jwksURI)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.refreshing = nil
+	close(refreshing)
+	if err != nil {
+		// Keep serving the cached key while the provider is unreachable.
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	a.jwksURI, a.keys = jwksURI, keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetchKeys downloads the JWKS, discovering its URI first when jwksURI is
+// empty.
+func (a *OIDCAuthenticator) fetchKeys(ctx context.Context, jwksURI string) (string, map[string]interface{}, error) {
+	if jwksURI == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(ctx, a.config.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return "", nil, fmt.Errorf("failed to discover %s: %w", a.config.Name, err)
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != a.config.Issuer || discovery.JWKSURI == "" {
+			return "", nil, fmt.Errorf("invalid discovery document for %s", a.config.Name)
+		}
+		jwksURI = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(ctx, jwksURI, &jwks); err != nil {
+		return "", nil, fmt.Errorf("failed to get %s signing keys: %w", a.config.Name, err)
+	}
+
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return jwksURI, keys, nil
+}
+
+func (a *OIDCAuthenticator) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
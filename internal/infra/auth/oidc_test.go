@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// fakeOIDCProvider serves a discovery document and a JWKS like a real
+// provider would.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	mu        sync.Mutex
+	keys      map[string]*rsa.PrivateKey
+	jwksCalls int
+	// hold, when set, makes the JWKS downloads wait until it is closed.
+	hold chan struct{}
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	p := &fakeOIDCProvider{keys: make(map[string]*rsa.PrivateKey)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   p.URL,
+			"jwks_uri": p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		hold := p.hold
+		p.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.jwksCalls++
+		var keys []map[string]string
+		for kid, key := range p.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	p.addKey(t, "key-1")
+	return p
+}
+
+func (p *fakeOIDCProvider) addKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[kid] = key
+}
+
+func (p *fakeOIDCProvider) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	p.mu.Lock()
+	key := p.keys[kid]
+	p.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	provider := newFakeOIDCProvider(t)
+	a := NewOIDCAuthenticator(OIDCProviderConfig{
+		Name:                "keycloak",
+		Issuer:              provider.URL,
+		ClientID:            "photocloud",
+		AllowedEmailDomains: []string{"Example.com"},
+	})
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            provider.URL,
+			"aud":            "photocloud",
+			"sub":            "user-1",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	userInfo, err := a.Authenticate(ctx, provider.sign(t, "key-1", validClaims()))
+	if err != nil {
+		t.Fatalf("expected valid token to be accepted: %v", err)
+	}
+	if userInfo.Email != "user@example.com" || userInfo.Provider != "oidc:keycloak" || userInfo.Subject != "user-1" {
+		t.Errorf("unexpected user info %+v", userInfo)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(jwt.MapClaims)
+	}{
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "other-app" }},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+		{"unverified email", func(c jwt.MapClaims) { c["email_verified"] = false }},
+		{"missing email_verified", func(c jwt.MapClaims) { delete(c, "email_verified") }},
+		{"domain not allowed", func(c jwt.MapClaims) { c["email"] = "user@other.com" }},
+	}
+	for _, tt := range tests {
+		claims := validClaims()
+		tt.mutate(claims)
+		if _, err := a.Authenticate(ctx, provider.sign(t, "key-1", claims)); err == nil {
+			t.Errorf("%s: expected token to be rejected", tt.name)
+		}
+	}
+
+	claims := validClaims()
+	claims["email_verified"] = "true"
+	if _, err := a.Authenticate(ctx, provider.sign(t, "key-1", claims)); err != nil {
+		t.Errorf("expected string email_verified to be accepted: %v", err)
+	}
+}
+
+func TestOIDCAuthenticator_KeyRotation(t *testing.T) {
+	ctx := context.Background()
+	provider := newFakeOIDCProvider(t)
+	now := time.Now()
+	a := NewOIDCAuthenticator(OIDCProviderConfig{Name: "keycloak", Issuer: provider.URL, ClientID: "photocloud"})
+	a.now = func() time.Time { return now }
+
+	claims := jwt.MapClaims{
+		"iss":            provider.URL,
+		"aud":            "photocloud",
+		"sub":            "user-1",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	if _, err := a.Authenticate(ctx, provider.sign(t, "key-1", claims)); err != nil {
+		t.Fatalf("expected valid token to be accepted: %v", err)
+	}
+
+	provider.addKey(t, "key-2")
+	rotated := provider.sign(t, "key-2", claims)
+	if _, err := a.Authenticate(ctx, rotated); err == nil {
+		t.Error("expected unknown key to be rejected until the refresh delay has passed")
+	}
+
+	now = now.Add(oidcKeysMinRefresh + time.Second)
+	if _, err := a.Authenticate(ctx, rotated); err != nil {
+		t.Errorf("expected rotated key to be fetched: %v", err)
+	}
+	if provider.jwksCalls != 2 {
+		t.Errorf("expected 2 JWKS downloads, got %d", provider.jwksCalls)
+	}
+}
+
+func TestOIDCAuthenticator_SlowProvider(t *testing.T) {
+	ctx := context.Background()
+	provider := newFakeOIDCProvider(t)
+	var mu sync.Mutex
+	now := time.Now()
+	a := NewOIDCAuthenticator(OIDCProviderConfig{Name: "keycloak", Issuer: provider.URL, ClientID: "photocloud"})
+	a.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            provider.URL,
+		"aud":            "photocloud",
+		"sub":            "user-1",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	known := provider.sign(t, "key-1", claims)
+	if _, err := a.Authenticate(ctx, known); err != nil {
+		t.Fatalf("expected valid token to be accepted: %v", err)
+	}
+
+	// A token with a new key starts a download that hangs.
+	provider.addKey(t, "key-2")
+	hold := make(chan struct{})
+	provider.mu.Lock()
+	provider.hold = hold
+	provider.mu.Unlock()
+	mu.Lock()
+	now = now.Add(oidcKeysMinRefresh + time.Second)
+	mu.Unlock()
+	token := provider.sign(t, "key-2", claims)
+	rotated := make(chan error)
+	go func() {
+		_, err := a.Authenticate(ctx, token)
+		rotated <- err
+	}()
+	for {
+		a.mu.Lock()
+		refreshing := a.refreshing != nil
+		a.mu.Unlock()
+		if refreshing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := a.Authenticate(ctx, known); err != nil {
+		t.Errorf("expected a known key to be served during the download: %v", err)
+	}
+	close(hold)
+	if err := <-rotated; err != nil {
+		t.Errorf("expected rotated key to be fetched: %v", err)
+	}
+}
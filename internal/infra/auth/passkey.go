@@ -1,8 +1,13 @@
 package auth
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -12,9 +17,10 @@ import (
 type PasskeyAuthenticator struct {
 	webAuthn *webauthn.WebAuthn
 	storage  domain.UserStorage
+	handles  domain.UserHandleStorage
 }
 
-func NewPasskeyAuthenticator(storage domain.UserStorage, config *webauthn.Config) (*PasskeyAuthenticator, error) {
+func NewPasskeyAuthenticator(storage domain.UserStorage, handles domain.UserHandleStorage, config *webauthn.Config) (*PasskeyAuthenticator, error) {
 	w, err := webauthn.New(config)
 	if err != nil {
 		return nil, err
@@ -22,25 +28,42 @@ func NewPasskeyAuthenticator(storage domain.UserStorage, config *webauthn.Config
 	return &PasskeyAuthenticator{
 		webAuthn: w,
 		storage:  storage,
+		handles:  handles,
 	}, nil
 }
 
-func (a *PasskeyAuthenticator) BeginRegistration(ctx context.Context, email string) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
-	user, err := a.storage.GetUser(ctx, email)
-	if err != nil {
-		user = &domain.PasskeyUserEntity{Email: email}
+// BeginRegistration attaches a new passkey to an account. The caller must have
+// verified the identity first: an existing session or a fresh magic link.
+func (a *PasskeyAuthenticator) BeginRegistration(ctx context.Context, userInfo *domain.UserInfo) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	user, err := a.storage.GetUser(ctx, userInfo.UserID)
+	if errors.Is(err, domain.ErrUserNotFound) {
+		// New accounts get an opaque user handle so that neither the email
+		// nor the account ID is stored on the authenticator.
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate user handle: %w", err)
+		}
+		user = &domain.PasskeyUserEntity{UserID: userInfo.UserID, Email: userInfo.Email, UserHandle: handle}
+	} else if err != nil {
+		return nil, nil, err
 	}
 
-	return a.webAuthn.BeginRegistration(&webauthnUserWrapper{user})
+	wrapper := &webauthnUserWrapper{PasskeyUser: user}
+	return a.webAuthn.BeginRegistration(wrapper,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithExclusions(webauthn.Credentials(wrapper.WebAuthnCredentials()).CredentialDescriptors()),
+	)
 }
 
-func (a *PasskeyAuthenticator) FinishRegistration(ctx context.Context, email string, sessionData webauthn.SessionData, response *http.Request) error {
-	user, err := a.storage.GetUser(ctx, email)
-	if err != nil {
-		user = &domain.PasskeyUserEntity{Email: email}
+func (a *PasskeyAuthenticator) FinishRegistration(ctx context.Context, userInfo *domain.UserInfo, nickname string, sessionData webauthn.SessionData, response *http.Request) error {
+	user, err := a.storage.GetUser(ctx, userInfo.UserID)
+	if errors.Is(err, domain.ErrUserNotFound) {
+		user = &domain.PasskeyUserEntity{UserID: userInfo.UserID, Email: userInfo.Email, UserHandle: sessionData.UserID}
+	} else if err != nil {
+		return err
 	}
 
-	credential, err := a.webAuthn.FinishRegistration(&webauthnUserWrapper{user}, sessionData, response)
+	credential, err := a.webAuthn.FinishRegistration(&webauthnUserWrapper{PasskeyUser: user}, sessionData, response)
 	if err != nil {
 		return err
 	}
@@ -51,32 +74,122 @@ func (a *PasskeyAuthenticator) FinishRegistration(ctx context.Context, email str
 		PublicKey:       credential.PublicKey,
 		AttestationType: credential.AttestationType,
 		Transport:       convertFromWebAuthnTransport(credential.Transport),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Flags:           convertFromWebAuthnFlags(credential.Flags),
+		Nickname:        nickname,
+		CreatedAt:       time.Now(),
 	})
 
-	return a.storage.SaveUser(ctx, email, pUser)
+	if len(pUser.UserHandle) > 0 {
+		if err := a.handles.SaveUserHandle(ctx, pUser.UserHandle, userInfo.UserID); err != nil {
+			return err
+		}
+	}
+	return a.storage.SaveUser(ctx, userInfo.UserID, pUser)
 }
 
-func (a *PasskeyAuthenticator) BeginLogin(ctx context.Context, email string) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
-	user, err := a.storage.GetUser(ctx, email)
+func (a *PasskeyAuthenticator) BeginLogin(ctx context.Context, userID string) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	user, err := a.storage.GetUser(ctx, userID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return a.webAuthn.BeginLogin(&webauthnUserWrapper{user})
+	return a.webAuthn.BeginLogin(&webauthnUserWrapper{PasskeyUser: user})
 }
 
-func (a *PasskeyAuthenticator) FinishLogin(ctx context.Context, email string, sessionData webauthn.SessionData, response *http.Request) (*domain.UserInfo, error) {
-	user, err := a.storage.GetUser(ctx, email)
+func (a *PasskeyAuthenticator) FinishLogin(ctx context.Context, userID string, sessionData webauthn.SessionData, response *http.Request) (*domain.UserInfo, error) {
+	user, err := a.storage.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponse(response)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = a.webAuthn.FinishLogin(&webauthnUserWrapper{user}, sessionData, response)
+	credential, err := a.webAuthn.ValidateLogin(&webauthnUserWrapper{user, parsedResponse}, sessionData, parsedResponse)
 	if err != nil {
 		return nil, err
 	}
 
-	return &domain.UserInfo{Email: email}, nil
+	if err := a.recordLogin(ctx, userID, user, credential); err != nil {
+		return nil, err
+	}
+	return &domain.UserInfo{UserID: userID, Email: user.WebAuthnName(), AuthMethod: domain.AuthMethodPasskey}, nil
+}
+
+// BeginDiscoverableLogin starts a usernameless login: the browser offers the
+// resident keys it holds for this relying party.
+func (a *PasskeyAuthenticator) BeginDiscoverableLogin(ctx context.Context) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return a.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationPreferred))
+}
+
+func (a *PasskeyAuthenticator) FinishDiscoverableLogin(ctx context.Context, sessionData webauthn.SessionData, response *http.Request) (*domain.UserInfo, error) {
+	parsedResponse, err := protocol.ParseCredentialRequestResponse(response)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		userID string
+		user   domain.PasskeyUser
+	)
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		var err error
+		if userID, err = a.userIDForUserHandle(ctx, userHandle); err != nil {
+			return nil, err
+		}
+		if user, err = a.storage.GetUser(ctx, userID); err != nil {
+			return nil, err
+		}
+		return &webauthnUserWrapper{user, parsedResponse}, nil
+	}
+
+	_, credential, err := a.webAuthn.ValidatePasskeyLogin(handler, sessionData, parsedResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.recordLogin(ctx, userID, user, credential); err != nil {
+		return nil, err
+	}
+	return &domain.UserInfo{UserID: userID, Email: user.WebAuthnName(), AuthMethod: domain.AuthMethodPasskey}, nil
+}
+
+// userIDForUserHandle resolves the account of a discoverable credential.
+// Passkeys registered before opaque handles were introduced carry the email,
+// which is also the ID of those accounts; the library still checks that it
+// matches the stored user's WebAuthn ID.
+func (a *PasskeyAuthenticator) userIDForUserHandle(ctx context.Context, userHandle []byte) (string, error) {
+	userID, err := a.handles.GetUserIDByUserHandle(ctx, userHandle)
+	if errors.Is(err, domain.ErrUserNotFound) && bytes.ContainsRune(userHandle, '@') {
+		return string(userHandle), nil
+	}
+	return userID, err
+}
+
+// recordLogin stores the sign counter and flags returned by the authenticator,
+// and refuses the login when the counter shows the credential was cloned.
+func (a *PasskeyAuthenticator) recordLogin(ctx context.Context, userID string, user domain.PasskeyUser, credential *webauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		return domain.ErrPasskeyCloned
+	}
+	pUser, ok := user.(*domain.PasskeyUserEntity)
+	if !ok {
+		return nil
+	}
+	for _, c := range pUser.Credentials {
+		if bytes.Equal(c.ID, credential.ID) {
+			c.SignCount = credential.Authenticator.SignCount
+			c.Flags = convertFromWebAuthnFlags(credential.Flags)
+			c.LastUsedAt = time.Now()
+			pUser.UpdateCredential(c)
+			return a.storage.SaveUser(ctx, userID, pUser)
+		}
+	}
+	return nil
 }
 
 func convertFromWebAuthnTransport(t []protocol.AuthenticatorTransport) []string {
@@ -87,8 +200,19 @@ func convertFromWebAuthnTransport(t []protocol.AuthenticatorTransport) []string
 	return res
 }
 
+func convertFromWebAuthnFlags(f webauthn.CredentialFlags) *domain.PasskeyCredentialFlags {
+	return &domain.PasskeyCredentialFlags{
+		UserPresent:    f.UserPresent,
+		UserVerified:   f.UserVerified,
+		BackupEligible: f.BackupEligible,
+		BackupState:    f.BackupState,
+	}
+}
+
 type webauthnUserWrapper struct {
 	domain.PasskeyUser
+	// assertion is the login response being validated, if any.
+	assertion *protocol.ParsedCredentialAssertionData
 }
 
 func (w *webauthnUserWrapper) WebAuthnCredentials() []webauthn.Credential {
@@ -100,12 +224,27 @@ func (w *webauthnUserWrapper) WebAuthnCredentials() []webauthn.Credential {
 			PublicKey:       c.PublicKey,
 			AttestationType: c.AttestationType,
 			Transport:       convertToWebAuthnTransport(c.Transport),
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		}
+		if c.Flags != nil {
+			res[i].Flags = webauthn.CredentialFlags{
+				UserPresent:    c.Flags.UserPresent,
+				UserVerified:   c.Flags.UserVerified,
+				BackupEligible: c.Flags.BackupEligible,
+				BackupState:    c.Flags.BackupState,
+			}
+		} else if w.assertion != nil {
+			// The backup eligibility of older credentials was never stored:
+			// trust the first value reported and record it afterwards.
+			res[i].Flags.BackupEligible = w.assertion.Response.AuthenticatorData.Flags.HasBackupEligible()
 		}
 	}
 	return res
 }
 
-
 func convertToWebAuthnTransport(t []string) []protocol.AuthenticatorTransport {
 	res := make([]protocol.AuthenticatorTransport, len(t))
 	for i, v := range t {
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockUserStorage struct {
+	users   map[string]domain.PasskeyUser
+	handles map[string]string
+}
+
+func newMockUserStorage() *mockUserStorage {
+	return &mockUserStorage{users: map[string]domain.PasskeyUser{}, handles: map[string]string{}}
+}
+
+func (m *mockUserStorage) GetUser(ctx context.Context, userID string) (domain.PasskeyUser, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, domain.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (m *mockUserStorage) SaveUser(ctx context.Context, userID string, user domain.PasskeyUser) error {
+	m.users[userID] = user
+	return nil
+}
+
+func (m *mockUserStorage) GetUserKeys(ctx context.Context, userID string) (domain.UserKeys, error) {
+	return nil, domain.ErrUserKeyNotFound
+}
+
+func (m *mockUserStorage) SaveUserKeys(ctx context.Context, userID string, keys domain.UserKeys) error {
+	return nil
+}
+
+func (m *mockUserStorage) GetUserIDByUserHandle(ctx context.Context, handle []byte) (string, error) {
+	userID, ok := m.handles[string(handle)]
+	if !ok {
+		return "", domain.ErrUserNotFound
+	}
+	return userID, nil
+}
+
+func (m *mockUserStorage) SaveUserHandle(ctx context.Context, handle []byte, userID string) error {
+	m.handles[string(handle)] = userID
+	return nil
+}
+
+func newTestPasskeyAuthenticator(t *testing.T, storage *mockUserStorage) *PasskeyAuthenticator {
+	t.Helper()
+	a, err := NewPasskeyAuthenticator(storage, storage, &webauthn.Config{
+		RPDisplayName: "Photo Cloud",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:8081"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestPasskeyAuthenticator_BeginRegistrationUserHandle(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockUserStorage()
+	storage.users["legacy@example.com"] = &domain.PasskeyUserEntity{
+		UserID:      "legacy@example.com",
+		Email:       "legacy@example.com",
+		Credentials: []domain.PasskeyCredential{{ID: []byte("credential")}},
+	}
+	a := newTestPasskeyAuthenticator(t, storage)
+
+	_, session, err := a.BeginRegistration(ctx, &domain.UserInfo{UserID: "3f2a9c", Email: "new@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(session.UserID) != 32 || bytes.Contains(session.UserID, []byte("new@example.com")) || bytes.Contains(session.UserID, []byte("3f2a9c")) {
+		t.Errorf("expected an opaque user handle for a new account, got %q", session.UserID)
+	}
+
+	options, session, err := a.BeginRegistration(ctx, &domain.UserInfo{UserID: "legacy@example.com", Email: "legacy@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(session.UserID) != "legacy@example.com" {
+		t.Errorf("expected legacy account to keep its email handle, got %q", session.UserID)
+	}
+	if len(options.Response.CredentialExcludeList) != 1 {
+		t.Errorf("expected existing credential to be excluded, got %d", len(options.Response.CredentialExcludeList))
+	}
+}
+
+func TestPasskeyAuthenticator_UserIDForUserHandle(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockUserStorage()
+	storage.handles["opaque-handle"] = "3f2a9c"
+	a := newTestPasskeyAuthenticator(t, storage)
+
+	tests := []struct {
+		handle         []byte
+		expectedUserID string
+		expectErr      bool
+	}{
+		{[]byte("opaque-handle"), "3f2a9c", false},
+		{[]byte("legacy@example.com"), "legacy@example.com", false},
+		{[]byte("unknown-handle"), "", true},
+	}
+	for _, tt := range tests {
+		userID, err := a.userIDForUserHandle(ctx, tt.handle)
+		if (err != nil) != tt.expectErr {
+			t.Errorf("%q: unexpected error: %v", tt.handle, err)
+		}
+		if userID != tt.expectedUserID {
+			t.Errorf("%q: expected user ID %q, got %q", tt.handle, tt.expectedUserID, userID)
+		}
+	}
+}
+
+func TestPasskeyAuthenticator_RecordLogin(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockUserStorage()
+	user := &domain.PasskeyUserEntity{
+		UserID:      "3f2a9c",
+		Email:       "user@example.com",
+		Credentials: []domain.PasskeyCredential{{ID: []byte("credential"), SignCount: 5, Nickname: "Phone"}},
+	}
+	a := newTestPasskeyAuthenticator(t, storage)
+
+	cloned := &webauthn.Credential{ID: []byte("credential"), Authenticator: webauthn.Authenticator{SignCount: 5, CloneWarning: true}}
+	if err := a.recordLogin(ctx, user.UserID, user, cloned); !errors.Is(err, domain.ErrPasskeyCloned) {
+		t.Fatalf("expected ErrPasskeyCloned, got %v", err)
+	}
+
+	used := &webauthn.Credential{
+		ID:            []byte("credential"),
+		Flags:         webauthn.CredentialFlags{BackupEligible: true, BackupState: true},
+		Authenticator: webauthn.Authenticator{SignCount: 6},
+	}
+	if err := a.recordLogin(ctx, user.UserID, user, used); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	saved := storage.users[user.UserID].GetCredentials()[0]
+	if saved.SignCount != 6 || saved.Flags == nil || !saved.Flags.BackupState || saved.LastUsedAt.IsZero() {
+		t.Errorf("expected sign count, flags and last use to be recorded, got %+v", saved)
+	}
+	if saved.Nickname != "Phone" {
+		t.Errorf("expected nickname to be kept, got %q", saved.Nickname)
+	}
+}
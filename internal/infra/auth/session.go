@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+const (
+	sessionAudience  = "photocloud-session"
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+	// tokenTypeChallenge is held between the first and the second factor.
+	tokenTypeChallenge  = "second-factor"
+	defaultAccessTTL    = 15 * time.Minute
+	defaultChallengeTTL = 5 * time.Minute
+)
+
+type SessionTokenIssuer struct {
+	secret    []byte
+	issuer    string
+	accessTTL time.Duration
+}
+
+func NewSessionTokenIssuer(secret string, issuer string) *SessionTokenIssuer {
+	return &SessionTokenIssuer{
+		secret:    []byte(secret),
+		issuer:    issuer,
+		accessTTL: defaultAccessTTL,
+	}
+}
+
+type sessionClaims struct {
+	UserID    string `json:"uid"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`
+	TokenType string `json:"typ"`
+	// AuthMethod is only set in challenge tokens, where no session exists yet
+	// to record it.
+	AuthMethod string `json:"amr,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IssueTokens signs a short-lived access token and a refresh token bound to the
+// session's current refresh token ID. The refresh token lives as long as the session.
+func (a *SessionTokenIssuer) IssueTokens(ctx context.Context, user *domain.UserInfo, session *domain.Session) (*domain.SessionTokens, error) {
+	now := time.Now()
+	accessExpiresAt := now.Add(a.accessTTL)
+
+	accessToken, err := a.sign(user, session.ID, "", tokenTypeAccess, now, accessExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign access token: %w", err)
+	}
+	refreshToken, err := a.sign(user, session.ID, session.RefreshTokenID, tokenTypeRefresh, now, session.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign refresh token: %w", err)
+	}
+
+	return &domain.SessionTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    accessExpiresAt,
+	}, nil
+}
+
+func (a *SessionTokenIssuer) ValidateAccessToken(ctx context.Context, token string) (*domain.UserInfo, error) {
+	claims, err := a.validate(token, tokenTypeAccess)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.UserInfo{UserID: claims.UserID, Email: claims.Email, SessionID: claims.SessionID, Scope: domain.CredentialScope(claims.Scope)}, nil
+}
+
+func (a *SessionTokenIssuer) ValidateRefreshToken(ctx context.Context, token string) (*domain.RefreshTokenClaims, error) {
+	claims, err := a.validate(token, tokenTypeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return nil, errors.New("token id not found in refresh token")
+	}
+	return &domain.RefreshTokenClaims{
+		User:    &domain.UserInfo{UserID: claims.UserID, Email: claims.Email, SessionID: claims.SessionID, Scope: domain.CredentialScope(claims.Scope)},
+		TokenID: claims.ID,
+	}, nil
+}
+
+// IssueChallengeToken signs the token exchanged for a session once the second
+// factor is verified.
+func (a *SessionTokenIssuer) IssueChallengeToken(ctx context.Context, user *domain.UserInfo) (string, error) {
+	now := time.Now()
+	token, err := a.sign(user, "", "", tokenTypeChallenge, now, now.Add(defaultChallengeTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign challenge token: %w", err)
+	}
+	return token, nil
+}
+
+func (a *SessionTokenIssuer) ValidateChallengeToken(ctx context.Context, token string) (*domain.UserInfo, error) {
+	claims, err := a.validate(token, tokenTypeChallenge)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.UserInfo{UserID: claims.UserID, Email: claims.Email, AuthMethod: claims.AuthMethod, Scope: domain.CredentialScope(claims.Scope)}, nil
+}
+
+func (a *SessionTokenIssuer) sign(user *domain.UserInfo, sessionID string, tokenID string, tokenType string, issuedAt time.Time, expiresAt time.Time) (string, error) {
+	claims := sessionClaims{
+		user.UserID,
+		user.Email,
+		sessionID,
+		tokenType,
+		"",
+		string(user.Scope),
+		jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   user.UserID,
+			Audience:  jwt.ClaimStrings{sessionAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			Issuer:    a.issuer,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+		},
+	}
+
+	if tokenType == tokenTypeChallenge {
+		claims.AuthMethod = user.AuthMethod
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(a.secret)
+}
+
+func (a *SessionTokenIssuer) validate(tokenString string, tokenType string) (*sessionClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &sessionClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return a.secret, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid session token: %w", err)
+	}
+
+	claims, ok := token.Claims.(*sessionClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid session token claims")
+	}
+	// Magic link tokens share the signing secret, so the audience and type
+	// are what keeps them from being replayed as session tokens.
+	if !claims.VerifyAudience(sessionAudience, true) || !claims.VerifyIssuer(a.issuer, true) {
+		return nil, errors.New("session token not issued for this api")
+	}
+	if claims.TokenType != tokenType {
+		return nil, fmt.Errorf("expected %s token, got %q", tokenType, claims.TokenType)
+	}
+	if claims.Email == "" || (claims.SessionID == "" && tokenType != tokenTypeChallenge) {
+		return nil, errors.New("email or session not found in session token")
+	}
+	// Tokens issued before account IDs existed belong to legacy accounts,
+	// whose ID is their email.
+	if claims.UserID == "" {
+		claims.UserID = claims.Email
+	}
+
+	return claims, nil
+}
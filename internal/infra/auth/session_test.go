@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+func TestSessionTokenIssuer(t *testing.T) {
+	ctx := context.Background()
+	a := NewSessionTokenIssuer("test-secret", "test-issuer")
+	user := &domain.UserInfo{Email: "user@example.com"}
+	session := &domain.Session{ID: "session-1", RefreshTokenID: "token-1", ExpiresAt: time.Now().Add(time.Hour)}
+
+	tokens, err := a.IssueTokens(ctx, user, session)
+	if err != nil {
+		t.Fatalf("failed to issue tokens: %v", err)
+	}
+
+	userInfo, err := a.ValidateAccessToken(ctx, tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("failed to validate access token: %v", err)
+	}
+	if userInfo.Email != user.Email || userInfo.SessionID != session.ID {
+		t.Errorf("expected %s/%s, got %s/%s", user.Email, session.ID, userInfo.Email, userInfo.SessionID)
+	}
+
+	claims, err := a.ValidateRefreshToken(ctx, tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed to validate refresh token: %v", err)
+	}
+	if claims.TokenID != session.RefreshTokenID {
+		t.Errorf("expected token id %s, got %s", session.RefreshTokenID, claims.TokenID)
+	}
+	if _, err := a.ValidateAccessToken(ctx, tokens.RefreshToken); err == nil {
+		t.Error("expected refresh token to be rejected as access token")
+	}
+	if _, err := NewSessionTokenIssuer("other-secret", "test-issuer").ValidateAccessToken(ctx, tokens.AccessToken); err == nil {
+		t.Error("expected token signed with another secret to be rejected")
+	}
+}
+
+func TestSessionTokenIssuer_RejectsMagicLinkToken(t *testing.T) {
+	ctx := context.Background()
+	magicLink := NewMagicLinkAuthenticator("test-secret", "test-issuer", &mockMagicLinkStorage{})
+	token, err := magicLink.GenerateToken(ctx, "user@example.com")
+	if err != nil {
+		t.Fatalf("failed to generate magic link token: %v", err)
+	}
+
+	a := NewSessionTokenIssuer("test-secret", "test-issuer")
+	if _, err := a.ValidateAccessToken(ctx, token); err == nil {
+		t.Error("expected magic link token to be rejected as access token")
+	}
+}
+
+func TestSessionTokenIssuer_ChallengeToken(t *testing.T) {
+	ctx := context.Background()
+	a := NewSessionTokenIssuer("test-secret", "test-issuer")
+	user := &domain.UserInfo{UserID: "account-1", Email: "user@example.com", AuthMethod: domain.AuthMethodGoogle, Scope: domain.CredentialScopeRead}
+
+	token, err := a.IssueChallengeToken(ctx, user)
+	if err != nil {
+		t.Fatalf("failed to issue challenge token: %v", err)
+	}
+	userInfo, err := a.ValidateChallengeToken(ctx, token)
+	if err != nil {
+		t.Fatalf("failed to validate challenge token: %v", err)
+	}
+	if userInfo.UserID != user.UserID || userInfo.AuthMethod != user.AuthMethod || userInfo.Scope != user.Scope {
+		t.Errorf("expected %s/%s/%s, got %s/%s/%s", user.UserID, user.AuthMethod, user.Scope, userInfo.UserID, userInfo.AuthMethod, userInfo.Scope)
+	}
+	if _, err := a.ValidateAccessToken(ctx, token); err == nil {
+		t.Error("expected challenge token to be rejected as access token")
+	}
+}
+
+func TestMagicLinkAuthenticator_RejectsSessionTokens(t *testing.T) {
+	ctx := context.Background()
+	a := NewSessionTokenIssuer("test-secret", "test-issuer")
+	user := &domain.UserInfo{UserID: "account-1", Email: "user@example.com"}
+	session := &domain.Session{ID: "session-1", RefreshTokenID: "token-1", ExpiresAt: time.Now().Add(time.Hour)}
+	tokens, err := a.IssueTokens(ctx, user, session)
+	if err != nil {
+		t.Fatalf("failed to issue tokens: %v", err)
+	}
+
+	storage := &mockMagicLinkStorage{}
+	magicLink := NewMagicLinkAuthenticator("test-secret", "test-issuer", storage)
+	if _, err := magicLink.ValidateToken(ctx, tokens.RefreshToken); err == nil {
+		t.Error("expected refresh token to be rejected as magic link")
+	}
+	if _, err := magicLink.ValidateToken(ctx, tokens.AccessToken); err == nil {
+		t.Error("expected access token to be rejected as magic link")
+	}
+	// A rejected token must not burn a nonce marker for its jti.
+	if len(storage.used) != 0 {
+		t.Errorf("expected no nonce to be consumed, got %v", storage.used)
+	}
+}
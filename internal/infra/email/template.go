@@ -1,12 +1,29 @@
 package email
 
-const MagicLinkEmailTemplate = `
+const MagicLinkEmailTemplate = emailHeader + `            <p>Bonjour,<br><br>Cliquez sur le bouton ci-dessous pour vous connecter à votre compte Photo Cloud. Ce lien expirera dans 15 minutes.</p>
+            <a href="%s" class="button">Se connecter</a>
+            <p style="margin-top: 30px;">Si le lien s'ouvre dans le mauvais navigateur, saisissez ce code dans l'application. Il est valable 15 minutes :<br>
+            <span class="code">%s</span></p>
+            <p style="margin-top: 30px; font-size: 14px; color: #666;">Si le bouton ne fonctionne pas, vous pouvez copier et coller ce lien dans votre navigateur :<br>
+            <span style="word-break: break-all; color: #6200ee;">%s</span></p>
+` + emailFooter
+
+// EmailChangeEmailTemplate confirms that the user owns the new address of
+// their account.
+const EmailChangeEmailTemplate = emailHeader + `            <p>Bonjour,<br><br>Cliquez sur le bouton ci-dessous pour utiliser cette adresse avec votre compte Photo Cloud. Ce lien expirera dans 15 minutes.</p>
+            <a href="%s" class="button">Confirmer l'adresse</a>
+            <p style="margin-top: 30px;">Vous pouvez aussi saisir ce code dans l'application. Il est valable 15 minutes :<br>
+            <span class="code">%s</span></p>
+            <p style="margin-top: 30px; font-size: 14px; color: #666;">Si vous n'avez pas demandé ce changement, ignorez cet email : votre compte reste inchangé.</p>
+` + emailFooter
+
+const emailHeader = `
 <!DOCTYPE html>
 <html lang="fr">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Connexion Photo Cloud</title>
+    <title>Photo Cloud</title>
     <style>
         body {
             font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif;
@@ -53,6 +70,13 @@ const MagicLinkEmailTemplate = `
             font-weight: bold;
             font-size: 16px;
         }
+        .code {
+            display: inline-block;
+            font-family: "SFMono-Regular", Consolas, monospace;
+            font-size: 28px;
+            letter-spacing: 6px;
+            color: #6200ee;
+        }
         .footer {
             padding: 20px;
             text-align: center;
@@ -68,11 +92,9 @@ const MagicLinkEmailTemplate = `
             <h1>Photo Cloud</h1>
         </div>
         <div class="content">
-            <p>Bonjour,<br><br>Cliquez sur le bouton ci-dessous pour vous connecter à votre compte Photo Cloud. Ce lien expirera dans 15 minutes.</p>
-            <a href="%s" class="button">Se connecter</a>
-            <p style="margin-top: 30px; font-size: 14px; color: #666;">Si le bouton ne fonctionne pas, vous pouvez copier et coller ce lien dans votre navigateur :<br>
-            <span style="word-break: break-all; color: #6200ee;">%s</span></p>
-        </div>
+`
+
+const emailFooter = `        </div>
         <div class="footer">
             &copy; 2024 Photo Cloud. Votre galerie privée à petit prix.
         </div>
@@ -0,0 +1,221 @@
+package keyenc
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// vaultStandIn serves the encrypt and decrypt endpoints of a transit engine
+// mounted at transit, with a single key.
+type vaultStandIn struct {
+	token string
+	key   string
+	aead  cipher.AEAD
+}
+
+func newVaultStandIn(t *testing.T) *httptest.Server {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	block, _ := aes.NewCipher(secret)
+	aead, _ := cipher.NewGCM(block)
+	server := httptest.NewServer(&vaultStandIn{token: "vault-token", key: "photocloud", aead: aead})
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (v *vaultStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+	}
+	if r.Header.Get("X-Vault-Token") != v.token {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/" + v.key:
+		plaintext, err := base64.StdEncoding.DecodeString(body["plaintext"])
+		if err != nil {
+			fail(http.StatusBadRequest, "invalid plaintext")
+			return
+		}
+		nonce := make([]byte, v.aead.NonceSize())
+		rand.Read(nonce)
+		ciphertext := "vault:v1:" + base64.StdEncoding.EncodeToString(v.aead.Seal(nonce, nonce, plaintext, nil))
+		json.NewEncoder(w).Encode(map[string]map[string]string{"data": {"ciphertext": ciphertext}})
+	case "/v1/transit/decrypt/" + v.key:
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(body["ciphertext"], "vault:v1:"))
+		if err != nil || len(sealed) < v.aead.NonceSize() {
+			fail(http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plaintext, err := v.aead.Open(nil, sealed[:v.aead.NonceSize()], sealed[v.aead.NonceSize():], nil)
+		if err != nil {
+			fail(http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]map[string]string{"data": {"plaintext": base64.StdEncoding.EncodeToString(plaintext)}})
+	default:
+		fail(http.StatusNotFound, "no handler for route")
+	}
+}
+
+func TestVaultEncrypter(t *testing.T) {
+	ctx := context.Background()
+	server := newVaultStandIn(t)
+	encrypter := NewVaultEncrypter(VaultConfig{Addr: server.URL + "/", Token: "vault-token", Key: "photocloud"})
+
+	key := []byte("01234567890123456789012345678901")
+	wrapped, err := encrypter.WrapKey(ctx, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(wrapped), "vault:v1:") {
+		t.Errorf("unexpected wrapped key %q", wrapped)
+	}
+	unwrapped, err := encrypter.UnwrapKey(ctx, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Fatalf("unexpected unwrapped key %q, %v", unwrapped, err)
+	}
+
+	denied := NewVaultEncrypter(VaultConfig{Addr: server.URL, Token: "wrong", Key: "photocloud"})
+	if _, err := denied.UnwrapKey(ctx, wrapped); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected the vault error, got %v", err)
+	}
+	if _, err := encrypter.UnwrapKey(ctx, []byte("vault:v1:AAAA")); err == nil {
+		t.Error("expected an invalid ciphertext to be rejected")
+	}
+}
+
+func TestLocalEncrypter(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keys", "user-keys.key")
+
+	if _, err := NewLocalEncrypter(path, false); err == nil {
+		t.Fatal("expected a missing key file to be rejected")
+	}
+	encrypter, err := NewLocalEncrypter(path, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a private key file, got %v, %v", info, err)
+	}
+
+	key := []byte("01234567890123456789012345678901")
+	wrapped, err := encrypter.WrapKey(ctx, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Error("expected the key to be encrypted")
+	}
+
+	// The key is read again from the file.
+	reloaded, err := NewLocalEncrypter(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unwrapped, err := reloaded.UnwrapKey(ctx, wrapped); err != nil || !bytes.Equal(unwrapped, key) {
+		t.Fatalf("unexpected unwrapped key %q, %v", unwrapped, err)
+	}
+
+	other, err := NewLocalEncrypter(filepath.Join(t.TempDir(), "other.key"), true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := other.UnwrapKey(ctx, wrapped); err == nil {
+		t.Error("expected another key file to fail")
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.key")
+	os.WriteFile(invalid, []byte("short"), 0o600)
+	if _, err := NewLocalEncrypter(invalid, false); err == nil {
+		t.Error("expected an invalid key file to be rejected")
+	}
+}
+
+type memoryUserStorage struct {
+	domain.UserStorage
+	keys map[string]domain.UserKeys
+}
+
+func (m *memoryUserStorage) GetUserKeys(ctx context.Context, userID string) (domain.UserKeys, error) {
+	keys, ok := m.keys[userID]
+	if !ok {
+		return nil, domain.ErrUserKeyNotFound
+	}
+	return keys, nil
+}
+
+func (m *memoryUserStorage) SaveUserKeys(ctx context.Context, userID string, keys domain.UserKeys) error {
+	m.keys[userID] = keys
+	return nil
+}
+
+func TestUserStorage(t *testing.T) {
+	ctx := context.Background()
+	server := newVaultStandIn(t)
+	vault := NewVaultEncrypter(VaultConfig{Addr: server.URL, Token: "vault-token", Key: "photocloud"})
+	legacyKey := []byte("legacy-key-stored-before-vault!!")
+	stored := &memoryUserStorage{keys: map[string]domain.UserKeys{"legacy": {{Version: 1, Key: legacyKey}}}}
+	storage := NewUserStorage(stored, vault)
+
+	keys := domain.UserKeys{
+		{Version: 1, Key: []byte("01234567890123456789012345678901")},
+		{Version: 2, Key: []byte("abcdefghijklmnopqrstuvwxyz012345")},
+	}
+	if err := storage.SaveUserKeys(ctx, "3f2a9c", keys); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, key := range stored.keys["3f2a9c"] {
+		if key.Version != keys[i].Version || bytes.Contains(key.Key, keys[i].Key) || !bytes.Contains(key.Key, []byte(`"encrypter":"vault"`)) {
+			t.Errorf("expected a wrapped key, got %d %s", key.Version, key.Key)
+		}
+	}
+	got, err := storage.GetUserKeys(ctx, "3f2a9c")
+	if err != nil || len(got) != 2 || !bytes.Equal(got[0].Key, keys[0].Key) || !bytes.Equal(got.Active().Key, keys[1].Key) {
+		t.Fatalf("unexpected keys %v, %v", got, err)
+	}
+
+	// Keys stored before the encrypter are wrapped on the first read.
+	if got, err := storage.GetUserKeys(ctx, "legacy"); err != nil || !bytes.Equal(got.Active().Key, legacyKey) {
+		t.Fatalf("unexpected legacy key %v, %v", got, err)
+	}
+	if bytes.Equal(stored.keys["legacy"][0].Key, legacyKey) {
+		t.Error("expected the legacy key to be wrapped")
+	}
+	if got, err := storage.GetUserKeys(ctx, "legacy"); err != nil || !bytes.Equal(got.Active().Key, legacyKey) {
+		t.Fatalf("unexpected legacy key %v, %v", got, err)
+	}
+
+	if _, err := storage.GetUserKeys(ctx, "unknown"); !errors.Is(err, domain.ErrUserKeyNotFound) {
+		t.Errorf("expected ErrUserKeyNotFound, got %v", err)
+	}
+
+	// A key wrapped by another encrypter is never mistaken for a legacy key.
+	local, err := NewLocalEncrypter(filepath.Join(t.TempDir(), "user-keys.key"), true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewUserStorage(stored, local).GetUserKeys(ctx, "3f2a9c"); err == nil || !strings.Contains(err.Error(), "wrapped by the vault key encrypter") {
+		t.Errorf("expected an encrypter mismatch, got %v", err)
+	}
+}
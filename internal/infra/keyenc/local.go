@@ -0,0 +1,90 @@
+package keyenc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalEncrypter wraps the keys with AES-256-GCM under a key read from a file,
+// which must be kept out of the bucket and of its backups.
+type LocalEncrypter struct {
+	aead cipher.AEAD
+}
+
+// NewLocalEncrypter reads the 32-byte key, raw or base64, from path. With
+// create, a missing file is created with a random key.
+func NewLocalEncrypter(path string, create bool) (*LocalEncrypter, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		data, err = createKeyFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key := data
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil && len(decoded) == 32 {
+		key = decoded
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key file %s must hold a 32-byte key, raw or base64", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalEncrypter{aead: aead}, nil
+}
+
+func createKeyFile(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	data := []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (e *LocalEncrypter) Name() string {
+	return "local"
+}
+
+// WrapKey returns the nonce followed by the sealed key.
+func (e *LocalEncrypter) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return e.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (e *LocalEncrypter) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < e.aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, sealed := wrapped[:e.aead.NonceSize()], wrapped[e.aead.NonceSize():]
+	key, err := e.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("wrapped key does not match the key file")
+	}
+	return key, nil
+}
@@ -0,0 +1,83 @@
+// Package keyenc wraps the user keys with a key encryption provider before
+// they are stored, so that reading the bucket with the MASTER_KEY is not
+// enough to decrypt the photos.
+package keyenc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// userKeySize is the size of the keys stored before they were wrapped.
+const userKeySize = 32
+
+// wrappedKey is stored in place of the user key.
+type wrappedKey struct {
+	Encrypter string `json:"encrypter"`
+	Key       []byte `json:"key"`
+}
+
+// UserStorage stores the user keys of the embedded storage wrapped by an
+// encrypter.
+type UserStorage struct {
+	domain.UserStorage
+	encrypter domain.KeyEncrypter
+}
+
+func NewUserStorage(storage domain.UserStorage, encrypter domain.KeyEncrypter) *UserStorage {
+	return &UserStorage{UserStorage: storage, encrypter: encrypter}
+}
+
+// GetUserKeys unwraps the stored keys. Keys stored before the encrypter was
+// configured are wrapped on the first read.
+func (s *UserStorage) GetUserKeys(ctx context.Context, userID string) (domain.UserKeys, error) {
+	keys, err := s.UserStorage.GetUserKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	unwrapped := make(domain.UserKeys, len(keys))
+	legacy := false
+	for i, key := range keys {
+		unwrapped[i] = key
+		var record wrappedKey
+		if err := json.Unmarshal(key.Key, &record); err != nil || record.Encrypter == "" {
+			if len(key.Key) != userKeySize {
+				return nil, fmt.Errorf("invalid user key %d for %s", key.Version, userID)
+			}
+			legacy = true
+			continue
+		}
+		if record.Encrypter != s.encrypter.Name() {
+			return nil, fmt.Errorf("user key of %s is wrapped by the %s key encrypter, not %s", userID, record.Encrypter, s.encrypter.Name())
+		}
+		if unwrapped[i].Key, err = s.encrypter.UnwrapKey(ctx, record.Key); err != nil {
+			return nil, fmt.Errorf("failed to unwrap user key: %w", err)
+		}
+	}
+
+	if legacy {
+		if err := s.SaveUserKeys(ctx, userID, unwrapped); err != nil {
+			return nil, fmt.Errorf("failed to wrap legacy user key: %w", err)
+		}
+	}
+	return unwrapped, nil
+}
+
+func (s *UserStorage) SaveUserKeys(ctx context.Context, userID string, keys domain.UserKeys) error {
+	wrapped := make(domain.UserKeys, len(keys))
+	for i, key := range keys {
+		data, err := s.encrypter.WrapKey(ctx, key.Key)
+		if err != nil {
+			return fmt.Errorf("failed to wrap user key: %w", err)
+		}
+		wrapped[i] = key
+		if wrapped[i].Key, err = json.Marshal(wrappedKey{Encrypter: s.encrypter.Name(), Key: data}); err != nil {
+			return fmt.Errorf("failed to marshal wrapped user key: %w", err)
+		}
+	}
+	return s.UserStorage.SaveUserKeys(ctx, userID, wrapped)
+}
@@ -0,0 +1,106 @@
+package keyenc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VaultConfig points to a key of a HashiCorp Vault transit secrets engine, or
+// of any service with the same API such as OpenBao.
+type VaultConfig struct {
+	Addr  string
+	Token string
+	// Mount is the path of the transit engine, transit by default.
+	Mount string
+	Key   string
+}
+
+// VaultEncrypter wraps the keys with the transit engine of Vault: the key
+// never leaves Vault, and the token may be limited to encrypt and decrypt.
+type VaultEncrypter struct {
+	config     VaultConfig
+	httpClient *http.Client
+}
+
+func NewVaultEncrypter(config VaultConfig) *VaultEncrypter {
+	config.Addr = strings.TrimSuffix(config.Addr, "/")
+	if config.Mount == "" {
+		config.Mount = "transit"
+	}
+	return &VaultEncrypter{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *VaultEncrypter) Name() string {
+	return "vault"
+}
+
+// WrapKey returns the ciphertext of Vault, such as vault:v1:...
+func (e *VaultEncrypter) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := e.post(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("vault returned no ciphertext")
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+func (e *VaultEncrypter) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := e.post(ctx, "decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode vault plaintext: %w", err)
+	}
+	return key, nil
+}
+
+func (e *VaultEncrypter) post(ctx context.Context, operation string, body interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", e.config.Addr, e.config.Mount, operation, url.PathEscape(e.config.Key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", e.config.Token)
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("vault %s failed with status %d: %s", operation, resp.StatusCode, strings.Join(failure.Errors, "; "))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
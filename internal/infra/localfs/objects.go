@@ -0,0 +1,298 @@
+package localfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every object is a data file and a metadata file. Key segments become
+// directories ending with ".d" and the last one files ending with ".o" and
+// ".m", so that "a" and "a/b" can both exist.
+const (
+	dirSuffix  = ".d"
+	dataSuffix = ".o"
+	metaSuffix = ".m"
+)
+
+type objectMeta struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"last_modified"`
+	ContentType  string            `json:"content_type,omitempty"`
+	SSEKeyMD5    string            `json:"sse_key_md5,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// writeCondition holds the If-Match and If-None-Match headers of a write.
+type writeCondition struct {
+	ifMatch     string
+	ifNoneMatch string
+}
+
+// objectStore keeps the objects of a bucket in a directory. Objects written
+// with an SSE-C key are encrypted with it.
+type objectStore struct {
+	dir string
+	// mu makes conditional writes atomic and keeps readers from seeing the
+	// data of one version with the metadata of another.
+	mu sync.RWMutex
+}
+
+func newObjectStore(dir string) (*objectStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	return &objectStore{dir: dir}, nil
+}
+
+func (s *objectStore) path(key string, suffix string) string {
+	segments := strings.Split(key, "/")
+	parts := []string{s.dir}
+	for i, segment := range segments {
+		if i == len(segments)-1 {
+			parts = append(parts, url.PathEscape(segment)+suffix)
+		} else {
+			parts = append(parts, url.PathEscape(segment)+dirSuffix)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+func (s *objectStore) head(key string) (*objectMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readMeta(key)
+}
+
+func (s *objectStore) readMeta(key string) (*objectMeta, error) {
+	data, err := os.ReadFile(s.path(key, metaSuffix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoSuchKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta objectMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata of %s: %w", key, err)
+	}
+	return &meta, nil
+}
+
+// get returns the content of the object, which must be read with the key it
+// was written with.
+func (s *objectStore) get(key string, sseKey []byte) ([]byte, *objectMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	meta, err := s.readMeta(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSSEKey(meta, sseKey); err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(s.path(key, dataSuffix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if sseKey != nil {
+		if data, err = decrypt(sseKey, data); err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt %s: %w", key, err)
+		}
+	}
+	return data, meta, nil
+}
+
+func (s *objectStore) put(key string, data []byte, meta objectMeta, sseKey []byte, condition writeCondition) (*objectMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if condition.ifMatch != "" || condition.ifNoneMatch != "" {
+		current, err := s.readMeta(key)
+		if err != nil && !errors.Is(err, errNoSuchKey) {
+			return nil, err
+		}
+		if condition.ifNoneMatch == "*" && current != nil {
+			return nil, errPreconditionFailed
+		}
+		if condition.ifMatch != "" && (current == nil || current.ETag != condition.ifMatch) {
+			return nil, errPreconditionFailed
+		}
+	}
+
+	sum := md5.Sum(data)
+	meta.Key = key
+	meta.Size = int64(len(data))
+	meta.ETag = `"` + hex.EncodeToString(sum[:]) + `"`
+	meta.LastModified = time.Now().UTC().Truncate(time.Second)
+	meta.SSEKeyMD5 = ""
+	if sseKey != nil {
+		keySum := md5.Sum(sseKey)
+		meta.SSEKeyMD5 = base64.StdEncoding.EncodeToString(keySum[:])
+		var err error
+		if data, err = encrypt(sseKey, data); err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s: %w", key, err)
+		}
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata of %s: %w", key, err)
+	}
+
+	dataPath := s.path(key, dataSuffix)
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0o700); err != nil {
+		return nil, err
+	}
+	if err := writeFile(dataPath, data); err != nil {
+		return nil, err
+	}
+	if err := writeFile(s.path(key, metaSuffix), metaBytes); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// delete succeeds when the object does not exist, as in S3.
+func (s *objectStore) delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metaPath := s.path(key, metaSuffix)
+	for _, path := range []string{metaPath, s.path(key, dataSuffix)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	// Drop the directories left empty; removing a directory that is not
+	// empty fails.
+	for dir := filepath.Dir(metaPath); dir != s.dir && strings.HasPrefix(dir, s.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// list returns the metadata of the objects whose key starts with prefix,
+// sorted by key.
+func (s *objectStore) list(prefix string) ([]objectMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Only the directory of the complete segments of the prefix can hold
+	// matching objects.
+	root := s.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = s.path(prefix[:i], dirSuffix)
+	}
+
+	var objects []objectMeta
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var meta objectMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		if strings.HasPrefix(meta.Key, prefix) {
+			objects = append(objects, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func checkSSEKey(meta *objectMeta, sseKey []byte) error {
+	if meta.SSEKeyMD5 == "" && sseKey == nil {
+		return nil
+	}
+	if meta.SSEKeyMD5 == "" || sseKey == nil {
+		return errSSEMismatch
+	}
+	sum := md5.Sum(sseKey)
+	if base64.StdEncoding.EncodeToString(sum[:]) != meta.SSEKeyMD5 {
+		return errAccessDenied
+	}
+	return nil
+}
+
+// writeFile replaces the file at once, so that a crash cannot leave half of
+// it.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func encrypt(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func decrypt(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
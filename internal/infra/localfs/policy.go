@@ -0,0 +1,108 @@
+package localfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// policy evaluates the subset of IAM policies used by s3store: Allow and
+// Deny statements on actions and resources with wildcards, StringLike
+// conditions on s3:prefix and StringEquals conditions on s3:if-none-match.
+type policy struct {
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Effect    string                         `json:"Effect"`
+	Action    []string                       `json:"Action"`
+	Resource  []string                       `json:"Resource"`
+	Condition map[string]map[string][]string `json:"Condition,omitempty"`
+}
+
+func newPolicy(document map[string]interface{}) (*policy, error) {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	var p policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+	return &p, nil
+}
+
+// allows reports whether action is allowed on resource. Requests are denied
+// unless a statement allows them and none denies them.
+func (p *policy) allows(action string, resource string, conditions map[string]string) bool {
+	allowed := false
+	for _, statement := range p.Statement {
+		if !statement.matches(action, resource, conditions) {
+			continue
+		}
+		if statement.Effect == "Deny" {
+			return false
+		}
+		allowed = allowed || statement.Effect == "Allow"
+	}
+	return allowed
+}
+
+func (s *policyStatement) matches(action string, resource string, conditions map[string]string) bool {
+	if !matchAny(s.Action, action) || !matchAny(s.Resource, resource) {
+		return false
+	}
+	for operator, keys := range s.Condition {
+		if operator != "StringLike" && operator != "StringEquals" {
+			return false
+		}
+		for key, patterns := range keys {
+			value, ok := conditions[key]
+			if !ok {
+				return false
+			}
+			if operator == "StringEquals" && !slices.Contains(patterns, value) {
+				return false
+			}
+			if operator == "StringLike" && !matchAny(patterns, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if wildcardMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches value against pattern, where "*" stands for any
+// sequence of characters, "/" included, and "?" for any single character.
+func wildcardMatch(pattern string, value string) bool {
+	p, v := 0, 0
+	star, mark := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			p++
+			v++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, v
+			p++
+		case star >= 0:
+			mark++
+			p, v = star+1, mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
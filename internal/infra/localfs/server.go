@@ -0,0 +1,519 @@
+package localfs
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxObjectSize is the largest object S3 accepts in a single PUT.
+const maxObjectSize = 5 << 30
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	errAccessDenied           = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errInvalidAccessKeyID     = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist or has expired."}
+	errSignatureDoesNotMatch  = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match."}
+	errAuthorizationMalformed = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed."}
+	errRequestTimeTooSkewed   = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The request time is too far from the server time."}
+	errRequestExpired         = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired."}
+	errContentSHA256Mismatch  = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The content does not match the signed hash."}
+	errIncompleteBody         = &s3Error{http.StatusBadRequest, "IncompleteBody", "The body is not a valid aws-chunked body."}
+	errNoSuchBucket           = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errNoSuchKey              = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errPreconditionFailed     = &s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold."}
+	errSSEMismatch            = &s3Error{http.StatusBadRequest, "InvalidRequest", "The SSE-C parameters do not match the ones the object was stored with."}
+	errInvalidSSEKey          = &s3Error{http.StatusBadRequest, "InvalidArgument", "The SSE-C parameters are invalid."}
+	errMalformedXML           = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML is not well-formed."}
+	errInvalidCopySource      = &s3Error{http.StatusBadRequest, "InvalidArgument", "The copy source is invalid."}
+	errNotImplemented         = &s3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported by the local endpoint."}
+	errInternal               = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error."}
+)
+
+// grant is what a key may do.
+type grant struct {
+	secret string
+	// policy is nil for the API's own key, which may do anything.
+	policy *policy
+}
+
+func (g *grant) allows(action string, resource string, conditions map[string]string) bool {
+	return g.policy == nil || g.policy.allows(action, resource, conditions)
+}
+
+// server is a minimal S3 endpoint serving one bucket: GetObject, HeadObject,
+// PutObject, CopyObject, DeleteObject, DeleteObjects and ListObjectsV2, with
+// path-style addressing.
+type server struct {
+	bucket  string
+	objects *objectStore
+	// lookup returns the grant of an access key, or errInvalidAccessKeyID.
+	lookup func(accessKey string) (*grant, error)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Like the CORS rules of the production bucket, see aws.cors.json.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, HEAD")
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := s.serve(w, r); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+func (s *server) serve(w http.ResponseWriter, r *http.Request) error {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		return errNoSuchBucket
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxObjectSize)
+	g, body, err := s.authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		return s.listObjects(w, r, g)
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		return s.deleteObjects(w, g, body)
+	case key == "" || query.Has("uploads") || query.Has("uploadId"):
+		return errNotImplemented
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return s.getObject(w, r, g, key, false)
+	case http.MethodHead:
+		return s.getObject(w, r, g, key, true)
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s.copyObject(w, r, g, key)
+		}
+		return s.putObject(w, r, g, key, body)
+	case http.MethodDelete:
+		return s.deleteObject(w, g, key)
+	}
+	return errNotImplemented
+}
+
+// authenticate checks the signature of the request and returns its body.
+func (s *server) authenticate(r *http.Request) (*grant, []byte, error) {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := s.lookup(sig.accessKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := sig.verify(r, g.secret); err != nil {
+		return nil, nil, err
+	}
+	body, err := sig.readPayload(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, body, nil
+}
+
+func (s *server) objectARN(key string) string {
+	return "arn:aws:s3:::" + s.bucket + "/" + key
+}
+
+func (s *server) getObject(w http.ResponseWriter, r *http.Request, g *grant, key string, headOnly bool) error {
+	if !g.allows("s3:GetObject", s.objectARN(key), nil) {
+		return errAccessDenied
+	}
+	sseKey, err := sseCustomerKey(r, "")
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	var meta *objectMeta
+	if headOnly {
+		meta, err = s.objects.head(key)
+		if err == nil {
+			err = checkSSEKey(meta, sseKey)
+		}
+	} else {
+		data, meta, err = s.objects.get(key, sseKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	writeObjectHeaders(w, meta)
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	if !headOnly {
+		w.Write(data)
+	}
+	return nil
+}
+
+func (s *server) putObject(w http.ResponseWriter, r *http.Request, g *grant, key string, body []byte) error {
+	if !g.allows("s3:PutObject", s.objectARN(key), writeConditions(r)) {
+		return errAccessDenied
+	}
+	sseKey, err := sseCustomerKey(r, "")
+	if err != nil {
+		return err
+	}
+
+	meta := objectMeta{ContentType: r.Header.Get("Content-Type"), Metadata: userMetadata(r.Header)}
+	stored, err := s.objects.put(key, body, meta, sseKey, conditionOf(r))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", stored.ETag)
+	writeSSEHeaders(w, stored)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+func (s *server) copyObject(w http.ResponseWriter, r *http.Request, g *grant, key string) error {
+	source, _, _ := strings.Cut(r.Header.Get("X-Amz-Copy-Source"), "?")
+	source, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	if err != nil {
+		return errInvalidCopySource
+	}
+	sourceBucket, sourceKey, _ := strings.Cut(source, "/")
+	if sourceBucket != s.bucket {
+		return errNoSuchBucket
+	}
+	if !g.allows("s3:GetObject", s.objectARN(sourceKey), nil) || !g.allows("s3:PutObject", s.objectARN(key), writeConditions(r)) {
+		return errAccessDenied
+	}
+
+	sourceSSEKey, err := sseCustomerKey(r, "Copy-Source-")
+	if err != nil {
+		return err
+	}
+	sseKey, err := sseCustomerKey(r, "")
+	if err != nil {
+		return err
+	}
+	data, meta, err := s.objects.get(sourceKey, sourceSSEKey)
+	if err != nil {
+		return err
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != meta.ETag {
+		return errPreconditionFailed
+	}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		meta.ContentType = r.Header.Get("Content-Type")
+		meta.Metadata = userMetadata(r.Header)
+	}
+	stored, err := s.objects.put(key, data, *meta, sseKey, conditionOf(r))
+	if err != nil {
+		return err
+	}
+	writeSSEHeaders(w, stored)
+	return writeXML(w, http.StatusOK, copyObjectResult{
+		ETag:         stored.ETag,
+		LastModified: stored.LastModified.Format(xmlTimeFormat),
+	})
+}
+
+func (s *server) deleteObject(w http.ResponseWriter, g *grant, key string) error {
+	if !g.allows("s3:DeleteObject", s.objectARN(key), nil) {
+		return errAccessDenied
+	}
+	if err := s.objects.delete(key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *server) deleteObjects(w http.ResponseWriter, g *grant, body []byte) error {
+	var request deleteRequest
+	if err := xml.Unmarshal(body, &request); err != nil {
+		return errMalformedXML
+	}
+
+	result := deleteResult{Xmlns: s3Namespace}
+	for _, object := range request.Objects {
+		var err error
+		if !g.allows("s3:DeleteObject", s.objectARN(object.Key), nil) {
+			err = errAccessDenied
+		} else {
+			err = s.objects.delete(object.Key)
+		}
+		if err != nil {
+			s3Err := errInternal
+			errors.As(err, &s3Err)
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: s3Err.code, Message: s3Err.message})
+		} else if !request.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: object.Key})
+		}
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+const xmlTimeFormat = "2006-01-02T15:04:05.000Z"
+
+type listResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	Contents              []listObject   `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (s *server) listObjects(w http.ResponseWriter, r *http.Request, g *grant) error {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if !g.allows("s3:ListBucket", "arn:aws:s3:::"+s.bucket, map[string]string{"s3:prefix": prefix}) {
+		return errAccessDenied
+	}
+
+	result := listResult{
+		Xmlns:             s3Namespace,
+		Name:              s.bucket,
+		Prefix:            prefix,
+		Delimiter:         query.Get("delimiter"),
+		MaxKeys:           1000,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        query.Get("start-after"),
+		EncodingType:      query.Get("encoding-type"),
+	}
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys >= 0 && maxKeys < result.MaxKeys {
+		result.MaxKeys = maxKeys
+	}
+	start := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token is invalid."}
+		}
+		start = max(start, string(token))
+	}
+	encode := func(name string) string { return name }
+	if result.EncodingType == "url" {
+		encode = func(name string) string { return uriEncode(name, false) }
+	}
+
+	objects, err := s.objects.list(prefix)
+	if err != nil {
+		return err
+	}
+	last := ""
+	for _, object := range objects {
+		// Keys sharing a prefix up to the delimiter are rolled up.
+		name, rolledUp := object.Key, false
+		if result.Delimiter != "" {
+			if i := strings.Index(object.Key[len(prefix):], result.Delimiter); i >= 0 {
+				name, rolledUp = object.Key[:len(prefix)+i+len(result.Delimiter)], true
+			}
+		}
+		if name <= start || name == last {
+			continue
+		}
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		if rolledUp {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(name)})
+		} else {
+			result.Contents = append(result.Contents, listObject{
+				Key:          encode(name),
+				LastModified: object.LastModified.Format(xmlTimeFormat),
+				ETag:         object.ETag,
+				Size:         object.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		last = name
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+// sseCustomerKey returns the SSE-C key of the request, or nil. Presigned URLs
+// carry it in the query.
+func sseCustomerKey(r *http.Request, prefix string) ([]byte, error) {
+	param := func(name string) string {
+		name = "X-Amz-" + prefix + "Server-Side-Encryption-Customer-" + name
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+		return r.URL.Query().Get(strings.ToLower(name))
+	}
+	algorithm := param("Algorithm")
+	if algorithm == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(param("Key"))
+	if algorithm != "AES256" || err != nil || len(key) != 32 {
+		return nil, errInvalidSSEKey
+	}
+	if keyMD5 := param("Key-MD5"); keyMD5 != "" {
+		sum := md5.Sum(key)
+		if base64.StdEncoding.EncodeToString(sum[:]) != keyMD5 {
+			return nil, errInvalidSSEKey
+		}
+	}
+	return key, nil
+}
+
+func conditionOf(r *http.Request) writeCondition {
+	return writeCondition{
+		ifMatch:     r.Header.Get("If-Match"),
+		ifNoneMatch: r.Header.Get("If-None-Match"),
+	}
+}
+
+// writeConditions are the policy condition keys of a write.
+func writeConditions(r *http.Request) map[string]string {
+	conditions := make(map[string]string)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		conditions["s3:if-none-match"] = ifNoneMatch
+	}
+	return conditions
+}
+
+func userMetadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for name := range header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(lower, "x-amz-meta-")] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+func writeObjectHeaders(w http.ResponseWriter, meta *objectMeta) {
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", meta.ETag)
+	w.Header().Set("Last-Modified", meta.LastModified.Format(http.TimeFormat))
+	for name, value := range meta.Metadata {
+		w.Header().Set("X-Amz-Meta-"+name, value)
+	}
+	writeSSEHeaders(w, meta)
+}
+
+func writeSSEHeaders(w http.ResponseWriter, meta *objectMeta) {
+	if meta.SSEKeyMD5 != "" {
+		w.Header().Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		w.Header().Set("X-Amz-Server-Side-Encryption-Customer-Key-MD5", meta.SSEKeyMD5)
+	}
+}
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.As(err, &maxBytesErr):
+		s3Err = &s3Error{http.StatusBadRequest, "EntityTooLarge", "The object exceeds the maximum allowed size."}
+	default:
+		log.Printf("Error serving %s %s: %v", r.Method, r.URL.Path, err)
+		s3Err = errInternal
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.status)
+		return
+	}
+	writeXML(w, s3Err.status, errorResponse{Code: s3Err.code, Message: s3Err.message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+	return nil
+}
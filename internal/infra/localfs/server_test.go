@@ -0,0 +1,690 @@
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/s3store"
+)
+
+var testKeys, _ = s3store.NewKeyring(s3store.MasterKey{Version: "1", Key: []byte("test-master-key-must-be-32-byte-")})
+
+func newTestRepository(t *testing.T) (*StorageRepository, *httptest.Server) {
+	repo, err := NewStorageRepository(context.Background(), t.TempDir(), "photos", "", testKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(repo.Handler())
+	t.Cleanup(server.Close)
+	repo.endpoint = server.URL
+	return repo, server
+}
+
+func newTestClient(t *testing.T, repo *StorageRepository, userID string, scope domain.CredentialScope) (*s3.Client, *domain.S3Credentials) {
+	creds, err := repo.IssueS3Credentials(context.Background(), userID, "session-"+string(scope), scope, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to issue credentials: %v", err)
+	}
+	client, err := s3store.NewClient(context.Background(), creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, creds
+}
+
+type sseKey struct {
+	algorithm, key, keyMD5 *string
+}
+
+func newSSEKey(key string) sseKey {
+	sum := md5.Sum([]byte(key))
+	return sseKey{
+		algorithm: aws.String("AES256"),
+		key:       aws.String(base64.StdEncoding.EncodeToString([]byte(key))),
+		keyMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}
+}
+
+func putObject(client *s3.Client, key string, body string, sse sseKey) error {
+	_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:               aws.String("photos"),
+		Key:                  aws.String(key),
+		Body:                 strings.NewReader(body),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	})
+	return err
+}
+
+// createObject writes the object only if it does not exist yet.
+func createObject(client *s3.Client, key string, body string) error {
+	_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String("photos"),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(body),
+		IfNoneMatch: aws.String("*"),
+	})
+	return err
+}
+
+func getObject(client *s3.Client, key string, sse sseKey) (string, error) {
+	output, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket:               aws.String("photos"),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer output.Body.Close()
+	data, err := io.ReadAll(output.Body)
+	return string(data), err
+}
+
+func TestServer_Objects(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	client, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeFull)
+	userKey := newSSEKey("user-key-must-be-32-bytes-long!!")
+
+	if err := putObject(client, "users/3f2a9c/2024/original/a.jpg", "photo a", userKey); err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+	if data, err := getObject(client, "users/3f2a9c/2024/original/a.jpg", userKey); err != nil || data != "photo a" {
+		t.Fatalf("unexpected object %q, %v", data, err)
+	}
+	if _, err := getObject(client, "users/3f2a9c/2024/original/a.jpg", sseKey{}); err == nil {
+		t.Error("expected the SSE-C key to be required")
+	}
+	if _, err := getObject(client, "users/3f2a9c/2024/original/a.jpg", newSSEKey("another-key-must-be-32-bytes-!!!")); err == nil {
+		t.Error("expected another SSE-C key to be rejected")
+	}
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("users/3f2a9c/2024/original/a.jpg"),
+	})
+	if err == nil {
+		t.Error("expected HeadObject without the SSE-C key to fail")
+	}
+
+	// Both "a" and "a/b" may exist.
+	for _, key := range []string{"users/3f2a9c/index.json", "users/3f2a9c/index.json/x", "users/3f2a9c/2024/original/b.jpg"} {
+		if err := putObject(client, key, "data", sseKey{}); err != nil {
+			t.Fatalf("failed to put %s: %v", key, err)
+		}
+	}
+
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket:  aws.String("photos"),
+		Prefix:  aws.String("users/3f2a9c/"),
+		MaxKeys: aws.Int32(1),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			t.Fatalf("failed to list objects: %v", err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	expected := "users/3f2a9c/2024/original/a.jpg,users/3f2a9c/2024/original/b.jpg,users/3f2a9c/index.json,users/3f2a9c/index.json/x"
+	if strings.Join(keys, ",") != expected {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	listing, err := client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
+		Bucket:    aws.String("photos"),
+		Prefix:    aws.String("users/3f2a9c/"),
+		Delimiter: aws.String("/"),
+	})
+	if err != nil {
+		t.Fatalf("failed to list objects: %v", err)
+	}
+	if len(listing.CommonPrefixes) != 2 || aws.ToString(listing.CommonPrefixes[0].Prefix) != "users/3f2a9c/2024/" || len(listing.Contents) != 1 {
+		t.Errorf("unexpected listing %+v %+v", listing.CommonPrefixes, listing.Contents)
+	}
+
+	if _, err := client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("users/3f2a9c/index.json"),
+	}); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+	var noSuchKey *types.NoSuchKey
+	if _, err := getObject(client, "users/3f2a9c/index.json", sseKey{}); !errors.As(err, &noSuchKey) {
+		t.Errorf("expected NoSuchKey, got %v", err)
+	}
+	if data, err := getObject(client, "users/3f2a9c/index.json/x", sseKey{}); err != nil || data != "data" {
+		t.Errorf("expected the other object to be kept, got %q, %v", data, err)
+	}
+}
+
+func TestServer_Scopes(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	upload, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeUpload)
+	read, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeRead)
+
+	if err := createObject(upload, "users/3f2a9c/2024/original/a.jpg", "photo"); err != nil {
+		t.Errorf("expected upload keys to write photos: %v", err)
+	}
+	if err := createObject(upload, "users/3f2a9c/secret.key", "key"); err == nil {
+		t.Error("expected upload keys not to write outside photos")
+	}
+	if err := createObject(upload, "users/someone-else/2024/original/a.jpg", "photo"); err == nil {
+		t.Error("expected keys not to reach another account")
+	}
+	if _, err := upload.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("users/3f2a9c/2024/original/a.jpg"),
+	}); err == nil {
+		t.Error("expected upload keys not to delete")
+	}
+	if _, err := read.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
+		Bucket: aws.String("photos"),
+		Prefix: aws.String("users/someone-else/"),
+	}); err == nil {
+		t.Error("expected keys not to list another account")
+	}
+	if data, err := getObject(read, "users/3f2a9c/2024/original/a.jpg", sseKey{}); err != nil || data != "photo" {
+		t.Errorf("expected read keys to read photos, got %q, %v", data, err)
+	}
+	if err := putObject(read, "users/3f2a9c/2024/original/b.jpg", "photo", sseKey{}); err == nil {
+		t.Error("expected read keys not to write")
+	}
+	if _, err := getObject(read, "system/users/3f2a9c/secret.key", sseKey{}); err == nil {
+		t.Error("expected keys not to reach system/")
+	}
+}
+
+func TestServer_UploadScopeCannotOverwrite(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	full, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeFull)
+	upload, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeUpload)
+	if err := putObject(full, "users/3f2a9c/2024/original/a.jpg", "photo", sseKey{}); err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+
+	if err := putObject(upload, "users/3f2a9c/2024/original/b.jpg", "photo", sseKey{}); err == nil {
+		t.Error("expected upload keys to need If-None-Match")
+	}
+	if err := createObject(upload, "users/3f2a9c/2024/original/a.jpg", "replaced"); !s3store.IsPreconditionFailed(err) {
+		t.Errorf("expected the photo not to be replaced, got %v", err)
+	}
+	if err := createObject(upload, "users/3f2a9c/index.json", "{}"); err == nil {
+		t.Error("expected upload keys not to write the index")
+	}
+	if data, err := getObject(full, "users/3f2a9c/2024/original/a.jpg", sseKey{}); err != nil || data != "photo" {
+		t.Errorf("expected the photo to be kept, got %q, %v", data, err)
+	}
+}
+
+func TestServer_PresignedURL(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	client, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeFull)
+	userKey := newSSEKey("user-key-must-be-32-bytes-long!!")
+	if err := putObject(client, "users/3f2a9c/2024/thumbnail/a.jpg", "thumbnail", userKey); err != nil {
+		t.Fatalf("failed to put object: %v", err)
+	}
+
+	presigned, err := s3.NewPresignClient(client).PresignGetObject(context.Background(), &s3.GetObjectInput{
+		Bucket:               aws.String("photos"),
+		Key:                  aws.String("users/3f2a9c/2024/thumbnail/a.jpg"),
+		SSECustomerAlgorithm: userKey.algorithm,
+		SSECustomerKey:       userKey.key,
+		SSECustomerKeyMD5:    userKey.keyMD5,
+	})
+	if err != nil {
+		t.Fatalf("failed to presign: %v", err)
+	}
+	req, _ := http.NewRequest(presigned.Method, presigned.URL, nil)
+	for name, values := range presigned.SignedHeader {
+		req.Header[name] = values
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "thumbnail" {
+		t.Errorf("unexpected response %d %s", res.StatusCode, body)
+	}
+
+	req, _ = http.NewRequest(presigned.Method, strings.Replace(presigned.URL, "thumbnail", "original", 1), nil)
+	for name, values := range presigned.SignedHeader {
+		req.Header[name] = values
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a tampered URL to be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestServer_Authentication(t *testing.T) {
+	repo, server := newTestRepository(t)
+	client, creds := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeFull)
+
+	res, err := http.Get(server.URL + "/photos/users/3f2a9c/index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected anonymous requests to be rejected, got %d", res.StatusCode)
+	}
+
+	forged := *creds
+	forged.SecretKey = "forged"
+	forgedClient, _ := s3store.NewClient(context.Background(), &forged)
+	if err := putObject(forgedClient, "users/3f2a9c/index.json", "{}", sseKey{}); err == nil {
+		t.Error("expected a wrong secret to be rejected")
+	}
+
+	if err := repo.RevokeS3Credentials(context.Background(), "3f2a9c", []string{"session-full"}); err != nil {
+		t.Fatalf("failed to revoke credentials: %v", err)
+	}
+	if err := putObject(client, "users/3f2a9c/index.json", "{}", sseKey{}); err == nil {
+		t.Error("expected revoked keys to be rejected")
+	}
+}
+
+func TestStorageRepository_ServerObjects(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	ctx := context.Background()
+
+	userKeys := domain.UserKeys{
+		{Version: 1, Key: []byte("user-key-version-1-of-32-bytes!!")},
+		{Version: 2, Key: []byte("user-key-version-2-of-32-bytes!!")},
+	}
+	if err := repo.SaveUserKeys(ctx, "3f2a9c", userKeys); err != nil {
+		t.Fatalf("failed to save user key: %v", err)
+	}
+	if keys, err := repo.GetUserKeys(ctx, "3f2a9c"); err != nil || string(keys.Active().Key) != "user-key-version-2-of-32-bytes!!" {
+		t.Fatalf("unexpected user key %v, %v", keys, err)
+	}
+	if _, err := repo.GetUser(ctx, "3f2a9c"); !errors.Is(err, domain.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	// Conditional writes keep identities to a single account.
+	if err := repo.LinkIdentity(ctx, "google", "123", "3f2a9c"); err != nil {
+		t.Fatalf("failed to link identity: %v", err)
+	}
+	if err := repo.LinkIdentity(ctx, "google", "123", "7b1d4e"); !errors.Is(err, domain.ErrIdentityAlreadyLinked) {
+		t.Errorf("expected ErrIdentityAlreadyLinked, got %v", err)
+	}
+
+	if err := repo.SaveInvite(ctx, &domain.Invite{ID: "invite", MaxUses: 2}); err != nil {
+		t.Fatalf("failed to save invite: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		err := repo.UpdateInvite(ctx, "invite", func(invite *domain.Invite) error {
+			invite.Uses++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to update invite: %v", err)
+		}
+	}
+	invites, err := repo.ListInvites(ctx)
+	if err != nil || len(invites) != 1 || invites[0].Uses != 2 {
+		t.Errorf("unexpected invites %+v, %v", invites, err)
+	}
+
+	client, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeFull)
+	if err := putObject(client, "users/3f2a9c/index.json", "{}", sseKey{}); err != nil {
+		t.Fatal(err)
+	}
+	// Photos uploaded before and after a key rotation.
+	previousKey, activeKey := newSSEKey(string(userKeys[0].Key)), newSSEKey(string(userKeys[1].Key))
+	if err := putObject(client, "users/3f2a9c/2024/original/1.jpg", "photo 1", previousKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(client, "users/3f2a9c/2024/original/2.jpg", "photo 2", activeKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CopyUserData(ctx, "3f2a9c", "7b1d4e", userKeys); err != nil {
+		t.Fatalf("failed to copy user data: %v", err)
+	}
+	if err := repo.DeleteUserData(ctx, "3f2a9c", "7b1d4e"); err != nil {
+		t.Fatalf("failed to delete user data: %v", err)
+	}
+	if keys, err := repo.GetUserKeys(ctx, "7b1d4e"); err != nil || string(keys.Active().Key) != "user-key-version-2-of-32-bytes!!" {
+		t.Errorf("expected the user key to move, got %v, %v", keys, err)
+	}
+	if _, err := repo.GetUserKeys(ctx, "3f2a9c"); err == nil {
+		t.Error("expected the previous user key to be deleted")
+	}
+	moved, _ := newTestClient(t, repo, "7b1d4e", domain.CredentialScopeFull)
+	if data, err := getObject(moved, "users/7b1d4e/index.json", sseKey{}); err != nil || data != "{}" {
+		t.Errorf("expected the photos to move, got %q, %v", data, err)
+	}
+	if data, err := getObject(moved, "users/7b1d4e/2024/original/1.jpg", previousKey); err != nil || data != "photo 1" {
+		t.Errorf("expected the photo to keep the previous user key, got %q, %v", data, err)
+	}
+	if data, err := getObject(moved, "users/7b1d4e/2024/original/2.jpg", activeKey); err != nil || data != "photo 2" {
+		t.Errorf("expected the photo to keep the active user key, got %q, %v", data, err)
+	}
+}
+
+func TestStorageRepository_UpdateSessions(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	ctx := context.Background()
+
+	// Another device writes between the read and the write of the first
+	// update, which runs again on its result instead of overwriting it.
+	runs := 0
+	err := repo.UpdateSessions(ctx, "3f2a9c", func(sessions []domain.Session) ([]domain.Session, error) {
+		runs++
+		if runs == 1 {
+			err := repo.UpdateSessions(ctx, "3f2a9c", func(sessions []domain.Session) ([]domain.Session, error) {
+				return append(sessions, domain.Session{ID: "laptop"}), nil
+			})
+			if err != nil {
+				t.Fatalf("failed to update sessions: %v", err)
+			}
+		}
+		return append(sessions, domain.Session{ID: "phone"}), nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update sessions: %v", err)
+	}
+	sessions, err := repo.GetSessions(ctx, "3f2a9c")
+	if err != nil || runs != 2 || len(sessions) != 2 || sessions[0].ID != "laptop" || sessions[1].ID != "phone" {
+		t.Errorf("expected both sessions after %d runs, got %+v, %v", runs, sessions, err)
+	}
+
+	errRevoked := errors.New("session revoked")
+	if err := repo.UpdateSessions(ctx, "3f2a9c", func(sessions []domain.Session) ([]domain.Session, error) {
+		return nil, errRevoked
+	}); !errors.Is(err, errRevoked) {
+		t.Errorf("expected the error of the update, got %v", err)
+	}
+	if sessions, _ := repo.GetSessions(ctx, "3f2a9c"); len(sessions) != 2 {
+		t.Errorf("expected a failed update to write nothing, got %+v", sessions)
+	}
+}
+
+func TestStorageRepository_DeleteMagicLinkNonces(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	ctx := context.Background()
+
+	if err := repo.ConsumeMagicLinkNonce(ctx, "user@example.com", "a1b2"); err != nil {
+		t.Fatalf("failed to consume nonce: %v", err)
+	}
+	if err := repo.DeleteMagicLinkNonces(ctx, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("failed to prune nonces: %v", err)
+	}
+	if err := repo.ConsumeMagicLinkNonce(ctx, "user@example.com", "a1b2"); !errors.Is(err, domain.ErrMagicLinkUsed) {
+		t.Errorf("expected a recent nonce to be kept, got %v", err)
+	}
+
+	if err := repo.DeleteMagicLinkNonces(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("failed to prune nonces: %v", err)
+	}
+	if err := repo.ConsumeMagicLinkNonce(ctx, "user@example.com", "a1b2"); err != nil {
+		t.Errorf("expected the nonce to be deleted, got %v", err)
+	}
+}
+
+func TestStorageRepository_UpdateMagicLinkCode(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	ctx := context.Background()
+	if err := repo.SaveMagicLinkCode(ctx, "user@example.com", &domain.MagicLinkCode{Nonce: "a1b2"}); err != nil {
+		t.Fatalf("failed to save code: %v", err)
+	}
+
+	// A concurrent attempt is counted between the read and the write of the
+	// first one, which runs again on its result.
+	runs := 0
+	err := repo.UpdateMagicLinkCode(ctx, "User@Example.com", func(code *domain.MagicLinkCode) (*domain.MagicLinkCode, error) {
+		runs++
+		if runs == 1 {
+			err := repo.UpdateMagicLinkCode(ctx, "user@example.com", func(code *domain.MagicLinkCode) (*domain.MagicLinkCode, error) {
+				code.Attempts++
+				return code, nil
+			})
+			if err != nil {
+				t.Fatalf("failed to update code: %v", err)
+			}
+		}
+		code.Attempts++
+		return code, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update code: %v", err)
+	}
+	var attempts int
+	repo.UpdateMagicLinkCode(ctx, "user@example.com", func(code *domain.MagicLinkCode) (*domain.MagicLinkCode, error) {
+		attempts = code.Attempts
+		return nil, errors.New("read only")
+	})
+	if runs != 2 || attempts != 2 {
+		t.Errorf("expected both attempts to be counted after %d runs, got %d", runs, attempts)
+	}
+}
+
+func TestStorageRepository_UpdateTOTP(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	ctx := context.Background()
+	err := repo.UpdateTOTP(ctx, "3f2a9c", func(config *domain.TOTPConfig) (*domain.TOTPConfig, error) {
+		if config != nil {
+			t.Errorf("expected no configuration, got %+v", config)
+		}
+		return &domain.TOTPConfig{Secret: []byte("secret"), LastStep: 1}, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to create configuration: %v", err)
+	}
+
+	// A concurrent verification is saved between the read and the write of
+	// the first one, which runs again on its result.
+	runs := 0
+	err = repo.UpdateTOTP(ctx, "3f2a9c", func(config *domain.TOTPConfig) (*domain.TOTPConfig, error) {
+		runs++
+		if runs == 1 {
+			err := repo.UpdateTOTP(ctx, "3f2a9c", func(config *domain.TOTPConfig) (*domain.TOTPConfig, error) {
+				config.LastStep = 2
+				return config, nil
+			})
+			if err != nil {
+				t.Fatalf("failed to update configuration: %v", err)
+			}
+		}
+		if config.LastStep >= 2 {
+			return nil, domain.ErrTOTPCodeInvalid
+		}
+		config.LastStep = 2
+		return config, nil
+	})
+	if runs != 2 || !errors.Is(err, domain.ErrTOTPCodeInvalid) {
+		t.Errorf("expected the replayed step to be rejected after %d runs, got %v", runs, err)
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"arn:aws:s3:::photos/users/a/*", "arn:aws:s3:::photos/users/a/2024/original/x.jpg", true},
+		{"arn:aws:s3:::photos/users/a/*", "arn:aws:s3:::photos/users/ab/x", false},
+		{"arn:aws:s3:::photos/users/a/*/original/*", "arn:aws:s3:::photos/users/a/2024/original/x.jpg", true},
+		{"arn:aws:s3:::photos/users/a/*/original/*", "arn:aws:s3:::photos/users/a/secret.key", false},
+		{"users/a/", "users/a/", true},
+		{"s3:*", "s3:GetObject", true},
+		{"s3:?etObject", "s3:GetObject", true},
+		{"*", "", true},
+	}
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.value); got != tt.match {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.match)
+		}
+	}
+}
+
+func TestDecodeChunked(t *testing.T) {
+	body := "5;chunk-signature=abc\r\nhello\r\n6\r\n world\r\n0\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n"
+	data, err := decodeChunked([]byte(body))
+	if err != nil || !bytes.Equal(data, []byte("hello world")) {
+		t.Errorf("unexpected payload %q, %v", data, err)
+	}
+	if _, err := decodeChunked([]byte("5\r\nhel")); err == nil {
+		t.Error("expected a truncated body to fail")
+	}
+}
+
+func TestStorageRepository_MasterKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	v1 := s3store.MasterKey{Version: "1", Key: []byte("test-master-key-must-be-32-byte-")}
+	v2 := s3store.MasterKey{Version: "2", Key: []byte("rotated-master-key-is-32-bytes!!")}
+	newRepository := func(active s3store.MasterKey, previous ...s3store.MasterKey) *StorageRepository {
+		keys, err := s3store.NewKeyring(active, previous...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := NewStorageRepository(ctx, dir, "photos", "", keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	}
+
+	old := newRepository(v1)
+	if err := old.SaveUserKeys(ctx, "3f2a9c", domain.UserKeys{{Version: 1, Key: []byte("user-key")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SaveInvite(ctx, &domain.Invite{ID: "invite", MaxUses: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Previous keys are still accepted for reads.
+	rotating := newRepository(v2, v1)
+	if keys, err := rotating.GetUserKeys(ctx, "3f2a9c"); err != nil || string(keys.Active().Key) != "user-key" {
+		t.Fatalf("unexpected user key %v, %v", keys, err)
+	}
+	if _, err := newRepository(v2).GetUserKeys(ctx, "3f2a9c"); err == nil {
+		t.Fatal("expected the new key alone not to read the old objects")
+	}
+
+	keys, err := rotating.ListServiceObjects(ctx, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("unexpected server objects %v", keys)
+	}
+	for _, key := range keys {
+		if rotated, err := rotating.RotateServiceObject(ctx, key); err != nil || !rotated {
+			t.Errorf("expected %s to be rotated, got %v, %v", key, rotated, err)
+		}
+		if rotated, err := rotating.RotateServiceObject(ctx, key); err != nil || rotated {
+			t.Errorf("expected %s to be rotated once, got %v, %v", key, rotated, err)
+		}
+	}
+
+	rotated := newRepository(v2)
+	if keys, err := rotated.GetUserKeys(ctx, "3f2a9c"); err != nil || string(keys.Active().Key) != "user-key" {
+		t.Errorf("unexpected user key %v, %v", keys, err)
+	}
+	if invites, err := rotated.ListInvites(ctx); err != nil || len(invites) != 1 {
+		t.Errorf("unexpected invites %v, %v", invites, err)
+	}
+}
+
+func TestStorageRepository_UserKeyRotation(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	ctx := context.Background()
+	keys := domain.UserKeys{
+		{Version: 1, Key: []byte("first-user-key-must-be-32-bytes!")},
+		{Version: 2, Key: []byte("second-user-key-is-also-32-bytes")},
+	}
+	v1, v2 := newSSEKey(string(keys[0].Key)), newSSEKey(string(keys[1].Key))
+
+	client, _ := newTestClient(t, repo, "3f2a9c", domain.CredentialScopeFull)
+	if err := putObject(client, "users/3f2a9c/2024/original/a.enc", "photo", v1); err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(client, "users/3f2a9c/2024/original/b.enc", "new photo", v2); err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(client, "users/3f2a9c/index.json", "{}", sseKey{}); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := repo.ListUserObjects(ctx, "3f2a9c", "users/3f2a9c/2024/original/a.enc", 10)
+	if err != nil || len(objects) != 2 || objects[0] != "users/3f2a9c/2024/original/b.enc" {
+		t.Fatalf("unexpected objects %v, %v", objects, err)
+	}
+	for key, expected := range map[string]bool{
+		"users/3f2a9c/2024/original/a.enc": true,
+		"users/3f2a9c/2024/original/b.enc": false,
+		"users/3f2a9c/index.json":          false,
+		"users/3f2a9c/missing.enc":         false,
+	} {
+		if rotated, err := repo.RotateUserObject(ctx, "3f2a9c", key, keys); err != nil || rotated != expected {
+			t.Errorf("%s: expected rotated=%v, got %v, %v", key, expected, rotated, err)
+		}
+	}
+	if data, err := getObject(client, "users/3f2a9c/2024/original/a.enc", v2); err != nil || data != "photo" {
+		t.Errorf("expected the photo to use the new key, got %q, %v", data, err)
+	}
+	if _, err := getObject(client, "users/3f2a9c/2024/original/a.enc", v1); err == nil {
+		t.Error("expected the previous key to be rejected")
+	}
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String("photos"),
+		Key:                  aws.String("users/3f2a9c/2024/original/a.enc"),
+		SSECustomerAlgorithm: v2.algorithm,
+		SSECustomerKey:       v2.key,
+		SSECustomerKeyMD5:    v2.keyMD5,
+	})
+	if err != nil || head.Metadata["user-key-version"] != "2" {
+		t.Errorf("expected the key version in the metadata, got %v, %v", head, err)
+	}
+	if _, err := repo.RotateUserObject(ctx, "3f2a9c", "users/3f2a9c/2024/original/a.enc", keys[:1]); err == nil {
+		t.Error("expected an object of an unknown key to fail")
+	}
+
+	// Pending rotations are listed until they complete.
+	rotation := &domain.UserKeyRotation{Version: 2}
+	if err := repo.SaveUserKeyRotation(ctx, "3f2a9c", rotation); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := repo.ListPendingUserKeyRotations(ctx); err != nil || len(pending) != 1 || pending[0] != "3f2a9c" {
+		t.Errorf("unexpected pending rotations %v, %v", pending, err)
+	}
+	now := time.Now()
+	rotation.CompletedAt = &now
+	if err := repo.SaveUserKeyRotation(ctx, "3f2a9c", rotation); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := repo.ListPendingUserKeyRotations(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("unexpected pending rotations %v, %v", pending, err)
+	}
+	if saved, err := repo.GetUserKeyRotation(ctx, "3f2a9c"); err != nil || saved.Version != 2 || saved.CompletedAt == nil {
+		t.Errorf("unexpected rotation %+v, %v", saved, err)
+	}
+}
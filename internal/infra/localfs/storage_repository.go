@@ -0,0 +1,293 @@
+// Package localfs stores the data on the local disk and serves it through an
+// embedded S3-compatible endpoint, so that the API and the apps run without
+// any cloud account. It is meant for development and end-to-end tests.
+package localfs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/s3store"
+)
+
+const (
+	region = "us-east-1"
+	// serviceAccessKey is the key of the API itself. It never leaves the
+	// process and its secret changes on every start.
+	serviceAccessKey = "PHOTOCLOUDSERVICE"
+	// serviceEndpoint is only used to sign the requests of the API, which are
+	// served in-process.
+	serviceEndpoint = "http://localfs"
+)
+
+// keyRecord is a key handed out to a session, stored in {dir}/.keys/. Its
+// secret is derived from the active MASTER_KEY and never stored, so rotating
+// the MASTER_KEY revokes the keys.
+type keyRecord struct {
+	UserID    string                 `json:"user_id"`
+	SessionID string                 `json:"session_id"`
+	Scope     domain.CredentialScope `json:"scope"`
+	ExpiresAt time.Time              `json:"expires_at"`
+}
+
+type StorageRepository struct {
+	*s3store.Store
+
+	bucket        string
+	endpoint      string
+	keysDir       string
+	keySecret     []byte
+	serviceSecret string
+	server        *server
+	service       *s3.Client
+}
+
+// NewStorageRepository stores the bucket in dir/{bucket}/. endpoint is the URL
+// at which clients reach Handler.
+func NewStorageRepository(ctx context.Context, dir string, bucket string, endpoint string, keys *s3store.Keyring) (*StorageRepository, error) {
+	objects, err := newObjectStore(filepath.Join(dir, bucket))
+	if err != nil {
+		return nil, err
+	}
+	keysDir := filepath.Join(dir, ".keys")
+	if err := os.MkdirAll(keysDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", keysDir, err)
+	}
+	serviceSecret := make([]byte, 32)
+	if _, err := rand.Read(serviceSecret); err != nil {
+		return nil, fmt.Errorf("failed to generate service secret: %w", err)
+	}
+
+	r := &StorageRepository{
+		bucket:        bucket,
+		endpoint:      endpoint,
+		keysDir:       keysDir,
+		keySecret:     keys.Active().Key,
+		serviceSecret: hex.EncodeToString(serviceSecret),
+	}
+	r.server = &server{bucket: bucket, objects: objects, lookup: r.lookupKey}
+	r.service, err = s3store.NewClient(ctx, &domain.S3Credentials{
+		AccessKey: serviceAccessKey,
+		SecretKey: r.serviceSecret,
+		Endpoint:  serviceEndpoint,
+		Region:    region,
+	}, func(o *s3.Options) {
+		o.HTTPClient = handlerClient{r.server}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.Store = s3store.New(bucket, keys, r)
+	return r, nil
+}
+
+// Handler serves the S3-compatible endpoint.
+func (r *StorageRepository) Handler() http.Handler {
+	return r.server
+}
+
+// handlerClient lets the API reach its own endpoint without a round trip
+// through the network.
+type handlerClient struct {
+	handler http.Handler
+}
+
+func (c handlerClient) Do(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	recorder := httptest.NewRecorder()
+	c.handler.ServeHTTP(recorder, req)
+	return recorder.Result(), nil
+}
+
+func (r *StorageRepository) ServiceClient(ctx context.Context) (*s3.Client, error) {
+	return r.service, nil
+}
+
+// DataClient is the service client, which reaches the whole bucket.
+func (r *StorageRepository) DataClient(ctx context.Context, userID string) (*s3.Client, error) {
+	return r.service, nil
+}
+
+// UserClient is never needed: no earlier version stored server objects in
+// the user prefixes of this backend.
+func (r *StorageRepository) UserClient(ctx context.Context, userID string) (*s3.Client, error) {
+	return nil, s3store.ErrNoUserClient
+}
+
+// lookupKey returns what the key may do: the keys of sessions get the policy
+// of their scope, standing in for the OVH user policies.
+func (r *StorageRepository) lookupKey(accessKey string) (*grant, error) {
+	if accessKey == serviceAccessKey {
+		return &grant{secret: r.serviceSecret}, nil
+	}
+	record, err := r.readKey(accessKey)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || !time.Now().Before(record.ExpiresAt) {
+		return nil, errInvalidAccessKeyID
+	}
+	p, err := newPolicy(s3store.ScopePolicy(r.bucket, record.UserID, record.Scope))
+	if err != nil {
+		return nil, err
+	}
+	return &grant{secret: r.secret(accessKey), policy: p}, nil
+}
+
+func (r *StorageRepository) secret(accessKey string) string {
+	mac := hmac.New(sha256.New, r.keySecret)
+	mac.Write([]byte("localfs-key:" + accessKey))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// StorageRepository implementation
+
+func (r *StorageRepository) IssueS3Credentials(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate access key: %w", err)
+	}
+	accessKey := "LOCAL" + strings.ToUpper(hex.EncodeToString(b))
+
+	data, err := json.Marshal(keyRecord{UserID: userID, SessionID: sessionID, Scope: scope, ExpiresAt: expiresAt})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key record: %w", err)
+	}
+	if err := writeFile(r.keyPath(accessKey), data); err != nil {
+		return nil, fmt.Errorf("failed to save key record: %w", err)
+	}
+
+	return &domain.S3Credentials{
+		AccessKey: accessKey,
+		SecretKey: r.secret(accessKey),
+		Endpoint:  r.endpoint,
+		Region:    region,
+		Bucket:    r.bucket,
+		ExpiresAt: &expiresAt,
+	}, nil
+}
+
+func (r *StorageRepository) RevokeS3Credentials(ctx context.Context, userID string, sessionIDs []string) error {
+	return r.deleteKeys(func(record *keyRecord) bool {
+		return record.UserID == userID && slices.Contains(sessionIDs, record.SessionID)
+	})
+}
+
+func (r *StorageRepository) RevokeExpiredS3Credentials(ctx context.Context) error {
+	now := time.Now()
+	return r.deleteKeys(func(record *keyRecord) bool {
+		return !now.Before(record.ExpiresAt)
+	})
+}
+
+func (r *StorageRepository) deleteKeys(match func(*keyRecord) bool) error {
+	entries, err := os.ReadDir(r.keysDir)
+	if err != nil {
+		return fmt.Errorf("failed to list keys: %w", err)
+	}
+	var errs []error
+	for _, entry := range entries {
+		accessKey, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		record, err := r.readKey(accessKey)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if record != nil && match(record) {
+			if err := os.Remove(r.keyPath(accessKey)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readKey returns nil when the key does not exist.
+func (r *StorageRepository) readKey(accessKey string) (*keyRecord, error) {
+	if accessKey == "" || strings.ContainsAny(accessKey, `/\.`) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(r.keyPath(accessKey))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", accessKey, err)
+	}
+	var record keyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode key %s: %w", accessKey, err)
+	}
+	return &record, nil
+}
+
+func (r *StorageRepository) keyPath(accessKey string) string {
+	return filepath.Join(r.keysDir, accessKey+".json")
+}
+
+// AccountDataStorage implementation. The API key reaches both prefixes, and
+// the keys of the clients only reach the prefix of the previous ID.
+
+func (r *StorageRepository) BeginUserMove(ctx context.Context, fromID string, toID string) error {
+	return nil
+}
+
+func (r *StorageRepository) CopyUserData(ctx context.Context, fromID string, toID string, keys domain.UserKeys) error {
+	if err := r.CopyObjects(ctx, r.service, userPrefix(fromID), userPrefix(toID), keys); err != nil {
+		return err
+	}
+	return r.CopyObjects(ctx, r.service, s3store.UserConfigPrefix(fromID), s3store.UserConfigPrefix(toID), nil)
+}
+
+func (r *StorageRepository) DeleteUserData(ctx context.Context, fromID string, toID string) error {
+	if err := r.DeleteObjects(ctx, r.service, userPrefix(fromID)); err != nil {
+		return err
+	}
+	return r.DeleteObjects(ctx, r.service, s3store.UserConfigPrefix(fromID))
+}
+
+func (r *StorageRepository) EndUserMove(ctx context.Context, toID string) error {
+	return nil
+}
+
+// LegacyAccountExists is always false: accounts keyed by email predate this
+// backend.
+func (r *StorageRepository) LegacyAccountExists(ctx context.Context, email string) (bool, error) {
+	return false, nil
+}
+
+// MigrateLegacyUserConfig has nothing to move: no earlier version stored
+// server objects in the user prefixes of this backend.
+func (r *StorageRepository) MigrateLegacyUserConfig(ctx context.Context) error {
+	return nil
+}
+
+func userPrefix(userID string) string {
+	return fmt.Sprintf("users/%s/", userID)
+}
@@ -0,0 +1,102 @@
+package ovh
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/s3store"
+)
+
+// AccountDataStorage implementation. While an account moves, its OVH user is
+// already described by the new ID and may access both prefixes. The users of
+// restricted scopes only get the new prefix: their sessions end with the move.
+
+func (r *StorageRepository) BeginUserMove(ctx context.Context, fromID string, toID string) error {
+	for _, scope := range domain.CredentialScopes {
+		from, to := scopeUserDescription(fromID, scope), scopeUserDescription(toID, scope)
+		userID, description, err := r.findUser(ctx, to, from)
+		if err != nil {
+			return err
+		}
+		if userID == nil {
+			if scope == domain.CredentialScopeFull {
+				return fmt.Errorf("no OVH user for %s", fromID)
+			}
+			continue
+		}
+		if description != to {
+			err = r.client.Put(fmt.Sprintf("/cloud/project/%s/user/%v", r.projectID, userID), map[string]string{
+				"description": to,
+			}, nil)
+			if err != nil {
+				return fmt.Errorf("failed to rename OVH user: %w", err)
+			}
+			r.users.delete(from)
+			r.users.set(to, userID)
+			r.legacyAccounts.delete(from)
+		}
+		policy := s3store.ScopePolicy(r.bucket, toID, scope)
+		if scope == domain.CredentialScopeFull {
+			policy = s3store.UserPolicy(r.bucket, fromID, toID)
+		}
+		if err := r.applyPolicy(userID, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *StorageRepository) CopyUserData(ctx context.Context, fromID string, toID string, keys domain.UserKeys) error {
+	s3Client, err := r.getMoveS3Client(ctx, fromID, toID)
+	if err != nil {
+		return err
+	}
+	if err := r.CopyObjects(ctx, s3Client, fmt.Sprintf("users/%s/", fromID), fmt.Sprintf("users/%s/", toID), keys); err != nil {
+		return err
+	}
+
+	serviceClient, err := r.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	return r.CopyObjects(ctx, serviceClient, s3store.UserConfigPrefix(fromID), s3store.UserConfigPrefix(toID), nil)
+}
+
+func (r *StorageRepository) DeleteUserData(ctx context.Context, fromID string, toID string) error {
+	s3Client, err := r.getMoveS3Client(ctx, fromID, toID)
+	if err != nil {
+		return err
+	}
+	if err := r.DeleteObjects(ctx, s3Client, fmt.Sprintf("users/%s/", fromID)); err != nil {
+		return err
+	}
+
+	serviceClient, err := r.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	return r.DeleteObjects(ctx, serviceClient, s3store.UserConfigPrefix(fromID))
+}
+
+func (r *StorageRepository) EndUserMove(ctx context.Context, toID string) error {
+	userID, _, err := r.findUser(ctx, toID)
+	if err != nil {
+		return err
+	}
+	if userID == nil {
+		return fmt.Errorf("no OVH user for %s", toID)
+	}
+	return r.applyPolicy(userID, s3store.UserPolicy(r.bucket, toID))
+}
+
+// getMoveS3Client returns a client of the moving user, whose policy must keep
+// both prefixes.
+func (r *StorageRepository) getMoveS3Client(ctx context.Context, fromID string, toID string) (*s3.Client, error) {
+	creds, err := r.provisionUser(ctx, toID, s3store.UserPolicy(r.bucket, fromID, toID), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user credentials: %w", err)
+	}
+	return s3store.NewClient(ctx, creds)
+}
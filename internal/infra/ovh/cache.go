@@ -0,0 +1,114 @@
+package ovh
+
+import (
+	"sync"
+	"time"
+)
+
+// provisioningTTL bounds how long a change made outside this API instance,
+// such as a user edited in the OVH console, goes unnoticed.
+const provisioningTTL = 5 * time.Minute
+
+// ttlCache is a concurrency-safe map whose entries expire. Concurrent loads
+// of the same key share a single call.
+type ttlCache[T any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry[T]
+	calls   map[string]*cacheCall[T]
+	swept   time.Time
+	now     func() time.Time
+}
+
+type cacheEntry[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+type cacheCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+func newTTLCache[T any](ttl time.Duration) *ttlCache[T] {
+	return &ttlCache[T]{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry[T]),
+		calls:   make(map[string]*cacheCall[T]),
+		now:     time.Now,
+	}
+}
+
+func (c *ttlCache[T]) get(key string) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(key)
+}
+
+func (c *ttlCache[T]) set(key string, value T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(key, value)
+}
+
+func (c *ttlCache[T]) delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
+
+// load returns the cached value of key, calling fn on a miss. Errors are not
+// cached.
+func (c *ttlCache[T]) load(key string, fn func() (T, error)) (T, error) {
+	c.mu.Lock()
+	if value, ok := c.lookup(key); ok {
+		c.mu.Unlock()
+		return value, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &cacheCall[T]{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.value, call.err = fn()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil {
+		c.store(key, call.value)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.value, call.err
+}
+
+func (c *ttlCache[T]) lookup(key string) (T, bool) {
+	entry, ok := c.entries[key]
+	if !ok || !c.now().Before(entry.expiresAt) {
+		var zero T
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// store also drops the expired entries once per TTL, so that entries of
+// users seen once do not pile up.
+func (c *ttlCache[T]) store(key string, value T) {
+	now := c.now()
+	if now.Sub(c.swept) > c.ttl {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[key] = cacheEntry[T]{value: value, expiresAt: now.Add(c.ttl)}
+}
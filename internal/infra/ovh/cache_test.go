@@ -0,0 +1,79 @@
+package ovh
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTTLCache_Expiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newTTLCache[string](time.Minute)
+	c.now = func() time.Time { return now }
+
+	calls := 0
+	load := func() (string, error) {
+		calls++
+		return "user-1", nil
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := c.load("alice", load); err != nil || v != "user-1" {
+			t.Fatalf("unexpected result %q, %v", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("alice"); ok {
+		t.Error("expected the entry to expire")
+	}
+	c.load("alice", load)
+	if calls != 2 {
+		t.Errorf("expected the value to be loaded again, got %d calls", calls)
+	}
+
+	c.delete("alice")
+	if _, err := c.load("alice", func() (string, error) { return "", errors.New("unavailable") }); err == nil {
+		t.Error("expected the error to be returned")
+	}
+	if _, ok := c.get("alice"); ok {
+		t.Error("expected errors not to be cached")
+	}
+}
+
+func TestTTLCache_LoadDeduplicates(t *testing.T) {
+	c := newTTLCache[int](time.Minute)
+	release := make(chan struct{})
+	var calls atomic.Int32
+
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = c.load("alice", func() (int, error) {
+				calls.Add(1)
+				<-release
+				return 42, nil
+			})
+		}()
+	}
+	// Let the goroutines queue up behind the first call.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call, got %d", calls.Load())
+	}
+	for _, v := range results {
+		if v != 42 {
+			t.Errorf("expected every caller to get 42, got %d", v)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package ovh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/s3store"
+)
+
+// StorageRepository implementation. OVH S3 keys never expire, so every session
+// gets its own key, recorded with an expiry in system/s3-credentials/, and the
+// API deletes the keys that are no longer recorded. The key the API uses
+// itself is recorded too and never handed out. Keys of restricted scopes
+// belong to other OVH users of the account, see scopeUserDescription.
+
+const (
+	s3CredentialsPrefix         = "system/s3-credentials/"
+	s3CredentialsUpdateAttempts = 3
+	// s3CredentialsOverlap is how long the previous key of a session stays
+	// valid once a new one is issued, for the requests still signed with it.
+	s3CredentialsOverlap = 5 * time.Minute
+)
+
+type s3CredentialsRecord struct {
+	Server   ovhS3Credential     `json:"server"`
+	Sessions []s3CredentialLease `json:"sessions,omitempty"`
+}
+
+type s3CredentialLease struct {
+	Access    string    `json:"access"`
+	SessionID string    `json:"session_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// errRecordUnchanged lets an update skip the write.
+var errRecordUnchanged = errors.New("record unchanged")
+
+// s3CredentialsKey is keyed by the OVH user ID, which is kept when an account
+// moves to a new ID.
+func s3CredentialsKey(ovhUserID interface{}) string {
+	return fmt.Sprintf("%s%v.json", s3CredentialsPrefix, ovhUserID)
+}
+
+func (r *StorageRepository) IssueS3Credentials(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error) {
+	// The account's own user holds the server key, needed even when the
+	// first login asks for a restricted scope.
+	ovhUserID, err := r.ensureUser(ctx, userID, s3store.UserPolicy(r.bucket, userID), true)
+	if err != nil {
+		return nil, err
+	}
+	if scope != domain.CredentialScopeFull {
+		ovhUserID, err = r.ensureUser(ctx, scopeUserDescription(userID, scope), s3store.ScopePolicy(r.bucket, userID, scope), true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var key ovhS3Credential
+	err = r.updateS3Credentials(ctx, ovhUserID, func(record *s3CredentialsRecord) error {
+		key, err = r.createS3Key(ovhUserID)
+		if err != nil {
+			return err
+		}
+		leases := shortenLeases(liveLeases(record.Sessions), sessionID, time.Now().Add(s3CredentialsOverlap))
+		record.Sessions = append(leases, s3CredentialLease{
+			Access:    key.Access,
+			SessionID: sessionID,
+			ExpiresAt: expiresAt,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := r.s3Credentials(key)
+	creds.ExpiresAt = &expiresAt
+	return creds, nil
+}
+
+// RevokeS3Credentials looks for the keys of the sessions in every scope.
+func (r *StorageRepository) RevokeS3Credentials(ctx context.Context, userID string, sessionIDs []string) error {
+	for _, scope := range domain.CredentialScopes {
+		ovhUserID, _, err := r.findUser(ctx, scopeUserDescription(userID, scope))
+		if err != nil {
+			return err
+		}
+		if ovhUserID == nil {
+			continue
+		}
+		err = r.updateS3Credentials(ctx, ovhUserID, func(record *s3CredentialsRecord) error {
+			leases := liveLeases(record.Sessions, sessionIDs...)
+			if len(leases) == len(record.Sessions) {
+				return errRecordUnchanged
+			}
+			record.Sessions = leases
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *StorageRepository) RevokeExpiredS3Credentials(ctx context.Context) error {
+	s3Client, err := r.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := r.ListObjects(ctx, s3Client, s3CredentialsPrefix)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for key := range keys {
+		ovhUserID := strings.TrimSuffix(strings.TrimPrefix(key, s3CredentialsPrefix), ".json")
+		err := r.updateS3Credentials(ctx, ovhUserID, func(record *s3CredentialsRecord) error {
+			leases := liveLeases(record.Sessions)
+			if len(leases) == len(record.Sessions) {
+				return errRecordUnchanged
+			}
+			record.Sessions = leases
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("OVH user %s: %w", ovhUserID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serverCredentials returns the key the API uses for an OVH user. Before keys
+// were per session the only key was also the clients' one: it is revoked with
+// every other unrecorded key when the record is created.
+func (r *StorageRepository) serverCredentials(ctx context.Context, ovhUserID interface{}) (*domain.S3Credentials, error) {
+	// The server key is never replaced once recorded.
+	return r.credentials.load(fmt.Sprint(ovhUserID), func() (*domain.S3Credentials, error) {
+		return r.recordedServerCredentials(ctx, ovhUserID)
+	})
+}
+
+func (r *StorageRepository) recordedServerCredentials(ctx context.Context, ovhUserID interface{}) (*domain.S3Credentials, error) {
+	var record s3CredentialsRecord
+	err := r.GetServiceObject(ctx, s3CredentialsKey(ovhUserID), &record)
+	var noSuchKey *types.NoSuchKey
+	if err != nil && !errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("failed to get S3 credentials record: %w", err)
+	}
+	if record.Server.Access != "" {
+		return r.s3Credentials(record.Server), nil
+	}
+
+	err = r.updateS3Credentials(ctx, ovhUserID, func(record *s3CredentialsRecord) error {
+		if record.Server.Access != "" {
+			return errRecordUnchanged
+		}
+		record.Server, err = r.createS3Key(ovhUserID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := r.GetServiceObject(ctx, s3CredentialsKey(ovhUserID), &record); err != nil {
+		return nil, fmt.Errorf("failed to get S3 credentials record: %w", err)
+	}
+	return r.s3Credentials(record.Server), nil
+}
+
+// updateS3Credentials applies update to the record of an OVH user with a
+// conditional write, then deletes the keys of the user the record no longer
+// lists. Keys created by a concurrent update that lost the race are deleted
+// too; that update retries with a new key.
+func (r *StorageRepository) updateS3Credentials(ctx context.Context, ovhUserID interface{}, update func(*s3CredentialsRecord) error) error {
+	key := s3CredentialsKey(ovhUserID)
+	for attempt := 0; ; attempt++ {
+		var record s3CredentialsRecord
+		etag, err := r.GetServiceObjectETag(ctx, key, &record)
+		var noSuchKey *types.NoSuchKey
+		if err != nil && !errors.As(err, &noSuchKey) {
+			return fmt.Errorf("failed to get S3 credentials record: %w", err)
+		}
+		if err := update(&record); errors.Is(err, errRecordUnchanged) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = r.PutServiceObjectWith(ctx, key, &record, func(input *s3.PutObjectInput) {
+			if etag == "" {
+				input.IfNoneMatch = aws.String("*")
+			} else {
+				input.IfMatch = aws.String(etag)
+			}
+		})
+		if err == nil {
+			return r.deleteUnrecordedKeys(ovhUserID, &record)
+		}
+		if !s3store.IsPreconditionFailed(err) || attempt+1 == s3CredentialsUpdateAttempts {
+			return fmt.Errorf("failed to save S3 credentials record: %w", err)
+		}
+	}
+}
+
+func (r *StorageRepository) deleteUnrecordedKeys(ovhUserID interface{}, record *s3CredentialsRecord) error {
+	var keys []ovhS3Credential
+	err := r.client.Get(fmt.Sprintf("/cloud/project/%s/user/%v/s3Credentials", r.projectID, ovhUserID), &keys)
+	if err != nil {
+		return fmt.Errorf("failed to list S3 credentials: %w", err)
+	}
+
+	recorded := []string{record.Server.Access}
+	for _, lease := range record.Sessions {
+		recorded = append(recorded, lease.Access)
+	}
+	for _, key := range keys {
+		if slices.Contains(recorded, key.Access) {
+			continue
+		}
+		err := r.client.Delete(fmt.Sprintf("/cloud/project/%s/user/%v/s3Credentials/%s", r.projectID, ovhUserID, key.Access), nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete S3 credentials %s: %w", key.Access, err)
+		}
+	}
+	return nil
+}
+
+func (r *StorageRepository) createS3Key(ovhUserID interface{}) (ovhS3Credential, error) {
+	var key ovhS3Credential
+	err := r.client.Post(fmt.Sprintf("/cloud/project/%s/user/%v/s3Credentials", r.projectID, ovhUserID), nil, &key)
+	if err != nil {
+		return key, fmt.Errorf("failed to generate S3 credentials: %w", err)
+	}
+	return key, nil
+}
+
+// shortenLeases makes the leases of the session expire by until at the
+// latest. Their keys are deleted once expired, by RevokeExpiredS3Credentials.
+func shortenLeases(leases []s3CredentialLease, sessionID string, until time.Time) []s3CredentialLease {
+	for i := range leases {
+		if leases[i].SessionID == sessionID && leases[i].ExpiresAt.After(until) {
+			leases[i].ExpiresAt = until
+		}
+	}
+	return leases
+}
+
+// liveLeases drops the expired leases and those of the given sessions.
+func liveLeases(leases []s3CredentialLease, sessionIDs ...string) []s3CredentialLease {
+	now := time.Now()
+	var res []s3CredentialLease
+	for _, lease := range leases {
+		if now.Before(lease.ExpiresAt) && !slices.Contains(sessionIDs, lease.SessionID) {
+			res = append(res, lease)
+		}
+	}
+	return res
+}
@@ -0,0 +1,28 @@
+package ovh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShortenLeases(t *testing.T) {
+	now := time.Now()
+	leases := []s3CredentialLease{
+		{Access: "old", SessionID: "session-1", ExpiresAt: now.Add(time.Hour)},
+		{Access: "other", SessionID: "session-2", ExpiresAt: now.Add(time.Hour)},
+		{Access: "ending", SessionID: "session-1", ExpiresAt: now.Add(time.Minute)},
+	}
+
+	// A new key replaces the previous ones of the session after the overlap,
+	// without cutting off the requests still signed with them.
+	leases = liveLeases(shortenLeases(leases, "session-1", now.Add(s3CredentialsOverlap)))
+	if len(leases) != 3 {
+		t.Fatalf("expected the previous keys to stay valid, got %+v", leases)
+	}
+	expected := []time.Time{now.Add(s3CredentialsOverlap), now.Add(time.Hour), now.Add(time.Minute)}
+	for i, lease := range leases {
+		if !lease.ExpiresAt.Equal(expected[i]) {
+			t.Errorf("expected %s to expire at %v, got %v", lease.Access, expected[i], lease.ExpiresAt)
+		}
+	}
+}
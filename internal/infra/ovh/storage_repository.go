@@ -1,38 +1,62 @@
 package ovh
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"strings"
+	"sync"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/ovh/go-ovh/ovh"
 	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/s3store"
 )
 
+// StorageRepository provisions an OVH user per account, whose keys are
+// handed out to its clients.
 type StorageRepository struct {
+	*s3store.Store
+
 	client    *ovh.Client
 	projectID string
 	region    string
 	bucket    string
-	masterKey []byte
+
+	// users maps OVH user descriptions to IDs, policies the IDs to the hash
+	// of the last applied policy, and credentials the IDs to the key the API
+	// uses, so that requests do not provision the user again.
+	users       *ttlCache[interface{}]
+	policies    *ttlCache[string]
+	credentials *ttlCache[*domain.S3Credentials]
+
+	// legacyAccounts maps emails to whether an OVH user has one as its
+	// description, so that logins of unknown emails do not list the users.
+	legacyAccounts *ttlCache[bool]
+
+	// serviceKey is the key of the service user, configured or created once.
+	serviceMu  sync.Mutex
+	serviceKey ovhS3Credential
 }
 
-func NewStorageRepository(client *ovh.Client, projectID string, region string, bucket string, masterKey []byte) *StorageRepository {
-	return &StorageRepository{
-		client:    client,
-		projectID: projectID,
-		region:    region,
-		bucket:    bucket,
-		masterKey: masterKey,
+func NewStorageRepository(client *ovh.Client, projectID string, region string, bucket string, serviceAccessKey string, serviceSecretKey string, keys *s3store.Keyring) *StorageRepository {
+	r := &StorageRepository{
+		client:      client,
+		projectID:   projectID,
+		region:      region,
+		bucket:      bucket,
+		serviceKey:  ovhS3Credential{Access: serviceAccessKey, Secret: serviceSecretKey},
+		users:       newTTLCache[interface{}](provisioningTTL),
+		policies:    newTTLCache[string](provisioningTTL),
+		credentials: newTTLCache[*domain.S3Credentials](provisioningTTL),
+
+		legacyAccounts: newTTLCache[bool](provisioningTTL),
 	}
+	r.Store = s3store.New(bucket, keys, r)
+	return r
 }
 
 type ovhUser struct {
@@ -45,265 +69,230 @@ type ovhS3Credential struct {
 	Secret string `json:"secret"`
 }
 
-func (r *StorageRepository) GetS3Credentials(ctx context.Context, email string) (*domain.S3Credentials, error) {
-	// 1. List users
-	var users []ovhUser
-	err := r.client.Get(fmt.Sprintf("/cloud/project/%s/user", r.projectID), &users)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list OVH users: %w", err)
-	}
+var errNoOVHUser = errors.New("no OVH user")
 
-	var userID interface{}
-	for _, u := range users {
-		if u.Description == email {
-			userID = u.ID
-			break
-		}
-	}
+// serviceUserDescription names the OVH user the API itself uses for objects
+// that do not belong to a single user. It cannot collide with an email.
+const serviceUserDescription = "photocloud-service"
 
-	// 2. Create user if not exists
-	if userID == nil {
-		var newUser ovhUser
-		// We use a basic role for object storage.
-		// Note: Some API versions might require a separate call for role assignment.
-		err = r.client.Post(fmt.Sprintf("/cloud/project/%s/user", r.projectID), map[string]any{
-			"description": email,
-			"roles": []string{
-				"objectstore_operator",
-			},
-		}, &newUser)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create OVH user: %w", err)
-		}
-		userID = newUser.ID
+// scopeUserDescription names the OVH user holding the keys of a scope. Full
+// keys belong to the account's own user; the others to a user of their own,
+// as OVH policies apply to users and not to keys. No email ends with "#".
+func scopeUserDescription(userID string, scope domain.CredentialScope) string {
+	if scope == domain.CredentialScopeFull {
+		return userID
 	}
+	return userID + "#" + string(scope)
+}
 
-	// 3. Apply S3 Policy
-	if r.bucket != "" {
-		policy := map[string]interface{}{
-			"Statement": []map[string]interface{}{
-				{
-					"Effect": "Allow",
-					"Action": []string{"s3:ListBucket"},
-					"Resource": []string{
-						fmt.Sprintf("arn:aws:s3:::%s", r.bucket),
-					},
-					"Condition": map[string]interface{}{
-						"StringLike": map[string]interface{}{
-							"s3:prefix": []string{
-								fmt.Sprintf("users/%s/", email),
-								fmt.Sprintf("users/%s/*", email),
-							},
-						},
-					},
+// getServiceS3Credentials returns the key of the service user: the
+// configured one, or else a key created on first use and kept for the
+// lifetime of the process. Existing keys are never rotated, as the other
+// instances of the API use them.
+func (r *StorageRepository) getServiceS3Credentials(ctx context.Context) (*domain.S3Credentials, error) {
+	userID, err := r.ensureUser(ctx, serviceUserDescription, map[string]interface{}{
+		"Statement": []map[string]interface{}{
+			{
+				"Effect": "Allow",
+				"Action": []string{"s3:ListBucket"},
+				"Resource": []string{
+					fmt.Sprintf("arn:aws:s3:::%s", r.bucket),
 				},
-				{
-					"Effect": "Allow",
-					"Action": []string{"s3:*"},
-					"Resource": []string{
-						fmt.Sprintf("arn:aws:s3:::%s/users/%s/*", r.bucket, email),
+				"Condition": map[string]interface{}{
+					"StringLike": map[string]interface{}{
+						"s3:prefix": []string{"system/", "system/*"},
 					},
 				},
 			},
-		}
-		policyBytes, _ := json.Marshal(policy)
-		err = r.client.Post(fmt.Sprintf("/cloud/project/%s/user/%v/policy", r.projectID, userID), map[string]string{
-			"policy": string(policyBytes),
-		}, nil)
+			{
+				"Effect": "Allow",
+				"Action": []string{"s3:*"},
+				"Resource": []string{
+					fmt.Sprintf("arn:aws:s3:::%s/system/*", r.bucket),
+				},
+			},
+		},
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	r.serviceMu.Lock()
+	defer r.serviceMu.Unlock()
+	if r.serviceKey.Access == "" {
+		key, err := r.createS3Key(userID)
 		if err != nil {
-			fmt.Printf("Warning: failed to apply S3 policy to user %v: %v\n", userID, err)
+			return nil, err
 		}
+		r.serviceKey = key
 	}
+	return r.s3Credentials(r.serviceKey), nil
+}
 
-	// 4. Get S3 credentials
-	var creds []ovhS3Credential
-	err = r.client.Get(fmt.Sprintf("/cloud/project/%s/user/%v/s3Credentials", r.projectID, userID), &creds)
+// provisionUser returns the S3 credentials the API itself uses for the OVH
+// user with this description, creating the user if allowed.
+func (r *StorageRepository) provisionUser(ctx context.Context, description string, policy map[string]interface{}, create bool) (*domain.S3Credentials, error) {
+	userID, err := r.ensureUser(ctx, description, policy, create)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list S3 credentials: %w", err)
+		return nil, err
 	}
+	return r.serverCredentials(ctx, userID)
+}
 
-	var s3Cred ovhS3Credential
-	if len(creds) == 0 {
-		err = r.client.Post(fmt.Sprintf("/cloud/project/%s/user/%v/s3Credentials", r.projectID, userID), nil, &s3Cred)
+// ensureUser returns the ID of the OVH user with this description, creating
+// it if allowed, and applies the policy.
+func (r *StorageRepository) ensureUser(ctx context.Context, description string, policy map[string]interface{}, create bool) (interface{}, error) {
+	userID, err := r.users.load(description, func() (interface{}, error) {
+		// 1. List users
+		userID, _, err := r.findUser(ctx, description)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate S3 credentials: %w", err)
+			return nil, err
 		}
-	} else {
-		s3Cred = creds[0]
-		var secret ovhS3Credential
-		err = r.client.Post(fmt.Sprintf("/cloud/project/%s/user/%v/s3Credentials/%s/secret", r.projectID, userID, s3Cred.Access), nil, &secret)
-		s3Cred.Secret = secret.Secret
-		if err != nil {
-			return nil, fmt.Errorf("failed to get S3 secret: %w", err)
+
+		// 2. Create user if not exists
+		if userID == nil && !create {
+			return nil, fmt.Errorf("%w: %s", errNoOVHUser, description)
+		}
+		if userID == nil {
+			var newUser ovhUser
+			// We use a basic role for object storage.
+			// Note: Some API versions might require a separate call for role assignment.
+			err = r.client.Post(fmt.Sprintf("/cloud/project/%s/user", r.projectID), map[string]any{
+				"description": description,
+				"roles": []string{
+					"objectstore_operator",
+				},
+			}, &newUser)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create OVH user: %w", err)
+			}
+			userID = newUser.ID
 		}
+		return userID, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	// 3. Apply S3 Policy
+	if err := r.applyPolicy(userID, policy); err != nil {
+		return nil, err
+	}
+	return userID, nil
+}
+
+func (r *StorageRepository) s3Credentials(key ovhS3Credential) *domain.S3Credentials {
 	return &domain.S3Credentials{
-		AccessKey: s3Cred.Access,
-		SecretKey: s3Cred.Secret,
+		AccessKey: key.Access,
+		SecretKey: key.Secret,
 		Endpoint:  fmt.Sprintf("https://s3.%s.io.cloud.ovh.net", r.region),
 		Region:    r.region,
 		Bucket:    r.bucket,
-	}, nil
-}
-
-// UserStorage implementation
-
-type passkeyUserRecord struct {
-	Email       string                     `json:"email"`
-	Credentials []domain.PasskeyCredential `json:"credentials"`
+	}
 }
 
-func (r *StorageRepository) getS3ClientForUser(ctx context.Context, email string) (*s3.Client, error) {
-	creds, err := r.GetS3Credentials(ctx, email)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user credentials: %w", err)
+// findUser returns the ID and description of the first OVH user having one
+// of the descriptions. Only lookups of a single description are answered from
+// the cache: a cached later description could hide an earlier one.
+func (r *StorageRepository) findUser(ctx context.Context, descriptions ...string) (interface{}, string, error) {
+	if len(descriptions) == 1 {
+		if userID, ok := r.users.get(descriptions[0]); ok {
+			return userID, descriptions[0], nil
+		}
 	}
 
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(creds.Region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(creds.AccessKey, creds.SecretKey, "")),
-	)
+	var users []ovhUser
+	err := r.client.Get(fmt.Sprintf("/cloud/project/%s/user", r.projectID), &users)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load user S3 config: %w", err)
+		return nil, "", fmt.Errorf("failed to list OVH users: %w", err)
 	}
-
-	return s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String(creds.Endpoint)
-		o.Region = creds.Region
-		o.Credentials = credentials.NewStaticCredentialsProvider(creds.AccessKey, creds.SecretKey, "")
-		o.UsePathStyle = true
-	}), nil
-}
-
-func (r *StorageRepository) GetUser(ctx context.Context, email string) (domain.PasskeyUser, error) {
-	s3Client, err := r.getS3ClientForUser(ctx, email)
-	if err != nil {
-		return nil, err
+	for _, u := range users {
+		r.users.set(u.Description, u.ID)
 	}
-
-	key := fmt.Sprintf("users/%s/config/passkeys.json", email)
-	algo, sseKey, sseKeyMD5 := r.getSSEParams()
-	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket:               aws.String(r.bucket),
-		Key:                  aws.String(key),
-		SSECustomerAlgorithm: aws.String(algo),
-		SSECustomerKey:       aws.String(sseKey),
-		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
-	})
-	if err != nil {
-		// Fallback for transition: try without SSE-C if it fails
-		outputPlain, errPlain := s3Client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(r.bucket),
-			Key:    aws.String(key),
-		})
-		if errPlain == nil {
-			defer outputPlain.Body.Close()
-			var record passkeyUserRecord
-			if err := json.NewDecoder(outputPlain.Body).Decode(&record); err == nil {
-				return &domain.PasskeyUserEntity{
-					Email:       record.Email,
-					Credentials: record.Credentials,
-				}, nil
+	for _, description := range descriptions {
+		for _, u := range users {
+			if u.Description == description {
+				return u.ID, description, nil
 			}
 		}
-		return nil, fmt.Errorf("failed to get user from S3: %w", err)
-	}
-	defer output.Body.Close()
-
-	var record passkeyUserRecord
-	if err := json.NewDecoder(output.Body).Decode(&record); err != nil {
-		return nil, fmt.Errorf("failed to decode user record: %w", err)
 	}
-
-	return &domain.PasskeyUserEntity{
-		Email:       record.Email,
-		Credentials: record.Credentials,
-	}, nil
+	return nil, "", nil
 }
 
-func (r *StorageRepository) SaveUser(ctx context.Context, email string, user domain.PasskeyUser) error {
-	s3Client, err := r.getS3ClientForUser(ctx, email)
-	if err != nil {
-		return err
+// applyPolicy skips the call when the same policy was applied recently.
+func (r *StorageRepository) applyPolicy(userID interface{}, policy map[string]interface{}) error {
+	if r.bucket == "" {
+		return nil
 	}
-
-	record := passkeyUserRecord{
-		Email:       email,
-		Credentials: user.GetCredentials(),
+	policyBytes, _ := json.Marshal(policy)
+	hash := sha256.Sum256(policyBytes)
+	version := hex.EncodeToString(hash[:])
+	if applied, ok := r.policies.get(fmt.Sprint(userID)); ok && applied == version {
+		return nil
 	}
 
-	data, err := json.Marshal(record)
+	err := r.client.Post(fmt.Sprintf("/cloud/project/%s/user/%v/policy", r.projectID, userID), map[string]string{
+		"policy": string(policyBytes),
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("failed to marshal user record: %w", err)
+		return fmt.Errorf("failed to apply S3 policy to user %v: %w", userID, err)
 	}
-
-	key := fmt.Sprintf("users/%s/config/passkeys.json", email)
-	algo, sseKey, sseKeyMD5 := r.getSSEParams()
-	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:               aws.String(r.bucket),
-		Key:                  aws.String(key),
-		Body:                 bytes.NewReader(data),
-		SSECustomerAlgorithm: aws.String(algo),
-		SSECustomerKey:       aws.String(sseKey),
-		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to save user to S3: %w", err)
-	}
-
+	r.policies.set(fmt.Sprint(userID), version)
 	return nil
 }
 
-func (r *StorageRepository) GetUserKey(ctx context.Context, email string) ([]byte, error) {
-	s3Client, err := r.getS3ClientForUser(ctx, email)
-	if err != nil {
-		return nil, err
+// UserClient does not create missing OVH users: only a login does, so that a
+// stale ID cannot bring back a moved account.
+func (r *StorageRepository) UserClient(ctx context.Context, userID string) (*s3.Client, error) {
+	creds, err := r.provisionUser(ctx, userID, s3store.UserPolicy(r.bucket, userID), false)
+	if errors.Is(err, errNoOVHUser) {
+		return nil, s3store.ErrNoUserClient
 	}
-
-	key := fmt.Sprintf("users/%s/secret.key", email)
-	algo, sseKey, sseKeyMD5 := r.getSSEParams()
-	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket:               aws.String(r.bucket),
-		Key:                  aws.String(key),
-		SSECustomerAlgorithm: aws.String(algo),
-		SSECustomerKey:       aws.String(sseKey),
-		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
-	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user key from S3: %w", err)
+		return nil, fmt.Errorf("failed to get user credentials: %w", err)
 	}
-	defer output.Body.Close()
+	return s3store.NewClient(ctx, creds)
+}
 
-	return io.ReadAll(output.Body)
+// DataClient uses the key of the account: the key of the API only reaches
+// system/.
+func (r *StorageRepository) DataClient(ctx context.Context, userID string) (*s3.Client, error) {
+	return r.UserClient(ctx, userID)
 }
 
-func (r *StorageRepository) SaveUserKey(ctx context.Context, email string, userKey []byte) error {
-	s3Client, err := r.getS3ClientForUser(ctx, email)
+func (r *StorageRepository) ServiceClient(ctx context.Context) (*s3.Client, error) {
+	creds, err := r.getServiceS3Credentials(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to get service credentials: %w", err)
 	}
+	return s3store.NewClient(ctx, creds)
+}
 
-	key := fmt.Sprintf("users/%s/secret.key", email)
-	algo, sseKey, sseKeyMD5 := r.getSSEParams()
-	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:               aws.String(r.bucket),
-		Key:                  aws.String(key),
-		Body:                 bytes.NewReader(userKey),
-		SSECustomerAlgorithm: aws.String(algo),
-		SSECustomerKey:       aws.String(sseKey),
-		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
-	})
+// MigrateLegacyUserConfig moves the server objects earlier versions stored
+// in the prefixes of the accounts, which all have an OVH user.
+func (r *StorageRepository) MigrateLegacyUserConfig(ctx context.Context) error {
+	var users []ovhUser
+	err := r.client.Get(fmt.Sprintf("/cloud/project/%s/user", r.projectID), &users)
 	if err != nil {
-		return fmt.Errorf("failed to save user key to S3: %w", err)
+		return fmt.Errorf("failed to list OVH users: %w", err)
 	}
-
-	return nil
+	var userIDs []string
+	for _, u := range users {
+		if u.Description != serviceUserDescription && !strings.Contains(u.Description, "#") {
+			userIDs = append(userIDs, u.Description)
+		}
+	}
+	return r.Store.MigrateUserConfig(ctx, userIDs)
 }
 
-func (r *StorageRepository) getSSEParams() (string, string, string) {
-	key := base64.StdEncoding.EncodeToString(r.masterKey)
-	hash := md5.Sum(r.masterKey)
-	keyMD5 := base64.StdEncoding.EncodeToString(hash[:])
-	return "AES256", key, keyMD5
+// LegacyAccountExists looks for the OVH user that every login created for
+// accounts keyed by email, without provisioning one.
+func (r *StorageRepository) LegacyAccountExists(ctx context.Context, email string) (bool, error) {
+	return r.legacyAccounts.load(email, func() (bool, error) {
+		userID, _, err := r.findUser(ctx, email)
+		if err != nil {
+			return false, err
+		}
+		return userID != nil, nil
+	})
 }
@@ -0,0 +1,189 @@
+// Package s3compat stores the data in any S3-compatible service with an STS
+// AssumeRole endpoint, such as MinIO or AWS. Clients get temporary keys
+// restricted by a session policy instead of keys of a user of their own.
+package s3compat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/s3store"
+)
+
+// minCredentialsTTL is the shortest duration STS accepts.
+const minCredentialsTTL = 15 * time.Minute
+
+// defaultRoleARN is sent when no role is configured: MinIO ignores the role
+// of AssumeRole, but the request requires one.
+const defaultRoleARN = "arn:minio:iam:::role/photocloud"
+
+type Config struct {
+	// Endpoint is the S3 endpoint the API uses.
+	Endpoint string
+	// PublicEndpoint is the S3 endpoint handed to clients, when they do not
+	// reach the service at Endpoint.
+	PublicEndpoint string
+	// STSEndpoint defaults to Endpoint, as with MinIO.
+	STSEndpoint string
+	Region      string
+	Bucket      string
+	// AccessKey is a key of the API, allowed to access the whole bucket and
+	// to assume RoleARN.
+	AccessKey string
+	SecretKey string
+	RoleARN   string
+}
+
+type StorageRepository struct {
+	*s3store.Store
+
+	config  Config
+	service *s3.Client
+	sts     *sts.Client
+}
+
+func NewStorageRepository(ctx context.Context, config Config, keys *s3store.Keyring) (*StorageRepository, error) {
+	if config.PublicEndpoint == "" {
+		config.PublicEndpoint = config.Endpoint
+	}
+	if config.STSEndpoint == "" {
+		config.STSEndpoint = config.Endpoint
+	}
+	if config.RoleARN == "" {
+		config.RoleARN = defaultRoleARN
+	}
+
+	service, err := s3store.NewClient(ctx, &domain.S3Credentials{
+		AccessKey: config.AccessKey,
+		SecretKey: config.SecretKey,
+		Endpoint:  config.Endpoint,
+		Region:    config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &StorageRepository{
+		config:  config,
+		service: service,
+		sts: sts.New(sts.Options{
+			BaseEndpoint: aws.String(config.STSEndpoint),
+			Region:       config.Region,
+			Credentials:  credentials.NewStaticCredentialsProvider(config.AccessKey, config.SecretKey, ""),
+		}),
+	}
+	r.Store = s3store.New(config.Bucket, keys, r)
+	return r, nil
+}
+
+func (r *StorageRepository) ServiceClient(ctx context.Context) (*s3.Client, error) {
+	return r.service, nil
+}
+
+// DataClient is the service client, which reaches the whole bucket.
+func (r *StorageRepository) DataClient(ctx context.Context, userID string) (*s3.Client, error) {
+	return r.service, nil
+}
+
+// UserClient is never needed: no earlier version stored server objects in
+// the user prefixes of this backend.
+func (r *StorageRepository) UserClient(ctx context.Context, userID string) (*s3.Client, error) {
+	return nil, s3store.ErrNoUserClient
+}
+
+// StorageRepository implementation. STS keys expire on their own: nothing is
+// recorded and nothing can be revoked. After a logout, the key of the session
+// stays usable until it expires, at most for the credentials TTL.
+
+func (r *StorageRepository) IssueS3Credentials(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error) {
+	policy := s3store.ScopePolicy(r.config.Bucket, userID, scope)
+	policy["Version"] = "2012-10-17"
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session policy: %w", err)
+	}
+
+	ttl := time.Until(expiresAt)
+	if ttl < minCredentialsTTL {
+		ttl = minCredentialsTTL
+	}
+	output, err := r.sts.AssumeRole(ctx, &sts.AssumeRoleInput{
+		RoleArn:         aws.String(r.config.RoleARN),
+		RoleSessionName: aws.String("photocloud-" + sessionID),
+		Policy:          aws.String(string(policyBytes)),
+		DurationSeconds: aws.Int32(int32(ttl / time.Second)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to assume role: %w", err)
+	}
+
+	creds := &domain.S3Credentials{
+		AccessKey:    aws.ToString(output.Credentials.AccessKeyId),
+		SecretKey:    aws.ToString(output.Credentials.SecretAccessKey),
+		SessionToken: aws.ToString(output.Credentials.SessionToken),
+		Endpoint:     r.config.PublicEndpoint,
+		Region:       r.config.Region,
+		Bucket:       r.config.Bucket,
+		ExpiresAt:    output.Credentials.Expiration,
+	}
+	if creds.ExpiresAt == nil {
+		creds.ExpiresAt = &expiresAt
+	}
+	return creds, nil
+}
+
+func (r *StorageRepository) RevokeS3Credentials(ctx context.Context, userID string, sessionIDs []string) error {
+	return nil
+}
+
+func (r *StorageRepository) RevokeExpiredS3Credentials(ctx context.Context) error {
+	return nil
+}
+
+// AccountDataStorage implementation. The API key reaches both prefixes, and
+// the keys of the clients are bound to the old ID until they expire.
+
+func (r *StorageRepository) BeginUserMove(ctx context.Context, fromID string, toID string) error {
+	return nil
+}
+
+func (r *StorageRepository) CopyUserData(ctx context.Context, fromID string, toID string, keys domain.UserKeys) error {
+	if err := r.CopyObjects(ctx, r.service, userPrefix(fromID), userPrefix(toID), keys); err != nil {
+		return err
+	}
+	return r.CopyObjects(ctx, r.service, s3store.UserConfigPrefix(fromID), s3store.UserConfigPrefix(toID), nil)
+}
+
+func (r *StorageRepository) DeleteUserData(ctx context.Context, fromID string, toID string) error {
+	if err := r.DeleteObjects(ctx, r.service, userPrefix(fromID)); err != nil {
+		return err
+	}
+	return r.DeleteObjects(ctx, r.service, s3store.UserConfigPrefix(fromID))
+}
+
+func (r *StorageRepository) EndUserMove(ctx context.Context, toID string) error {
+	return nil
+}
+
+// LegacyAccountExists is always false: accounts keyed by email predate this
+// backend.
+func (r *StorageRepository) LegacyAccountExists(ctx context.Context, email string) (bool, error) {
+	return false, nil
+}
+
+// MigrateLegacyUserConfig has nothing to move: no earlier version stored
+// server objects in the user prefixes of this backend.
+func (r *StorageRepository) MigrateLegacyUserConfig(ctx context.Context) error {
+	return nil
+}
+
+func userPrefix(userID string) string {
+	return fmt.Sprintf("users/%s/", userID)
+}
@@ -0,0 +1,189 @@
+package s3compat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/snigle/photocloud/internal/domain"
+	"github.com/snigle/photocloud/internal/infra/s3store"
+)
+
+var testKeys, _ = s3store.NewKeyring(s3store.MasterKey{Version: "1", Key: []byte("test-master-key-must-be-32-byte-")})
+
+// newFakeSTS answers AssumeRole like STS would and records the request.
+func newFakeSTS(t *testing.T, form *url.Values) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %v", err)
+		}
+		*form = r.PostForm
+		fmt.Fprint(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>TEMPACCESS</AccessKeyId>
+      <SecretAccessKey>TEMPSECRET</SecretAccessKey>
+      <SessionToken>TEMPTOKEN</SessionToken>
+      <Expiration>2030-01-01T13:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+  <ResponseMetadata><RequestId>1</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestIssueS3Credentials(t *testing.T) {
+	var form url.Values
+	sts := newFakeSTS(t, &form)
+	repo, err := NewStorageRepository(context.Background(), Config{
+		Endpoint:       "http://minio:9000",
+		PublicEndpoint: "https://s3.example.com",
+		STSEndpoint:    sts.URL,
+		Region:         "us-east-1",
+		Bucket:         "photos",
+		AccessKey:      "api",
+		SecretKey:      "api-secret",
+	}, testKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := repo.IssueS3Credentials(context.Background(), "3f2a9c", "0a1b2c", domain.CredentialScopeUpload, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to issue credentials: %v", err)
+	}
+	if creds.AccessKey != "TEMPACCESS" || creds.SecretKey != "TEMPSECRET" || creds.SessionToken != "TEMPTOKEN" {
+		t.Errorf("unexpected keys %+v", creds)
+	}
+	if creds.Endpoint != "https://s3.example.com" || creds.Bucket != "photos" {
+		t.Errorf("expected the public endpoint and the bucket, got %+v", creds)
+	}
+	if creds.ExpiresAt == nil || !creds.ExpiresAt.Equal(time.Date(2030, 1, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the expiry of STS, got %v", creds.ExpiresAt)
+	}
+
+	if form.Get("Action") != "AssumeRole" || form.Get("RoleArn") != defaultRoleARN || form.Get("RoleSessionName") != "photocloud-0a1b2c" {
+		t.Errorf("unexpected request %v", form)
+	}
+	if d := form.Get("DurationSeconds"); d != "3599" && d != "3600" {
+		t.Errorf("expected a duration of one hour, got %s", d)
+	}
+	var policy map[string]interface{}
+	if err := json.Unmarshal([]byte(form.Get("Policy")), &policy); err != nil {
+		t.Fatalf("failed to decode policy: %v", err)
+	}
+	if policy["Version"] != "2012-10-17" {
+		t.Errorf("expected a versioned policy, got %v", policy["Version"])
+	}
+	if p := form.Get("Policy"); !strings.Contains(p, "photos/users/3f2a9c/*/original/*") || !strings.Contains(p, `"s3:if-none-match"`) || strings.Contains(p, `"s3:*"`) || strings.Contains(p, "index.json") {
+		t.Errorf("expected the upload policy of the account, got %s", p)
+	}
+}
+
+func TestIssueS3Credentials_MinimumDuration(t *testing.T) {
+	var form url.Values
+	sts := newFakeSTS(t, &form)
+	repo, err := NewStorageRepository(context.Background(), Config{
+		Endpoint:    "http://minio:9000",
+		STSEndpoint: sts.URL,
+		Region:      "us-east-1",
+		Bucket:      "photos",
+		AccessKey:   "api",
+		SecretKey:   "api-secret",
+		RoleARN:     "arn:aws:iam::123456789012:role/photocloud",
+	}, testKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.IssueS3Credentials(context.Background(), "3f2a9c", "0a1b2c", domain.CredentialScopeFull, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("failed to issue credentials: %v", err)
+	}
+	if form.Get("DurationSeconds") != "900" {
+		t.Errorf("expected the minimum duration of STS, got %s", form.Get("DurationSeconds"))
+	}
+	if form.Get("RoleArn") != "arn:aws:iam::123456789012:role/photocloud" {
+		t.Errorf("expected the configured role, got %s", form.Get("RoleArn"))
+	}
+}
+
+// TestMinIO runs against the MinIO given by S3COMPAT_TEST_ENDPOINT, whose
+// bucket S3COMPAT_TEST_BUCKET exists and may be written by the user of
+// S3COMPAT_TEST_ACCESS_KEY and S3COMPAT_TEST_SECRET_KEY.
+func TestMinIO(t *testing.T) {
+	endpoint := os.Getenv("S3COMPAT_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3COMPAT_TEST_ENDPOINT is not set")
+	}
+	ctx := context.Background()
+	repo, err := NewStorageRepository(ctx, Config{
+		Endpoint:  endpoint,
+		Region:    "us-east-1",
+		Bucket:    os.Getenv("S3COMPAT_TEST_BUCKET"),
+		AccessKey: os.Getenv("S3COMPAT_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3COMPAT_TEST_SECRET_KEY"),
+	}, testKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t.Cleanup(func() { repo.DeleteUserData(ctx, userID, "") })
+
+	if err := repo.SaveUserKeys(ctx, userID, domain.UserKeys{{Version: 1, Key: []byte("user-key")}}); err != nil {
+		t.Fatalf("failed to save user key: %v", err)
+	}
+	if keys, err := repo.GetUserKeys(ctx, userID); err != nil || string(keys.Active().Key) != "user-key" {
+		t.Fatalf("unexpected user key %v, %v", keys, err)
+	}
+
+	creds, err := repo.IssueS3Credentials(ctx, userID, "0a1b2c", domain.CredentialScopeUpload, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to issue credentials: %v", err)
+	}
+	client, err := s3store.NewClient(ctx, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key string) error {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(creds.Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader([]byte("photo")),
+			IfNoneMatch: aws.String("*"),
+		})
+		return err
+	}
+	if err := put(fmt.Sprintf("users/%s/2024/original/photo.jpg", userID)); err != nil {
+		t.Errorf("expected upload keys to write photos: %v", err)
+	}
+	if err := put(fmt.Sprintf("users/%s/secret.key", userID)); err == nil {
+		t.Error("expected upload keys not to write outside photos")
+	}
+	if err := put("users/someone-else/2024/original/photo.jpg"); err == nil {
+		t.Error("expected keys not to reach another account")
+	}
+	if _, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(creds.Bucket),
+		Key:    aws.String(s3store.UserConfigPrefix(userID) + "secret.key"),
+	}); err == nil {
+		t.Error("expected keys not to reach system/")
+	}
+
+	_, err = repo.GetUser(ctx, userID)
+	if !errors.Is(err, domain.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package s3store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// AccountStorage implementation
+
+type identityRecord struct {
+	AccountID string `json:"account_id"`
+	Provider  string `json:"provider"`
+	Subject   string `json:"subject"`
+}
+
+func (s *Store) GetAccount(ctx context.Context, id string) (*domain.Account, error) {
+	var account domain.Account
+	err := s.GetServiceObject(ctx, fmt.Sprintf("system/accounts/%s.json", id), &account)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, domain.ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account from S3: %w", err)
+	}
+	return &account, nil
+}
+
+func (s *Store) SaveAccount(ctx context.Context, account *domain.Account) error {
+	if err := s.putServiceObject(ctx, fmt.Sprintf("system/accounts/%s.json", account.ID), account, false); err != nil {
+		return fmt.Errorf("failed to save account to S3: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) GetAccountIDByIdentity(ctx context.Context, provider string, subject string) (string, error) {
+	var record identityRecord
+	err := s.GetServiceObject(ctx, identityKey(provider, subject), &record)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return "", domain.ErrIdentityNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get identity from S3: %w", err)
+	}
+	return record.AccountID, nil
+}
+
+// LinkIdentity only creates the identity record if it does not exist yet, so
+// that two accounts racing for the same identity cannot both get it.
+func (s *Store) LinkIdentity(ctx context.Context, provider string, subject string, accountID string) error {
+	record := identityRecord{AccountID: accountID, Provider: provider, Subject: subject}
+	err := s.putServiceObject(ctx, identityKey(provider, subject), record, true)
+	if err == nil {
+		return nil
+	}
+	if !IsPreconditionFailed(err) {
+		return fmt.Errorf("failed to save identity to S3: %w", err)
+	}
+
+	owner, err := s.GetAccountIDByIdentity(ctx, provider, subject)
+	if err != nil {
+		return err
+	}
+	if owner != accountID {
+		return domain.ErrIdentityAlreadyLinked
+	}
+	return nil
+}
+
+func (s *Store) UnlinkIdentity(ctx context.Context, provider string, subject string) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(identityKey(provider, subject)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete identity from S3: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) MoveIdentity(ctx context.Context, provider string, subject string, fromID string, toID string) error {
+	owner, err := s.GetAccountIDByIdentity(ctx, provider, subject)
+	if err != nil && !errors.Is(err, domain.ErrIdentityNotFound) {
+		return err
+	}
+	if owner == toID {
+		return nil
+	}
+	if err == nil && owner != fromID {
+		return domain.ErrIdentityAlreadyLinked
+	}
+	record := identityRecord{AccountID: toID, Provider: provider, Subject: subject}
+	if err := s.putServiceObject(ctx, identityKey(provider, subject), record, false); err != nil {
+		return fmt.Errorf("failed to save identity to S3: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) DeleteAccount(ctx context.Context, id string) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(fmt.Sprintf("system/accounts/%s.json", id)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete account from S3: %w", err)
+	}
+	return nil
+}
+
+func identityKey(provider string, subject string) string {
+	return fmt.Sprintf("system/identities/%s.json", domain.IdentityID(provider, subject))
+}
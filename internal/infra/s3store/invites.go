@@ -0,0 +1,104 @@
+package s3store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// InviteStorage implementation
+
+const inviteUpdateAttempts = 3
+
+func inviteKey(id string) string {
+	return fmt.Sprintf("system/invites/%s.json", id)
+}
+
+func (s *Store) SaveInvite(ctx context.Context, invite *domain.Invite) error {
+	if err := s.putServiceObject(ctx, inviteKey(invite.ID), invite, true); err != nil {
+		return fmt.Errorf("failed to save invite to S3: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) ListInvites(ctx context.Context) ([]domain.Invite, error) {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.ListObjects(ctx, s3Client, "system/invites/")
+	if err != nil {
+		return nil, err
+	}
+
+	invites := make([]domain.Invite, 0, len(keys))
+	for key := range keys {
+		var invite domain.Invite
+		if err := s.GetServiceObject(ctx, key, &invite); err != nil {
+			return nil, fmt.Errorf("failed to get invite from S3: %w", err)
+		}
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.After(invites[j].CreatedAt) })
+	return invites, nil
+}
+
+// UpdateInvite writes the invite back only if nobody changed it meanwhile, so
+// that concurrent sign-ups cannot exceed its use count.
+func (s *Store) UpdateInvite(ctx context.Context, id string, update func(*domain.Invite) error) error {
+	for attempt := 0; ; attempt++ {
+		var invite domain.Invite
+		etag, err := s.GetServiceObjectETag(ctx, inviteKey(id), &invite)
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return domain.ErrInviteNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get invite from S3: %w", err)
+		}
+		if err := update(&invite); err != nil {
+			return err
+		}
+
+		err = s.PutServiceObjectWith(ctx, inviteKey(id), &invite, func(input *s3.PutObjectInput) {
+			input.IfMatch = aws.String(etag)
+		})
+		if err == nil {
+			return nil
+		}
+		if !IsPreconditionFailed(err) || attempt+1 == inviteUpdateAttempts {
+			return fmt.Errorf("failed to save invite to S3: %w", err)
+		}
+	}
+}
+
+func (s *Store) DeleteInvite(ctx context.Context, id string) error {
+	var invite domain.Invite
+	err := s.GetServiceObject(ctx, inviteKey(id), &invite)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return domain.ErrInviteNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get invite from S3: %w", err)
+	}
+
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(inviteKey(id)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete invite from S3: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package s3store
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// masterKeyVersionMetadata is the metadata recording which MASTER_KEY
+// encrypts a server object. Objects written before versions existed have
+// none and use the first MASTER_KEY.
+const masterKeyVersionMetadata = "master-key-version"
+
+// MasterKey is one version of the MASTER_KEY.
+type MasterKey struct {
+	Version string
+	Key     []byte
+}
+
+// Keyring holds the MASTER_KEY used for every write, and the previous ones,
+// still accepted for reads until the rotation re-encrypted their objects.
+type Keyring struct {
+	active   MasterKey
+	previous []MasterKey
+}
+
+func NewKeyring(active MasterKey, previous ...MasterKey) (*Keyring, error) {
+	versions := make(map[string]bool)
+	for _, key := range append([]MasterKey{active}, previous...) {
+		if key.Version == "" {
+			return nil, errors.New("master key without version")
+		}
+		if len(key.Key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes long", key.Version)
+		}
+		if versions[key.Version] {
+			return nil, fmt.Errorf("duplicate master key version %s", key.Version)
+		}
+		versions[key.Version] = true
+	}
+	return &Keyring{active: active, previous: previous}, nil
+}
+
+func (k *Keyring) Active() MasterKey {
+	return k.active
+}
+
+func (k *Keyring) Previous() []MasterKey {
+	return k.previous
+}
+
+// keys returns the active key first, as most objects use it.
+func (k *Keyring) keys() []MasterKey {
+	return append([]MasterKey{k.active}, k.previous...)
+}
+
+func (k MasterKey) sseParams() (string, string, string) {
+	return sseParams(k.Key)
+}
+
+func sseParams(key []byte) (string, string, string) {
+	hash := md5.Sum(key)
+	return "AES256", base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// getSSEParams returns the SSE-C parameters of new objects, which must also
+// carry keyMetadata.
+func (s *Store) getSSEParams() (string, string, string) {
+	return s.keys.active.sseParams()
+}
+
+func (s *Store) keyMetadata() map[string]string {
+	return map[string]string{masterKeyVersionMetadata: s.keys.active.Version}
+}
+
+// getObject reads a server object with whichever MASTER_KEY encrypts it.
+func (s *Store) getObject(ctx context.Context, s3Client *s3.Client, key string) (*s3.GetObjectOutput, error) {
+	var output *s3.GetObjectOutput
+	err := s.withObjectKey(func(masterKey MasterKey) error {
+		algo, sseKey, sseKeyMD5 := masterKey.sseParams()
+		var err error
+		output, err = s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:               aws.String(s.bucket),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: aws.String(algo),
+			SSECustomerKey:       aws.String(sseKey),
+			SSECustomerKeyMD5:    aws.String(sseKeyMD5),
+		})
+		return err
+	})
+	return output, err
+}
+
+// headObject returns the MASTER_KEY encrypting a server object along with its
+// attributes.
+func (s *Store) headObject(ctx context.Context, s3Client *s3.Client, key string) (MasterKey, *s3.HeadObjectOutput, error) {
+	var found MasterKey
+	var output *s3.HeadObjectOutput
+	err := s.withObjectKey(func(masterKey MasterKey) error {
+		algo, sseKey, sseKeyMD5 := masterKey.sseParams()
+		var err error
+		output, err = s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(s.bucket),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: aws.String(algo),
+			SSECustomerKey:       aws.String(sseKey),
+			SSECustomerKeyMD5:    aws.String(sseKeyMD5),
+		})
+		found = masterKey
+		return err
+	})
+	return found, output, err
+}
+
+// withObjectKey calls request with every MASTER_KEY until S3 accepts one.
+// S3 cannot tell which key encrypts an object without the key, so a wrong
+// key is only noticed by the error it returns.
+func (s *Store) withObjectKey(request func(MasterKey) error) error {
+	var firstErr error
+	for _, masterKey := range s.keys.keys() {
+		err := request(masterKey)
+		if err == nil || !isWrongSSEKey(err) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// isWrongSSEKey reports whether S3 rejected the SSE-C key of a request: AWS
+// answers 403 for another key and 400 for a missing one.
+func isWrongSSEKey(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return false
+	}
+	var responseErr *awshttp.ResponseError
+	if !errors.As(err, &responseErr) {
+		return false
+	}
+	status := responseErr.HTTPStatusCode()
+	return status == http.StatusBadRequest || status == http.StatusForbidden
+}
+
+// reencryptOnCopy sets the SSE-C parameters of a copy of a server object
+// encrypted with masterKey, so that the copy uses the active MASTER_KEY.
+func (s *Store) reencryptOnCopy(input *s3.CopyObjectInput, masterKey MasterKey, head *s3.HeadObjectOutput) {
+	metadata := s.keyMetadata()
+	for name, value := range head.Metadata {
+		if name != masterKeyVersionMetadata {
+			metadata[name] = value
+		}
+	}
+	sourceAlgo, sourceKey, sourceKeyMD5 := masterKey.sseParams()
+	algo, sseKey, sseKeyMD5 := s.getSSEParams()
+	input.CopySourceSSECustomerAlgorithm = aws.String(sourceAlgo)
+	input.CopySourceSSECustomerKey = aws.String(sourceKey)
+	input.CopySourceSSECustomerKeyMD5 = aws.String(sourceKeyMD5)
+	input.SSECustomerAlgorithm = aws.String(algo)
+	input.SSECustomerKey = aws.String(sseKey)
+	input.SSECustomerKeyMD5 = aws.String(sseKeyMD5)
+	input.ContentType = head.ContentType
+	input.Metadata = metadata
+	input.MetadataDirective = types.MetadataDirectiveReplace
+}
@@ -0,0 +1,164 @@
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// MagicLinkStorage implementation
+
+// magicLinkPrefix keeps the state of magic links out of user prefixes: links
+// can be requested for addresses that have no account yet.
+func magicLinkPrefix(email string) string {
+	return fmt.Sprintf("system/magic-links/%s/", domain.IdentityID(domain.IdentityProviderEmail, domain.NormalizeEmail(email)))
+}
+
+// ConsumeMagicLinkNonce creates an empty marker object for the nonce. The
+// write is conditional so that two concurrent logins with the same link
+// cannot both succeed.
+func (s *Store) ConsumeMagicLinkNonce(ctx context.Context, email string, nonce string) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := magicLinkPrefix(email) + "nonces/" + nonce
+	algo, sseKey, sseKeyMD5 := s.getSSEParams()
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(nil),
+		IfNoneMatch:          aws.String("*"),
+		SSECustomerAlgorithm: aws.String(algo),
+		SSECustomerKey:       aws.String(sseKey),
+		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
+		Metadata:             s.keyMetadata(),
+	})
+	if err != nil {
+		if IsPreconditionFailed(err) {
+			return domain.ErrMagicLinkUsed
+		}
+		return fmt.Errorf("failed to save magic link nonce to S3: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteMagicLinkNonces deletes the nonce markers written before
+// consumedBefore. S3 has no expiry per object, and lifecycle rules are not
+// supported by every backend, so the markers are pruned by the API.
+func (s *Store) DeleteMagicLinkNonces(ctx context.Context, consumedBefore time.Time) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var expired []string
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String("system/magic-links/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list magic link nonces: %w", err)
+		}
+		for _, object := range page.Contents {
+			if strings.Contains(aws.ToString(object.Key), "/nonces/") && aws.ToTime(object.LastModified).Before(consumedBefore) {
+				expired = append(expired, aws.ToString(object.Key))
+			}
+		}
+	}
+	if err := s.deleteKeys(ctx, s3Client, expired); err != nil {
+		return fmt.Errorf("failed to delete magic link nonces: %w", err)
+	}
+	return nil
+}
+
+// magicLinkCodeUpdateAttempts bounds the retries of UpdateMagicLinkCode when
+// other attempts get in first.
+const magicLinkCodeUpdateAttempts = 5
+
+func (s *Store) SaveMagicLinkCode(ctx context.Context, email string, code *domain.MagicLinkCode) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(code)
+	if err != nil {
+		return fmt.Errorf("failed to marshal magic link code: %w", err)
+	}
+	if err := s.putSSEObject(ctx, s3Client, magicLinkPrefix(email)+"code.json", data, nil); err != nil {
+		return fmt.Errorf("failed to save magic link code to S3: %w", err)
+	}
+	return nil
+}
+
+// UpdateMagicLinkCode writes the updated code with If-Match on the ETag that
+// was read, or If-None-Match when there was no code, and retries on a
+// concurrent write.
+func (s *Store) UpdateMagicLinkCode(ctx context.Context, email string, update func(*domain.MagicLinkCode) (*domain.MagicLinkCode, error)) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := magicLinkPrefix(email) + "code.json"
+	for attempt := 0; ; attempt++ {
+		pending, etag, err := s.getMagicLinkCode(ctx, s3Client, key)
+		if err != nil {
+			return err
+		}
+		code, err := update(pending)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(code)
+		if err != nil {
+			return fmt.Errorf("failed to marshal magic link code: %w", err)
+		}
+		err = s.putSSEObject(ctx, s3Client, key, data, func(input *s3.PutObjectInput) {
+			if etag == "" {
+				input.IfNoneMatch = aws.String("*")
+			} else {
+				input.IfMatch = aws.String(etag)
+			}
+		})
+		if err == nil {
+			return nil
+		}
+		if !IsPreconditionFailed(err) || attempt+1 == magicLinkCodeUpdateAttempts {
+			return fmt.Errorf("failed to save magic link code to S3: %w", err)
+		}
+	}
+}
+
+// getMagicLinkCode returns nil when there is no pending code.
+func (s *Store) getMagicLinkCode(ctx context.Context, s3Client *s3.Client, key string) (*domain.MagicLinkCode, string, error) {
+	output, err := s.getObject(ctx, s3Client, key)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get magic link code from S3: %w", err)
+	}
+	defer output.Body.Close()
+
+	var code domain.MagicLinkCode
+	if err := json.NewDecoder(output.Body).Decode(&code); err != nil {
+		return nil, "", fmt.Errorf("failed to decode magic link code: %w", err)
+	}
+	return &code, aws.ToString(output.ETag), nil
+}
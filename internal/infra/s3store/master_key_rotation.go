@@ -0,0 +1,109 @@
+package s3store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// MasterKeyRotationStorage implementation
+
+const masterKeyRotationKey = "system/master-key-rotation.json"
+
+func (s *Store) ActiveMasterKeyVersion() string {
+	return s.keys.active.Version
+}
+
+// ListServiceObjects returns, in order, up to limit server objects after the
+// given key.
+func (s *Store) ListServiceObjects(ctx context.Context, after string, limit int) ([]string, error) {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:     aws.String(s.bucket),
+		Prefix:     aws.String("system/"),
+		StartAfter: aws.String(after),
+		MaxKeys:    aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list server objects: %w", err)
+	}
+	keys := make([]string, len(output.Contents))
+	for i, object := range output.Contents {
+		keys[i] = aws.ToString(object.Key)
+	}
+	return keys, nil
+}
+
+// RotateServiceObject re-encrypts a server object with the active MASTER_KEY
+// and reports whether it had to. Objects that are not encrypted with a
+// MASTER_KEY are left alone.
+func (s *Store) RotateServiceObject(ctx context.Context, key string) (bool, error) {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}); err == nil {
+		return false, nil
+	}
+	masterKey, head, err := s.headObject(ctx, s3Client, key)
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if masterKey.Version == s.keys.active.Version && head.Metadata[masterKeyVersionMetadata] == masterKey.Version {
+		return false, nil
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(copySource(s.bucket, key)),
+		CopySourceIfMatch: head.ETag,
+	}
+	s.reencryptOnCopy(input, masterKey, head)
+	_, err = s3Client.CopyObject(ctx, input)
+	if IsPreconditionFailed(err) {
+		// Written again since, with the active key.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to re-encrypt %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *Store) GetMasterKeyRotation(ctx context.Context) (*domain.MasterKeyRotation, error) {
+	var rotation domain.MasterKeyRotation
+	err := s.GetServiceObject(ctx, masterKeyRotationKey, &rotation)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get master key rotation from S3: %w", err)
+	}
+	return &rotation, nil
+}
+
+func (s *Store) SaveMasterKeyRotation(ctx context.Context, rotation *domain.MasterKeyRotation) error {
+	if err := s.putServiceObject(ctx, masterKeyRotationKey, rotation, false); err != nil {
+		return fmt.Errorf("failed to save master key rotation to S3: %w", err)
+	}
+	return nil
+}
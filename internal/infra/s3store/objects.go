@@ -0,0 +1,136 @@
+package s3store
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// CopyObjects copies the objects of fromPrefix to toPrefix. Photos encrypted
+// with a version of keys keep it.
+func (s *Store) CopyObjects(ctx context.Context, s3Client *s3.Client, fromPrefix string, toPrefix string, keys domain.UserKeys) error {
+	copied, err := s.ListObjects(ctx, s3Client, toPrefix)
+	if err != nil {
+		return err
+	}
+	objects, err := s.ListObjects(ctx, s3Client, fromPrefix)
+	if err != nil {
+		return err
+	}
+
+	for key, size := range objects {
+		rel := strings.TrimPrefix(key, fromPrefix)
+		if copiedSize, ok := copied[toPrefix+rel]; ok && copiedSize == size {
+			continue
+		}
+
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(toPrefix + rel),
+			CopySource: aws.String(copySource(s.bucket, key)),
+		}
+		// Server objects are encrypted with the MASTER_KEY and must be
+		// re-encrypted on copy; photos are encrypted by the client, with
+		// SSE-C and the user key or on its own.
+		_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil && len(keys) > 0 {
+			var userKey domain.UserKey
+			if userKey, _, err = s.headUserObject(ctx, s3Client, key, keys); err == nil {
+				algo, sseKey, sseKeyMD5 := sseParams(userKey.Key)
+				input.CopySourceSSECustomerAlgorithm = aws.String(algo)
+				input.CopySourceSSECustomerKey = aws.String(sseKey)
+				input.CopySourceSSECustomerKeyMD5 = aws.String(sseKeyMD5)
+				input.SSECustomerAlgorithm = aws.String(algo)
+				input.SSECustomerKey = aws.String(sseKey)
+				input.SSECustomerKeyMD5 = aws.String(sseKeyMD5)
+			}
+		}
+		if err != nil {
+			masterKey, head, err := s.headObject(ctx, s3Client, key)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", key, err)
+			}
+			s.reencryptOnCopy(input, masterKey, head)
+		}
+		if _, err := s3Client.CopyObject(ctx, input); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) DeleteObjects(ctx context.Context, s3Client *s3.Client, prefix string) error {
+	objects, err := s.ListObjects(ctx, s3Client, prefix)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	if err := s.deleteKeys(ctx, s3Client, keys); err != nil {
+		return fmt.Errorf("failed to delete objects of %s: %w", prefix, err)
+	}
+	return nil
+}
+
+// deleteKeys deletes objects in batches of 1000, the most a request accepts.
+func (s *Store) deleteKeys(ctx context.Context, s3Client *s3.Client, keys []string) error {
+	for len(keys) > 0 {
+		batch := make([]types.ObjectIdentifier, 0, min(len(keys), 1000))
+		for _, key := range keys[:cap(batch)] {
+			batch = append(batch, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		keys = keys[len(batch):]
+		_, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListObjects returns the size of every object under prefix.
+func (s *Store) ListObjects(ctx context.Context, s3Client *s3.Client, prefix string) (map[string]int64, error) {
+	objects := make(map[string]int64)
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			objects[aws.ToString(object.Key)] = aws.ToInt64(object.Size)
+		}
+	}
+	return objects, nil
+}
+
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// UserConfigPrefix is where the server-owned objects of an account are
+// stored, see getUserConfig.
+func UserConfigPrefix(userID string) string {
+	return userConfigKey(userID, "")
+}
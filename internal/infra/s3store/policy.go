@@ -0,0 +1,82 @@
+package s3store
+
+import (
+	"fmt"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// UserPolicy grants access to the prefixes of the given account IDs.
+func UserPolicy(bucket string, userIDs ...string) map[string]interface{} {
+	var resources []string
+	for _, id := range userIDs {
+		resources = append(resources, userObjects(bucket, id, "*"))
+	}
+	return listPolicy(bucket, userIDs, allowStatement([]string{"s3:*"}, resources...))
+}
+
+// ScopePolicy is the policy of the keys of a scope. Upload keys may only
+// create photos: secret.key, the index and the server's files must not be
+// written, and existing photos must not be replaced, so every write must
+// carry If-None-Match: *.
+func ScopePolicy(bucket string, userID string, scope domain.CredentialScope) map[string]interface{} {
+	switch scope {
+	case domain.CredentialScopeRead:
+		return listPolicy(bucket, []string{userID}, allowStatement([]string{"s3:GetObject"}, userObjects(bucket, userID, "*")))
+	case domain.CredentialScopeUpload:
+		create := allowStatement([]string{"s3:PutObject"},
+			userObjects(bucket, userID, "*/original/*"),
+			userObjects(bucket, userID, "*/1080p/*"),
+			userObjects(bucket, userID, "*/thumbnail/*"),
+			userObjects(bucket, userID, "*/metadata/*"),
+		)
+		create["Condition"] = map[string]interface{}{
+			"StringEquals": map[string]interface{}{
+				"s3:if-none-match": []string{"*"},
+			},
+		}
+		return listPolicy(bucket, []string{userID},
+			allowStatement([]string{"s3:GetObject"}, userObjects(bucket, userID, "*")),
+			create,
+		)
+	default:
+		return UserPolicy(bucket, userID)
+	}
+}
+
+// listPolicy lets the user list the prefixes of the given account IDs, on
+// top of the given statements.
+func listPolicy(bucket string, userIDs []string, statements ...map[string]interface{}) map[string]interface{} {
+	var prefixes []string
+	for _, id := range userIDs {
+		prefixes = append(prefixes, fmt.Sprintf("users/%s/", id), fmt.Sprintf("users/%s/*", id))
+	}
+	return map[string]interface{}{
+		"Statement": append([]map[string]interface{}{
+			{
+				"Effect": "Allow",
+				"Action": []string{"s3:ListBucket"},
+				"Resource": []string{
+					fmt.Sprintf("arn:aws:s3:::%s", bucket),
+				},
+				"Condition": map[string]interface{}{
+					"StringLike": map[string]interface{}{
+						"s3:prefix": prefixes,
+					},
+				},
+			},
+		}, statements...),
+	}
+}
+
+func userObjects(bucket string, userID string, pattern string) string {
+	return fmt.Sprintf("arn:aws:s3:::%s/users/%s/%s", bucket, userID, pattern)
+}
+
+func allowStatement(actions []string, resources ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"Effect":   "Allow",
+		"Action":   actions,
+		"Resource": resources,
+	}
+}
@@ -0,0 +1,130 @@
+// Package s3store stores the server's records in an S3 bucket, whatever the
+// provider. Providers only differ in how they hand out keys, see Backend.
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// ErrNoUserClient is returned by backends that have no key of their own for
+// the account.
+var ErrNoUserClient = errors.New("no S3 client for the user")
+
+// Backend provides the S3 clients of a provider.
+type Backend interface {
+	// ServiceClient may access system/.
+	ServiceClient(ctx context.Context) (*s3.Client, error)
+	// UserClient may access the prefix of the account. It is only used to
+	// move objects stored there by earlier versions.
+	UserClient(ctx context.Context, userID string) (*s3.Client, error)
+	// DataClient may access the objects of the account, to re-encrypt them.
+	DataClient(ctx context.Context, userID string) (*s3.Client, error)
+}
+
+type Store struct {
+	bucket  string
+	keys    *Keyring
+	backend Backend
+}
+
+func New(bucket string, keys *Keyring, backend Backend) *Store {
+	return &Store{
+		bucket:  bucket,
+		keys:    keys,
+		backend: backend,
+	}
+}
+
+func NewClient(ctx context.Context, creds *domain.S3Credentials, optFns ...func(*s3.Options)) (*s3.Client, error) {
+	provider := credentials.NewStaticCredentialsProvider(creds.AccessKey, creds.SecretKey, creds.SessionToken)
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(creds.Region),
+		config.WithCredentialsProvider(provider),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user S3 config: %w", err)
+	}
+
+	return s3.NewFromConfig(cfg, append([]func(*s3.Options){func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(creds.Endpoint)
+		o.Region = creds.Region
+		o.Credentials = provider
+		o.UsePathStyle = true
+	}}, optFns...)...), nil
+}
+
+func (s *Store) GetServiceObject(ctx context.Context, key string, v interface{}) error {
+	_, err := s.GetServiceObjectETag(ctx, key, v)
+	return err
+}
+
+// GetServiceObjectETag also returns the ETag of the object, for conditional
+// updates.
+func (s *Store) GetServiceObjectETag(ctx context.Context, key string, v interface{}) (string, error) {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := s.getObject(ctx, s3Client, key)
+	if err != nil {
+		return "", err
+	}
+	defer output.Body.Close()
+
+	if err := json.NewDecoder(output.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+func (s *Store) putServiceObject(ctx context.Context, key string, v interface{}, onlyIfAbsent bool) error {
+	return s.PutServiceObjectWith(ctx, key, v, func(input *s3.PutObjectInput) {
+		if onlyIfAbsent {
+			input.IfNoneMatch = aws.String("*")
+		}
+	})
+}
+
+func (s *Store) PutServiceObjectWith(ctx context.Context, key string, v interface{}, condition func(*s3.PutObjectInput)) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", key, err)
+	}
+
+	algo, sseKey, sseKeyMD5 := s.getSSEParams()
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		SSECustomerAlgorithm: aws.String(algo),
+		SSECustomerKey:       aws.String(sseKey),
+		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
+		Metadata:             s.keyMetadata(),
+	}
+	condition(input)
+	_, err = s3Client.PutObject(ctx, input)
+	return err
+}
+
+// IsPreconditionFailed reports whether a conditional write lost.
+func IsPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict")
+}
@@ -0,0 +1,204 @@
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Server-owned objects of an account (secret.key, passkeys, sessions, TOTP)
+// are stored under system/users/{id}/ with the service identity, out of reach
+// of the user's own keys. Earlier versions stored them in the user prefix:
+// MigrateUserConfig moves them once, and they are never read there afterwards.
+
+var errUserConfigNotFound = errors.New("user configuration not found")
+
+// userConfigNames are the objects earlier versions stored in the user prefix.
+var userConfigNames = []string{"secret.key", "passkeys.json", "sessions.json", "totp.json"}
+
+// userConfigMigrationKey records that every account was migrated.
+const userConfigMigrationKey = "system/migrations/user-config.json"
+
+type userConfigMigration struct {
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+func userConfigKey(userID string, name string) string {
+	return fmt.Sprintf("system/users/%s/%s", userID, name)
+}
+
+func legacyUserConfigKey(userID string, name string) string {
+	if name == "secret.key" {
+		return fmt.Sprintf("users/%s/secret.key", userID)
+	}
+	return fmt.Sprintf("users/%s/config/%s", userID, name)
+}
+
+// getUserConfig returns errUserConfigNotFound when the object does not exist.
+func (s *Store) getUserConfig(ctx context.Context, userID string, name string) ([]byte, error) {
+	data, _, err := s.getUserConfigETag(ctx, userID, name)
+	return data, err
+}
+
+// getUserConfigETag also returns the ETag of the object, for conditional
+// updates.
+func (s *Store) getUserConfigETag(ctx context.Context, userID string, name string) ([]byte, string, error) {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	output, err := s.getObject(ctx, s3Client, userConfigKey(userID, name))
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, "", errUserConfigNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Body.Close()
+	data, err := io.ReadAll(output.Body)
+	return data, aws.ToString(output.ETag), err
+}
+
+// putUserConfigIfMatch writes the object only if its ETag is still etag, or
+// if it still does not exist when etag is empty.
+func (s *Store) putUserConfigIfMatch(ctx context.Context, userID string, name string, data []byte, etag string) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	return s.putSSEObject(ctx, s3Client, userConfigKey(userID, name), data, func(input *s3.PutObjectInput) {
+		if etag == "" {
+			input.IfNoneMatch = aws.String("*")
+		} else {
+			input.IfMatch = aws.String(etag)
+		}
+	})
+}
+
+func (s *Store) putUserConfig(ctx context.Context, userID string, name string, data []byte) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	return s.putSSEObject(ctx, s3Client, userConfigKey(userID, name), data, nil)
+}
+
+func (s *Store) deleteUserConfig(ctx context.Context, userID string, name string) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(userConfigKey(userID, name)),
+	})
+	return err
+}
+
+// MigrateUserConfig moves the server objects earlier versions stored in the
+// prefixes of the given accounts to system/users/, unless a previous run
+// completed. It must finish before requests are served, as the objects are no
+// longer looked up in the user prefix.
+func (s *Store) MigrateUserConfig(ctx context.Context, userIDs []string) error {
+	var migration userConfigMigration
+	err := s.GetServiceObject(ctx, userConfigMigrationKey, &migration)
+	var noSuchKey *types.NoSuchKey
+	if err == nil {
+		return nil
+	}
+	if !errors.As(err, &noSuchKey) {
+		return fmt.Errorf("failed to get user configuration migration: %w", err)
+	}
+
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err := s.migrateAccountConfig(ctx, s3Client, userID); err != nil {
+			return err
+		}
+	}
+
+	migration.CompletedAt = time.Now()
+	if err := s.putServiceObject(ctx, userConfigMigrationKey, migration, false); err != nil {
+		return fmt.Errorf("failed to save user configuration migration: %w", err)
+	}
+	return nil
+}
+
+// migrateAccountConfig moves the objects of an account. Only objects encrypted
+// with a MASTER_KEY are moved: the user could have written anything else, and
+// the copy does not replace an object written meanwhile.
+func (s *Store) migrateAccountConfig(ctx context.Context, s3Client *s3.Client, userID string) error {
+	userClient, err := s.backend.UserClient(ctx, userID)
+	if errors.Is(err, ErrNoUserClient) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, name := range userConfigNames {
+		legacyKey := legacyUserConfigKey(userID, name)
+		data, err := s.getSSEObject(ctx, userClient, legacyKey)
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) || isWrongSSEKey(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", legacyKey, err)
+		}
+
+		err = s.putSSEObject(ctx, s3Client, userConfigKey(userID, name), data, func(input *s3.PutObjectInput) {
+			input.IfNoneMatch = aws.String("*")
+		})
+		if err != nil && !IsPreconditionFailed(err) {
+			return fmt.Errorf("failed to migrate %s: %w", legacyKey, err)
+		}
+
+		_, err = userClient.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(legacyKey),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", legacyKey, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) getSSEObject(ctx context.Context, s3Client *s3.Client, key string) ([]byte, error) {
+	output, err := s.getObject(ctx, s3Client, key)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
+
+func (s *Store) putSSEObject(ctx context.Context, s3Client *s3.Client, key string, data []byte, condition func(*s3.PutObjectInput)) error {
+	algo, sseKey, sseKeyMD5 := s.getSSEParams()
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		SSECustomerAlgorithm: aws.String(algo),
+		SSECustomerKey:       aws.String(sseKey),
+		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
+		Metadata:             s.keyMetadata(),
+	}
+	if condition != nil {
+		condition(input)
+	}
+	_, err := s3Client.PutObject(ctx, input)
+	return err
+}
@@ -0,0 +1,190 @@
+package s3store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// UserKeyRotationStorage implementation
+
+// userKeyVersionMetadata is the metadata recording which version of the user
+// key encrypts an object of the user. The apps set it on upload.
+const userKeyVersionMetadata = "user-key-version"
+
+// pendingUserKeyRotationsPrefix holds an empty marker per user whose key
+// rotation did not complete, so that they are resumed after a restart.
+const pendingUserKeyRotationsPrefix = "system/user-key-rotations/"
+
+func (s *Store) ListUserObjects(ctx context.Context, userID string, after string, limit int) ([]string, error) {
+	s3Client, err := s.backend.DataClient(ctx, userID)
+	if errors.Is(err, ErrNoUserClient) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:     aws.String(s.bucket),
+		Prefix:     aws.String(fmt.Sprintf("users/%s/", userID)),
+		StartAfter: aws.String(after),
+		MaxKeys:    aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects of %s: %w", userID, err)
+	}
+	keys := make([]string, len(output.Contents))
+	for i, object := range output.Contents {
+		keys[i] = aws.ToString(object.Key)
+	}
+	return keys, nil
+}
+
+// RotateUserObject copies an object onto itself, decrypting it with the
+// version of the user key that encrypts it and encrypting it with the active
+// one. Objects that are not encrypted are left alone.
+func (s *Store) RotateUserObject(ctx context.Context, userID string, key string, keys domain.UserKeys) (bool, error) {
+	s3Client, err := s.backend.DataClient(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}); err == nil {
+		return false, nil
+	}
+	userKey, head, err := s.headUserObject(ctx, s3Client, key, keys)
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	active := keys.Active()
+	if userKey.Version == active.Version {
+		return false, nil
+	}
+
+	metadata := map[string]string{}
+	for name, value := range head.Metadata {
+		metadata[name] = value
+	}
+	metadata[userKeyVersionMetadata] = strconv.Itoa(active.Version)
+	sourceAlgo, sourceKey, sourceKeyMD5 := sseParams(userKey.Key)
+	algo, sseKey, sseKeyMD5 := sseParams(active.Key)
+	_, err = s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:                         aws.String(s.bucket),
+		Key:                            aws.String(key),
+		CopySource:                     aws.String(copySource(s.bucket, key)),
+		CopySourceIfMatch:              head.ETag,
+		CopySourceSSECustomerAlgorithm: aws.String(sourceAlgo),
+		CopySourceSSECustomerKey:       aws.String(sourceKey),
+		CopySourceSSECustomerKeyMD5:    aws.String(sourceKeyMD5),
+		SSECustomerAlgorithm:           aws.String(algo),
+		SSECustomerKey:                 aws.String(sseKey),
+		SSECustomerKeyMD5:              aws.String(sseKeyMD5),
+		ContentType:                    head.ContentType,
+		Metadata:                       metadata,
+		MetadataDirective:              types.MetadataDirectiveReplace,
+	})
+	if IsPreconditionFailed(err) {
+		// Written again since, by an app holding the active key.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to re-encrypt %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// headUserObject tries the versions of the user key from the newest, as the
+// objects of earlier rotations use it.
+func (s *Store) headUserObject(ctx context.Context, s3Client *s3.Client, key string, keys domain.UserKeys) (domain.UserKey, *s3.HeadObjectOutput, error) {
+	var firstErr error
+	for _, userKey := range append(domain.UserKeys{keys.Active()}, keys.Previous()...) {
+		algo, sseKey, sseKeyMD5 := sseParams(userKey.Key)
+		output, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(s.bucket),
+			Key:                  aws.String(key),
+			SSECustomerAlgorithm: aws.String(algo),
+			SSECustomerKey:       aws.String(sseKey),
+			SSECustomerKeyMD5:    aws.String(sseKeyMD5),
+		})
+		if err == nil || !isWrongSSEKey(err) {
+			return userKey, output, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return domain.UserKey{}, nil, firstErr
+}
+
+func (s *Store) GetUserKeyRotation(ctx context.Context, userID string) (*domain.UserKeyRotation, error) {
+	var rotation domain.UserKeyRotation
+	err := s.GetServiceObject(ctx, userConfigKey(userID, "key-rotation.json"), &rotation)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key rotation from S3: %w", err)
+	}
+	return &rotation, nil
+}
+
+// SaveUserKeyRotation also marks the rotation as pending until it completes.
+func (s *Store) SaveUserKeyRotation(ctx context.Context, userID string, rotation *domain.UserKeyRotation) error {
+	if err := s.putServiceObject(ctx, userConfigKey(userID, "key-rotation.json"), rotation, false); err != nil {
+		return fmt.Errorf("failed to save key rotation to S3: %w", err)
+	}
+
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	marker := pendingUserKeyRotationsPrefix + userID
+	if rotation.CompletedAt != nil {
+		_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(marker),
+		})
+	} else {
+		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(marker),
+			Body:   strings.NewReader(""),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update pending key rotations: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) ListPendingUserKeyRotations(ctx context.Context) ([]string, error) {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s.ListObjects(ctx, s3Client, pendingUserKeyRotationsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]string, 0, len(objects))
+	for key := range objects {
+		userIDs = append(userIDs, strings.TrimPrefix(key, pendingUserKeyRotationsPrefix))
+	}
+	return userIDs, nil
+}
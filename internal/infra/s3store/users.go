@@ -0,0 +1,302 @@
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// UserStorage implementation
+
+type passkeyUserRecord struct {
+	Email       string                     `json:"email"`
+	UserHandle  []byte                     `json:"user_handle,omitempty"`
+	Credentials []domain.PasskeyCredential `json:"credentials"`
+}
+
+// handle returns the WebAuthn user handle, which was the email before handles
+// were stored.
+func (r passkeyUserRecord) handle() []byte {
+	if len(r.UserHandle) == 0 {
+		return []byte(r.Email)
+	}
+	return r.UserHandle
+}
+
+func (s *Store) GetUser(ctx context.Context, userID string) (domain.PasskeyUser, error) {
+	data, err := s.getUserConfig(ctx, userID, "passkeys.json")
+	if errors.Is(err, errUserConfigNotFound) {
+		return nil, domain.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user from S3: %w", err)
+	}
+
+	var record passkeyUserRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode user record: %w", err)
+	}
+
+	return &domain.PasskeyUserEntity{
+		UserID:      userID,
+		Email:       record.Email,
+		UserHandle:  record.handle(),
+		Credentials: record.Credentials,
+	}, nil
+}
+
+func (s *Store) SaveUser(ctx context.Context, userID string, user domain.PasskeyUser) error {
+	record := passkeyUserRecord{
+		Email:       user.WebAuthnName(),
+		UserHandle:  user.WebAuthnID(),
+		Credentials: user.GetCredentials(),
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user record: %w", err)
+	}
+	if err := s.putUserConfig(ctx, userID, "passkeys.json", data); err != nil {
+		return fmt.Errorf("failed to save user to S3: %w", err)
+	}
+	return nil
+}
+
+// userKeysRecord is stored in secret.key. The file held the raw key before
+// versions existed.
+type userKeysRecord struct {
+	Keys []userKeyRecord `json:"keys"`
+}
+
+type userKeyRecord struct {
+	Version   int       `json:"version"`
+	Key       []byte    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Store) GetUserKeys(ctx context.Context, userID string) (domain.UserKeys, error) {
+	data, err := s.getUserConfig(ctx, userID, "secret.key")
+	if errors.Is(err, errUserConfigNotFound) {
+		return nil, domain.ErrUserKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user key from S3: %w", err)
+	}
+
+	var record userKeysRecord
+	if err := json.Unmarshal(data, &record); err != nil || len(record.Keys) == 0 {
+		return domain.UserKeys{{Version: 1, Key: data}}, nil
+	}
+	keys := make(domain.UserKeys, len(record.Keys))
+	for i, key := range record.Keys {
+		keys[i] = domain.UserKey{Version: key.Version, Key: key.Key, CreatedAt: key.CreatedAt}
+	}
+	return keys, nil
+}
+
+func (s *Store) SaveUserKeys(ctx context.Context, userID string, keys domain.UserKeys) error {
+	record := userKeysRecord{Keys: make([]userKeyRecord, len(keys))}
+	for i, key := range keys {
+		record.Keys[i] = userKeyRecord{Version: key.Version, Key: key.Key, CreatedAt: key.CreatedAt}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user keys: %w", err)
+	}
+	if err := s.putUserConfig(ctx, userID, "secret.key", data); err != nil {
+		return fmt.Errorf("failed to save user key to S3: %w", err)
+	}
+	return nil
+}
+
+// UserHandleStorage implementation
+
+// userHandleRecord only has Email for handles saved before account IDs
+// existed; those accounts use their email as ID.
+type userHandleRecord struct {
+	UserID string `json:"user_id,omitempty"`
+	Email  string `json:"email,omitempty"`
+}
+
+func (s *Store) GetUserIDByUserHandle(ctx context.Context, handle []byte) (string, error) {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("system/passkey-handles/%s.json", base64.RawURLEncoding.EncodeToString(handle))
+	output, err := s.getObject(ctx, s3Client, key)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return "", domain.ErrUserNotFound
+		}
+		return "", fmt.Errorf("failed to get user handle from S3: %w", err)
+	}
+	defer output.Body.Close()
+
+	var record userHandleRecord
+	if err := json.NewDecoder(output.Body).Decode(&record); err != nil {
+		return "", fmt.Errorf("failed to decode user handle record: %w", err)
+	}
+	if record.UserID == "" {
+		return record.Email, nil
+	}
+	return record.UserID, nil
+}
+
+func (s *Store) SaveUserHandle(ctx context.Context, handle []byte, userID string) error {
+	s3Client, err := s.backend.ServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(userHandleRecord{UserID: userID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal user handle record: %w", err)
+	}
+
+	key := fmt.Sprintf("system/passkey-handles/%s.json", base64.RawURLEncoding.EncodeToString(handle))
+	algo, sseKey, sseKeyMD5 := s.getSSEParams()
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		SSECustomerAlgorithm: aws.String(algo),
+		SSECustomerKey:       aws.String(sseKey),
+		SSECustomerKeyMD5:    aws.String(sseKeyMD5),
+		Metadata:             s.keyMetadata(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save user handle to S3: %w", err)
+	}
+
+	return nil
+}
+
+// SessionStorage implementation
+
+const sessionUpdateAttempts = 5
+
+type sessionsRecord struct {
+	Sessions []domain.Session `json:"sessions"`
+}
+
+func (s *Store) GetSessions(ctx context.Context, userID string) ([]domain.Session, error) {
+	data, err := s.getUserConfig(ctx, userID, "sessions.json")
+	if errors.Is(err, errUserConfigNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions from S3: %w", err)
+	}
+
+	var record sessionsRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode sessions record: %w", err)
+	}
+	return record.Sessions, nil
+}
+
+// UpdateSessions writes the sessions back only if nobody changed them
+// meanwhile: every device of the user updates the same object, and a lost
+// refresh would otherwise bring back a rotated token.
+func (s *Store) UpdateSessions(ctx context.Context, userID string, update func([]domain.Session) ([]domain.Session, error)) error {
+	for attempt := 0; ; attempt++ {
+		var record sessionsRecord
+		data, etag, err := s.getUserConfigETag(ctx, userID, "sessions.json")
+		if err != nil && !errors.Is(err, errUserConfigNotFound) {
+			return fmt.Errorf("failed to get sessions from S3: %w", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("failed to decode sessions record: %w", err)
+			}
+		}
+
+		sessions, err := update(record.Sessions)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(sessionsRecord{Sessions: sessions}); err != nil {
+			return fmt.Errorf("failed to marshal sessions record: %w", err)
+		}
+		err = s.putUserConfigIfMatch(ctx, userID, "sessions.json", data, etag)
+		if err == nil {
+			return nil
+		}
+		if !IsPreconditionFailed(err) || attempt+1 == sessionUpdateAttempts {
+			return fmt.Errorf("failed to save sessions to S3: %w", err)
+		}
+	}
+}
+
+// TOTPStorage implementation
+
+const totpUpdateAttempts = 5
+
+func (s *Store) GetTOTP(ctx context.Context, userID string) (*domain.TOTPConfig, error) {
+	data, err := s.getUserConfig(ctx, userID, "totp.json")
+	if errors.Is(err, errUserConfigNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TOTP configuration from S3: %w", err)
+	}
+
+	var config domain.TOTPConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode TOTP configuration: %w", err)
+	}
+	return &config, nil
+}
+
+// UpdateTOTP writes the configuration back only if nobody changed it
+// meanwhile, like UpdateSessions: the last accepted step and the used
+// recovery codes must not be lost to a concurrent verification.
+func (s *Store) UpdateTOTP(ctx context.Context, userID string, update func(*domain.TOTPConfig) (*domain.TOTPConfig, error)) error {
+	for attempt := 0; ; attempt++ {
+		var current *domain.TOTPConfig
+		data, etag, err := s.getUserConfigETag(ctx, userID, "totp.json")
+		if err != nil && !errors.Is(err, errUserConfigNotFound) {
+			return fmt.Errorf("failed to get TOTP configuration from S3: %w", err)
+		}
+		if err == nil {
+			current = &domain.TOTPConfig{}
+			if err := json.Unmarshal(data, current); err != nil {
+				return fmt.Errorf("failed to decode TOTP configuration: %w", err)
+			}
+		}
+
+		config, err := update(current)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(config); err != nil {
+			return fmt.Errorf("failed to marshal TOTP configuration: %w", err)
+		}
+		err = s.putUserConfigIfMatch(ctx, userID, "totp.json", data, etag)
+		if err == nil {
+			return nil
+		}
+		if !IsPreconditionFailed(err) || attempt+1 == totpUpdateAttempts {
+			return fmt.Errorf("failed to save TOTP configuration to S3: %w", err)
+		}
+	}
+}
+
+func (s *Store) DeleteTOTP(ctx context.Context, userID string) error {
+	if err := s.deleteUserConfig(ctx, userID, "totp.json"); err != nil {
+		return fmt.Errorf("failed to delete TOTP configuration from S3: %w", err)
+	}
+	return nil
+}
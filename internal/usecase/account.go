@@ -0,0 +1,397 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type AccountUseCase struct {
+	storage      domain.AccountStorage
+	data         domain.AccountDataStorage
+	userStorage  domain.UserStorage
+	handles      domain.UserHandleStorage
+	registration *RegistrationUseCase
+	now          func() time.Time
+}
+
+func NewAccountUseCase(storage domain.AccountStorage, data domain.AccountDataStorage, userStorage domain.UserStorage, handles domain.UserHandleStorage, registration *RegistrationUseCase) *AccountUseCase {
+	return &AccountUseCase{
+		storage:      storage,
+		data:         data,
+		userStorage:  userStorage,
+		handles:      handles,
+		registration: registration,
+		now:          time.Now,
+	}
+}
+
+// Resolve sets the account of a freshly authenticated user. An identity seen
+// for the first time joins the account that owns the same verified email, or
+// a new account when there is none and the registration mode admits it,
+// possibly with the invitation code.
+func (uc *AccountUseCase) Resolve(ctx context.Context, user *domain.UserInfo, invite string) error {
+	if user.UserID != "" {
+		return nil
+	}
+	identity := identityOf(user, uc.now())
+
+	id, err := uc.storage.GetAccountIDByIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		user.UserID = id
+		return uc.resumeEmailChange(ctx, user)
+	}
+	if !errors.Is(err, domain.ErrIdentityNotFound) {
+		return fmt.Errorf("failed to look up identity: %w", err)
+	}
+
+	account, err := uc.accountByEmail(ctx, user.Email)
+	if errors.Is(err, domain.ErrAccountNotFound) {
+		account, err = uc.create(ctx, user.Email, invite)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := uc.link(ctx, account, identity); err != nil {
+		return err
+	}
+	user.UserID = account.ID
+	return nil
+}
+
+// Lookup returns the ID of the account a user can log in to with this email.
+func (uc *AccountUseCase) Lookup(ctx context.Context, email string) (string, error) {
+	account, err := uc.accountByEmail(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	return account.ID, nil
+}
+
+func (uc *AccountUseCase) Get(ctx context.Context, user *domain.UserInfo) (*domain.Account, error) {
+	return uc.storage.GetAccount(ctx, user.UserID)
+}
+
+// Link adds the identity another authenticator just verified to the account.
+func (uc *AccountUseCase) Link(ctx context.Context, user *domain.UserInfo, linked *domain.UserInfo) (*domain.Identity, error) {
+	account, err := uc.storage.GetAccount(ctx, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	identity := identityOf(linked, uc.now())
+
+	// A legacy account owns its email even before it has logged in again.
+	if identity.Provider == domain.IdentityProviderEmail && linked.Email != account.ID {
+		legacy, err := uc.storage.LegacyAccountExists(ctx, linked.Email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up legacy account: %w", err)
+		}
+		if legacy {
+			return nil, domain.ErrIdentityAlreadyLinked
+		}
+	}
+
+	if err := uc.link(ctx, account, identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// Unlink removes a login method. The last one cannot be removed, otherwise
+// the library could only be reached with passkeys, if any.
+func (uc *AccountUseCase) Unlink(ctx context.Context, user *domain.UserInfo, identityID string) error {
+	account, err := uc.storage.GetAccount(ctx, user.UserID)
+	if err != nil {
+		return err
+	}
+	identity, ok := account.RemoveIdentity(identityID)
+	if !ok {
+		return domain.ErrIdentityNotFound
+	}
+	if len(account.Identities) == 0 {
+		return domain.ErrLastIdentity
+	}
+
+	if err := uc.storage.SaveAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+	if err := uc.storage.UnlinkIdentity(ctx, identity.Provider, identity.Subject); err != nil {
+		return fmt.Errorf("failed to unlink identity: %w", err)
+	}
+	return nil
+}
+
+// CheckEmail returns ErrEmailInUse if the email cannot become the address of
+// the user's account.
+func (uc *AccountUseCase) CheckEmail(ctx context.Context, user *domain.UserInfo, email string) error {
+	id, err := uc.storage.GetAccountIDByIdentity(ctx, domain.IdentityProviderEmail, domain.NormalizeEmail(email))
+	if err == nil && id != user.UserID {
+		return domain.ErrEmailInUse
+	}
+	if err != nil && !errors.Is(err, domain.ErrIdentityNotFound) {
+		return fmt.Errorf("failed to look up email identity: %w", err)
+	}
+	if email == user.UserID {
+		return nil
+	}
+	legacy, err := uc.storage.LegacyAccountExists(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to look up legacy account: %w", err)
+	}
+	if legacy {
+		return domain.ErrEmailInUse
+	}
+	return nil
+}
+
+// ChangeEmail replaces the email of the account by an address the user has
+// just proven to own. Accounts still keyed by their email move to a new ID so
+// that the next change does not have to move anything. The user is updated
+// with the new email and ID.
+func (uc *AccountUseCase) ChangeEmail(ctx context.Context, user *domain.UserInfo, email string) error {
+	if err := uc.resumeEmailChange(ctx, user); err != nil {
+		return err
+	}
+	if err := uc.CheckEmail(ctx, user, email); err != nil {
+		return err
+	}
+	account, err := uc.storage.GetAccount(ctx, user.UserID)
+	if err != nil {
+		return err
+	}
+
+	// Reserve the new address before anything moves.
+	err = uc.storage.LinkIdentity(ctx, domain.IdentityProviderEmail, domain.NormalizeEmail(email), account.ID)
+	if errors.Is(err, domain.ErrIdentityAlreadyLinked) {
+		return domain.ErrEmailInUse
+	}
+	if err != nil {
+		return fmt.Errorf("failed to link email: %w", err)
+	}
+
+	change := &domain.EmailChange{Email: email, StartedAt: uc.now()}
+	if account.KeyedByEmail() {
+		change.FromID = account.ID
+		if change.ToID, err = randomID(); err != nil {
+			return err
+		}
+	}
+	account.EmailChange = change
+	if err := uc.storage.SaveAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+	return uc.finishEmailChange(ctx, account, user)
+}
+
+// resumeEmailChange finishes an email change that was interrupted.
+func (uc *AccountUseCase) resumeEmailChange(ctx context.Context, user *domain.UserInfo) error {
+	account, err := uc.storage.GetAccount(ctx, user.UserID)
+	if errors.Is(err, domain.ErrAccountNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if account.EmailChange == nil {
+		return nil
+	}
+	return uc.finishEmailChange(ctx, account, user)
+}
+
+func (uc *AccountUseCase) finishEmailChange(ctx context.Context, account *domain.Account, user *domain.UserInfo) error {
+	change := account.EmailChange
+	if change.ToID != "" {
+		if err := uc.moveAccount(ctx, account); err != nil {
+			return fmt.Errorf("failed to move account %s: %w", change.FromID, err)
+		}
+		account.ID = change.ToID
+	}
+
+	previous := domain.NormalizeEmail(account.Email)
+	newEmail := identityOf(&domain.UserInfo{Email: change.Email}, change.StartedAt)
+	if previous != newEmail.Subject {
+		if old, ok := account.RemoveIdentity(domain.IdentityID(domain.IdentityProviderEmail, previous)); ok {
+			if err := uc.storage.UnlinkIdentity(ctx, old.Provider, old.Subject); err != nil {
+				return fmt.Errorf("failed to unlink previous email: %w", err)
+			}
+		}
+	}
+	account.AddIdentity(newEmail)
+	account.Email = change.Email
+	if change.ToID == "" {
+		if err := uc.renamePasskeyUser(ctx, account.ID, account.ID, change.Email); err != nil {
+			return err
+		}
+	}
+
+	account.EmailChange = nil
+	if err := uc.storage.SaveAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+	if change.ToID != "" {
+		if err := uc.storage.DeleteAccount(ctx, change.FromID); err != nil {
+			return fmt.Errorf("failed to delete previous account record: %w", err)
+		}
+	}
+
+	user.UserID = account.ID
+	user.Email = account.Email
+	return nil
+}
+
+// moveAccount moves the objects, identities and passkey handles of an account
+// keyed by email to its new ID. The previous account record is kept, with the
+// change in progress, until the move is over.
+func (uc *AccountUseCase) moveAccount(ctx context.Context, account *domain.Account) error {
+	change := account.EmailChange
+	if err := uc.data.BeginUserMove(ctx, change.FromID, change.ToID); err != nil {
+		return err
+	}
+	keys, err := uc.userStorage.GetUserKeys(ctx, change.FromID)
+	if err != nil && !errors.Is(err, domain.ErrUserKeyNotFound) {
+		return fmt.Errorf("failed to get user key: %w", err)
+	}
+	if err := uc.data.CopyUserData(ctx, change.FromID, change.ToID, keys); err != nil {
+		return err
+	}
+
+	moved := *account
+	moved.ID = change.ToID
+	if err := uc.storage.SaveAccount(ctx, &moved); err != nil {
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+	for _, identity := range account.Identities {
+		if err := uc.storage.MoveIdentity(ctx, identity.Provider, identity.Subject, change.FromID, change.ToID); err != nil {
+			return fmt.Errorf("failed to move identity: %w", err)
+		}
+	}
+	err = uc.storage.MoveIdentity(ctx, domain.IdentityProviderEmail, domain.NormalizeEmail(change.Email), change.FromID, change.ToID)
+	if err != nil {
+		return fmt.Errorf("failed to move identity: %w", err)
+	}
+	if err := uc.renamePasskeyUser(ctx, change.FromID, change.ToID, change.Email); err != nil {
+		return err
+	}
+
+	if err := uc.data.DeleteUserData(ctx, change.FromID, change.ToID); err != nil {
+		return err
+	}
+	return uc.data.EndUserMove(ctx, change.ToID)
+}
+
+// renamePasskeyUser updates the name shown by authenticators. Passkeys keep
+// their user handle, which must now lead to the new ID.
+func (uc *AccountUseCase) renamePasskeyUser(ctx context.Context, fromID string, toID string, email string) error {
+	user, err := uc.userStorage.GetUser(ctx, toID)
+	if errors.Is(err, domain.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get passkeys: %w", err)
+	}
+
+	handle := user.WebAuthnID()
+	if fromID != toID {
+		if err := uc.handles.SaveUserHandle(ctx, handle, toID); err != nil {
+			return fmt.Errorf("failed to save passkey user handle: %w", err)
+		}
+	}
+	err = uc.userStorage.SaveUser(ctx, toID, &domain.PasskeyUserEntity{
+		UserID:      toID,
+		Email:       email,
+		UserHandle:  handle,
+		Credentials: user.GetCredentials(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save passkeys: %w", err)
+	}
+	return nil
+}
+
+// accountByEmail finds the account of an email identity. Accounts created
+// before account IDs existed are keyed by their email and get their account
+// record on first use.
+func (uc *AccountUseCase) accountByEmail(ctx context.Context, email string) (*domain.Account, error) {
+	id, err := uc.storage.GetAccountIDByIdentity(ctx, domain.IdentityProviderEmail, domain.NormalizeEmail(email))
+	if err == nil {
+		return uc.storage.GetAccount(ctx, id)
+	}
+	if !errors.Is(err, domain.ErrIdentityNotFound) {
+		return nil, fmt.Errorf("failed to look up email identity: %w", err)
+	}
+
+	legacy, err := uc.storage.LegacyAccountExists(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up legacy account: %w", err)
+	}
+	if !legacy {
+		return nil, domain.ErrAccountNotFound
+	}
+
+	account, err := uc.storage.GetAccount(ctx, email)
+	if errors.Is(err, domain.ErrAccountNotFound) {
+		account = &domain.Account{ID: email, Email: email, CreatedAt: uc.now()}
+		err = uc.storage.SaveAccount(ctx, account)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load legacy account: %w", err)
+	}
+	if err := uc.link(ctx, account, identityOf(&domain.UserInfo{Email: email}, uc.now())); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (uc *AccountUseCase) create(ctx context.Context, email string, invite string) (*domain.Account, error) {
+	if err := uc.registration.Admit(ctx, email, invite); err != nil {
+		return nil, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	account := &domain.Account{ID: id, Email: email, CreatedAt: uc.now()}
+	if err := uc.storage.SaveAccount(ctx, account); err != nil {
+		return nil, fmt.Errorf("failed to save account: %w", err)
+	}
+	if err := uc.link(ctx, account, identityOf(&domain.UserInfo{Email: email}, uc.now())); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// link records the identity both in its lookup index, which decides who owns
+// it, and in the account so that it can be listed.
+func (uc *AccountUseCase) link(ctx context.Context, account *domain.Account, identity domain.Identity) error {
+	err := uc.storage.LinkIdentity(ctx, identity.Provider, identity.Subject, account.ID)
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	if account.AddIdentity(identity) {
+		if err := uc.storage.SaveAccount(ctx, account); err != nil {
+			return fmt.Errorf("failed to save account: %w", err)
+		}
+	}
+	return nil
+}
+
+func identityOf(user *domain.UserInfo, now time.Time) domain.Identity {
+	if user.Provider == "" || user.Provider == domain.IdentityProviderEmail {
+		return domain.Identity{
+			Provider: domain.IdentityProviderEmail,
+			Subject:  domain.NormalizeEmail(user.Email),
+			Email:    user.Email,
+			LinkedAt: now,
+		}
+	}
+	return domain.Identity{
+		Provider: user.Provider,
+		Subject:  user.Subject,
+		Email:    user.Email,
+		LinkedAt: now,
+	}
+}
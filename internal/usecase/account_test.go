@@ -0,0 +1,366 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockAccountStorage struct {
+	accounts   map[string]domain.Account
+	identities map[string]string
+	legacy     map[string]bool
+}
+
+func newMockAccountStorage() *mockAccountStorage {
+	return &mockAccountStorage{
+		accounts:   map[string]domain.Account{},
+		identities: map[string]string{},
+		legacy:     map[string]bool{},
+	}
+}
+
+func (m *mockAccountStorage) GetAccount(ctx context.Context, id string) (*domain.Account, error) {
+	account, ok := m.accounts[id]
+	if !ok {
+		return nil, domain.ErrAccountNotFound
+	}
+	account.Identities = append([]domain.Identity(nil), account.Identities...)
+	return &account, nil
+}
+
+func (m *mockAccountStorage) SaveAccount(ctx context.Context, account *domain.Account) error {
+	saved := *account
+	saved.Identities = append([]domain.Identity(nil), account.Identities...)
+	m.accounts[account.ID] = saved
+	return nil
+}
+
+func (m *mockAccountStorage) GetAccountIDByIdentity(ctx context.Context, provider string, subject string) (string, error) {
+	id, ok := m.identities[domain.IdentityID(provider, subject)]
+	if !ok {
+		return "", domain.ErrIdentityNotFound
+	}
+	return id, nil
+}
+
+func (m *mockAccountStorage) LinkIdentity(ctx context.Context, provider string, subject string, accountID string) error {
+	key := domain.IdentityID(provider, subject)
+	if id, ok := m.identities[key]; ok && id != accountID {
+		return domain.ErrIdentityAlreadyLinked
+	}
+	m.identities[key] = accountID
+	return nil
+}
+
+func (m *mockAccountStorage) UnlinkIdentity(ctx context.Context, provider string, subject string) error {
+	delete(m.identities, domain.IdentityID(provider, subject))
+	return nil
+}
+
+func (m *mockAccountStorage) MoveIdentity(ctx context.Context, provider string, subject string, fromID string, toID string) error {
+	key := domain.IdentityID(provider, subject)
+	if id, ok := m.identities[key]; ok && id != fromID && id != toID {
+		return domain.ErrIdentityAlreadyLinked
+	}
+	m.identities[key] = toID
+	return nil
+}
+
+func (m *mockAccountStorage) DeleteAccount(ctx context.Context, id string) error {
+	delete(m.accounts, id)
+	return nil
+}
+
+func (m *mockAccountStorage) LegacyAccountExists(ctx context.Context, email string) (bool, error) {
+	return m.legacy[email], nil
+}
+
+// mockAccountData keeps the objects of each account as a set of names.
+type mockAccountData struct {
+	objects  map[string]map[string]bool
+	failCopy bool
+	// keys are the user keys the last copy was given.
+	keys domain.UserKeys
+}
+
+func (m *mockAccountData) BeginUserMove(ctx context.Context, fromID string, toID string) error {
+	return nil
+}
+
+func (m *mockAccountData) CopyUserData(ctx context.Context, fromID string, toID string, keys domain.UserKeys) error {
+	m.keys = keys
+	if m.failCopy {
+		m.failCopy = false
+		return errors.New("connection reset")
+	}
+	if m.objects[toID] == nil {
+		m.objects[toID] = map[string]bool{}
+	}
+	for name := range m.objects[fromID] {
+		m.objects[toID][name] = true
+	}
+	return nil
+}
+
+func (m *mockAccountData) DeleteUserData(ctx context.Context, fromID string, toID string) error {
+	delete(m.objects, fromID)
+	return nil
+}
+
+func (m *mockAccountData) EndUserMove(ctx context.Context, toID string) error {
+	return nil
+}
+
+type mockUserHandleStorage struct {
+	handles map[string]string
+}
+
+func (m *mockUserHandleStorage) GetUserIDByUserHandle(ctx context.Context, handle []byte) (string, error) {
+	id, ok := m.handles[string(handle)]
+	if !ok {
+		return "", domain.ErrUserNotFound
+	}
+	return id, nil
+}
+
+func (m *mockUserHandleStorage) SaveUserHandle(ctx context.Context, handle []byte, userID string) error {
+	m.handles[string(handle)] = userID
+	return nil
+}
+
+func newTestAccountUseCase(storage *mockAccountStorage) (*AccountUseCase, *mockAccountData, *mockUserStorage, *mockUserHandleStorage) {
+	data := &mockAccountData{objects: map[string]map[string]bool{}}
+	users := &mockUserStorage{users: map[string]domain.PasskeyUser{}}
+	users.getUserKeysFunc = func(ctx context.Context, userID string) (domain.UserKeys, error) {
+		return domain.UserKeys{{Version: 1, Key: []byte(userID + "-key")}}, nil
+	}
+	handles := &mockUserHandleStorage{handles: map[string]string{}}
+	registration := NewRegistrationUseCase(domain.RegistrationOpen, nil, nil)
+	return NewAccountUseCase(storage, data, users, handles, registration), data, users, handles
+}
+
+func TestAccountUseCase_Resolve(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockAccountStorage()
+	uc, _, _, _ := newTestAccountUseCase(storage)
+
+	magicLink := &domain.UserInfo{Email: "Test@example.com", Provider: domain.IdentityProviderEmail}
+	if err := uc.Resolve(ctx, magicLink, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if magicLink.UserID == "" || magicLink.UserID == magicLink.Email {
+		t.Fatalf("expected a new opaque account ID, got %q", magicLink.UserID)
+	}
+
+	again := &domain.UserInfo{Email: "test@example.com", Provider: domain.IdentityProviderEmail}
+	if err := uc.Resolve(ctx, again, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.UserID != magicLink.UserID {
+		t.Errorf("expected the same account, got %q and %q", magicLink.UserID, again.UserID)
+	}
+
+	// A provider asserting the same verified email joins the account.
+	google := &domain.UserInfo{Email: "test@example.com", Provider: "google", Subject: "1234"}
+	if err := uc.Resolve(ctx, google, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if google.UserID != magicLink.UserID {
+		t.Errorf("expected google identity to join the email account, got %q", google.UserID)
+	}
+	if account := storage.accounts[magicLink.UserID]; len(account.Identities) != 2 {
+		t.Errorf("expected 2 identities, got %+v", account.Identities)
+	}
+
+	// Once linked, the provider subject wins even if the email changed.
+	renamed := &domain.UserInfo{Email: "renamed@example.com", Provider: "google", Subject: "1234"}
+	if err := uc.Resolve(ctx, renamed, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if renamed.UserID != magicLink.UserID {
+		t.Errorf("expected the linked account, got %q", renamed.UserID)
+	}
+}
+
+func TestAccountUseCase_ResolveLegacy(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockAccountStorage()
+	storage.legacy["old@example.com"] = true
+	uc, _, _, _ := newTestAccountUseCase(storage)
+
+	user := &domain.UserInfo{Email: "old@example.com", Provider: "google", Subject: "42"}
+	if err := uc.Resolve(ctx, user, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.UserID != "old@example.com" {
+		t.Errorf("expected legacy account to keep its email as ID, got %q", user.UserID)
+	}
+
+	id, err := uc.Lookup(ctx, "old@example.com")
+	if err != nil || id != "old@example.com" {
+		t.Errorf("expected lookup to find the legacy account, got %q, %v", id, err)
+	}
+	if _, err := uc.Lookup(ctx, "unknown@example.com"); !errors.Is(err, domain.ErrAccountNotFound) {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+}
+
+func TestAccountUseCase_LinkAndUnlink(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockAccountStorage()
+	storage.legacy["legacy@example.com"] = true
+	uc, _, _, _ := newTestAccountUseCase(storage)
+
+	alice := &domain.UserInfo{Email: "alice@example.com"}
+	bob := &domain.UserInfo{Email: "bob@example.com"}
+	for _, u := range []*domain.UserInfo{alice, bob} {
+		if err := uc.Resolve(ctx, u, ""); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	github := &domain.UserInfo{Email: "alice@users.example.com", Provider: "oidc:github", Subject: "alice"}
+	identity, err := uc.Link(ctx, alice, github)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := uc.Link(ctx, bob, github); !errors.Is(err, domain.ErrIdentityAlreadyLinked) {
+		t.Errorf("expected ErrIdentityAlreadyLinked, got %v", err)
+	}
+	if _, err := uc.Link(ctx, bob, &domain.UserInfo{Email: "legacy@example.com"}); !errors.Is(err, domain.ErrIdentityAlreadyLinked) {
+		t.Errorf("expected legacy email to be refused, got %v", err)
+	}
+
+	account, err := uc.Get(ctx, alice)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.Unlink(ctx, alice, "unknown"); !errors.Is(err, domain.ErrIdentityNotFound) {
+		t.Errorf("expected ErrIdentityNotFound, got %v", err)
+	}
+	for _, i := range account.Identities {
+		if i.ID() == identity.ID() {
+			continue
+		}
+		if err := uc.Unlink(ctx, alice, i.ID()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := uc.Unlink(ctx, alice, identity.ID()); !errors.Is(err, domain.ErrLastIdentity) {
+		t.Errorf("expected ErrLastIdentity, got %v", err)
+	}
+
+	// The unlinked email is free to create a new account.
+	again := &domain.UserInfo{Email: "alice@example.com"}
+	if err := uc.Resolve(ctx, again, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.UserID == alice.UserID {
+		t.Error("expected unlinked email to no longer reach the account")
+	}
+}
+
+func TestAccountUseCase_ChangeEmail(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockAccountStorage()
+	uc, data, users, _ := newTestAccountUseCase(storage)
+
+	user := &domain.UserInfo{Email: "alice@example.com"}
+	if err := uc.Resolve(ctx, user, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	users.users[user.UserID] = &domain.PasskeyUserEntity{UserID: user.UserID, Email: user.Email, UserHandle: []byte("handle")}
+	other := &domain.UserInfo{Email: "bob@example.com"}
+	if err := uc.Resolve(ctx, other, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := uc.ChangeEmail(ctx, user, "bob@example.com"); !errors.Is(err, domain.ErrEmailInUse) {
+		t.Fatalf("expected ErrEmailInUse, got %v", err)
+	}
+
+	id := user.UserID
+	if err := uc.ChangeEmail(ctx, user, "alice@new.example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.UserID != id || user.Email != "alice@new.example.com" {
+		t.Errorf("expected only the email to change, got %+v", user)
+	}
+	if len(data.objects) != 0 {
+		t.Error("expected no data to move for an account with an ID")
+	}
+	if users.users[id].WebAuthnName() != "alice@new.example.com" {
+		t.Error("expected passkey user to be renamed")
+	}
+
+	if _, err := uc.Lookup(ctx, "alice@example.com"); !errors.Is(err, domain.ErrAccountNotFound) {
+		t.Errorf("expected previous email to be released, got %v", err)
+	}
+	if got, err := uc.Lookup(ctx, "alice@new.example.com"); err != nil || got != id {
+		t.Errorf("expected new email to reach the account, got %q, %v", got, err)
+	}
+}
+
+func TestAccountUseCase_ChangeEmailMovesLegacyAccount(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockAccountStorage()
+	storage.legacy["old@example.com"] = true
+	uc, data, users, handles := newTestAccountUseCase(storage)
+	data.objects["old@example.com"] = map[string]bool{"secret.key": true, "config/passkeys.json": true, "2024/original/1.enc": true}
+	// Passkeys registered before handles were opaque use the email.
+	users.users["old@example.com"] = &domain.PasskeyUserEntity{UserID: "old@example.com", Email: "old@example.com", UserHandle: []byte("old@example.com")}
+
+	user := &domain.UserInfo{Email: "old@example.com"}
+	if err := uc.Resolve(ctx, user, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	google := &domain.UserInfo{Email: "old@example.com", Provider: "google", Subject: "42"}
+	if err := uc.Resolve(ctx, google, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The move fails halfway and resumes on the next login.
+	data.failCopy = true
+	if err := uc.ChangeEmail(ctx, user, "new@example.com"); err == nil {
+		t.Fatal("expected the move to fail")
+	}
+	if storage.accounts["old@example.com"].EmailChange == nil {
+		t.Fatal("expected the email change to be saved")
+	}
+	// The passkey user was copied along with the other objects.
+	users.users[storage.accounts["old@example.com"].EmailChange.ToID] = users.users["old@example.com"]
+
+	again := &domain.UserInfo{Email: "old@example.com", Provider: "google", Subject: "42"}
+	if err := uc.Resolve(ctx, again, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.UserID == "old@example.com" || again.Email != "new@example.com" {
+		t.Fatalf("expected the move to resume, got %+v", again)
+	}
+
+	if _, ok := data.objects["old@example.com"]; ok {
+		t.Error("expected previous objects to be deleted")
+	}
+	if string(data.keys.Active().Key) != "old@example.com-key" {
+		t.Errorf("expected the photos to be copied with the user key, got %v", data.keys)
+	}
+	if len(data.objects[again.UserID]) != 3 {
+		t.Errorf("expected objects to be copied, got %v", data.objects[again.UserID])
+	}
+	if _, ok := storage.accounts["old@example.com"]; ok {
+		t.Error("expected previous account record to be deleted")
+	}
+	account := storage.accounts[again.UserID]
+	if account.EmailChange != nil || account.Email != "new@example.com" || len(account.Identities) != 2 {
+		t.Errorf("unexpected account %+v", account)
+	}
+	if handles.handles["old@example.com"] != again.UserID {
+		t.Error("expected the legacy passkey handle to lead to the new ID")
+	}
+	if got, err := uc.Lookup(ctx, "new@example.com"); err != nil || got != again.UserID {
+		t.Errorf("expected new email to reach the moved account, got %q, %v", got, err)
+	}
+}
@@ -4,41 +4,91 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/snigle/photocloud/internal/domain"
 )
 
+// defaultCredentialsTTL bounds how long a leaked S3 key stays usable.
+const defaultCredentialsTTL = time.Hour
+
 type GetS3CredentialsUseCase struct {
-	storageRepo domain.StorageRepository
-	userStorage domain.UserStorage
+	storageRepo    domain.StorageRepository
+	userStorage    domain.UserStorage
+	credentialsTTL time.Duration
+	now            func() time.Time
 }
 
 func NewGetS3CredentialsUseCase(repo domain.StorageRepository, userStorage domain.UserStorage) *GetS3CredentialsUseCase {
 	return &GetS3CredentialsUseCase{
-		storageRepo: repo,
-		userStorage: userStorage,
+		storageRepo:    repo,
+		userStorage:    userStorage,
+		credentialsTTL: defaultCredentialsTTL,
+		now:            time.Now,
 	}
 }
 
-func (uc *GetS3CredentialsUseCase) Execute(ctx context.Context, email string) (*domain.S3Credentials, error) {
-	creds, err := uc.storageRepo.GetS3Credentials(ctx, email)
+// Execute issues the S3 credentials of the session of user. An empty scope
+// asks for the scope of the session.
+func (uc *GetS3CredentialsUseCase) Execute(ctx context.Context, user *domain.UserInfo, scope domain.CredentialScope) (*domain.S3Credentials, error) {
+	if scope == "" {
+		scope = user.Scope
+	}
+	if scope == "" {
+		scope = domain.CredentialScopeFull
+	}
+	if !user.Scope.Allows(scope) {
+		return nil, domain.ErrCredentialScopeDenied
+	}
+
+	creds, err := uc.storageRepo.IssueS3Credentials(ctx, user.UserID, user.SessionID, scope, uc.now().Add(uc.credentialsTTL))
 	if err != nil {
 		return nil, err
 	}
+	creds.Scope = scope
 
-	userKey, err := uc.userStorage.GetUserKey(ctx, email)
-	if err != nil {
-		// If key not found (or any error for this POC), generate a new one
-		userKey = make([]byte, 32)
-		if _, err := rand.Read(userKey); err != nil {
-			return nil, fmt.Errorf("failed to generate user key: %w", err)
+	keys, err := uc.userStorage.GetUserKeys(ctx, user.UserID)
+	if errors.Is(err, domain.ErrUserKeyNotFound) {
+		key, err := newUserKey(1, uc.now())
+		if err != nil {
+			return nil, err
 		}
-		if err := uc.userStorage.SaveUserKey(ctx, email, userKey); err != nil {
+		keys = domain.UserKeys{key}
+		if err := uc.userStorage.SaveUserKeys(ctx, user.UserID, keys); err != nil {
 			return nil, fmt.Errorf("failed to save user key: %w", err)
 		}
+	} else if err != nil {
+		// Never replace a key that could not be read: the photos encrypted
+		// with it would be lost.
+		return nil, fmt.Errorf("failed to get user key: %w", err)
 	}
 
-	creds.UserKey = base64.StdEncoding.EncodeToString(userKey)
+	active := keys.Active()
+	creds.UserKey = base64.StdEncoding.EncodeToString(active.Key)
+	creds.UserKeyVersion = active.Version
+	for _, key := range keys.Previous() {
+		creds.PreviousUserKeys = append(creds.PreviousUserKeys, domain.S3UserKey{
+			Version: key.Version,
+			Key:     base64.StdEncoding.EncodeToString(key.Key),
+		})
+	}
 	return creds, nil
 }
+
+// userKeySize is the size of the AES-256 keys of SSE-C.
+const userKeySize = 32
+
+func newUserKey(version int, now time.Time) (domain.UserKey, error) {
+	key := make([]byte, userKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return domain.UserKey{}, fmt.Errorf("failed to generate user key: %w", err)
+	}
+	return domain.UserKey{Version: version, Key: key, CreatedAt: now}, nil
+}
+
+// RevokeExpired deletes the keys of sessions that stopped refreshing them.
+func (uc *GetS3CredentialsUseCase) RevokeExpired(ctx context.Context) error {
+	return uc.storageRepo.RevokeExpiredS3Credentials(ctx)
+}
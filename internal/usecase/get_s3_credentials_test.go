@@ -2,66 +2,90 @@ package usecase
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/snigle/photocloud/internal/domain"
 )
 
 type mockStorageRepository struct {
-	getS3CredentialsFunc func(ctx context.Context, email string) (*domain.S3Credentials, error)
-	getUserKeyFunc       func(ctx context.Context, email string) ([]byte, error)
-	saveUserKeyFunc      func(ctx context.Context, email string, key []byte) error
+	issueS3CredentialsFunc func(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error)
+	getUserKeysFunc        func(ctx context.Context, userID string) (domain.UserKeys, error)
+	saveUserKeysFunc       func(ctx context.Context, userID string, keys domain.UserKeys) error
+	revoked                map[string][]string
 }
 
-func (m *mockStorageRepository) GetS3Credentials(ctx context.Context, email string) (*domain.S3Credentials, error) {
-	return m.getS3CredentialsFunc(ctx, email)
+func (m *mockStorageRepository) IssueS3Credentials(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error) {
+	return m.issueS3CredentialsFunc(ctx, userID, sessionID, scope, expiresAt)
 }
 
-func (m *mockStorageRepository) GetUserKey(ctx context.Context, email string) ([]byte, error) {
-	return m.getUserKeyFunc(ctx, email)
+func (m *mockStorageRepository) RevokeS3Credentials(ctx context.Context, userID string, sessionIDs []string) error {
+	if m.revoked == nil {
+		m.revoked = map[string][]string{}
+	}
+	m.revoked[userID] = append(m.revoked[userID], sessionIDs...)
+	return nil
+}
+
+func (m *mockStorageRepository) RevokeExpiredS3Credentials(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockStorageRepository) GetUserKeys(ctx context.Context, userID string) (domain.UserKeys, error) {
+	return m.getUserKeysFunc(ctx, userID)
 }
 
-func (m *mockStorageRepository) SaveUserKey(ctx context.Context, email string, key []byte) error {
-	return m.saveUserKeyFunc(ctx, email, key)
+func (m *mockStorageRepository) SaveUserKeys(ctx context.Context, userID string, keys domain.UserKeys) error {
+	return m.saveUserKeysFunc(ctx, userID, keys)
 }
 
 // Implement other methods to satisfy UserStorage interface
-func (m *mockStorageRepository) GetUser(ctx context.Context, email string) (domain.PasskeyUser, error) {
+func (m *mockStorageRepository) GetUser(ctx context.Context, userID string) (domain.PasskeyUser, error) {
 	return nil, nil
 }
-func (m *mockStorageRepository) SaveUser(ctx context.Context, email string, user domain.PasskeyUser) error {
+func (m *mockStorageRepository) SaveUser(ctx context.Context, userID string, user domain.PasskeyUser) error {
 	return nil
 }
 
 func TestGetS3CredentialsUseCase_Execute(t *testing.T) {
 	ctx := context.Background()
-	email := "test@example.com"
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := &domain.UserInfo{UserID: "account-1", Email: "test@example.com", SessionID: "session-1"}
 	expectedCreds := &domain.S3Credentials{
 		AccessKey: "access",
 		SecretKey: "secret",
 		Endpoint:  "https://s3.gra.io.cloud.ovh.net",
 		Region:    "gra",
 	}
+	previousKey := []byte("previous-user-key-of-32-bytes!!!")
 	userKey := []byte("01234567890123456789012345678901")
 
 	mockRepo := &mockStorageRepository{
-		getS3CredentialsFunc: func(ctx context.Context, email string) (*domain.S3Credentials, error) {
-			if email != "test@example.com" {
-				return nil, errors.New("unexpected email")
+		issueS3CredentialsFunc: func(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error) {
+			if userID != "account-1" || sessionID != "session-1" {
+				return nil, errors.New("unexpected user or session")
+			}
+			if scope != domain.CredentialScopeFull {
+				return nil, errors.New("unexpected scope")
+			}
+			if !expiresAt.Equal(now.Add(defaultCredentialsTTL)) {
+				return nil, errors.New("unexpected expiry")
 			}
 			return expectedCreds, nil
 		},
-		getUserKeyFunc: func(ctx context.Context, email string) ([]byte, error) {
-			return userKey, nil
+		getUserKeysFunc: func(ctx context.Context, userID string) (domain.UserKeys, error) {
+			return domain.UserKeys{{Version: 1, Key: previousKey}, {Version: 2, Key: userKey}}, nil
 		},
-		saveUserKeyFunc: func(ctx context.Context, email string, key []byte) error {
+		saveUserKeysFunc: func(ctx context.Context, userID string, keys domain.UserKeys) error {
 			return nil
 		},
 	}
 
 	uc := NewGetS3CredentialsUseCase(mockRepo, mockRepo)
-	creds, err := uc.Execute(ctx, email)
+	uc.now = func() time.Time { return now }
+	creds, err := uc.Execute(ctx, user, "")
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -70,4 +94,88 @@ func TestGetS3CredentialsUseCase_Execute(t *testing.T) {
 	if creds != expectedCreds {
 		t.Errorf("expected %+v, got %+v", expectedCreds, creds)
 	}
+	if creds.UserKey != base64.StdEncoding.EncodeToString(userKey) || creds.UserKeyVersion != 2 {
+		t.Errorf("expected the active user key, got %q version %d", creds.UserKey, creds.UserKeyVersion)
+	}
+	if len(creds.PreviousUserKeys) != 1 || creds.PreviousUserKeys[0] != (domain.S3UserKey{Version: 1, Key: base64.StdEncoding.EncodeToString(previousKey)}) {
+		t.Errorf("unexpected previous keys %+v", creds.PreviousUserKeys)
+	}
+}
+
+func TestGetS3CredentialsUseCase_Scope(t *testing.T) {
+	ctx := context.Background()
+	var issued []domain.CredentialScope
+	mockRepo := &mockStorageRepository{
+		issueS3CredentialsFunc: func(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error) {
+			issued = append(issued, scope)
+			return &domain.S3Credentials{AccessKey: "access"}, nil
+		},
+		getUserKeysFunc: func(ctx context.Context, userID string) (domain.UserKeys, error) {
+			return domain.UserKeys{{Version: 1, Key: make([]byte, 32)}}, nil
+		},
+	}
+	uc := NewGetS3CredentialsUseCase(mockRepo, mockRepo)
+
+	backup := &domain.UserInfo{UserID: "account-1", SessionID: "session-1", Scope: domain.CredentialScopeUpload}
+	creds, err := uc.Execute(ctx, backup, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.Scope != domain.CredentialScopeUpload {
+		t.Errorf("expected upload credentials, got %q", creds.Scope)
+	}
+	if _, err := uc.Execute(ctx, backup, domain.CredentialScopeFull); !errors.Is(err, domain.ErrCredentialScopeDenied) {
+		t.Errorf("expected ErrCredentialScopeDenied, got %v", err)
+	}
+	if _, err := uc.Execute(ctx, backup, domain.CredentialScopeRead); !errors.Is(err, domain.ErrCredentialScopeDenied) {
+		t.Errorf("expected ErrCredentialScopeDenied, got %v", err)
+	}
+
+	full := &domain.UserInfo{UserID: "account-1", SessionID: "session-2", Scope: domain.CredentialScopeFull}
+	if _, err := uc.Execute(ctx, full, domain.CredentialScopeRead); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(issued) != 2 || issued[1] != domain.CredentialScopeRead {
+		t.Errorf("unexpected issued scopes %v", issued)
+	}
+}
+
+func TestGetS3CredentialsUseCase_UserKey(t *testing.T) {
+	ctx := context.Background()
+	var saved domain.UserKeys
+	mockRepo := &mockStorageRepository{
+		issueS3CredentialsFunc: func(ctx context.Context, userID string, sessionID string, scope domain.CredentialScope, expiresAt time.Time) (*domain.S3Credentials, error) {
+			return &domain.S3Credentials{AccessKey: "access"}, nil
+		},
+		getUserKeysFunc: func(ctx context.Context, userID string) (domain.UserKeys, error) {
+			return nil, domain.ErrUserKeyNotFound
+		},
+		saveUserKeysFunc: func(ctx context.Context, userID string, keys domain.UserKeys) error {
+			saved = keys
+			return nil
+		},
+	}
+	uc := NewGetS3CredentialsUseCase(mockRepo, mockRepo)
+	user := &domain.UserInfo{UserID: "account-1", SessionID: "session-1"}
+
+	// The first credentials create the key.
+	creds, err := uc.Execute(ctx, user, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(saved) != 1 || len(saved[0].Key) != 32 || creds.UserKey != base64.StdEncoding.EncodeToString(saved[0].Key) || creds.UserKeyVersion != 1 {
+		t.Errorf("expected a new 32-byte key, got %q", creds.UserKey)
+	}
+
+	// A key that cannot be read is never replaced.
+	saved = nil
+	mockRepo.getUserKeysFunc = func(ctx context.Context, userID string) (domain.UserKeys, error) {
+		return nil, errors.New("vault unavailable")
+	}
+	if _, err := uc.Execute(ctx, user, ""); err == nil {
+		t.Error("expected the error to be returned")
+	}
+	if saved != nil {
+		t.Error("expected the key to be left alone")
+	}
 }
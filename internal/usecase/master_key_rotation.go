@@ -0,0 +1,94 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+var ErrRotationRunning = errors.New("a master key rotation is already running")
+
+// masterKeyRotationBatch is how many objects are rotated between two saves of
+// the progress, and so how many are visited again after a crash.
+const masterKeyRotationBatch = 100
+
+// MasterKeyRotationUseCase re-encrypts the server objects with the active
+// MASTER_KEY, so that the previous ones can be dropped from the keyring.
+type MasterKeyRotationUseCase struct {
+	storage domain.MasterKeyRotationStorage
+	batch   int
+	now     func() time.Time
+	running sync.Mutex
+}
+
+func NewMasterKeyRotationUseCase(storage domain.MasterKeyRotationStorage) *MasterKeyRotationUseCase {
+	return &MasterKeyRotationUseCase{
+		storage: storage,
+		batch:   masterKeyRotationBatch,
+		now:     time.Now,
+	}
+}
+
+func (uc *MasterKeyRotationUseCase) Status(ctx context.Context) (*domain.MasterKeyRotation, error) {
+	return uc.storage.GetMasterKeyRotation(ctx)
+}
+
+// Run resumes the rotation to the active MASTER_KEY where it stopped. A
+// completed rotation is only run again if some objects failed. progress is
+// called after every batch.
+func (uc *MasterKeyRotationUseCase) Run(ctx context.Context, progress func(*domain.MasterKeyRotation)) (*domain.MasterKeyRotation, error) {
+	if !uc.running.TryLock() {
+		return nil, ErrRotationRunning
+	}
+	defer uc.running.Unlock()
+
+	rotation, err := uc.storage.GetMasterKeyRotation(ctx)
+	if err != nil {
+		return nil, err
+	}
+	version := uc.storage.ActiveMasterKeyVersion()
+	switch {
+	case rotation == nil || rotation.Version != version:
+		rotation = &domain.MasterKeyRotation{Version: version, StartedAt: uc.now()}
+	case rotation.CompletedAt != nil && len(rotation.Failed) == 0:
+		return rotation, nil
+	case rotation.CompletedAt != nil:
+		rotation = &domain.MasterKeyRotation{Version: version, StartedAt: uc.now()}
+	}
+
+	for rotation.CompletedAt == nil {
+		if err := ctx.Err(); err != nil {
+			return rotation, err
+		}
+		keys, err := uc.storage.ListServiceObjects(ctx, rotation.LastKey, uc.batch)
+		if err != nil {
+			return rotation, err
+		}
+		for _, key := range keys {
+			rotated, err := uc.storage.RotateServiceObject(ctx, key)
+			if err != nil {
+				rotation.Failed = append(rotation.Failed, key)
+				rotation.LastError = err.Error()
+			}
+			if rotated {
+				rotation.Rotated++
+			}
+			rotation.Scanned++
+			rotation.LastKey = key
+		}
+		rotation.UpdatedAt = uc.now()
+		if len(keys) < uc.batch {
+			rotation.CompletedAt = &rotation.UpdatedAt
+		}
+		if err := uc.storage.SaveMasterKeyRotation(ctx, rotation); err != nil {
+			return rotation, err
+		}
+		if progress != nil {
+			progress(rotation)
+		}
+	}
+	return rotation, nil
+}
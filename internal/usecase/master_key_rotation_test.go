@@ -0,0 +1,166 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockMasterKeyRotationStorage struct {
+	version  string
+	objects  map[string]string // key: version of its master key
+	broken   map[string]bool
+	rotation *domain.MasterKeyRotation
+	saves    int
+	failSave int // save that fails, counting from 1
+}
+
+func (m *mockMasterKeyRotationStorage) ActiveMasterKeyVersion() string {
+	return m.version
+}
+
+func (m *mockMasterKeyRotationStorage) ListServiceObjects(ctx context.Context, after string, limit int) ([]string, error) {
+	var keys []string
+	for key := range m.objects {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (m *mockMasterKeyRotationStorage) RotateServiceObject(ctx context.Context, key string) (bool, error) {
+	if m.broken[key] {
+		return false, errors.New("no master key decrypts " + key)
+	}
+	if m.objects[key] == m.version {
+		return false, nil
+	}
+	m.objects[key] = m.version
+	return true, nil
+}
+
+func (m *mockMasterKeyRotationStorage) GetMasterKeyRotation(ctx context.Context) (*domain.MasterKeyRotation, error) {
+	if m.rotation == nil {
+		return nil, nil
+	}
+	rotation := *m.rotation
+	return &rotation, nil
+}
+
+func (m *mockMasterKeyRotationStorage) SaveMasterKeyRotation(ctx context.Context, rotation *domain.MasterKeyRotation) error {
+	m.saves++
+	if m.saves == m.failSave {
+		return errors.New("S3 unavailable")
+	}
+	saved := *rotation
+	m.rotation = &saved
+	return nil
+}
+
+func TestMasterKeyRotationUseCase_Run(t *testing.T) {
+	storage := &mockMasterKeyRotationStorage{
+		version: "2",
+		objects: map[string]string{
+			"system/identities/a.json":       "1",
+			"system/invites/b.json":          "2",
+			"system/users/a/passkeys.json":   "1",
+			"system/users/a/secret.key":      "1",
+			"system/users/b/secret.key":      "1",
+			"system/users/c/sessions.json":   "2",
+			"system/passkey-handles/x.json":  "1",
+			"system/magic-links/y/code.json": "1",
+		},
+		broken:   map[string]bool{"system/users/b/secret.key": true},
+		failSave: 2,
+	}
+	uc := NewMasterKeyRotationUseCase(storage)
+	uc.batch = 3
+
+	// The job stops when its progress cannot be saved.
+	var progress []int
+	rotation, err := uc.Run(context.Background(), func(r *domain.MasterKeyRotation) {
+		progress = append(progress, r.Scanned)
+	})
+	if err == nil {
+		t.Fatal("expected the failed save to stop the rotation")
+	}
+	if storage.rotation.Scanned != 3 || storage.rotation.CompletedAt != nil {
+		t.Fatalf("unexpected saved progress %+v", storage.rotation)
+	}
+
+	// It resumes after the last saved object.
+	rotation, err = uc.Run(context.Background(), func(r *domain.MasterKeyRotation) {
+		progress = append(progress, r.Scanned)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotation.CompletedAt == nil || rotation.Version != "2" {
+		t.Fatalf("expected a completed rotation, got %+v", rotation)
+	}
+	// The objects of the unsaved batch were rotated by the first run.
+	if rotation.Scanned != 8 || rotation.Rotated != 2 {
+		t.Errorf("unexpected counts %+v", rotation)
+	}
+	if len(rotation.Failed) != 1 || rotation.Failed[0] != "system/users/b/secret.key" || rotation.LastError == "" {
+		t.Errorf("unexpected failures %+v", rotation)
+	}
+	if len(progress) != 3 || progress[0] != 3 || progress[2] != 8 {
+		t.Errorf("unexpected progress %v", progress)
+	}
+	for key, version := range storage.objects {
+		if version != "2" && !storage.broken[key] {
+			t.Errorf("%s left on version %s", key, version)
+		}
+	}
+
+	// Failed objects are retried by a new scan.
+	delete(storage.broken, "system/users/b/secret.key")
+	rotation, err = uc.Run(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotation.Rotated != 1 || len(rotation.Failed) != 0 || rotation.Scanned != 8 {
+		t.Errorf("unexpected retry %+v", rotation)
+	}
+
+	// A completed rotation is not run again.
+	saves := storage.saves
+	if _, err := uc.Run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if storage.saves != saves {
+		t.Error("expected a completed rotation to be left alone")
+	}
+
+	// A new MASTER_KEY starts a new rotation.
+	storage.version = "3"
+	rotation, err = uc.Run(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotation.Version != "3" || rotation.Rotated != 8 {
+		t.Errorf("unexpected rotation %+v", rotation)
+	}
+}
+
+func TestMasterKeyRotationUseCase_RunOnce(t *testing.T) {
+	storage := &mockMasterKeyRotationStorage{version: "2", objects: map[string]string{}}
+	uc := NewMasterKeyRotationUseCase(storage)
+	uc.running.Lock()
+	if _, err := uc.Run(context.Background(), nil); !errors.Is(err, ErrRotationRunning) {
+		t.Errorf("expected ErrRotationRunning, got %v", err)
+	}
+	uc.running.Unlock()
+	if _, err := uc.Run(context.Background(), nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
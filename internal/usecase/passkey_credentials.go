@@ -0,0 +1,79 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+const maxPasskeyNicknameLength = 64
+
+var ErrInvalidPasskeyNickname = errors.New("passkey nickname must be between 1 and 64 characters")
+
+type PasskeyCredentialsUseCase struct {
+	userStorage domain.UserStorage
+}
+
+func NewPasskeyCredentialsUseCase(userStorage domain.UserStorage) *PasskeyCredentialsUseCase {
+	return &PasskeyCredentialsUseCase{
+		userStorage: userStorage,
+	}
+}
+
+func (uc *PasskeyCredentialsUseCase) List(ctx context.Context, user *domain.UserInfo) ([]domain.PasskeyCredential, error) {
+	passkeyUser, err := uc.userStorage.GetUser(ctx, user.UserID)
+	if errors.Is(err, domain.ErrUserNotFound) {
+		return []domain.PasskeyCredential{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return passkeyUser.GetCredentials(), nil
+}
+
+func (uc *PasskeyCredentialsUseCase) Rename(ctx context.Context, user *domain.UserInfo, credentialID []byte, nickname string) error {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" || utf8.RuneCountInString(nickname) > maxPasskeyNicknameLength {
+		return ErrInvalidPasskeyNickname
+	}
+
+	return uc.update(ctx, user, func(entity *domain.PasskeyUserEntity) bool {
+		for _, c := range entity.Credentials {
+			if bytes.Equal(c.ID, credentialID) {
+				c.Nickname = nickname
+				return entity.UpdateCredential(c)
+			}
+		}
+		return false
+	})
+}
+
+func (uc *PasskeyCredentialsUseCase) Delete(ctx context.Context, user *domain.UserInfo, credentialID []byte) error {
+	return uc.update(ctx, user, func(entity *domain.PasskeyUserEntity) bool {
+		return entity.RemoveCredential(credentialID)
+	})
+}
+
+func (uc *PasskeyCredentialsUseCase) update(ctx context.Context, user *domain.UserInfo, apply func(entity *domain.PasskeyUserEntity) bool) error {
+	passkeyUser, err := uc.userStorage.GetUser(ctx, user.UserID)
+	if errors.Is(err, domain.ErrUserNotFound) {
+		return domain.ErrPasskeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	entity, ok := passkeyUser.(*domain.PasskeyUserEntity)
+	if !ok {
+		return fmt.Errorf("unexpected passkey user type %T", passkeyUser)
+	}
+	if !apply(entity) {
+		return domain.ErrPasskeyNotFound
+	}
+	return uc.userStorage.SaveUser(ctx, user.UserID, entity)
+}
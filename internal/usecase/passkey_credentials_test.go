@@ -0,0 +1,69 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockUserStorage struct {
+	mockStorageRepository
+	users map[string]domain.PasskeyUser
+}
+
+func (m *mockUserStorage) GetUser(ctx context.Context, userID string) (domain.PasskeyUser, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, domain.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (m *mockUserStorage) SaveUser(ctx context.Context, userID string, user domain.PasskeyUser) error {
+	m.users[userID] = user
+	return nil
+}
+
+func TestPasskeyCredentialsUseCase(t *testing.T) {
+	ctx := context.Background()
+	user := &domain.UserInfo{UserID: "account-1", Email: "test@example.com"}
+	storage := &mockUserStorage{users: map[string]domain.PasskeyUser{
+		user.UserID: &domain.PasskeyUserEntity{
+			UserID: user.UserID,
+			Email:  user.Email,
+			Credentials: []domain.PasskeyCredential{
+				{ID: []byte("phone"), Nickname: "Phone"},
+				{ID: []byte("laptop")},
+			},
+		},
+	}}
+	uc := NewPasskeyCredentialsUseCase(storage)
+
+	if err := uc.Rename(ctx, user, []byte("laptop"), "  Work laptop "); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.Rename(ctx, user, []byte("laptop"), " "); !errors.Is(err, ErrInvalidPasskeyNickname) {
+		t.Fatalf("expected ErrInvalidPasskeyNickname, got %v", err)
+	}
+	if err := uc.Delete(ctx, user, []byte("phone")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.Delete(ctx, user, []byte("phone")); !errors.Is(err, domain.ErrPasskeyNotFound) {
+		t.Fatalf("expected ErrPasskeyNotFound, got %v", err)
+	}
+
+	creds, err := uc.List(ctx, user)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(creds) != 1 || creds[0].Nickname != "Work laptop" {
+		t.Errorf("expected only the renamed laptop to remain, got %+v", creds)
+	}
+
+	creds, err = uc.List(ctx, &domain.UserInfo{Email: "nopasskey@example.com"})
+	if err != nil || len(creds) != 0 {
+		t.Errorf("expected no passkeys for an account without any, got %+v, %v", creds, err)
+	}
+}
@@ -0,0 +1,229 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/snigle/photocloud/internal/domain"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	recoveryKitFormat = 1
+	// The argon2id parameters recommended by RFC 9106 when memory is
+	// constrained.
+	recoveryKitTime    = 3
+	recoveryKitMemory  = 64 * 1024 // KiB
+	recoveryKitThreads = 4
+	// Kits asking for more are rejected, so that a forged kit cannot exhaust
+	// the server.
+	maxRecoveryKitTime    = 10
+	maxRecoveryKitMemory  = 256 * 1024
+	maxRecoveryKitThreads = 16
+
+	recoveryKitSaltSize = 16
+	// The header holds the format, the argon2id parameters and the salt. It
+	// is authenticated along with the keys.
+	recoveryKitHeaderSize = 1 + 4 + 4 + 1 + recoveryKitSaltSize
+	// Every key is sealed as its version, its creation time and the key.
+	recoveryKitKeySize  = 4 + 8 + userKeySize
+	minPassphraseLength = 12
+)
+
+type RecoveryKitUseCase struct {
+	userStorage domain.UserStorage
+	sessions    domain.SessionStorage
+	credentials domain.StorageRepository
+	now         func() time.Time
+}
+
+// NewRecoveryKitUseCase returns the recovery kit use case. The S3 keys of the
+// sessions are revoked through credentials when a kit is restored.
+func NewRecoveryKitUseCase(userStorage domain.UserStorage, sessions domain.SessionStorage, credentials domain.StorageRepository) *RecoveryKitUseCase {
+	return &RecoveryKitUseCase{
+		userStorage: userStorage,
+		sessions:    sessions,
+		credentials: credentials,
+		now:         time.Now,
+	}
+}
+
+// Create seals every version of the key of user with a key derived from
+// passphrase with argon2id. The code is uppercase base32 in groups of four,
+// which QR codes encode in their compact alphanumeric mode.
+func (uc *RecoveryKitUseCase) Create(ctx context.Context, user *domain.UserInfo, passphrase string) (*domain.RecoveryKit, error) {
+	if utf8.RuneCountInString(passphrase) < minPassphraseLength {
+		return nil, domain.ErrPassphraseTooShort
+	}
+	keys, err := uc.userStorage.GetUserKeys(ctx, user.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user key: %w", err)
+	}
+
+	header := make([]byte, recoveryKitHeaderSize)
+	header[0] = recoveryKitFormat
+	binary.BigEndian.PutUint32(header[1:], recoveryKitTime)
+	binary.BigEndian.PutUint32(header[5:], recoveryKitMemory)
+	header[9] = recoveryKitThreads
+	if _, err := rand.Read(header[10:]); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	plaintext := make([]byte, 0, len(keys)*recoveryKitKeySize)
+	for _, key := range keys {
+		if len(key.Key) != userKeySize {
+			return nil, fmt.Errorf("invalid user key %d for %s", key.Version, user.UserID)
+		}
+		plaintext = binary.BigEndian.AppendUint32(plaintext, uint32(key.Version))
+		plaintext = binary.BigEndian.AppendUint64(plaintext, uint64(key.CreatedAt.Unix()))
+		plaintext = append(plaintext, key.Key...)
+	}
+
+	aead, err := recoveryKitCipher(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	kit := append(append([]byte{}, header...), nonce...)
+	kit = aead.Seal(kit, nonce, plaintext, header)
+
+	code := totpEncoding.EncodeToString(kit)
+	groups := make([]string, 0, len(code)/4+1)
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return &domain.RecoveryKit{
+		Code:       strings.Join(append(groups, code), "-"),
+		Email:      user.Email,
+		KeyVersion: keys.Active().Version,
+		CreatedAt:  uc.now(),
+	}, nil
+}
+
+// Restore opens a recovery kit and installs its keys. Stored keys missing
+// from the kit, such as one generated after the keys were lost, are kept as
+// newer versions so that their objects stay readable; stored keys that cannot
+// be read are replaced. It returns the keys of the user.
+func (uc *RecoveryKitUseCase) Restore(ctx context.Context, user *domain.UserInfo, code string, passphrase string) (domain.UserKeys, error) {
+	restored, err := uc.open(code, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := restored
+	if stored, err := uc.userStorage.GetUserKeys(ctx, user.UserID); err == nil {
+		var changed bool
+		if keys, changed = mergeUserKeys(restored, stored); !changed {
+			return stored, nil
+		}
+	}
+	if err := uc.userStorage.SaveUserKeys(ctx, user.UserID, keys); err != nil {
+		return nil, fmt.Errorf("failed to save user key: %w", err)
+	}
+
+	// The apps must fetch the restored keys before they write again.
+	if err := revokeSessionCredentials(ctx, uc.sessions, uc.credentials, user.UserID, uc.now()); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (uc *RecoveryKitUseCase) open(code string, passphrase string) (domain.UserKeys, error) {
+	kit, err := totpEncoding.DecodeString(strings.ToUpper(normalizeCode(code)))
+	if err != nil || len(kit) < recoveryKitHeaderSize || kit[0] != recoveryKitFormat {
+		return nil, domain.ErrInvalidRecoveryKit
+	}
+	header := kit[:recoveryKitHeaderSize]
+	aead, err := recoveryKitCipher(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	sealed := kit[recoveryKitHeaderSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, domain.ErrInvalidRecoveryKit
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], header)
+	if err != nil {
+		return nil, domain.ErrRecoveryKitPassphrase
+	}
+	if len(plaintext) == 0 || len(plaintext)%recoveryKitKeySize != 0 {
+		return nil, domain.ErrInvalidRecoveryKit
+	}
+
+	var keys domain.UserKeys
+	for ; len(plaintext) > 0; plaintext = plaintext[recoveryKitKeySize:] {
+		key := domain.UserKey{
+			Version:   int(binary.BigEndian.Uint32(plaintext)),
+			CreatedAt: time.Unix(int64(binary.BigEndian.Uint64(plaintext[4:])), 0).UTC(),
+			Key:       bytes.Clone(plaintext[12:recoveryKitKeySize]),
+		}
+		if len(keys) > 0 && key.Version <= keys.Active().Version {
+			return nil, domain.ErrInvalidRecoveryKit
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// recoveryKitCipher derives the key of a kit from the passphrase and the
+// parameters of its header.
+func recoveryKitCipher(passphrase string, header []byte) (cipher.AEAD, error) {
+	iterations := binary.BigEndian.Uint32(header[1:])
+	memory := binary.BigEndian.Uint32(header[5:])
+	threads := header[9]
+	if iterations == 0 || iterations > maxRecoveryKitTime || memory == 0 || memory > maxRecoveryKitMemory || threads == 0 || threads > maxRecoveryKitThreads {
+		return nil, domain.ErrInvalidRecoveryKit
+	}
+
+	key := argon2.IDKey([]byte(passphrase), header[10:], iterations, memory, threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// mergeUserKeys appends the stored keys missing from the restored ones,
+// renumbered after them. It reports false when the stored keys already hold
+// every restored key.
+func mergeUserKeys(restored domain.UserKeys, stored domain.UserKeys) (domain.UserKeys, bool) {
+	contains := func(keys domain.UserKeys, key domain.UserKey) bool {
+		for _, k := range keys {
+			if bytes.Equal(k.Key, key.Key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	changed := false
+	for _, key := range restored {
+		if !contains(stored, key) {
+			changed = true
+		}
+	}
+	if !changed {
+		return stored, false
+	}
+
+	keys := append(domain.UserKeys{}, restored...)
+	for _, key := range stored {
+		if !contains(restored, key) {
+			key.Version = keys.Active().Version + 1
+			keys = append(keys, key)
+		}
+	}
+	return keys, true
+}
@@ -0,0 +1,100 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+func TestRecoveryKitUseCase(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := &domain.UserInfo{UserID: "account-1", Email: "test@example.com"}
+	original := domain.UserKeys{
+		{Version: 1, Key: bytes.Repeat([]byte{1}, 32), CreatedAt: now.Add(-48 * time.Hour)},
+		{Version: 2, Key: bytes.Repeat([]byte{2}, 32), CreatedAt: now.Add(-24 * time.Hour)},
+	}
+	keys := original
+	users := &mockStorageRepository{
+		getUserKeysFunc: func(ctx context.Context, userID string) (domain.UserKeys, error) {
+			if keys == nil {
+				return nil, domain.ErrUserKeyNotFound
+			}
+			return keys, nil
+		},
+		saveUserKeysFunc: func(ctx context.Context, userID string, saved domain.UserKeys) error {
+			keys = saved
+			return nil
+		},
+	}
+	sessions := &mockSessionStorage{sessions: map[string][]domain.Session{"account-1": {
+		{ID: "phone", ExpiresAt: now.Add(time.Hour)},
+	}}}
+	uc := NewRecoveryKitUseCase(users, sessions, users)
+	uc.now = func() time.Time { return now }
+
+	if _, err := uc.Create(ctx, user, "too short"); !errors.Is(err, domain.ErrPassphraseTooShort) {
+		t.Errorf("expected ErrPassphraseTooShort, got %v", err)
+	}
+	kit, err := uc.Create(ctx, user, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !regexp.MustCompile(`^[A-Z2-7]{4}(-[A-Z2-7]{1,4})+$`).MatchString(kit.Code) {
+		t.Errorf("unexpected code %q", kit.Code)
+	}
+	if kit.KeyVersion != 2 || kit.Email != user.Email || !kit.CreatedAt.Equal(now) {
+		t.Errorf("unexpected kit %+v", kit)
+	}
+
+	// The keys are lost, and a new one is generated on the next login.
+	keys = domain.UserKeys{{Version: 1, Key: bytes.Repeat([]byte{3}, 32), CreatedAt: now}}
+
+	if _, err := uc.Restore(ctx, user, kit.Code, "wrong horse battery staple"); !errors.Is(err, domain.ErrRecoveryKitPassphrase) {
+		t.Errorf("expected ErrRecoveryKitPassphrase, got %v", err)
+	}
+	if _, err := uc.Restore(ctx, user, "not a recovery kit", "correct horse battery staple"); !errors.Is(err, domain.ErrInvalidRecoveryKit) {
+		t.Errorf("expected ErrInvalidRecoveryKit, got %v", err)
+	}
+	if len(users.revoked) != 0 {
+		t.Fatalf("expected no revocation before a restore, got %v", users.revoked)
+	}
+
+	// Codes are typed back in any case, with or without separators.
+	typed := strings.ToLower(strings.ReplaceAll(kit.Code, "-", " "))
+	restored, err := uc.Restore(ctx, user, typed, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(restored) != 3 || len(keys) != 3 {
+		t.Fatalf("expected the restored keys and the new one, got %+v", keys)
+	}
+	for i, key := range original {
+		if keys[i].Version != key.Version || !bytes.Equal(keys[i].Key, key.Key) || !keys[i].CreatedAt.Equal(key.CreatedAt) {
+			t.Errorf("unexpected key %d: %+v", i, keys[i])
+		}
+	}
+	if active := keys.Active(); active.Version != 3 || active.Key[0] != 3 {
+		t.Errorf("expected the new key to be kept as version 3, got %+v", active)
+	}
+	if len(users.revoked["account-1"]) != 1 {
+		t.Errorf("expected the S3 keys of the sessions to be revoked, got %v", users.revoked)
+	}
+
+	// Restoring the same kit again changes nothing.
+	if _, err := uc.Restore(ctx, user, kit.Code, "correct horse battery staple"); err != nil || len(keys) != 3 || len(users.revoked["account-1"]) != 1 {
+		t.Errorf("expected no change, got %+v, %v", keys, err)
+	}
+
+	// Keys that are not found at all are replaced.
+	keys = nil
+	if _, err := uc.Restore(ctx, user, kit.Code, "correct horse battery staple"); err != nil || len(keys) != 2 || keys.Active().Version != 2 {
+		t.Errorf("unexpected keys %+v, %v", keys, err)
+	}
+}
@@ -0,0 +1,114 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+var ErrInvalidInvite = errors.New("invitations need at least one use and a validity in the future")
+
+type RegistrationUseCase struct {
+	mode           domain.RegistrationMode
+	allowedDomains []string
+	invites        domain.InviteStorage
+	now            func() time.Time
+}
+
+func NewRegistrationUseCase(mode domain.RegistrationMode, allowedDomains []string, invites domain.InviteStorage) *RegistrationUseCase {
+	domains := make([]string, 0, len(allowedDomains))
+	for _, d := range allowedDomains {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return &RegistrationUseCase{
+		mode:           mode,
+		allowedDomains: domains,
+		invites:        invites,
+		now:            time.Now,
+	}
+}
+
+// Admit decides whether a new account may be created for email, using up one
+// use of the invitation code if one is needed.
+func (uc *RegistrationUseCase) Admit(ctx context.Context, email string, code string) error {
+	switch uc.mode {
+	case domain.RegistrationOpen:
+		return nil
+	case domain.RegistrationAllowlist:
+		at := strings.LastIndex(email, "@")
+		if at >= 0 && slices.Contains(uc.allowedDomains, strings.ToLower(email[at+1:])) {
+			return nil
+		}
+	case domain.RegistrationInviteOnly:
+	default:
+		return domain.ErrRegistrationClosed
+	}
+
+	if code == "" {
+		return domain.ErrInviteRequired
+	}
+	err := uc.invites.UpdateInvite(ctx, inviteID(code), func(invite *domain.Invite) error {
+		if !invite.Usable(uc.now()) {
+			return domain.ErrInviteInvalid
+		}
+		invite.Uses++
+		return nil
+	})
+	if errors.Is(err, domain.ErrInviteNotFound) {
+		return domain.ErrInviteInvalid
+	}
+	return err
+}
+
+// CreateInvite issues a new invitation code. The code is only returned here.
+func (uc *RegistrationUseCase) CreateInvite(ctx context.Context, admin *domain.UserInfo, maxUses int, validity time.Duration, note string) (string, *domain.Invite, error) {
+	if maxUses < 1 || validity <= 0 {
+		return "", nil, ErrInvalidInvite
+	}
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("failed to generate invitation code: %w", err)
+	}
+	code := base32.StdEncoding.EncodeToString(b)
+
+	now := uc.now()
+	invite := &domain.Invite{
+		ID:        inviteID(code),
+		Note:      note,
+		CreatedBy: admin.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(validity),
+		MaxUses:   maxUses,
+	}
+	if err := uc.invites.SaveInvite(ctx, invite); err != nil {
+		return "", nil, fmt.Errorf("failed to save invitation: %w", err)
+	}
+	return code, invite, nil
+}
+
+func (uc *RegistrationUseCase) ListInvites(ctx context.Context) ([]domain.Invite, error) {
+	return uc.invites.ListInvites(ctx)
+}
+
+func (uc *RegistrationUseCase) DeleteInvite(ctx context.Context, id string) error {
+	return uc.invites.DeleteInvite(ctx, id)
+}
+
+// inviteID hashes the code so that stored invitations cannot be used by
+// whoever reads them. Codes are case and dash insensitive.
+func inviteID(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte("invite\x00" + code))
+	return hex.EncodeToString(hash[:16])
+}
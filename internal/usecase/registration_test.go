@@ -0,0 +1,142 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockInviteStorage struct {
+	invites map[string]domain.Invite
+}
+
+func (m *mockInviteStorage) SaveInvite(ctx context.Context, invite *domain.Invite) error {
+	m.invites[invite.ID] = *invite
+	return nil
+}
+
+func (m *mockInviteStorage) ListInvites(ctx context.Context) ([]domain.Invite, error) {
+	var invites []domain.Invite
+	for _, invite := range m.invites {
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+func (m *mockInviteStorage) UpdateInvite(ctx context.Context, id string, update func(*domain.Invite) error) error {
+	invite, ok := m.invites[id]
+	if !ok {
+		return domain.ErrInviteNotFound
+	}
+	if err := update(&invite); err != nil {
+		return err
+	}
+	m.invites[id] = invite
+	return nil
+}
+
+func (m *mockInviteStorage) DeleteInvite(ctx context.Context, id string) error {
+	delete(m.invites, id)
+	return nil
+}
+
+func TestRegistrationUseCase_Modes(t *testing.T) {
+	ctx := context.Background()
+	invites := &mockInviteStorage{invites: map[string]domain.Invite{}}
+	admin := &domain.UserInfo{Email: "admin@example.com"}
+
+	open := NewRegistrationUseCase(domain.RegistrationOpen, nil, invites)
+	if err := open.Admit(ctx, "anyone@gmail.com", ""); err != nil {
+		t.Errorf("open: unexpected error: %v", err)
+	}
+
+	allowlist := NewRegistrationUseCase(domain.RegistrationAllowlist, []string{" Example.com "}, invites)
+	if err := allowlist.Admit(ctx, "user@EXAMPLE.com", ""); err != nil {
+		t.Errorf("allowlist: expected allowed domain to be admitted: %v", err)
+	}
+	if err := allowlist.Admit(ctx, "user@gmail.com", ""); !errors.Is(err, domain.ErrInviteRequired) {
+		t.Errorf("allowlist: expected ErrInviteRequired, got %v", err)
+	}
+	code, _, err := allowlist.CreateInvite(ctx, admin, 1, time.Hour, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := allowlist.Admit(ctx, "user@gmail.com", code); err != nil {
+		t.Errorf("allowlist: expected invitation to admit other domains: %v", err)
+	}
+
+	closed := NewRegistrationUseCase(domain.RegistrationClosed, []string{"example.com"}, invites)
+	code, _, err = closed.CreateInvite(ctx, admin, 1, time.Hour, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := closed.Admit(ctx, "user@example.com", code); !errors.Is(err, domain.ErrRegistrationClosed) {
+		t.Errorf("closed: expected ErrRegistrationClosed, got %v", err)
+	}
+}
+
+func TestRegistrationUseCase_Invites(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	invites := &mockInviteStorage{invites: map[string]domain.Invite{}}
+	uc := NewRegistrationUseCase(domain.RegistrationInviteOnly, nil, invites)
+	uc.now = func() time.Time { return now }
+	admin := &domain.UserInfo{Email: "admin@example.com"}
+
+	if _, _, err := uc.CreateInvite(ctx, admin, 0, time.Hour, ""); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("expected ErrInvalidInvite, got %v", err)
+	}
+	code, invite, err := uc.CreateInvite(ctx, admin, 2, time.Hour, "family")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if invite.ID == code {
+		t.Error("expected the code not to be stored")
+	}
+
+	if err := uc.Admit(ctx, "a@example.com", ""); !errors.Is(err, domain.ErrInviteRequired) {
+		t.Errorf("expected ErrInviteRequired, got %v", err)
+	}
+	if err := uc.Admit(ctx, "a@example.com", "WRONG"); !errors.Is(err, domain.ErrInviteInvalid) {
+		t.Errorf("expected ErrInviteInvalid, got %v", err)
+	}
+	if err := uc.Admit(ctx, "a@example.com", code); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := uc.Admit(ctx, "b@example.com", code); !errors.Is(err, domain.ErrInviteInvalid) {
+		t.Errorf("expected expired invitation to be refused, got %v", err)
+	}
+	now = now.Add(-2 * time.Hour)
+	if err := uc.Admit(ctx, "b@example.com", code); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.Admit(ctx, "c@example.com", code); !errors.Is(err, domain.ErrInviteInvalid) {
+		t.Errorf("expected used up invitation to be refused, got %v", err)
+	}
+	if invites.invites[invite.ID].Uses != 2 {
+		t.Errorf("expected 2 uses, got %d", invites.invites[invite.ID].Uses)
+	}
+}
+
+func TestAccountUseCase_ResolveEnforcesRegistration(t *testing.T) {
+	ctx := context.Background()
+	storage := newMockAccountStorage()
+	storage.legacy["old@example.com"] = true
+	registration := NewRegistrationUseCase(domain.RegistrationClosed, nil, nil)
+	uc := NewAccountUseCase(storage, nil, nil, nil, registration)
+
+	if err := uc.Resolve(ctx, &domain.UserInfo{Email: "new@example.com"}, ""); !errors.Is(err, domain.ErrRegistrationClosed) {
+		t.Errorf("expected ErrRegistrationClosed, got %v", err)
+	}
+	if len(storage.accounts) != 0 {
+		t.Error("expected no account to be created")
+	}
+	if err := uc.Resolve(ctx, &domain.UserInfo{Email: "old@example.com"}, ""); err != nil {
+		t.Errorf("expected existing accounts to log in: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package usecase
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew also accepts the codes of the neighbouring steps, for phones
+	// whose clock drifts.
+	totpSkew          = 1
+	totpSecretSize    = 20
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type SecondFactorUseCase struct {
+	storage    domain.TOTPStorage
+	challenges domain.SecondFactorChallengeIssuer
+	issuer     string
+	now        func() time.Time
+}
+
+// NewSecondFactorUseCase returns the TOTP use case. issuer is the name shown
+// in authenticator apps.
+func NewSecondFactorUseCase(storage domain.TOTPStorage, challenges domain.SecondFactorChallengeIssuer, issuer string) *SecondFactorUseCase {
+	return &SecondFactorUseCase{
+		storage:    storage,
+		challenges: challenges,
+		issuer:     issuer,
+		now:        time.Now,
+	}
+}
+
+// Required tells whether the login of user still needs a second factor.
+// Passkeys already prove both possession and user verification.
+func (uc *SecondFactorUseCase) Required(ctx context.Context, user *domain.UserInfo) (bool, error) {
+	if user.AuthMethod == domain.AuthMethodPasskey {
+		return false, nil
+	}
+	config, err := uc.storage.GetTOTP(ctx, user.UserID)
+	if err != nil {
+		return false, fmt.Errorf("failed to load two-factor configuration: %w", err)
+	}
+	return config.Enabled(), nil
+}
+
+// Challenge returns a challenge token when the login of user still needs a
+// second factor, and an empty string otherwise.
+func (uc *SecondFactorUseCase) Challenge(ctx context.Context, user *domain.UserInfo) (string, error) {
+	required, err := uc.Required(ctx, user)
+	if err != nil || !required {
+		return "", err
+	}
+	return uc.challenges.IssueChallengeToken(ctx, user)
+}
+
+// OpenChallenge returns the user a challenge token was issued for.
+func (uc *SecondFactorUseCase) OpenChallenge(ctx context.Context, token string) (*domain.UserInfo, error) {
+	return uc.challenges.ValidateChallengeToken(ctx, token)
+}
+
+// Verify checks a code of the authenticator app, or uses up a recovery code.
+func (uc *SecondFactorUseCase) Verify(ctx context.Context, userID string, code string) error {
+	return uc.updateTOTP(ctx, userID, func(config *domain.TOTPConfig) error {
+		if !config.Enabled() {
+			return domain.ErrTOTPNotEnabled
+		}
+		if !uc.acceptCode(config, code) && !uc.acceptRecoveryCode(config, code) {
+			return domain.ErrTOTPCodeInvalid
+		}
+		return nil
+	})
+}
+
+func (uc *SecondFactorUseCase) Status(ctx context.Context, user *domain.UserInfo) (*domain.TOTPConfig, error) {
+	config, err := uc.storage.GetTOTP(ctx, user.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load two-factor configuration: %w", err)
+	}
+	return config, nil
+}
+
+// BeginEnrollment generates a new secret and returns it with the otpauth URI
+// to show as a QR code. It replaces any pending enrollment.
+func (uc *SecondFactorUseCase) BeginEnrollment(ctx context.Context, user *domain.UserInfo) (string, string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	err := uc.storage.UpdateTOTP(ctx, user.UserID, func(config *domain.TOTPConfig) (*domain.TOTPConfig, error) {
+		if config.Enabled() {
+			return nil, domain.ErrTOTPAlreadyEnabled
+		}
+		return &domain.TOTPConfig{Secret: secret}, nil
+	})
+	if errors.Is(err, domain.ErrTOTPAlreadyEnabled) {
+		return "", "", err
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to save two-factor configuration: %w", err)
+	}
+
+	encoded := totpEncoding.EncodeToString(secret)
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + uc.issuer + ":" + user.Email,
+		RawQuery: url.Values{
+			"secret":    {encoded},
+			"issuer":    {uc.issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+	return encoded, uri.String(), nil
+}
+
+// ConfirmEnrollment enables the pending app once the user entered one of its
+// codes, and returns the recovery codes. They are not shown again.
+func (uc *SecondFactorUseCase) ConfirmEnrollment(ctx context.Context, user *domain.UserInfo, code string) ([]string, error) {
+	var codes []string
+	err := uc.updateTOTP(ctx, user.UserID, func(config *domain.TOTPConfig) error {
+		if config == nil {
+			return domain.ErrTOTPNotEnabled
+		}
+		if config.Enabled() {
+			return domain.ErrTOTPAlreadyEnabled
+		}
+		if !uc.acceptCode(config, code) {
+			return domain.ErrTOTPCodeInvalid
+		}
+
+		var err error
+		if codes, err = newRecoveryCodes(config); err != nil {
+			return err
+		}
+		now := uc.now()
+		config.EnabledAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, used or not.
+func (uc *SecondFactorUseCase) RegenerateRecoveryCodes(ctx context.Context, user *domain.UserInfo, code string) ([]string, error) {
+	var codes []string
+	err := uc.updateTOTP(ctx, user.UserID, func(config *domain.TOTPConfig) error {
+		if !config.Enabled() {
+			return domain.ErrTOTPNotEnabled
+		}
+		if !uc.acceptCode(config, code) {
+			return domain.ErrTOTPCodeInvalid
+		}
+
+		var err error
+		codes, err = newRecoveryCodes(config)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable removes the app. A current code or a recovery code is required so
+// that a stolen session cannot turn the second factor off.
+func (uc *SecondFactorUseCase) Disable(ctx context.Context, user *domain.UserInfo, code string) error {
+	if err := uc.Verify(ctx, user.UserID, code); err != nil {
+		return err
+	}
+	if err := uc.storage.DeleteTOTP(ctx, user.UserID); err != nil {
+		return fmt.Errorf("failed to delete two-factor configuration: %w", err)
+	}
+	return nil
+}
+
+// updateTOTP applies update to the configuration of the user with a
+// conditional write, so that concurrent requests cannot both use the same
+// code. The errors of the domain returned by update are returned as is.
+func (uc *SecondFactorUseCase) updateTOTP(ctx context.Context, userID string, update func(*domain.TOTPConfig) error) error {
+	err := uc.storage.UpdateTOTP(ctx, userID, func(config *domain.TOTPConfig) (*domain.TOTPConfig, error) {
+		if err := update(config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	})
+	if errors.Is(err, domain.ErrTOTPNotEnabled) || errors.Is(err, domain.ErrTOTPAlreadyEnabled) || errors.Is(err, domain.ErrTOTPCodeInvalid) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save two-factor configuration: %w", err)
+	}
+	return nil
+}
+
+// acceptCode checks a code of the app and records its step so that it cannot
+// be replayed.
+func (uc *SecondFactorUseCase) acceptCode(config *domain.TOTPConfig, code string) bool {
+	code = normalizeCode(code)
+	if len(code) != totpDigits {
+		return false
+	}
+	step := uc.now().Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= config.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(config.Secret, s)), []byte(code)) == 1 {
+			config.LastStep = s
+			return true
+		}
+	}
+	return false
+}
+
+func (uc *SecondFactorUseCase) acceptRecoveryCode(config *domain.TOTPConfig, code string) bool {
+	hash := recoveryCodeHash(code)
+	for i, rc := range config.RecoveryCodes {
+		if rc.UsedAt == nil && subtle.ConstantTimeCompare(rc.Hash, hash) == 1 {
+			now := uc.now()
+			config.RecoveryCodes[i].UsedAt = &now
+			return true
+		}
+	}
+	return false
+}
+
+// totpCode computes the RFC 6238 code of a time step, with HMAC-SHA1 as
+// expected by every authenticator app.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// newRecoveryCodes replaces the recovery codes of config and returns them,
+// formatted as "abcd-efgh".
+func newRecoveryCodes(config *domain.TOTPConfig) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	config.RecoveryCodes = make([]domain.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		config.RecoveryCodes[i] = domain.RecoveryCode{Hash: recoveryCodeHash(code)}
+	}
+	return codes, nil
+}
+
+func recoveryCodeHash(code string) []byte {
+	hash := sha256.Sum256([]byte("recovery\x00" + strings.ToLower(normalizeCode(code))))
+	return hash[:]
+}
+
+func normalizeCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,211 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockTOTPStorage struct {
+	mu      sync.Mutex
+	configs map[string]domain.TOTPConfig
+}
+
+func (m *mockTOTPStorage) GetTOTP(ctx context.Context, userID string) (*domain.TOTPConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	config, ok := m.configs[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &config, nil
+}
+
+func (m *mockTOTPStorage) UpdateTOTP(ctx context.Context, userID string, update func(*domain.TOTPConfig) (*domain.TOTPConfig, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var current *domain.TOTPConfig
+	if config, ok := m.configs[userID]; ok {
+		config.RecoveryCodes = append([]domain.RecoveryCode(nil), config.RecoveryCodes...)
+		current = &config
+	}
+	config, err := update(current)
+	if err != nil {
+		return err
+	}
+	m.configs[userID] = *config
+	return nil
+}
+
+func (m *mockTOTPStorage) DeleteTOTP(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.configs, userID)
+	return nil
+}
+
+type mockChallengeIssuer struct{}
+
+func (m *mockChallengeIssuer) IssueChallengeToken(ctx context.Context, user *domain.UserInfo) (string, error) {
+	return "challenge:" + user.UserID, nil
+}
+
+func (m *mockChallengeIssuer) ValidateChallengeToken(ctx context.Context, token string) (*domain.UserInfo, error) {
+	userID, ok := strings.CutPrefix(token, "challenge:")
+	if !ok {
+		return nil, errors.New("invalid challenge token")
+	}
+	return &domain.UserInfo{UserID: userID}, nil
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		2000000000: "279037",
+	}
+	for unix, want := range tests {
+		if got := totpCode(secret, unix/totpPeriod); got != want {
+			t.Errorf("totpCode at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestSecondFactorUseCase_Enrollment(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage := &mockTOTPStorage{configs: map[string]domain.TOTPConfig{}}
+	uc := NewSecondFactorUseCase(storage, &mockChallengeIssuer{}, "PhotoCloud")
+	uc.now = func() time.Time { return now }
+	user := &domain.UserInfo{UserID: "account-1", Email: "user@example.com", AuthMethod: domain.AuthMethodMagicLink}
+
+	secret, uri, err := uc.BeginEnrollment(ctx, user)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/PhotoCloud:user@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("unexpected provisioning URI %s", uri)
+	}
+	if token, _ := uc.Challenge(ctx, user); token != "" {
+		t.Error("expected a pending enrollment not to require a second factor")
+	}
+
+	config := storage.configs["account-1"]
+	code := totpCode(config.Secret, now.Unix()/totpPeriod)
+	if _, err := uc.ConfirmEnrollment(ctx, user, totpCode(config.Secret, now.Unix()/totpPeriod+5)); !errors.Is(err, domain.ErrTOTPCodeInvalid) {
+		t.Errorf("expected ErrTOTPCodeInvalid, got %v", err)
+	}
+	recoveryCodes, err := uc.ConfirmEnrollment(ctx, user, code)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	token, err := uc.Challenge(ctx, user)
+	if err != nil || token == "" {
+		t.Fatalf("expected a challenge, got %q, %v", token, err)
+	}
+	passkeyUser := *user
+	passkeyUser.AuthMethod = domain.AuthMethodPasskey
+	if token, _ := uc.Challenge(ctx, &passkeyUser); token != "" {
+		t.Error("expected passkey logins not to be challenged")
+	}
+
+	if err := uc.Verify(ctx, "account-1", code); !errors.Is(err, domain.ErrTOTPCodeInvalid) {
+		t.Errorf("expected the enrollment code not to be replayed, got %v", err)
+	}
+	now = now.Add(totpPeriod * time.Second)
+	if err := uc.Verify(ctx, "account-1", totpCode(config.Secret, now.Unix()/totpPeriod)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSecondFactorUseCase_RecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage := &mockTOTPStorage{configs: map[string]domain.TOTPConfig{}}
+	uc := NewSecondFactorUseCase(storage, &mockChallengeIssuer{}, "PhotoCloud")
+	uc.now = func() time.Time { return now }
+	user := &domain.UserInfo{UserID: "account-1", Email: "user@example.com"}
+
+	if err := uc.Verify(ctx, "account-1", "123456"); !errors.Is(err, domain.ErrTOTPNotEnabled) {
+		t.Errorf("expected ErrTOTPNotEnabled, got %v", err)
+	}
+	if _, _, err := uc.BeginEnrollment(ctx, user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := storage.configs["account-1"].Secret
+	recoveryCodes, err := uc.ConfirmEnrollment(ctx, user, totpCode(secret, now.Unix()/totpPeriod))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := uc.Verify(ctx, "account-1", strings.ToUpper(recoveryCodes[0])); err != nil {
+		t.Errorf("expected recovery code to be accepted: %v", err)
+	}
+	if err := uc.Verify(ctx, "account-1", recoveryCodes[0]); !errors.Is(err, domain.ErrTOTPCodeInvalid) {
+		t.Errorf("expected recovery code to be single use, got %v", err)
+	}
+	config := storage.configs["account-1"]
+	if left := config.RecoveryCodesLeft(); left != recoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, left)
+	}
+
+	if err := uc.Disable(ctx, user, recoveryCodes[1]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := storage.configs["account-1"]; ok {
+		t.Error("expected the configuration to be deleted")
+	}
+}
+
+func TestSecondFactorUseCase_ConcurrentVerify(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage := &mockTOTPStorage{configs: map[string]domain.TOTPConfig{}}
+	uc := NewSecondFactorUseCase(storage, &mockChallengeIssuer{}, "PhotoCloud")
+	uc.now = func() time.Time { return now }
+	user := &domain.UserInfo{UserID: "account-1", Email: "user@example.com"}
+
+	if _, _, err := uc.BeginEnrollment(ctx, user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := storage.configs["account-1"].Secret
+	recoveryCodes, err := uc.ConfirmEnrollment(ctx, user, totpCode(secret, now.Unix()/totpPeriod))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now = now.Add(totpPeriod * time.Second)
+	code := totpCode(secret, now.Unix()/totpPeriod)
+
+	// Each code must be accepted once, however many requests race with it.
+	for _, code := range []string{code, recoveryCodes[0]} {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		accepted := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if uc.Verify(ctx, "account-1", code) == nil {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if accepted != 1 {
+			t.Errorf("expected code %s to be accepted once, got %d", code, accepted)
+		}
+	}
+}
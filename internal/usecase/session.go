@@ -0,0 +1,313 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+const (
+	defaultSessionTTL = 30 * 24 * time.Hour
+	// lastSeenResolution avoids rewriting sessions.json on every request of a busy client.
+	lastSeenResolution = time.Minute
+)
+
+type SessionUseCase struct {
+	storage     domain.SessionStorage
+	issuer      domain.SessionTokenIssuer
+	credentials domain.StorageRepository
+	sessionTTL  time.Duration
+	now         func() time.Time
+}
+
+// NewSessionUseCase returns the session use case. The S3 keys of sessions are
+// revoked through credentials when the sessions are.
+func NewSessionUseCase(storage domain.SessionStorage, issuer domain.SessionTokenIssuer, credentials domain.StorageRepository) *SessionUseCase {
+	return &SessionUseCase{
+		storage:     storage,
+		issuer:      issuer,
+		credentials: credentials,
+		sessionTTL:  defaultSessionTTL,
+		now:         time.Now,
+	}
+}
+
+// Start opens a new refresh-token family for a freshly authenticated user.
+func (uc *SessionUseCase) Start(ctx context.Context, user *domain.UserInfo, client domain.ClientInfo) (*domain.SessionTokens, error) {
+	now := uc.now()
+	sessionID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	tokenID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	session := domain.Session{
+		ID:             sessionID,
+		RefreshTokenID: tokenID,
+		AuthMethod:     user.AuthMethod,
+		Scope:          user.Scope,
+		UserAgent:      client.UserAgent,
+		IP:             client.IP,
+		CreatedAt:      now,
+		LastSeenAt:     now,
+		ExpiresAt:      now.Add(uc.sessionTTL),
+	}
+
+	err = uc.storage.UpdateSessions(ctx, user.UserID, func(sessions []domain.Session) ([]domain.Session, error) {
+		return append(pruneSessions(sessions, now), session), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save sessions: %w", err)
+	}
+
+	user.SessionID = session.ID
+	return uc.issuer.IssueTokens(ctx, user, &session)
+}
+
+// Refresh rotates the refresh token of a session. Presenting a token that was
+// already rotated revokes the whole family.
+func (uc *SessionUseCase) Refresh(ctx context.Context, refreshToken string, client domain.ClientInfo) (*domain.UserInfo, *domain.SessionTokens, error) {
+	claims, err := uc.issuer.ValidateRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	user := claims.User
+
+	tokenID, err := randomID()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := uc.now()
+	var session domain.Session
+	reused := false
+	err = uc.storage.UpdateSessions(ctx, user.UserID, func(sessions []domain.Session) ([]domain.Session, error) {
+		s := findSession(sessions, user.SessionID)
+		if s == nil || !s.Active(now) {
+			return nil, domain.ErrSessionRevoked
+		}
+		reused = s.RefreshTokenID != claims.TokenID
+		if reused {
+			s.RevokedAt = &now
+			return sessions, nil
+		}
+		s.RefreshTokenID = tokenID
+		s.ExpiresAt = now.Add(uc.sessionTTL)
+		s.Seen(now, client)
+		session = *s
+		return sessions, nil
+	})
+	if errors.Is(err, domain.ErrSessionRevoked) {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to save sessions: %w", err)
+	}
+
+	if reused {
+		if err := uc.credentials.RevokeS3Credentials(ctx, user.UserID, []string{user.SessionID}); err != nil {
+			return nil, nil, fmt.Errorf("failed to revoke S3 credentials: %w", err)
+		}
+		return nil, nil, domain.ErrRefreshTokenReused
+	}
+
+	user.AuthMethod = session.AuthMethod
+	user.Scope = session.Scope
+	tokens, err := uc.issuer.IssueTokens(ctx, user, &session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, tokens, nil
+}
+
+// Reissue rotates the tokens of the current session of user after its email
+// or account ID changed. The session keeps its login method and scope, so that
+// it stays bound to the second factor checked when it started.
+func (uc *SessionUseCase) Reissue(ctx context.Context, user *domain.UserInfo, client domain.ClientInfo) (*domain.SessionTokens, error) {
+	tokenID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	now := uc.now()
+	var session domain.Session
+	err = uc.storage.UpdateSessions(ctx, user.UserID, func(sessions []domain.Session) ([]domain.Session, error) {
+		s := findSession(sessions, user.SessionID)
+		if s == nil || !s.Active(now) {
+			return nil, domain.ErrSessionRevoked
+		}
+		s.RefreshTokenID = tokenID
+		s.Seen(now, client)
+		session = *s
+		return sessions, nil
+	})
+	if errors.Is(err, domain.ErrSessionRevoked) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save sessions: %w", err)
+	}
+
+	user.AuthMethod = session.AuthMethod
+	user.Scope = session.Scope
+	return uc.issuer.IssueTokens(ctx, user, &session)
+}
+
+// Touch checks that the session behind an access token has not been revoked
+// and records the client activity.
+func (uc *SessionUseCase) Touch(ctx context.Context, user *domain.UserInfo, client domain.ClientInfo) error {
+	sessions, err := uc.storage.GetSessions(ctx, user.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
+	}
+
+	now := uc.now()
+	session := findSession(sessions, user.SessionID)
+	if session == nil || !session.Active(now) {
+		return domain.ErrSessionRevoked
+	}
+	if now.Sub(session.LastSeenAt) < lastSeenResolution && session.IP == client.IP {
+		return nil
+	}
+
+	err = uc.storage.UpdateSessions(ctx, user.UserID, func(sessions []domain.Session) ([]domain.Session, error) {
+		session := findSession(sessions, user.SessionID)
+		if session == nil || !session.Active(now) {
+			return nil, domain.ErrSessionRevoked
+		}
+		session.Seen(now, client)
+		return sessions, nil
+	})
+	if errors.Is(err, domain.ErrSessionRevoked) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save sessions: %w", err)
+	}
+	return nil
+}
+
+// RequireRecentLogin checks that the session of user logged in less than
+// maxAge ago. Refreshing a session does not count as a login.
+func (uc *SessionUseCase) RequireRecentLogin(ctx context.Context, user *domain.UserInfo, maxAge time.Duration) error {
+	sessions, err := uc.storage.GetSessions(ctx, user.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
+	}
+
+	now := uc.now()
+	session := findSession(sessions, user.SessionID)
+	if session == nil || !session.Active(now) {
+		return domain.ErrSessionRevoked
+	}
+	if now.Sub(session.CreatedAt) > maxAge {
+		return domain.ErrReauthenticationRequired
+	}
+	return nil
+}
+
+// List returns the sessions that can still be refreshed.
+func (uc *SessionUseCase) List(ctx context.Context, user *domain.UserInfo) ([]domain.Session, error) {
+	sessions, err := uc.storage.GetSessions(ctx, user.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sessions: %w", err)
+	}
+
+	now := uc.now()
+	res := []domain.Session{}
+	for _, s := range sessions {
+		if s.Active(now) {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+// Revoke logs out one of the user's sessions.
+func (uc *SessionUseCase) Revoke(ctx context.Context, user *domain.UserInfo, sessionID string) error {
+	sessions, err := uc.storage.GetSessions(ctx, user.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
+	}
+	if s := findSession(sessions, sessionID); s == nil || !s.Active(uc.now()) {
+		return domain.ErrSessionNotFound
+	}
+	return uc.revoke(ctx, user.UserID, func(s *domain.Session) bool {
+		return s.ID == sessionID
+	})
+}
+
+// Logout revokes the session the refresh token belongs to.
+func (uc *SessionUseCase) Logout(ctx context.Context, refreshToken string) error {
+	claims, err := uc.issuer.ValidateRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	return uc.revoke(ctx, claims.User.UserID, func(s *domain.Session) bool {
+		return s.ID == claims.User.SessionID
+	})
+}
+
+// LogoutAll revokes every session of the user.
+func (uc *SessionUseCase) LogoutAll(ctx context.Context, user *domain.UserInfo) error {
+	return uc.revoke(ctx, user.UserID, func(s *domain.Session) bool { return true })
+}
+
+func (uc *SessionUseCase) revoke(ctx context.Context, userID string, match func(s *domain.Session) bool) error {
+	now := uc.now()
+	var revoked []string
+	err := uc.storage.UpdateSessions(ctx, userID, func(sessions []domain.Session) ([]domain.Session, error) {
+		revoked = nil
+		for i := range sessions {
+			if sessions[i].RevokedAt == nil && match(&sessions[i]) {
+				sessions[i].RevokedAt = &now
+				revoked = append(revoked, sessions[i].ID)
+			}
+		}
+		return pruneSessions(sessions, now), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save sessions: %w", err)
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	if err := uc.credentials.RevokeS3Credentials(ctx, userID, revoked); err != nil {
+		return fmt.Errorf("failed to revoke S3 credentials: %w", err)
+	}
+	return nil
+}
+
+// pruneSessions drops families that can no longer be used. Revoked families are
+// kept until they would have expired so that reuse is still detected.
+func pruneSessions(sessions []domain.Session, now time.Time) []domain.Session {
+	res := sessions[:0]
+	for _, s := range sessions {
+		if now.Before(s.ExpiresAt) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func findSession(sessions []domain.Session, id string) *domain.Session {
+	for i := range sessions {
+		if sessions[i].ID == id {
+			return &sessions[i]
+		}
+	}
+	return nil
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,239 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockSessionStorage struct {
+	sessions map[string][]domain.Session
+}
+
+func (m *mockSessionStorage) GetSessions(ctx context.Context, userID string) ([]domain.Session, error) {
+	return append([]domain.Session(nil), m.sessions[userID]...), nil
+}
+
+func (m *mockSessionStorage) UpdateSessions(ctx context.Context, userID string, update func([]domain.Session) ([]domain.Session, error)) error {
+	sessions, err := update(append([]domain.Session(nil), m.sessions[userID]...))
+	if err != nil {
+		return err
+	}
+	m.sessions[userID] = sessions
+	return nil
+}
+
+// mockSessionIssuer encodes the claims as "user|session|token" instead of signing them.
+type mockSessionIssuer struct{}
+
+func (mockSessionIssuer) IssueTokens(ctx context.Context, user *domain.UserInfo, session *domain.Session) (*domain.SessionTokens, error) {
+	return &domain.SessionTokens{
+		AccessToken:  user.UserID + "|" + session.ID,
+		RefreshToken: user.UserID + "|" + session.ID + "|" + session.RefreshTokenID,
+	}, nil
+}
+
+func (mockSessionIssuer) ValidateAccessToken(ctx context.Context, token string) (*domain.UserInfo, error) {
+	parts := strings.Split(token, "|")
+	if len(parts) != 2 {
+		return nil, errors.New("invalid access token")
+	}
+	return &domain.UserInfo{UserID: parts[0], SessionID: parts[1]}, nil
+}
+
+func (mockSessionIssuer) ValidateRefreshToken(ctx context.Context, token string) (*domain.RefreshTokenClaims, error) {
+	parts := strings.Split(token, "|")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid refresh token")
+	}
+	return &domain.RefreshTokenClaims{
+		User:    &domain.UserInfo{UserID: parts[0], SessionID: parts[1]},
+		TokenID: parts[2],
+	}, nil
+}
+
+func TestSessionUseCase_RefreshRotatesToken(t *testing.T) {
+	ctx := context.Background()
+	storage := &mockSessionStorage{sessions: map[string][]domain.Session{}}
+	uc := NewSessionUseCase(storage, mockSessionIssuer{}, &mockStorageRepository{})
+
+	tokens, err := uc.Start(ctx, &domain.UserInfo{UserID: "account-1", Email: "test@example.com", Scope: domain.CredentialScopeUpload}, domain.ClientInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	user, rotated, err := uc.Refresh(ctx, tokens.RefreshToken, domain.ClientInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotated.RefreshToken == tokens.RefreshToken {
+		t.Error("expected refresh token to be rotated")
+	}
+	if user.Scope != domain.CredentialScopeUpload {
+		t.Errorf("expected the session scope to be kept, got %q", user.Scope)
+	}
+
+	if _, _, err := uc.Refresh(ctx, rotated.RefreshToken, domain.ClientInfo{}); err != nil {
+		t.Fatalf("expected rotated token to be accepted: %v", err)
+	}
+}
+
+func TestSessionUseCase_Reissue(t *testing.T) {
+	ctx := context.Background()
+	storage := &mockSessionStorage{sessions: map[string][]domain.Session{}}
+	uc := NewSessionUseCase(storage, mockSessionIssuer{}, &mockStorageRepository{})
+
+	tokens, err := uc.Start(ctx, &domain.UserInfo{UserID: "account-1", AuthMethod: domain.AuthMethodPasskey, Scope: domain.CredentialScopeFull}, domain.ClientInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	user, _ := mockSessionIssuer{}.ValidateAccessToken(ctx, tokens.AccessToken)
+
+	reissued, err := uc.Reissue(ctx, user, domain.ClientInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(storage.sessions["account-1"]) != 1 || reissued.AccessToken != tokens.AccessToken {
+		t.Errorf("expected the same session, got %+v", storage.sessions["account-1"])
+	}
+	if user.AuthMethod != domain.AuthMethodPasskey || user.Scope != domain.CredentialScopeFull {
+		t.Errorf("expected the login method and scope of the session, got %+v", user)
+	}
+	if _, _, err := uc.Refresh(ctx, tokens.RefreshToken, domain.ClientInfo{}); !errors.Is(err, domain.ErrRefreshTokenReused) {
+		t.Errorf("expected the previous refresh token to be rotated, got %v", err)
+	}
+
+	if _, err := uc.Reissue(ctx, user, domain.ClientInfo{}); !errors.Is(err, domain.ErrSessionRevoked) {
+		t.Errorf("expected a revoked session to be refused, got %v", err)
+	}
+}
+
+func TestSessionUseCase_RequireRecentLogin(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage := &mockSessionStorage{sessions: map[string][]domain.Session{}}
+	uc := NewSessionUseCase(storage, mockSessionIssuer{}, &mockStorageRepository{})
+	uc.now = func() time.Time { return now }
+
+	tokens, err := uc.Start(ctx, &domain.UserInfo{UserID: "account-1"}, domain.ClientInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	user, _ := mockSessionIssuer{}.ValidateAccessToken(ctx, tokens.AccessToken)
+	if err := uc.RequireRecentLogin(ctx, user, 10*time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Refreshing the session does not make the login recent again.
+	now = now.Add(time.Hour)
+	if _, _, err := uc.Refresh(ctx, tokens.RefreshToken, domain.ClientInfo{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.RequireRecentLogin(ctx, user, 10*time.Minute); !errors.Is(err, domain.ErrReauthenticationRequired) {
+		t.Errorf("expected ErrReauthenticationRequired, got %v", err)
+	}
+}
+
+func TestSessionUseCase_ReuseRevokesFamily(t *testing.T) {
+	ctx := context.Background()
+	storage := &mockSessionStorage{sessions: map[string][]domain.Session{}}
+	uc := NewSessionUseCase(storage, mockSessionIssuer{}, &mockStorageRepository{})
+
+	stolen, err := uc.Start(ctx, &domain.UserInfo{UserID: "account-1", Email: "test@example.com"}, domain.ClientInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, legit, err := uc.Refresh(ctx, stolen.RefreshToken, domain.ClientInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, err := uc.Refresh(ctx, stolen.RefreshToken, domain.ClientInfo{}); !errors.Is(err, domain.ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if _, _, err := uc.Refresh(ctx, legit.RefreshToken, domain.ClientInfo{}); !errors.Is(err, domain.ErrSessionRevoked) {
+		t.Fatalf("expected family to be revoked, got %v", err)
+	}
+}
+
+func TestSessionUseCase_Logout(t *testing.T) {
+	ctx := context.Background()
+	storage := &mockSessionStorage{sessions: map[string][]domain.Session{}}
+	credentials := &mockStorageRepository{}
+	uc := NewSessionUseCase(storage, mockSessionIssuer{}, credentials)
+	user := &domain.UserInfo{UserID: "account-1", Email: "test@example.com"}
+
+	phone, _ := uc.Start(ctx, user, domain.ClientInfo{})
+	laptop, _ := uc.Start(ctx, user, domain.ClientInfo{})
+	tablet, _ := uc.Start(ctx, user, domain.ClientInfo{})
+
+	if err := uc.Logout(ctx, phone.RefreshToken); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := uc.Refresh(ctx, phone.RefreshToken, domain.ClientInfo{}); !errors.Is(err, domain.ErrSessionRevoked) {
+		t.Fatalf("expected logged out session to be revoked, got %v", err)
+	}
+	if _, _, err := uc.Refresh(ctx, laptop.RefreshToken, domain.ClientInfo{}); err != nil {
+		t.Fatalf("expected other sessions to survive logout: %v", err)
+	}
+	if revoked := credentials.revoked["account-1"]; len(revoked) != 1 {
+		t.Errorf("expected the S3 key of the logged out session to be revoked, got %v", revoked)
+	}
+
+	if err := uc.LogoutAll(ctx, user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := uc.Refresh(ctx, tablet.RefreshToken, domain.ClientInfo{}); !errors.Is(err, domain.ErrSessionRevoked) {
+		t.Fatalf("expected every session to be revoked, got %v", err)
+	}
+	if revoked := credentials.revoked["account-1"]; len(revoked) != 3 {
+		t.Errorf("expected the S3 keys of every session to be revoked, got %v", revoked)
+	}
+}
+
+func TestSessionUseCase_ListAndRevoke(t *testing.T) {
+	ctx := context.Background()
+	storage := &mockSessionStorage{sessions: map[string][]domain.Session{}}
+	uc := NewSessionUseCase(storage, mockSessionIssuer{}, &mockStorageRepository{})
+	user := &domain.UserInfo{UserID: "account-1", Email: "test@example.com", AuthMethod: domain.AuthMethodPasskey}
+
+	phone, _ := uc.Start(ctx, user, domain.ClientInfo{UserAgent: "Phone", IP: "192.0.2.1"})
+	if _, err := uc.Start(ctx, user, domain.ClientInfo{UserAgent: "Laptop", IP: "192.0.2.2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sessions, err := uc.List(ctx, user)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	if sessions[0].UserAgent != "Phone" || sessions[0].AuthMethod != domain.AuthMethodPasskey || sessions[0].IP != "192.0.2.1" {
+		t.Errorf("unexpected session metadata: %+v", sessions[0])
+	}
+
+	phoneUser, _ := mockSessionIssuer{}.ValidateAccessToken(ctx, phone.AccessToken)
+	if err := uc.Touch(ctx, phoneUser, domain.ClientInfo{IP: "192.0.2.3"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := uc.Revoke(ctx, user, sessions[0].ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.Revoke(ctx, user, sessions[0].ID); !errors.Is(err, domain.ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	if err := uc.Touch(ctx, phoneUser, domain.ClientInfo{}); !errors.Is(err, domain.ErrSessionRevoked) {
+		t.Fatalf("expected revoked session to be rejected, got %v", err)
+	}
+
+	sessions, _ = uc.List(ctx, user)
+	if len(sessions) != 1 || sessions[0].UserAgent != "Laptop" {
+		t.Errorf("expected only the laptop session to remain, got %+v", sessions)
+	}
+}
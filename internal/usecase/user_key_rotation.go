@@ -0,0 +1,170 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+// userKeyRotationBatch is how many objects are re-encrypted between two saves
+// of the progress.
+const userKeyRotationBatch = 100
+
+// UserKeyRotationUseCase replaces the key of a user, for instance after it
+// leaked, and re-encrypts the objects of the user with the new version.
+type UserKeyRotationUseCase struct {
+	userStorage domain.UserStorage
+	storage     domain.UserKeyRotationStorage
+	sessions    domain.SessionStorage
+	credentials domain.StorageRepository
+	batch       int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func NewUserKeyRotationUseCase(userStorage domain.UserStorage, storage domain.UserKeyRotationStorage, sessions domain.SessionStorage, credentials domain.StorageRepository) *UserKeyRotationUseCase {
+	return &UserKeyRotationUseCase{
+		userStorage: userStorage,
+		storage:     storage,
+		sessions:    sessions,
+		credentials: credentials,
+		batch:       userKeyRotationBatch,
+		now:         time.Now,
+		running:     make(map[string]bool),
+	}
+}
+
+func (uc *UserKeyRotationUseCase) Status(ctx context.Context, userID string) (*domain.UserKeyRotation, error) {
+	return uc.storage.GetUserKeyRotation(ctx, userID)
+}
+
+// Start adds a new version of the key of the user, which Run then applies to
+// every object. The S3 keys of the sessions are revoked, so that the apps
+// fetch the new version before they write again.
+func (uc *UserKeyRotationUseCase) Start(ctx context.Context, userID string) (*domain.UserKeyRotation, error) {
+	rotation, err := uc.storage.GetUserKeyRotation(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if rotation != nil && rotation.CompletedAt == nil {
+		return nil, domain.ErrUserKeyRotationPending
+	}
+
+	keys, err := uc.userStorage.GetUserKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newUserKey(keys.Active().Version+1, uc.now())
+	if err != nil {
+		return nil, err
+	}
+	if err := uc.userStorage.SaveUserKeys(ctx, userID, append(keys, key)); err != nil {
+		return nil, fmt.Errorf("failed to save user key: %w", err)
+	}
+
+	rotation = &domain.UserKeyRotation{Version: key.Version, StartedAt: key.CreatedAt, UpdatedAt: key.CreatedAt}
+	if err := uc.storage.SaveUserKeyRotation(ctx, userID, rotation); err != nil {
+		return nil, err
+	}
+
+	if err := revokeSessionCredentials(ctx, uc.sessions, uc.credentials, userID, key.CreatedAt); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
+
+// revokeSessionCredentials revokes the S3 keys of the active sessions of the
+// user, which must then fetch their credentials again.
+func revokeSessionCredentials(ctx context.Context, storage domain.SessionStorage, credentials domain.StorageRepository, userID string, now time.Time) error {
+	sessions, err := storage.GetSessions(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
+	}
+	var sessionIDs []string
+	for i := range sessions {
+		if sessions[i].Active(now) {
+			sessionIDs = append(sessionIDs, sessions[i].ID)
+		}
+	}
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	if err := credentials.RevokeS3Credentials(ctx, userID, sessionIDs); err != nil {
+		return fmt.Errorf("failed to revoke S3 credentials: %w", err)
+	}
+	return nil
+}
+
+// Run resumes the rotation of the key of the user where it stopped. progress
+// is called after every batch.
+func (uc *UserKeyRotationUseCase) Run(ctx context.Context, userID string, progress func(*domain.UserKeyRotation)) (*domain.UserKeyRotation, error) {
+	uc.mu.Lock()
+	if uc.running[userID] {
+		uc.mu.Unlock()
+		return nil, domain.ErrUserKeyRotationRunning
+	}
+	uc.running[userID] = true
+	uc.mu.Unlock()
+	defer func() {
+		uc.mu.Lock()
+		delete(uc.running, userID)
+		uc.mu.Unlock()
+	}()
+
+	rotation, err := uc.storage.GetUserKeyRotation(ctx, userID)
+	if err != nil || rotation == nil || rotation.CompletedAt != nil {
+		return rotation, err
+	}
+	keys, err := uc.userStorage.GetUserKeys(ctx, userID)
+	if err != nil {
+		return rotation, fmt.Errorf("failed to get user key: %w", err)
+	}
+	if keys.Active().Version != rotation.Version {
+		// A recovery kit was restored since: start again with its active key.
+		rotation.Version = keys.Active().Version
+		rotation.LastKey = ""
+	}
+
+	for rotation.CompletedAt == nil {
+		if err := ctx.Err(); err != nil {
+			return rotation, err
+		}
+		objects, err := uc.storage.ListUserObjects(ctx, userID, rotation.LastKey, uc.batch)
+		if err != nil {
+			return rotation, err
+		}
+		for _, object := range objects {
+			rotated, err := uc.storage.RotateUserObject(ctx, userID, object, keys)
+			if err != nil {
+				rotation.Failed = append(rotation.Failed, object)
+				rotation.LastError = err.Error()
+			}
+			if rotated {
+				rotation.Rotated++
+			}
+			rotation.Scanned++
+			rotation.LastKey = object
+		}
+		rotation.UpdatedAt = uc.now()
+		if len(objects) < uc.batch {
+			rotation.CompletedAt = &rotation.UpdatedAt
+		}
+		if err := uc.storage.SaveUserKeyRotation(ctx, userID, rotation); err != nil {
+			return rotation, err
+		}
+		if progress != nil {
+			progress(rotation)
+		}
+	}
+	return rotation, nil
+}
+
+// Pending returns the users whose rotation must be resumed.
+func (uc *UserKeyRotationUseCase) Pending(ctx context.Context) ([]string, error) {
+	return uc.storage.ListPendingUserKeyRotations(ctx)
+}
@@ -0,0 +1,186 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/snigle/photocloud/internal/domain"
+)
+
+type mockUserKeyRotationStorage struct {
+	objects   map[string]int // key: version of its user key
+	broken    map[string]bool
+	rotations map[string]*domain.UserKeyRotation
+	failSave  int // save that fails, counting from 1
+	saves     int
+}
+
+func (m *mockUserKeyRotationStorage) ListUserObjects(ctx context.Context, userID string, after string, limit int) ([]string, error) {
+	var keys []string
+	for key := range m.objects {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (m *mockUserKeyRotationStorage) RotateUserObject(ctx context.Context, userID string, key string, keys domain.UserKeys) (bool, error) {
+	if m.broken[key] {
+		return false, errors.New("no user key decrypts " + key)
+	}
+	if m.objects[key] == keys.Active().Version {
+		return false, nil
+	}
+	m.objects[key] = keys.Active().Version
+	return true, nil
+}
+
+func (m *mockUserKeyRotationStorage) GetUserKeyRotation(ctx context.Context, userID string) (*domain.UserKeyRotation, error) {
+	rotation, ok := m.rotations[userID]
+	if !ok {
+		return nil, nil
+	}
+	saved := *rotation
+	return &saved, nil
+}
+
+func (m *mockUserKeyRotationStorage) SaveUserKeyRotation(ctx context.Context, userID string, rotation *domain.UserKeyRotation) error {
+	m.saves++
+	if m.saves == m.failSave {
+		return errors.New("S3 unavailable")
+	}
+	saved := *rotation
+	m.rotations[userID] = &saved
+	return nil
+}
+
+func (m *mockUserKeyRotationStorage) ListPendingUserKeyRotations(ctx context.Context) ([]string, error) {
+	var userIDs []string
+	for userID, rotation := range m.rotations {
+		if rotation.CompletedAt == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, nil
+}
+
+func TestUserKeyRotationUseCase(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	keys := domain.UserKeys{{Version: 1, Key: make([]byte, 32)}}
+	users := &mockStorageRepository{
+		getUserKeysFunc: func(ctx context.Context, userID string) (domain.UserKeys, error) {
+			return keys, nil
+		},
+		saveUserKeysFunc: func(ctx context.Context, userID string, saved domain.UserKeys) error {
+			keys = saved
+			return nil
+		},
+	}
+	storage := &mockUserKeyRotationStorage{
+		objects: map[string]int{
+			"users/account-1/2024/original/a.enc":  1,
+			"users/account-1/2024/original/b.enc":  1,
+			"users/account-1/2024/thumbnail/a.enc": 1,
+			"users/account-1/2024/thumbnail/b.enc": 1,
+			"users/account-1/index.json":           1,
+		},
+		broken:    map[string]bool{"users/account-1/2024/original/b.enc": true},
+		rotations: map[string]*domain.UserKeyRotation{},
+		failSave:  3,
+	}
+	sessions := &mockSessionStorage{sessions: map[string][]domain.Session{"account-1": {
+		{ID: "phone", ExpiresAt: now.Add(time.Hour)},
+		{ID: "laptop", ExpiresAt: now.Add(-time.Hour)},
+	}}}
+	uc := NewUserKeyRotationUseCase(users, storage, sessions, users)
+	uc.batch = 2
+	uc.now = func() time.Time { return now }
+
+	rotation, err := uc.Start(ctx, "account-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotation.Version != 2 || len(keys) != 2 || keys.Active().Version != 2 || !keys.Active().CreatedAt.Equal(now) {
+		t.Fatalf("expected a second key version, got %+v and %d keys", rotation, len(keys))
+	}
+	if len(users.revoked["account-1"]) != 1 || users.revoked["account-1"][0] != "phone" {
+		t.Errorf("expected the S3 keys of the active sessions to be revoked, got %v", users.revoked)
+	}
+	if pending, _ := uc.Pending(ctx); len(pending) != 1 || pending[0] != "account-1" {
+		t.Errorf("unexpected pending rotations %v", pending)
+	}
+	if _, err := uc.Start(ctx, "account-1"); !errors.Is(err, domain.ErrUserKeyRotationPending) {
+		t.Errorf("expected ErrUserKeyRotationPending, got %v", err)
+	}
+
+	// The job stops when its progress cannot be saved, and resumes after the
+	// last saved object.
+	if _, err := uc.Run(ctx, "account-1", nil); err == nil {
+		t.Fatal("expected the failed save to stop the rotation")
+	}
+	if saved := storage.rotations["account-1"]; saved.Scanned != 2 || saved.CompletedAt != nil {
+		t.Fatalf("unexpected saved progress %+v", saved)
+	}
+	var progress []int
+	rotation, err = uc.Run(ctx, "account-1", func(r *domain.UserKeyRotation) {
+		progress = append(progress, r.Scanned)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotation.CompletedAt == nil || rotation.Scanned != 5 || rotation.Rotated != 2 {
+		t.Errorf("unexpected rotation %+v", rotation)
+	}
+	if len(rotation.Failed) != 1 || rotation.Failed[0] != "users/account-1/2024/original/b.enc" {
+		t.Errorf("unexpected failures %+v", rotation)
+	}
+	if len(progress) != 2 || progress[1] != 5 {
+		t.Errorf("unexpected progress %v", progress)
+	}
+	for key, version := range storage.objects {
+		if version != 2 && !storage.broken[key] {
+			t.Errorf("%s left on version %d", key, version)
+		}
+	}
+	if pending, _ := uc.Pending(ctx); len(pending) != 0 {
+		t.Errorf("unexpected pending rotations %v", pending)
+	}
+
+	// A completed rotation is left alone, and a new one may start.
+	saves := storage.saves
+	if _, err := uc.Run(ctx, "account-1", nil); err != nil || storage.saves != saves {
+		t.Errorf("expected a completed rotation to be left alone, got %v", err)
+	}
+	delete(storage.broken, "users/account-1/2024/original/b.enc")
+	if _, err := uc.Start(ctx, "account-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rotation, err = uc.Run(ctx, "account-1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotation.Version != 3 || rotation.Rotated != 5 || len(keys) != 3 {
+		t.Errorf("unexpected rotation %+v", rotation)
+	}
+}
+
+func TestUserKeyRotationUseCase_RunOnce(t *testing.T) {
+	storage := &mockUserKeyRotationStorage{rotations: map[string]*domain.UserKeyRotation{}}
+	uc := NewUserKeyRotationUseCase(&mockStorageRepository{}, storage, &mockSessionStorage{}, &mockStorageRepository{})
+	uc.running["account-1"] = true
+	if _, err := uc.Run(context.Background(), "account-1", nil); !errors.Is(err, domain.ErrUserKeyRotationRunning) {
+		t.Errorf("expected ErrUserKeyRotationRunning, got %v", err)
+	}
+	if rotation, err := uc.Run(context.Background(), "account-2", nil); err != nil || rotation != nil {
+		t.Errorf("expected no rotation, got %+v, %v", rotation, err)
+	}
+}